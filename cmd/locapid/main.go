@@ -1,18 +1,87 @@
 package main
 
 import (
+	"bufio"
+	"fmt"
 	"log"
 	"os"
+	"strings"
 
+	"github.com/fsnotify/fsnotify"
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
 
 	"mist-location-visualization/internal/locapiserver"
 )
 
+// setDefaults sets the default values of the configuration
+func setDefaults(v *viper.Viper) {
+	v.SetDefault("mist.endpoint", "api.mist.com")
+	v.SetDefault("mist.location_timeout", 60)
+	v.SetDefault("mist.refresh_time", 1800)
+	v.SetDefault("http.shutdown_timeout", 30)
+	v.SetDefault("http.oidc.jwks_refresh", 3600)
+	v.SetDefault("http.oidc.name_claim", "sub")
+	v.SetDefault("http.oidc.roles_claim", "roles")
+	v.SetDefault("visit.min_dwell", 60)
+	v.SetDefault("occupancy.interval", 300)
+	v.SetDefault("health.webhook_timeout", 300)
+	v.SetDefault("filter.method", "none")
+	v.SetDefault("webhook.max_body_size", 1048576)
+	v.SetDefault("webhook.max_event_age", 600)
+	v.SetDefault("webhook.max_clock_skew", 60)
+	v.SetDefault("webhook.dedupe_window", 600)
+	v.SetDefault("webhook.out_of_order", "discard")
+	v.SetDefault("proximity.distance", 2)
+	v.SetDefault("proximity.min_duration", 300)
+	v.SetDefault("proximity.max_gap", 60)
+	v.SetDefault("rules.interval", 30)
+	v.SetDefault("retention.interval", 3600)
+	v.SetDefault("archive.dir", "archive")
+	v.SetDefault("archive.max_size", 100)
+	v.SetDefault("archive.max_files", 10)
+}
+
+// loadConfig reads the configuration file with a fresh viper instance
+func loadConfig(configFile string) (locapiserver.Config, error) {
+	var config locapiserver.Config
+
+	v := viper.New()
+	setDefaults(v)
+	v.SetConfigFile(configFile)
+	v.SetConfigType("json")
+	err := v.ReadInConfig()
+	if err != nil {
+		return config, err
+	}
+
+	err = v.Unmarshal(&config)
+	return config, err
+}
+
+// readPassword reads the password from the first line of stdin, prompting for it on a terminal
+func readPassword() (string, error) {
+	info, err := os.Stdin.Stat()
+	if err == nil && info.Mode()&os.ModeCharDevice != 0 {
+		fmt.Fprint(os.Stderr, "Password: ")
+	}
+
+	line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil && line == "" {
+		return "", fmt.Errorf("failed to read password from stdin (%v)", err)
+	}
+
+	password := strings.TrimRight(line, "\r\n")
+	if password == "" {
+		return "", fmt.Errorf("empty password")
+	}
+	return password, nil
+}
+
 func main() {
 	var err error
 	var configFile string
+	var watch bool
 	var config locapiserver.Config
 
 	rootCmd := &cobra.Command {
@@ -26,6 +95,20 @@ func main() {
 				log.Fatalf("Failed on init: %v", err)
 			}
 
+			// Reload on SIGHUP, and on file changes with --watch
+			e.SetConfigLoader(func() (locapiserver.Config, error) {
+				return loadConfig(configFile)
+			})
+			if watch {
+				w := viper.New()
+				w.SetConfigFile(configFile)
+				w.OnConfigChange(func(fsnotify.Event) {
+					log.Printf("Config file %s changed", configFile)
+					e.ReloadConfig()
+				})
+				w.WatchConfig()
+			}
+
 			err = e.Run()
 			if err != nil {
 				log.Fatalf("Failed on start: %v", err)
@@ -33,15 +116,71 @@ func main() {
 		},
 	}
 
-	rootCmd.PersistentFlags().StringVarP(&configFile, "config", "c", "config.json", "Path to configuration")
+	var replayOpts locapiserver.ReplayOptions
+	replayCmd := &cobra.Command {
+		Use: "replay [flags] archive.jsonl...",
+		Short: "Replay archived Mist webhooks into a locapid instance",
+		Args: cobra.MinimumNArgs(1),
+		// Replay does not need the server configuration
+		PersistentPreRun: func(c *cobra.Command, args []string) {},
+		Run: func(c *cobra.Command, args []string) {
+			err := locapiserver.Replay(args, replayOpts)
+			if err != nil {
+				log.Fatalf("Failed on replay: %v", err)
+			}
+		},
+	}
+	replayCmd.Flags().StringVarP(&replayOpts.Target, "target", "t", "http://localhost:18080/mistrecv", "URL of the webhook receiver")
+	replayCmd.Flags().Float64VarP(&replayOpts.Speed, "speed", "s", 1, "Playback speed (1 = original pace, 0 = as fast as possible)")
+	replayCmd.Flags().StringVar(&replayOpts.Secret, "secret", "", "Sign webhooks again with this secret")
+	rootCmd.AddCommand(replayCmd)
+
+	hashCmd := &cobra.Command {
+		Use: "hash-password [password]",
+		Short: "Print the bcrypt hash of a password read from stdin for http.users[].password_hash",
+		Args: cobra.MaximumNArgs(1),
+		PersistentPreRun: func(c *cobra.Command, args []string) {},
+		Run: func(c *cobra.Command, args []string) {
+			// an argument ends up in the shell history and the process list
+			var password string
+			if len(args) == 1 {
+				log.Printf("Warning: password given as argument, prefer stdin")
+				password = args[0]
+			} else {
+				password, err = readPassword()
+				if err != nil {
+					log.Fatalf("Failed to read password: %v", err)
+				}
+			}
+
+			hash, err := locapiserver.HashPassword(password)
+			if err != nil {
+				log.Fatalf("Failed to hash password: %v", err)
+			}
+			fmt.Println(hash)
+		},
+	}
+	rootCmd.AddCommand(hashCmd)
 
-	// Defaults
-	viper.SetDefault("mist.endpoint", "api.mist.com")
-	viper.SetDefault("mist.location_timeout", 60)
-	viper.SetDefault("mist.refresh_time", 1800)
+	rulesTestCmd := &cobra.Command {
+		Use: "rules-test rules.json [events.json...]",
+		Short: "Validate a rules file and show the rules matching sample events without running actions",
+		Args: cobra.MinimumNArgs(1),
+		PersistentPreRun: func(c *cobra.Command, args []string) {},
+		Run: func(c *cobra.Command, args []string) {
+			err := locapiserver.CheckRules(args[0], args[1:], os.Stdout)
+			if err != nil {
+				log.Fatalf("Failed to check rules: %v", err)
+			}
+		},
+	}
+	rootCmd.AddCommand(rulesTestCmd)
+
+	rootCmd.PersistentFlags().StringVarP(&configFile, "config", "c", "config.json", "Path to configuration")
+	rootCmd.Flags().BoolVarP(&watch, "watch", "w", false, "Reload the configuration when the file changes")
 
 	// Read Configuration File Before Start
-	cobra.OnInitialize(func() {
+	rootCmd.PersistentPreRun = func(c *cobra.Command, args []string) {
 		_, err := os.Stat(configFile)
 		if os.IsNotExist(err) {
 			envConfFile := os.Getenv("CONFIG_FILE")
@@ -57,22 +196,15 @@ func main() {
 			}
 		}
 
-		viper.SetConfigFile(configFile)
-		viper.SetConfigType("json")
-		err = viper.ReadInConfig()
+		config, err = loadConfig(configFile)
 		if err != nil {
 			log.Fatalf("Failed to read config: %v", err)
 		}
 
-		err = viper.Unmarshal(&config)
-		if err != nil {
-			log.Fatalf("Failed to parse config: %v", err)
-		}
-
 		log.Printf("Loaded config file: %s", configFile)
-	})
+	}
 
-	// Launch (cobra.OnInitializa -> rootCmd.Run)
+	// Launch (rootCmd.PersistentPreRun -> rootCmd.Run)
 	err = rootCmd.Execute()
 	if err != nil {
 		log.Fatal(err)
@@ -4,15 +4,36 @@ import (
 	"log"
 	"os"
 
+	"github.com/fsnotify/fsnotify"
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
 
 	"mist-location-visualization/internal/mistpoller"
 )
 
+// loadConfig reads the configuration file with a fresh viper instance
+func loadConfig(configFile string) (mistpoller.Config, error) {
+	var config mistpoller.Config
+
+	v := viper.New()
+	v.SetDefault("mist.endpoint", "api.mist.com")
+	v.SetDefault("mist.timeout", 30)
+	v.SetDefault("health.stale_after", 900)
+	v.SetConfigFile(configFile)
+	v.SetConfigType("json")
+	err := v.ReadInConfig()
+	if err != nil {
+		return config, err
+	}
+
+	err = v.Unmarshal(&config)
+	return config, err
+}
+
 func main() {
 	var err error
 	var configFile string
+	var watch bool
 	var config mistpoller.Config
 
 	rootCmd := &cobra.Command {
@@ -26,6 +47,20 @@ func main() {
 				log.Fatalf("Failed on init: %v", err)
 			}
 
+			// Reload on SIGHUP, and on file changes with --watch
+			rcvr.SetConfigLoader(func() (mistpoller.Config, error) {
+				return loadConfig(configFile)
+			})
+			if watch {
+				w := viper.New()
+				w.SetConfigFile(configFile)
+				w.OnConfigChange(func(fsnotify.Event) {
+					log.Printf("Config file %s changed", configFile)
+					rcvr.ReloadConfig()
+				})
+				w.WatchConfig()
+			}
+
 			err = rcvr.Run()
 			if err != nil {
 				log.Fatalf("Failed on start: %v", err)
@@ -34,9 +69,7 @@ func main() {
 	}
 
 	rootCmd.PersistentFlags().StringVarP(&configFile, "config", "c", "config.json", "Path to configuration")
-
-	// Default Values
-	viper.SetDefault("mist.endpoint", "api.mist.com")
+	rootCmd.Flags().BoolVarP(&watch, "watch", "w", false, "Reload the configuration when the file changes")
 
 	// Read Configuration File Before Start
 	cobra.OnInitialize(func() {
@@ -55,18 +88,11 @@ func main() {
 			}
 		}
 
-		viper.SetConfigFile(configFile)
-		viper.SetConfigType("json")
-		err = viper.ReadInConfig()
+		config, err = loadConfig(configFile)
 		if err != nil {
 			log.Fatalf("Failed to read config: %v", err)
 		}
 
-		err = viper.Unmarshal(&config)
-		if err != nil {
-			log.Fatalf("Failed to parse config: %v", err)
-		}
-
 		log.Printf("Loaded config file: %s", configFile)
 	})
 
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"log"
+	"os"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+
+	"mist-location-visualization/internal/tagsim"
+)
+
+func main() {
+	var err error
+	var configFile string
+	var config tagsim.Config
+
+	rootCmd := &cobra.Command {
+		Use: "tagsim",
+		Short: "Simulate BLE tag movement and send Mist webhooks to locapid",
+		// Main Entry Point
+		Run: func(c *cobra.Command, args []string) {
+			// Init 
+			sim, err := tagsim.New(config)
+			if err != nil {
+				log.Fatalf("Failed on init: %v", err)
+			}
+
+			err = sim.Run()
+			if err != nil {
+				log.Fatalf("Failed on start: %v", err)
+			}
+		},
+	}
+
+	rootCmd.PersistentFlags().StringVarP(&configFile, "config", "c", "config.json", "Path to configuration")
+
+	// Defaults
+	viper.SetDefault("target.url", "http://localhost:18080/mistrecv")
+	viper.SetDefault("interval", 1.0)
+	viper.SetDefault("seed", 1)
+	viper.SetDefault("tags.count", 10)
+	viper.SetDefault("tags.mac_prefix", "5a")
+	viper.SetDefault("tags.speed", 1.2)
+
+	// Read Configuration File Before Start
+	cobra.OnInitialize(func() {
+		_, err := os.Stat(configFile)
+		if os.IsNotExist(err) {
+			envConfFile := os.Getenv("CONFIG_FILE")
+			if envConfFile != "" {
+				_, err := os.Stat(envConfFile)
+				if os.IsNotExist(err) {
+					log.Fatalf("Config file %s does not exist!", envConfFile)
+				}
+
+				configFile = envConfFile
+			} else {
+				log.Fatalf("Config file %s does not exist!", configFile)
+			}
+		}
+
+		viper.SetConfigFile(configFile)
+		viper.SetConfigType("json")
+		err = viper.ReadInConfig()
+		if err != nil {
+			log.Fatalf("Failed to read config: %v", err)
+		}
+
+		err = viper.Unmarshal(&config)
+		if err != nil {
+			log.Fatalf("Failed to parse config: %v", err)
+		}
+
+		log.Printf("Loaded config file: %s", configFile)
+	})
+
+	// Launch (cobra.OnInitializa -> rootCmd.Run)
+	err = rootCmd.Execute()
+	if err != nil {
+		log.Fatal(err)
+	}
+}
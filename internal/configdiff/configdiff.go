@@ -0,0 +1,112 @@
+// Package configdiff lists the differences between two configurations for reload logs
+package configdiff
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+)
+
+// secretKeys are parts of key names whose values are never shown
+var secretKeys = []string{"secret", "password", "apikey", "key_sha256", "salt"}
+
+// Change is a value which differs between two configurations. Path uses the mapstructure
+// names, e.g. "http.users[1].scopes". Old or New is empty when a list element was added or removed.
+type Change struct {
+	Path   string
+	Old    string
+	New    string
+	Secret bool
+}
+
+func (c Change) String() string {
+	switch {
+	case c.Old == "":
+		return fmt.Sprintf("%s: added", c.Path)
+	case c.New == "":
+		return fmt.Sprintf("%s: removed", c.Path)
+	case c.Secret:
+		return fmt.Sprintf("%s: changed", c.Path)
+	}
+	return fmt.Sprintf("%s: %s -> %s", c.Path, c.Old, c.New)
+}
+
+// Under reports whether the change is at prefix or below it
+func (c Change) Under(prefix string) bool {
+	return c.Path == prefix || strings.HasPrefix(c.Path, prefix+".") || strings.HasPrefix(c.Path, prefix+"[")
+}
+
+// Diff returns the changes from old to new, which must be of the same struct type
+func Diff(old interface{}, new interface{}) []Change {
+	changes := make([]Change, 0)
+	diff(&changes, "", reflect.ValueOf(old), reflect.ValueOf(new), false)
+	return changes
+}
+
+func isSecret(name string) bool {
+	name = strings.ToLower(name)
+	for _, v := range secretKeys {
+		if strings.Contains(name, v) {
+			return true
+		}
+	}
+	return false
+}
+
+func format(v reflect.Value) string {
+	if v.Kind() == reflect.String {
+		return fmt.Sprintf("%q", v.String())
+	}
+	return fmt.Sprintf("%v", v.Interface())
+}
+
+func join(path string, name string) string {
+	if path == "" {
+		return name
+	}
+	return path + "." + name
+}
+
+func diff(changes *[]Change, path string, a reflect.Value, b reflect.Value, secret bool) {
+	switch a.Kind() {
+	case reflect.Struct:
+		t := a.Type()
+		for i := 0; i < t.NumField(); i++ {
+			f := t.Field(i)
+			if !f.IsExported() {
+				continue
+			}
+			name := strings.Split(f.Tag.Get("mapstructure"), ",")[0]
+			if name == "" {
+				name = strings.ToLower(f.Name)
+			}
+			diff(changes, join(path, name), a.Field(i), b.Field(i), secret || isSecret(name))
+		}
+
+	case reflect.Slice:
+		// lists of scalars are compared as a whole, lists of structs element by element
+		if a.Type().Elem().Kind() != reflect.Struct {
+			if !reflect.DeepEqual(a.Interface(), b.Interface()) {
+				*changes = append(*changes, Change{Path: path, Old: format(a), New: format(b), Secret: secret})
+			}
+			return
+		}
+
+		for i := 0; i < max(a.Len(), b.Len()); i++ {
+			p := fmt.Sprintf("%s[%d]", path, i)
+			switch {
+			case i >= a.Len():
+				*changes = append(*changes, Change{Path: p, New: format(b.Index(i)), Secret: true})
+			case i >= b.Len():
+				*changes = append(*changes, Change{Path: p, Old: format(a.Index(i)), Secret: true})
+			default:
+				diff(changes, p, a.Index(i), b.Index(i), secret)
+			}
+		}
+
+	default:
+		if !reflect.DeepEqual(a.Interface(), b.Interface()) {
+			*changes = append(*changes, Change{Path: path, Old: format(a), New: format(b), Secret: secret})
+		}
+	}
+}
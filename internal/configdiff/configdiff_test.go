@@ -0,0 +1,57 @@
+package configdiff
+
+import (
+	"testing"
+)
+
+type testUser struct {
+	User     string   `mapstructure:"user"`
+	Password string   `mapstructure:"password"`
+	Scopes   []string `mapstructure:"scopes"`
+}
+
+type testConfig struct {
+	Mist struct {
+		Apikey   string `mapstructure:"apikey"`
+		Interval int    `mapstructure:"interval"`
+	} `mapstructure:"mist"`
+	Users []testUser `mapstructure:"users"`
+}
+
+func TestDiff(t *testing.T) {
+	a := testConfig{}
+	a.Mist.Apikey = "old"
+	a.Mist.Interval = 60
+	a.Users = []testUser{{User: "ops", Password: "x", Scopes: []string{"admin"}}}
+
+	b := testConfig{}
+	b.Mist.Apikey = "new"
+	b.Mist.Interval = 30
+	b.Users = []testUser{{User: "ops", Password: "y", Scopes: []string{"read"}}, {User: "kiosk"}}
+
+	want := []string{
+		"mist.apikey: changed",
+		"mist.interval: 60 -> 30",
+		"users[0].password: changed",
+		"users[0].scopes: [admin] -> [read]",
+		"users[1]: added",
+	}
+
+	changes := Diff(a, b)
+	if len(changes) != len(want) {
+		t.Fatalf("Diff: %v; want %v", changes, want)
+	}
+	for i, c := range changes {
+		if c.String() != want[i] {
+			t.Errorf("Diff[%d] = %s; want %s", i, c, want[i])
+		}
+	}
+
+	if !changes[4].Under("users") || changes[1].Under("mist.inter") {
+		t.Errorf("Under: unexpected result")
+	}
+
+	if changes := Diff(a, a); len(changes) != 0 {
+		t.Errorf("Diff of equal configs: %v", changes)
+	}
+}
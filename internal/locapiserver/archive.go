@@ -0,0 +1,190 @@
+package locapiserver
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const archiveFileName = "webhooks.jsonl"
+
+// WebhookRecord is a raw webhook request as archived on disk (one JSON object per line)
+type WebhookRecord struct {
+	ReceivedAt time.Time         `json:"received_at"`
+	RemoteAddr string            `json:"remote_addr"`
+	Headers    map[string]string `json:"headers"`
+	Body       string            `json:"body"`
+}
+
+// webhookArchive appends raw webhooks to a JSONL file and rotates it by size
+type webhookArchive struct {
+	mu       sync.Mutex
+	dir      string
+	maxSize  int64
+	maxFiles int
+	f        *os.File
+	size     int64
+}
+
+func newWebhookArchive(dir string, maxSizeMb int, maxFiles int) (*webhookArchive, error) {
+	err := os.MkdirAll(dir, 0750)
+	if err != nil {
+		return nil, err
+	}
+
+	a := &webhookArchive{
+		dir:      dir,
+		maxSize:  int64(maxSizeMb) * 1024 * 1024,
+		maxFiles: maxFiles,
+	}
+
+	err = a.open()
+	if err != nil {
+		return nil, err
+	}
+
+	return a, nil
+}
+
+func (a *webhookArchive) open() error {
+	f, err := os.OpenFile(filepath.Join(a.dir, archiveFileName), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0640)
+	if err != nil {
+		return err
+	}
+
+	st, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+
+	if a.f != nil {
+		a.f.Close()
+	}
+	a.f = f
+	a.size = st.Size()
+	return nil
+}
+
+// rotate renames the current file with a timestamp suffix and removes the oldest archives.
+// The current file stays open until the new one is, so a failed rotation loses no writes.
+func (a *webhookArchive) rotate() error {
+	rotated := fmt.Sprintf("webhooks-%s.jsonl", time.Now().UTC().Format("20060102T150405.000000000"))
+	err := os.Rename(filepath.Join(a.dir, archiveFileName), filepath.Join(a.dir, rotated))
+	if err != nil {
+		return err
+	}
+
+	err = a.open()
+	if err != nil {
+		return err
+	}
+
+	if a.maxFiles > 0 {
+		files, err := filepath.Glob(filepath.Join(a.dir, "webhooks-*.jsonl"))
+		if err != nil {
+			return err
+		}
+
+		sort.Strings(files)
+		for len(files) > a.maxFiles {
+			err := os.Remove(files[0])
+			if err != nil {
+				log.Printf("webhookArchive: failed to remove %s (%v)", files[0], err)
+			}
+			files = files[1:]
+		}
+	}
+
+	return nil
+}
+
+// archiveFiles lists the archive files in dir, the current one included
+func archiveFiles(dir string) []string {
+	files, _ := filepath.Glob(filepath.Join(dir, "webhooks*.jsonl"))
+	return files
+}
+
+// purge removes the rotated files last written before cutoff and returns how many
+func (a *webhookArchive) purge(cutoff time.Time) (int, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	files, err := filepath.Glob(filepath.Join(a.dir, "webhooks-*.jsonl"))
+	if err != nil {
+		return 0, err
+	}
+
+	n := 0
+	for _, v := range files {
+		st, err := os.Stat(v)
+		if err != nil || !st.ModTime().Before(cutoff) {
+			continue
+		}
+
+		err = os.Remove(v)
+		if err != nil {
+			return n, err
+		}
+		n++
+	}
+
+	return n, nil
+}
+
+func (a *webhookArchive) Write(rec *WebhookRecord) error {
+	b, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	b = append(b, '\n')
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if a.maxSize > 0 && a.size > 0 && a.size+int64(len(b)) > a.maxSize {
+		err = a.rotate()
+		if err != nil {
+			// keep writing to the current file, the next write retries
+			log.Printf("webhookArchive: failed to rotate (%v)", err)
+		}
+	}
+
+	n, err := a.f.Write(b)
+	a.size += int64(n)
+	return err
+}
+
+func (a *webhookArchive) Close() error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	return a.f.Close()
+}
+
+// newWebhookRecord captures a request; credentials are not archived
+func newWebhookRecord(r *http.Request, body []byte) *WebhookRecord {
+	rec := &WebhookRecord{
+		ReceivedAt: time.Now(),
+		RemoteAddr: r.RemoteAddr,
+		Headers:    make(map[string]string),
+		Body:       string(body),
+	}
+
+	for k, v := range r.Header {
+		switch strings.ToLower(k) {
+		case "authorization", "cookie":
+			continue
+		}
+		rec.Headers[k] = strings.Join(v, ", ")
+	}
+
+	return rec
+}
@@ -0,0 +1,107 @@
+package locapiserver
+
+import (
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"mist-location-visualization/internal/mistfake"
+)
+
+func TestArchiveAndReplay(t *testing.T) {
+	dir := t.TempDir()
+	src := newTestEnv(t, func(cfg *Config) {
+		cfg.Archive.Enabled = true
+		cfg.Archive.Dir = dir
+	})
+
+	for i, mac := range []string{macTaro, macForklift} {
+		err := src.webhook.PostLocationAsset(
+			mistfake.LocationAssetEvent{Mac: mac, SiteId: mistfake.SiteId, MapId: mistfake.MapId11F, X: 10, Y: 20, Timestamp: testTimestamp + float64(i)},
+		)
+		if err != nil {
+			t.Fatalf("location-asset webhook: %v", err)
+		}
+	}
+
+	dst := newTestEnv(t, func(cfg *Config) {
+		cfg.Mist.Secret = "othersecret"
+	})
+
+	// the original signature no longer matches, so webhooks are rejected
+	archive := filepath.Join(dir, archiveFileName)
+	err := Replay([]string{archive}, ReplayOptions{Target: dst.http.URL + "/mistrecv"})
+	if err != nil {
+		t.Fatalf("Replay: %v", err)
+	}
+	status, _ := dst.get(t, "/entity/"+macTaro)
+	if status != http.StatusNotFound {
+		t.Errorf("entity exists after replay with stale signature (status %d)", status)
+	}
+
+	err = Replay([]string{archive}, ReplayOptions{Target: dst.http.URL + "/mistrecv", Secret: "othersecret"})
+	if err != nil {
+		t.Fatalf("Replay: %v", err)
+	}
+	for _, mac := range []string{macTaro, macForklift} {
+		status, _ := dst.get(t, "/entity/"+mac)
+		if status != http.StatusOK {
+			t.Errorf("GET /entity/%s after replay: status %d", mac, status)
+		}
+	}
+}
+
+func TestArchiveRotation(t *testing.T) {
+	dir := t.TempDir()
+	a, err := newWebhookArchive(dir, 0, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer a.Close()
+	a.maxSize = 100
+
+	for i := 0; i < 10; i++ {
+		err := a.Write(&WebhookRecord{Body: `{"topic":"zone","events":[]}`})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	rotated, _ := filepath.Glob(filepath.Join(dir, "webhooks-*.jsonl"))
+	if len(rotated) != 2 {
+		t.Errorf("got %d rotated files; want 2", len(rotated))
+	}
+
+	// writes go on to the current file while the rotation fails
+	os.Remove(filepath.Join(dir, archiveFileName))
+	for i := 0; i < 3; i++ {
+		err := a.Write(&WebhookRecord{Body: `{"topic":"zone","events":[]}`})
+		if err != nil {
+			t.Fatalf("Write after failed rotation: %v", err)
+		}
+	}
+}
+
+func TestArchiveRejectsUnsigned(t *testing.T) {
+	dir := t.TempDir()
+	e := newTestEnv(t, func(cfg *Config) {
+		cfg.Archive.Enabled = true
+		cfg.Archive.Dir = dir
+	})
+
+	resp, err := http.Post(e.http.URL+"/mistrecv", "application/json", strings.NewReader(`{"topic":"zone","events":[]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("unsigned webhook: status %d; want %d", resp.StatusCode, http.StatusUnauthorized)
+	}
+
+	st, err := os.Stat(filepath.Join(dir, archiveFileName))
+	if err != nil || st.Size() != 0 {
+		t.Errorf("unsigned webhook archived (%v)", err)
+	}
+}
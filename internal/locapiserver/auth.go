@@ -0,0 +1,360 @@
+package locapiserver
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"net/http"
+	"slices"
+	"strings"
+
+	"mist-location-visualization/internal/models"
+
+	"github.com/go-chi/render"
+	"golang.org/x/crypto/bcrypt"
+	"gorm.io/gorm"
+)
+
+// Scopes granted to API users and keys. Admin implies read.
+const (
+	scopeRead  = "read"
+	scopeAdmin = "admin"
+)
+
+// Principal is the authenticated caller of the read API.
+// Restricted callers only see the maps of Orgs and the maps in Maps. Tenant bound callers
+// only see the entities whose organisation (DisplayOrg) is one of Tenants.
+type Principal struct {
+	Name    string
+	Scopes  []string
+	Orgs    []string
+	Maps    []string
+	Tenants []string
+
+	restricted bool
+	tenanted   bool
+	mapIds     map[string]bool
+}
+
+func (p *Principal) hasScope(scope string) bool {
+	return slices.Contains(p.Scopes, scope) || slices.Contains(p.Scopes, scopeAdmin)
+}
+
+// apiUser is a basic authentication user; hash is a bcrypt hash unless plain is set
+type apiUser struct {
+	hash    []byte
+	plain   string
+	scopes  []string
+	tenants []string
+	maps    []string
+}
+
+// apiAuth holds the credentials of the read API, keyed by user name and by key hash
+type apiAuth struct {
+	realm     string
+	users     map[string]*apiUser
+	keys      map[string]*Principal
+	oidc      *oidcVerifier
+	anonymous bool
+}
+
+func defaultScopes(scopes []string) []string {
+	if len(scopes) == 0 {
+		return []string{scopeRead}
+	}
+	return scopes
+}
+
+// validateScopes checks scopes and that admins are not bound to tenants or maps
+func validateScopes(scopes []string, tenants []string, maps []string) error {
+	for _, v := range scopes {
+		if v != scopeRead && v != scopeAdmin {
+			return fmt.Errorf("unknown scope %s", v)
+		}
+	}
+
+	if slices.Contains(scopes, scopeAdmin) && (len(tenants) > 0 || len(maps) > 0) {
+		return fmt.Errorf("admin scope cannot be limited to tenants or maps")
+	}
+	return nil
+}
+
+// newBoundPrincipal returns a caller limited to tenants and maps when they are given
+func newBoundPrincipal(name string, scopes []string, tenants []string, maps []string) *Principal {
+	return &Principal{
+		Name:       name,
+		Scopes:     scopes,
+		Maps:       maps,
+		Tenants:    tenants,
+		restricted: len(maps) > 0,
+		tenanted:   len(tenants) > 0,
+	}
+}
+
+func newApiAuth(cfg Config) (*apiAuth, error) {
+	a := &apiAuth{
+		realm:     cfg.Http.ServerName,
+		users:     make(map[string]*apiUser),
+		keys:      make(map[string]*Principal),
+		anonymous: cfg.Http.Anonymous,
+	}
+
+	if cfg.Http.BasicAuth {
+		if len(cfg.Http.Users) == 0 {
+			return nil, fmt.Errorf("basic_auth is enabled without users")
+		}
+		for _, v := range cfg.Http.Users {
+			err := validateScopes(v.Scopes, v.Tenants, v.Maps)
+			if err != nil {
+				return nil, fmt.Errorf("user %s: %w", v.User, err)
+			}
+
+			u := &apiUser{scopes: defaultScopes(v.Scopes), tenants: v.Tenants, maps: v.Maps}
+			switch {
+			case v.PasswordHash != "":
+				u.hash = []byte(v.PasswordHash)
+				_, err := bcrypt.Cost(u.hash)
+				if err != nil {
+					return nil, fmt.Errorf("user %s: invalid password_hash: %w", v.User, err)
+				}
+			case v.Password != "":
+				log.Printf("newApiAuth: Warning: user %s has a plain text password, use password_hash instead", v.User)
+				u.plain = v.Password
+			default:
+				return nil, fmt.Errorf("user %s has no password", v.User)
+			}
+			a.users[v.User] = u
+		}
+	}
+
+	for _, v := range cfg.Http.ApiKeys {
+		err := validateScopes(v.Scopes, v.Tenants, v.Maps)
+		if err != nil {
+			return nil, fmt.Errorf("api key %s: %w", v.Name, err)
+		}
+
+		hash := strings.ToLower(v.KeySha256)
+		if len(hash) != sha256.Size*2 {
+			return nil, fmt.Errorf("api key %s: key_sha256 must be a hex encoded SHA-256 hash", v.Name)
+		}
+		a.keys[hash] = newBoundPrincipal(v.Name, defaultScopes(v.Scopes), v.Tenants, v.Maps)
+	}
+
+	if cfg.Http.Oidc.JwksFile != "" || cfg.Http.Oidc.JwksUrl != "" {
+		var err error
+		a.oidc, err = newOidcVerifier(cfg.Http.Oidc)
+		if err != nil {
+			return nil, fmt.Errorf("oidc: %w", err)
+		}
+	}
+
+	return a, nil
+}
+
+// enabled reports whether any credentials are configured; without them the API is read only
+func (a *apiAuth) enabled() bool {
+	return len(a.users) > 0 || len(a.keys) > 0 || a.oidc != nil || a.anonymous
+}
+
+// authenticate returns the caller of r, or nil when the credentials are missing or wrong
+func (a *apiAuth) authenticate(r *http.Request) *Principal {
+	if !a.enabled() {
+		return &Principal{Name: "anonymous", Scopes: []string{scopeRead}}
+	}
+
+	if user, pass, ok := r.BasicAuth(); ok {
+		u, found := a.users[user]
+		if !found {
+			return nil
+		}
+
+		if u.hash != nil {
+			if bcrypt.CompareHashAndPassword(u.hash, []byte(pass)) != nil {
+				return nil
+			}
+		} else if subtle.ConstantTimeCompare([]byte(u.plain), []byte(pass)) != 1 {
+			return nil
+		}
+
+		return newBoundPrincipal(user, u.scopes, u.tenants, u.maps)
+	}
+
+	if key, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); ok {
+		// JWTs have three dot separated parts, API keys have none
+		if a.oidc != nil && strings.Count(key, ".") == 2 {
+			p, err := a.oidc.verify(r.Context(), key)
+			if err != nil {
+				log.Printf("authenticate: Rejected token (%v)", err)
+				return nil
+			}
+
+			return p
+		}
+
+		sum := sha256.Sum256([]byte(key))
+		p, found := a.keys[hex.EncodeToString(sum[:])]
+		if !found {
+			return nil
+		}
+
+		// the allowed maps are resolved per request
+		cp := *p
+		return &cp
+	}
+
+	if a.anonymous {
+		return &Principal{Name: "anonymous", Scopes: []string{scopeRead}}
+	}
+
+	return nil
+}
+
+// apiAuthenticate stores the caller in the request context or rejects the request
+func (s *LocApiServer) apiAuthenticate(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		auth := s.auth.Load()
+		p := auth.authenticate(r)
+		if p == nil {
+			if len(auth.users) > 0 {
+				w.Header().Set("WWW-Authenticate", fmt.Sprintf(`Basic realm="%s"`, auth.realm))
+			}
+			err := fmt.Errorf("invalid credentials")
+			render.Render(w, r, s.httpErrUnauthorized(err))
+			return
+		}
+
+		if p.restricted {
+			err := s.resolveAllowedMaps(r.Context(), p)
+			if err != nil {
+				log.Printf("apiAuthenticate: Failed to query DB (%v)", err)
+				err := fmt.Errorf("failed to get data from backend")
+				render.Render(w, r, s.httpErrUnexpected(err))
+				return
+			}
+		}
+
+		ctx := context.WithValue(r.Context(), "principal", p)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// resolveAllowedMaps collects the maps a restricted caller may see from its organisations and maps
+func (s *LocApiServer) resolveAllowedMaps(ctx context.Context, p *Principal) error {
+	p.mapIds = make(map[string]bool)
+	for _, v := range p.Maps {
+		p.mapIds[v] = true
+	}
+
+	if len(p.Orgs) == 0 {
+		return nil
+	}
+
+	ids := make([]string, 0)
+	ret := s.dbConn.WithContext(ctx).Model(&models.Map{}).
+		Joins("JOIN sites ON sites.id = maps.site_id").
+		Where("sites.org_id IN ?", p.Orgs).
+		Pluck("maps.id", &ids)
+	if ret.Error != nil {
+		return ret.Error
+	}
+
+	for _, v := range ids {
+		p.mapIds[v] = true
+	}
+
+	return nil
+}
+
+// getPrincipal returns the caller stored by apiAuthenticate
+func getPrincipal(ctx context.Context) *Principal {
+	p, _ := ctx.Value("principal").(*Principal)
+	return p
+}
+
+// allowsMap reports whether the caller may see mapId
+func (p *Principal) allowsMap(mapId string) bool {
+	return p == nil || !p.restricted || p.mapIds[mapId]
+}
+
+// restrictMaps limits q to rows whose column refers to a map the caller of ctx may see
+func restrictMaps(ctx context.Context, q *gorm.DB, column string) *gorm.DB {
+	p := getPrincipal(ctx)
+	if p == nil || !p.restricted {
+		return q
+	}
+
+	ids := make([]string, 0, len(p.mapIds))
+	for v := range p.mapIds {
+		ids = append(ids, v)
+	}
+
+	return q.Where(column+" IN ?", ids)
+}
+
+// allowsTenant reports whether the caller may see entities of the organisation org
+func (p *Principal) allowsTenant(org string) bool {
+	return p == nil || !p.tenanted || slices.Contains(p.Tenants, org)
+}
+
+// restrictTenants limits q to rows whose column is an organisation the caller of ctx may see
+func restrictTenants(ctx context.Context, q *gorm.DB, column string) *gorm.DB {
+	p := getPrincipal(ctx)
+	if p == nil || !p.tenanted {
+		return q
+	}
+
+	return q.Where(column+" IN ?", p.Tenants)
+}
+
+// restrictEntities limits q to rows whose column is the mac of an entity the caller of ctx may see
+func restrictEntities(ctx context.Context, q *gorm.DB, column string) *gorm.DB {
+	p := getPrincipal(ctx)
+	if p == nil || !p.tenanted {
+		return q
+	}
+
+	macs := q.Session(&gorm.Session{NewDB: true}).Model(&models.Entity{}).Select("mac").Where("display_org IN ?", p.Tenants)
+	return q.Where(column+" IN (?)", macs)
+}
+
+// apiRequireScope rejects callers without scope
+func (s *LocApiServer) apiRequireScope(scope string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			p := getPrincipal(r.Context())
+			if p == nil || !p.hasScope(scope) {
+				err := fmt.Errorf("scope %s required", scope)
+				render.Render(w, r, s.httpErrForbidden(err))
+				return
+			}
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// apiRequireUnrestricted rejects callers limited to some maps or tenants
+func (s *LocApiServer) apiRequireUnrestricted(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if p := getPrincipal(r.Context()); p != nil && (p.restricted || p.tenanted) {
+			err := fmt.Errorf("not available to callers restricted to maps or tenants")
+			render.Render(w, r, s.httpErrForbidden(err))
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// HashPassword returns the bcrypt hash to use as password_hash in the configuration
+func HashPassword(password string) (string, error) {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return "", err
+	}
+
+	return string(hash), nil
+}
@@ -0,0 +1,118 @@
+package locapiserver
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"golang.org/x/crypto/bcrypt"
+
+	"mist-location-visualization/internal/mistfake"
+)
+
+func TestApiAuth(t *testing.T) {
+	hash, err := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keySum := sha256.Sum256([]byte("kioskkey"))
+
+	e := newTestEnv(t, func(cfg *Config) {
+		cfg.Http.BasicAuth = true
+		cfg.Http.Users = append(cfg.Http.Users, UserConfig{User: "admin", PasswordHash: string(hash), Scopes: []string{scopeAdmin}})
+		cfg.Http.ApiKeys = append(cfg.Http.ApiKeys, ApiKeyConfig{Name: "kiosk", KeySha256: hex.EncodeToString(keySum[:])})
+	})
+
+	// webhooks need no API credentials
+	err = e.webhook.PostLocationAsset(
+		mistfake.LocationAssetEvent{Mac: macTaro, SiteId: mistfake.SiteId, MapId: mistfake.MapId11F, X: 10, Y: 20, Timestamp: testTimestamp},
+	)
+	if err != nil {
+		t.Fatalf("location-asset webhook without basic auth: %v", err)
+	}
+
+	for _, c := range []struct {
+		name   string
+		set    func(req *http.Request)
+		status int
+	}{
+		{"no credentials", func(req *http.Request) {}, http.StatusUnauthorized},
+		{"bcrypt user", func(req *http.Request) { req.SetBasicAuth("admin", "secret") }, http.StatusOK},
+		{"wrong password", func(req *http.Request) { req.SetBasicAuth("admin", "wrong") }, http.StatusUnauthorized},
+		{"api key", func(req *http.Request) { req.Header.Set("Authorization", "Bearer kioskkey") }, http.StatusOK},
+		{"unknown api key", func(req *http.Request) { req.Header.Set("Authorization", "Bearer otherkey") }, http.StatusUnauthorized},
+	} {
+		req, _ := http.NewRequest(http.MethodGet, e.http.URL+"/entity", nil)
+		c.set(req)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != c.status {
+			t.Errorf("GET /entity with %s: status %d; want %d", c.name, resp.StatusCode, c.status)
+		}
+	}
+}
+
+func TestApiAuthAnonymous(t *testing.T) {
+	e := newTestEnv(t, func(cfg *Config) {
+		cfg.Http.Anonymous = true
+	})
+
+	status, _ := e.get(t, "/entity")
+	if status != http.StatusOK {
+		t.Errorf("anonymous GET /entity: status %d; want %d", status, http.StatusOK)
+	}
+
+	p := e.server.auth.Load().authenticate(httptest.NewRequest(http.MethodGet, "/entity", nil))
+	if p == nil || p.hasScope(scopeAdmin) {
+		t.Errorf("anonymous caller has admin scope")
+	}
+}
+
+func TestApiAuthNotConfigured(t *testing.T) {
+	e := newTestEnv(t)
+
+	status, _ := e.get(t, "/entity")
+	if status != http.StatusOK {
+		t.Errorf("GET /entity without auth: status %d; want %d", status, http.StatusOK)
+	}
+	status, _ = e.send(t, http.MethodPost, "/rule/reload", "", nil)
+	if status != http.StatusForbidden {
+		t.Errorf("POST /rule/reload without auth: status %d; want %d", status, http.StatusForbidden)
+	}
+}
+
+func TestNewApiAuthInvalid(t *testing.T) {
+	for name, cfg := range map[string]Config{
+		"unknown scope": func() (c Config) {
+			c.Http.ApiKeys = []ApiKeyConfig{{Name: "k", KeySha256: hex.EncodeToString(make([]byte, sha256.Size)), Scopes: []string{"write"}}}
+			return
+		}(),
+		"short key hash": func() (c Config) {
+			c.Http.ApiKeys = []ApiKeyConfig{{Name: "k", KeySha256: "abcd"}}
+			return
+		}(),
+		"admin bound to tenants": func() (c Config) {
+			c.Http.ApiKeys = []ApiKeyConfig{{Name: "k", KeySha256: hex.EncodeToString(make([]byte, sha256.Size)), Scopes: []string{scopeAdmin}, Tenants: []string{"Juniper"}}}
+			return
+		}(),
+		"basic auth without users": func() (c Config) {
+			c.Http.BasicAuth = true
+			return
+		}(),
+		"bad password hash": func() (c Config) {
+			c.Http.BasicAuth = true
+			c.Http.Users = []UserConfig{{User: "u", PasswordHash: "plain"}}
+			return
+		}(),
+	} {
+		_, err := newApiAuth(cfg)
+		if err == nil {
+			t.Errorf("newApiAuth with %s: no error", name)
+		}
+	}
+}
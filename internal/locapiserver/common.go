@@ -27,6 +27,22 @@ func (s *LocApiServer) httpErrUnauthorized(err error) render.Renderer {
 	}
 }
 
+func (s *LocApiServer) httpErrForbidden(err error) render.Renderer {
+	return &HttpErrResponse{
+		Err:            err,
+		HTTPStatusCode: http.StatusForbidden,
+		ErrorText:      "Forbidden",
+	}
+}
+
+func (s *LocApiServer) httpErrTooLarge(err error) render.Renderer {
+	return &HttpErrResponse{
+		Err:            err,
+		HTTPStatusCode: http.StatusRequestEntityTooLarge,
+		ErrorText:      "Request entity too large",
+	}
+}
+
 func (s *LocApiServer) httpErrUnexpected(err error) render.Renderer {
 	return &HttpErrResponse{
 		Err:            err,
@@ -35,6 +51,14 @@ func (s *LocApiServer) httpErrUnexpected(err error) render.Renderer {
 	}
 }
 
+func (s *LocApiServer) httpErrNotFound(err error) render.Renderer {
+	return &HttpErrResponse{
+		Err:            err,
+		HTTPStatusCode: http.StatusNotFound,
+		ErrorText:      "Not Found",
+	}
+}
+
 func (s *LocApiServer) httpErrInvalidRequest(err error) render.Renderer {
 	return &HttpErrResponse{
 		Err:            err,
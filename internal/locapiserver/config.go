@@ -1,5 +1,9 @@
 package locapiserver
 
+import (
+	"mist-location-visualization/internal/models"
+)
+
 // Config defines the configuration structure for the location API server
 type Config struct {
 	Mist struct {
@@ -8,26 +12,127 @@ type Config struct {
 		LocationTimeout int       `mapstructure:"location_timeout"`
 		RefreshTime     int       `mapstructure:"refresh_time"`
 		Secret          string    `mapstructure:"secret"`
+		Secrets         []string  `mapstructure:"secrets"`
 		Debug           bool      `mapstructure:"debug"`
 	}                             `mapstructure:"mist"`
-	Db struct {
-		Driver  string `mapstructure:"driver"`
-		Debug   bool   `mapstructure:"debug"`
-		Mysql   struct {
-			User     string `mapstructure:"user"`
-			Password string `mapstructure:"password"`
-			Host     string `mapstructure:"host"`
-			Database string `mapstructure:"database"`
-		} `mapstructure:"mysql"`
-	} `mapstructure:"db"`
+	Db models.DbConfig `mapstructure:"db"`
 	Http struct {
-		ServerName string `mapstructure:"server_name"`
-		Listen     string `mapstructure:"listen"`
-		BasicAuth  bool   `mapstructure:"basic_auth"`
-		Debug      bool   `mapstructure:"debug"`
-		Users      []struct {
-			User     string `mapstructure:"user"`
-			Password string `mapstructure:"password"`
-		} `mapstructure:"users"`
+		ServerName      string `mapstructure:"server_name"`
+		Listen          string `mapstructure:"listen"`
+		BasicAuth       bool   `mapstructure:"basic_auth"`
+		ShutdownTimeout int    `mapstructure:"shutdown_timeout"`
+		Debug           bool   `mapstructure:"debug"`
+		Anonymous       bool   `mapstructure:"anonymous"`
+		Users           []UserConfig   `mapstructure:"users"`
+		ApiKeys         []ApiKeyConfig `mapstructure:"api_keys"`
+		Oidc            OidcConfig     `mapstructure:"oidc"`
+		Tls struct {
+			CertFile     string `mapstructure:"cert_file"`
+			KeyFile      string `mapstructure:"key_file"`
+			MinVersion   string `mapstructure:"min_version"`
+			ClientCaFile string `mapstructure:"client_ca_file"`
+		} `mapstructure:"tls"`
 	} `mapstructure:"http"`
+	Visit struct {
+		MinDwell int `mapstructure:"min_dwell"`
+	} `mapstructure:"visit"`
+	Occupancy struct {
+		Interval int `mapstructure:"interval"`
+	} `mapstructure:"occupancy"`
+	Health struct {
+		WebhookTimeout int `mapstructure:"webhook_timeout"`
+	} `mapstructure:"health"`
+	Filter struct {
+		Method           string  `mapstructure:"method"`
+		Window           int     `mapstructure:"window"`
+		Alpha            float64 `mapstructure:"alpha"`
+		ProcessNoise     float64 `mapstructure:"process_noise"`
+		MeasurementNoise float64 `mapstructure:"measurement_noise"`
+		MaxSpeed         float64 `mapstructure:"max_speed"`
+	} `mapstructure:"filter"`
+	Webhook struct {
+		MaxBodySize  int    `mapstructure:"max_body_size"`
+		MaxEventAge  int    `mapstructure:"max_event_age"`
+		MaxClockSkew int    `mapstructure:"max_clock_skew"`
+		DedupeWindow int    `mapstructure:"dedupe_window"`
+		OutOfOrder   string `mapstructure:"out_of_order"`
+	} `mapstructure:"webhook"`
+	Proximity struct {
+		Enabled     bool    `mapstructure:"enabled"`
+		Distance    float64 `mapstructure:"distance"`
+		MinDuration int     `mapstructure:"min_duration"`
+		MaxGap      int     `mapstructure:"max_gap"`
+	} `mapstructure:"proximity"`
+	Privacy struct {
+		Pseudonymize bool   `mapstructure:"pseudonymize"`
+		Salt         string `mapstructure:"salt"`
+		ExemptAdmin  bool   `mapstructure:"exempt_admin"`
+	} `mapstructure:"privacy"`
+	Retention struct {
+		Interval     int `mapstructure:"interval"`
+		Entities     int `mapstructure:"entities"`
+		Visits       int `mapstructure:"visits"`
+		FloorChanges int `mapstructure:"floor_changes"`
+		Positions    int `mapstructure:"positions"`
+		Occupancy    int `mapstructure:"occupancy"`
+		Contacts     int `mapstructure:"contacts"`
+		Alerts       int `mapstructure:"alerts"`
+		Audit        int `mapstructure:"audit"`
+		Archive      int `mapstructure:"archive"`
+	} `mapstructure:"retention"`
+	Rules struct {
+		File     string `mapstructure:"file"`
+		Interval int    `mapstructure:"interval"`
+	} `mapstructure:"rules"`
+	Archive struct {
+		Enabled  bool   `mapstructure:"enabled"`
+		Dir      string `mapstructure:"dir"`
+		MaxSize  int    `mapstructure:"max_size"`
+		MaxFiles int    `mapstructure:"max_files"`
+	} `mapstructure:"archive"`
+}
+
+// UserConfig is a basic authentication user of the read API.
+// Password is the legacy plain text form of PasswordHash (bcrypt).
+// Tenants and Maps limit the user to entities of those organisations and maps.
+type UserConfig struct {
+	User         string   `mapstructure:"user"`
+	Password     string   `mapstructure:"password"`
+	PasswordHash string   `mapstructure:"password_hash"`
+	Scopes       []string `mapstructure:"scopes"`
+	Tenants      []string `mapstructure:"tenants"`
+	Maps         []string `mapstructure:"maps"`
+}
+
+// ApiKeyConfig is a bearer token of the read API, stored as its hex encoded SHA-256 hash.
+// Tenants and Maps limit the key like those of UserConfig.
+type ApiKeyConfig struct {
+	Name      string   `mapstructure:"name"`
+	KeySha256 string   `mapstructure:"key_sha256"`
+	Scopes    []string `mapstructure:"scopes"`
+	Tenants   []string `mapstructure:"tenants"`
+	Maps      []string `mapstructure:"maps"`
+}
+
+// OidcConfig validates JWT bearer tokens issued by an OpenID Connect provider.
+// Claim names may refer to nested claims with dots, e.g. "realm_access.roles".
+type OidcConfig struct {
+	Issuer       string           `mapstructure:"issuer"`
+	Audience     string           `mapstructure:"audience"`
+	JwksFile     string           `mapstructure:"jwks_file"`
+	JwksUrl      string           `mapstructure:"jwks_url"`
+	JwksRefresh  int              `mapstructure:"jwks_refresh"`
+	Leeway       int              `mapstructure:"leeway"`
+	NameClaim    string           `mapstructure:"name_claim"`
+	RolesClaim   string           `mapstructure:"roles_claim"`
+	OrgsClaim    string           `mapstructure:"orgs_claim"`
+	MapsClaim    string           `mapstructure:"maps_claim"`
+	TenantsClaim string           `mapstructure:"tenants_claim"`
+	Roles        []OidcRoleConfig `mapstructure:"roles"`
+}
+
+// OidcRoleConfig grants scopes to tokens carrying Role in the roles claim
+type OidcRoleConfig struct {
+	Role   string   `mapstructure:"role"`
+	Scopes []string `mapstructure:"scopes"`
 }
@@ -0,0 +1,219 @@
+package locapiserver
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"sync"
+	"time"
+)
+
+// Position filter methods
+const (
+	filterNone          = "none"
+	filterMovingAverage = "moving_average"
+	filterExponential   = "exponential"
+	filterKalman        = "kalman"
+)
+
+const (
+	defaultFilterWindow           = 5
+	defaultFilterAlpha            = 0.3
+	defaultFilterProcessNoise     = 1.0
+	defaultFilterMeasurementNoise = 4.0
+	// filter states of entities not seen for this long are dropped
+	filterStateTimeout = time.Hour
+)
+
+// errTeleportEvent is returned for positions implying a speed above the configured maximum
+var errTeleportEvent = errors.New("position implies a speed above the maximum")
+
+// kalmanAxis is a one dimensional Kalman filter with a random walk model
+type kalmanAxis struct {
+	x float64 // estimate
+	p float64 // estimate variance
+}
+
+// update predicts the variance growth over dt seconds with process noise q,
+// then corrects the estimate with measurement z of variance r
+func (k *kalmanAxis) update(z float64, dt float64, q float64, r float64) float64 {
+	k.p += q * dt
+	gain := k.p / (k.p + r)
+	k.x += gain * (z - k.x)
+	k.p *= 1 - gain
+	return k.x
+}
+
+// filterState is the filter state of one entity; positions are in metres
+type filterState struct {
+	mapId  string
+	ts     float64 // time of the last accepted position
+	rawX   float64
+	rawY   float64
+	x      float64
+	y      float64
+	window [][2]float64
+	kx     kalmanAxis
+	ky     kalmanAxis
+}
+
+// positionFilter smooths entity positions and rejects positions implying impossible speeds
+type positionFilter struct {
+	method           string
+	window           int
+	alpha            float64
+	processNoise     float64
+	measurementNoise float64
+	maxSpeed         float64
+
+	mu        sync.Mutex
+	states    map[string]*filterState
+	lastSweep time.Time
+}
+
+func newPositionFilter(cfg Config) (*positionFilter, error) {
+	f := &positionFilter{
+		method:           cfg.Filter.Method,
+		window:           cfg.Filter.Window,
+		alpha:            cfg.Filter.Alpha,
+		processNoise:     cfg.Filter.ProcessNoise,
+		measurementNoise: cfg.Filter.MeasurementNoise,
+		maxSpeed:         cfg.Filter.MaxSpeed,
+		states:           make(map[string]*filterState),
+	}
+
+	switch f.method {
+	case "":
+		f.method = filterNone
+	case filterNone, filterMovingAverage, filterExponential, filterKalman:
+	default:
+		return nil, fmt.Errorf("unknown filter method %s", f.method)
+	}
+
+	if f.window <= 0 {
+		f.window = defaultFilterWindow
+	}
+	if f.alpha <= 0 || f.alpha > 1 {
+		f.alpha = defaultFilterAlpha
+	}
+	if f.processNoise <= 0 {
+		f.processNoise = defaultFilterProcessNoise
+	}
+	if f.measurementNoise <= 0 {
+		f.measurementNoise = defaultFilterMeasurementNoise
+	}
+
+	return f, nil
+}
+
+// enabled reports whether positions are smoothed or checked at all
+func (f *positionFilter) enabled() bool {
+	return f.method != filterNone || f.maxSpeed > 0
+}
+
+// apply returns the smoothed position of mac for a raw position at ts (unix seconds).
+// The state starts over when the entity changes maps. Positions without ts are taken
+// at the receive time and not checked against the maximum speed.
+func (f *positionFilter) apply(mac string, mapId string, x float64, y float64, ts float64) (float64, float64, error) {
+	if !f.enabled() {
+		return x, y, nil
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	now := time.Now()
+	f.sweep(now)
+
+	timed := ts > 0
+	if !timed {
+		ts = float64(now.UnixNano()) / 1e9
+	}
+
+	st, ok := f.states[mac]
+	if !ok || st.mapId != mapId {
+		st = &filterState{
+			mapId:  mapId,
+			x:      x,
+			y:      y,
+			window: [][2]float64{{x, y}},
+			kx:     kalmanAxis{x: x, p: f.measurementNoise},
+			ky:     kalmanAxis{x: y, p: f.measurementNoise},
+		}
+		f.states[mac] = st
+		st.accept(x, y, ts)
+		return x, y, nil
+	}
+
+	dt := ts - st.ts
+	if dt < 0 {
+		dt = 0
+	}
+
+	// rejected positions leave the state alone, so a real move is accepted
+	// once enough time has passed for the distance to be plausible
+	if f.maxSpeed > 0 && timed {
+		dist := math.Hypot(x-st.rawX, y-st.rawY)
+		if dist > f.maxSpeed*dt {
+			return st.x, st.y, errTeleportEvent
+		}
+	}
+
+	switch f.method {
+	case filterNone:
+		st.x, st.y = x, y
+
+	case filterMovingAverage:
+		st.window = append(st.window, [2]float64{x, y})
+		if len(st.window) > f.window {
+			st.window = st.window[len(st.window)-f.window:]
+		}
+		sumX, sumY := 0.0, 0.0
+		for _, p := range st.window {
+			sumX += p[0]
+			sumY += p[1]
+		}
+		st.x = sumX / float64(len(st.window))
+		st.y = sumY / float64(len(st.window))
+
+	case filterExponential:
+		st.x = f.alpha*x + (1-f.alpha)*st.x
+		st.y = f.alpha*y + (1-f.alpha)*st.y
+
+	case filterKalman:
+		st.x = st.kx.update(x, dt, f.processNoise, f.measurementNoise)
+		st.y = st.ky.update(y, dt, f.processNoise, f.measurementNoise)
+	}
+
+	st.accept(x, y, ts)
+	return st.x, st.y, nil
+}
+
+func (st *filterState) accept(x float64, y float64, ts float64) {
+	st.rawX = x
+	st.rawY = y
+	st.ts = ts
+}
+
+// reset forgets the state of mac, e.g. when its position timed out
+func (f *positionFilter) reset(mac string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	delete(f.states, mac)
+}
+
+// sweep drops the states of entities not seen within filterStateTimeout
+func (f *positionFilter) sweep(now time.Time) {
+	if now.Sub(f.lastSweep) < filterStateTimeout {
+		return
+	}
+
+	cutoff := float64(now.Add(-filterStateTimeout).Unix())
+	for mac, st := range f.states {
+		if st.ts < cutoff {
+			delete(f.states, mac)
+		}
+	}
+	f.lastSweep = now
+}
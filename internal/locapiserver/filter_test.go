@@ -0,0 +1,118 @@
+package locapiserver
+
+import (
+	"encoding/json"
+	"math"
+	"net/http"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+
+	"mist-location-visualization/internal/mistfake"
+)
+
+func TestPositionFilterMethods(t *testing.T) {
+	// a stationary badge at (10, 10) with +-2 m of jitter
+	jitter := [][2]float64{{10, 10}, {12, 8}, {8, 12}, {12, 12}, {8, 8}, {11, 9}, {9, 11}, {12, 10}, {8, 10}, {10, 12}}
+
+	for _, method := range []string{filterMovingAverage, filterExponential, filterKalman} {
+		t.Run(method, func(t *testing.T) {
+			cfg := Config{}
+			cfg.Filter.Method = method
+			f, err := newPositionFilter(cfg)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			maxRaw, maxSmoothed := 0.0, 0.0
+			for i, p := range jitter {
+				x, y, err := f.apply(macTaro, mistfake.MapId11F, p[0], p[1], float64(testTimestamp+i))
+				if err != nil {
+					t.Fatalf("apply: %v", err)
+				}
+				if i >= 5 {
+					maxRaw = max(maxRaw, math.Hypot(p[0]-10, p[1]-10))
+					maxSmoothed = max(maxSmoothed, math.Hypot(x-10, y-10))
+				}
+			}
+
+			if maxSmoothed >= maxRaw/2 {
+				t.Errorf("smoothed error %.2f m; want less than half of raw %.2f m", maxSmoothed, maxRaw)
+			}
+		})
+	}
+}
+
+func TestPositionFilterTeleport(t *testing.T) {
+	cfg := Config{}
+	cfg.Filter.MaxSpeed = 3
+	f, err := newPositionFilter(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	steps := []struct {
+		x, ts float64
+		err   error
+	}{
+		{0, 0, nil},
+		{2, 1, nil},
+		{40, 2, errTeleportEvent},  // 38 m in 1 s
+		{40, 10, errTeleportEvent}, // 38 m in 9 s
+		{40, 20, nil},              // 38 m in 19 s
+	}
+	for _, v := range steps {
+		x, _, err := f.apply(macTaro, mistfake.MapId11F, v.x, 0, testTimestamp+v.ts)
+		if err != v.err {
+			t.Errorf("position %v at +%vs: %v; want %v", v.x, v.ts, err, v.err)
+		}
+		if err == nil && x != v.x {
+			t.Errorf("position %v at +%vs: got %v without smoothing", v.x, v.ts, x)
+		}
+	}
+
+	// a new map starts over
+	_, _, err = f.apply(macTaro, mistfake.MapId12F, 0, 0, testTimestamp+21)
+	if err != nil {
+		t.Errorf("first position on another map: %v", err)
+	}
+
+	// positions without a timestamp have no time to check the speed against
+	for _, v := range []float64{5, 10} {
+		x, _, err := f.apply(macTaro, mistfake.MapId12F, v, 0, 0)
+		if err != nil || x != v {
+			t.Errorf("position %v without timestamp: got %v (%v)", v, x, err)
+		}
+	}
+}
+
+func TestWebhookSmoothedPosition(t *testing.T) {
+	e := newTestEnv(t, func(cfg *Config) {
+		cfg.Filter.Method = filterExponential
+		cfg.Filter.Alpha = 0.5
+		cfg.Filter.MaxSpeed = 5
+	})
+
+	for _, ev := range []mistfake.LocationAssetEvent{
+		{Mac: macTaro, SiteId: mistfake.SiteId, MapId: mistfake.MapId11F, X: 10, Y: 20, Timestamp: testTimestamp},
+		{Mac: macTaro, SiteId: mistfake.SiteId, MapId: mistfake.MapId11F, X: 12, Y: 20, Timestamp: testTimestamp + 1},
+		{Mac: macTaro, SiteId: mistfake.SiteId, MapId: mistfake.MapId11F, X: 60, Y: 20, Timestamp: testTimestamp + 2},
+	} {
+		err := e.webhook.PostLocationAsset(ev)
+		if err != nil {
+			t.Fatalf("location-asset webhook: %v", err)
+		}
+	}
+
+	status, body := e.get(t, "/entity/"+macTaro)
+	o := EntityExtView{}
+	json.Unmarshal(body, &o)
+	// 15 pixels per metre; smoothed x is 11 m, raw x is 12 m
+	if status != http.StatusOK || o.X != 165 || o.RawX != 180 {
+		t.Errorf("entity position x %v raw_x %v; want 165 180", o.X, o.RawX)
+	}
+
+	if v := testutil.ToFloat64(e.server.metrics.webhookEvents.WithLabelValues("location-asset", eventOutcomeTeleport)); v != 1 {
+		t.Errorf("teleport events = %v; want 1", v)
+	}
+}
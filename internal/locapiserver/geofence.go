@@ -0,0 +1,381 @@
+package locapiserver
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"time"
+
+	"mist-location-visualization/internal/models"
+
+	"github.com/go-chi/chi"
+	"github.com/go-chi/render"
+	"github.com/google/uuid"
+)
+
+// GeofenceExtView represents the external view of a geofence for API responses
+type GeofenceExtView struct {
+	Id       string         `json:"id"`
+	Name     string         `json:"name"`
+	MapId    string         `json:"map_id"`
+	SiteId   string         `json:"site_id"`
+	Shape    string         `json:"shape"`
+	Vertices []models.Point `json:"vertices,omitempty"`
+	Center   *models.Point  `json:"center,omitempty"`
+	Radius   float64        `json:"radius,omitempty"`
+}
+
+func (e *GeofenceExtView) Render(w http.ResponseWriter, r *http.Request) error {
+	return nil
+}
+
+func newGeofenceExtView(g models.Geofence) *GeofenceExtView {
+	o := &GeofenceExtView{
+		Id:     g.Id,
+		Name:   g.Name,
+		MapId:  g.MapId,
+		SiteId: g.SiteId,
+		Shape:  g.Shape,
+	}
+
+	switch g.Shape {
+	case models.GeofenceShapePolygon:
+		o.Vertices = g.Vertices
+	case models.GeofenceShapeCircle:
+		center := g.Center
+		o.Center = &center
+		o.Radius = g.Radius
+	}
+
+	return o
+}
+
+// GeofenceRequest is the body of geofence create and update requests
+type GeofenceRequest struct {
+	Name     string         `json:"name"`
+	MapId    string         `json:"map_id"`
+	Shape    string         `json:"shape"`
+	Vertices []models.Point `json:"vertices"`
+	Center   *models.Point  `json:"center"`
+	Radius   float64        `json:"radius"`
+}
+
+func (e *GeofenceRequest) Bind(r *http.Request) error {
+	if e.Name == "" {
+		return fmt.Errorf("missing name")
+	}
+	if e.MapId == "" {
+		return fmt.Errorf("missing map_id")
+	}
+
+	switch e.Shape {
+	case models.GeofenceShapePolygon:
+		if len(e.Vertices) < 3 {
+			return fmt.Errorf("a polygon needs at least 3 vertices")
+		}
+	case models.GeofenceShapeCircle:
+		if e.Center == nil || e.Radius <= 0 {
+			return fmt.Errorf("a circle needs a center and a positive radius")
+		}
+	default:
+		return fmt.Errorf("invalid shape %s", e.Shape)
+	}
+
+	return nil
+}
+
+// geofenceContains reports whether p (in metres) is inside g
+func geofenceContains(g *models.Geofence, p models.Point) bool {
+	switch g.Shape {
+	case models.GeofenceShapeCircle:
+		return math.Hypot(p.X-g.Center.X, p.Y-g.Center.Y) <= g.Radius
+
+	case models.GeofenceShapePolygon:
+		// ray casting
+		in := false
+		n := len(g.Vertices)
+		for i, j := 0, n-1; i < n; j, i = i, i+1 {
+			a, b := g.Vertices[i], g.Vertices[j]
+			if (a.Y > p.Y) != (b.Y > p.Y) && p.X < (b.X-a.X)*(p.Y-a.Y)/(b.Y-a.Y)+a.X {
+				in = !in
+			}
+		}
+		return in
+	}
+
+	return false
+}
+
+// findZone returns the Mist zone or geofence with id, or nil when there is none
+func (s *LocApiServer) findZone(ctx context.Context, id string) (*models.Zone, error) {
+	zone := models.Zone{}
+	ret := s.dbConn.WithContext(ctx).Where("id = ?", id).Limit(1).Find(&zone)
+	if ret.Error != nil {
+		return nil, ret.Error
+	} else if ret.RowsAffected > 0 {
+		return &zone, nil
+	}
+
+	g := models.Geofence{}
+	ret = s.dbConn.WithContext(ctx).Where("id = ?", id).Limit(1).Find(&g)
+	if ret.Error != nil {
+		return nil, ret.Error
+	} else if ret.RowsAffected == 0 {
+		return nil, nil
+	}
+
+	return &models.Zone{Id: g.Id, Name: g.Name, MapId: g.MapId, SiteId: g.SiteId}, nil
+}
+
+// newGeofenceZoneExtView returns a geofence in the zone APIs, counting the entities of kinds inside
+func (s *LocApiServer) newGeofenceZoneExtView(ctx context.Context, g models.Geofence, kinds []string) *ZoneExtView {
+	var count int64
+
+	inside := s.dbConn.WithContext(ctx).Model(&models.ZoneVisit{}).Select("mac").
+		Where("zone_id = ? AND geofence = ? AND exit_at IS NULL", g.Id, true)
+	ret := s.entityQuery(ctx, kinds).Where("mac IN (?)", inside).Count(&count)
+	if ret.Error != nil {
+		log.Printf("newGeofenceZoneExtView: Failed to query DB on count (%v)", ret.Error)
+		count = 0
+	}
+
+	return &ZoneExtView{
+		Id:     g.Id,
+		Name:   g.Name,
+		MapId:  g.MapId,
+		Source: zoneSourceGeofence,
+		Count:  count,
+	}
+}
+
+// evaluateGeofences opens and closes the geofence visits of mac for a position (in metres) on mapId
+func (s *LocApiServer) evaluateGeofences(ctx context.Context, mac string, mapId string, x float64, y float64, t time.Time) {
+	geofences := make([]models.Geofence, 0)
+	ret := s.dbConn.WithContext(ctx).Where("map_id = ?", mapId).Find(&geofences)
+	if ret.Error != nil {
+		log.Printf("evaluateGeofences: Failed to query DB (%v)", ret.Error)
+		return
+	}
+
+	open := make([]models.ZoneVisit, 0)
+	ret = s.dbConn.WithContext(ctx).Where("mac = ? AND exit_at IS NULL AND geofence = ?", mac, true).Find(&open)
+	if ret.Error != nil {
+		log.Printf("evaluateGeofences: Failed to query DB on visits (%v)", ret.Error)
+		return
+	}
+
+	openIdx := make(map[string]*models.ZoneVisit)
+	for i := range open {
+		openIdx[open[i].ZoneId] = &open[i]
+	}
+
+	p := models.Point{X: x, Y: y}
+	for _, g := range geofences {
+		inside := geofenceContains(&g, p)
+		v, wasInside := openIdx[g.Id]
+		delete(openIdx, g.Id)
+
+		switch {
+		case inside && !wasInside:
+			log.Printf("evaluateGeofences: Mac %s entered geofence %s", mac, g.Name)
+			s.metrics.geofenceEvents.WithLabelValues("enter").Inc()
+			visit := &models.ZoneVisit{
+				Mac:      mac,
+				ZoneId:   g.Id,
+				MapId:    mapId,
+				Geofence: true,
+				EnterAt:  t,
+			}
+			ret := s.dbConn.WithContext(ctx).Create(visit)
+			if ret.Error != nil {
+				log.Printf("evaluateGeofences: Failed to store geofence visit (%v)", ret.Error)
+			}
+			s.fireZoneRules(ctx, ruleTriggerEnter, visit, t, 0, nil)
+
+		case !inside && wasInside:
+			log.Printf("evaluateGeofences: Mac %s left geofence %s", mac, g.Name)
+			s.metrics.geofenceEvents.WithLabelValues("exit").Inc()
+			s.closeZoneVisit(ctx, v, t)
+		}
+	}
+
+	// visits of geofences which were deleted or moved to another map
+	for _, v := range openIdx {
+		s.closeZoneVisit(ctx, v, t)
+	}
+
+	return
+}
+
+func (s *LocApiServer) apiGeofenceIdCtx(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key := chi.URLParam(r, "geofenceid")
+		if key == "" {
+			err := fmt.Errorf("Missing geofenceid param")
+			render.Render(w, r, s.httpErrInvalidRequest(err))
+			return
+		}
+
+		g := models.Geofence{}
+		ret := s.dbConn.WithContext(r.Context()).Where("id = ?", key).Limit(1).Find(&g)
+		if ret.Error != nil {
+			log.Printf("apiGeofenceIdCtx: Failed to query DB (%v)", ret.Error)
+			err := fmt.Errorf("failed to get data from backend")
+			render.Render(w, r, s.httpErrUnexpected(err))
+			return
+		} else if ret.RowsAffected == 0 || !getPrincipal(r.Context()).allowsMap(g.MapId) {
+			err := fmt.Errorf("geofence %s not found", key)
+			render.Render(w, r, s.httpErrNotFound(err))
+			return
+		}
+
+		ctx := context.WithValue(r.Context(), "geofence", &g)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+func (s *LocApiServer) apiGeofenceRouter() chi.Router {
+	r := chi.NewRouter()
+	r.Get("/", s.apiGeofenceGetAll)
+	r.With(s.apiRequireScope(scopeAdmin)).Post("/", s.apiGeofencePost)
+	r.Route("/{geofenceid}", func(r chi.Router) {
+		r.Use(s.apiGeofenceIdCtx)
+		r.Get("/", s.apiGeofenceGet)
+		r.With(s.apiRequireScope(scopeAdmin)).Put("/", s.apiGeofencePut)
+		r.With(s.apiRequireScope(scopeAdmin)).Delete("/", s.apiGeofenceDelete)
+	})
+
+	return r
+}
+
+func (s *LocApiServer) apiGeofenceGetAll(w http.ResponseWriter, r *http.Request) {
+	q := restrictMaps(r.Context(), s.dbConn.WithContext(r.Context()), "map_id")
+	if mapId := r.URL.Query().Get("map_id"); mapId != "" {
+		q = q.Where("map_id = ?", mapId)
+	}
+
+	geofences := make([]models.Geofence, 0)
+	ret := q.Order("name").Find(&geofences)
+	if ret.Error != nil {
+		log.Printf("apiGeofenceGetAll: Failed to query DB (%v)", ret.Error)
+		err := fmt.Errorf("failed to get data from backend")
+		render.Render(w, r, s.httpErrUnexpected(err))
+		return
+	}
+
+	outs := []render.Renderer{}
+	for _, g := range geofences {
+		outs = append(outs, newGeofenceExtView(g))
+	}
+
+	render.RenderList(w, r, outs)
+	return
+}
+
+func (s *LocApiServer) apiGeofenceGet(w http.ResponseWriter, r *http.Request) {
+	g := r.Context().Value("geofence").(*models.Geofence)
+
+	render.Render(w, r, newGeofenceExtView(*g))
+	return
+}
+
+// applyGeofenceRequest copies a validated request into g after checking its map
+func (s *LocApiServer) applyGeofenceRequest(w http.ResponseWriter, r *http.Request, g *models.Geofence) bool {
+	data := &GeofenceRequest{}
+	r.Body = http.MaxBytesReader(w, r.Body, defaultWebhookMaxBodySize)
+	err := render.Bind(r, data)
+	if err != nil {
+		render.Render(w, r, s.httpErrInvalidRequest(err))
+		return false
+	}
+
+	mapEntry := models.Map{}
+	ret := s.dbConn.WithContext(r.Context()).Where("id = ?", data.MapId).Limit(1).Find(&mapEntry)
+	if ret.Error != nil {
+		log.Printf("applyGeofenceRequest: Failed to query DB (%v)", ret.Error)
+		err := fmt.Errorf("failed to get data from backend")
+		render.Render(w, r, s.httpErrUnexpected(err))
+		return false
+	} else if ret.RowsAffected == 0 || !getPrincipal(r.Context()).allowsMap(data.MapId) {
+		err := fmt.Errorf("map %s not found", data.MapId)
+		render.Render(w, r, s.httpErrInvalidRequest(err))
+		return false
+	}
+
+	g.Name = data.Name
+	g.MapId = mapEntry.Id
+	g.SiteId = mapEntry.SiteId
+	g.Shape = data.Shape
+	g.Vertices = nil
+	g.Center = models.Point{}
+	g.Radius = 0
+
+	switch data.Shape {
+	case models.GeofenceShapePolygon:
+		g.Vertices = data.Vertices
+	case models.GeofenceShapeCircle:
+		g.Center = *data.Center
+		g.Radius = data.Radius
+	}
+
+	return true
+}
+
+func (s *LocApiServer) apiGeofencePost(w http.ResponseWriter, r *http.Request) {
+	g := &models.Geofence{Id: uuid.NewString()}
+	if !s.applyGeofenceRequest(w, r, g) {
+		return
+	}
+
+	ret := s.dbConn.WithContext(r.Context()).Create(g)
+	if ret.Error != nil {
+		log.Printf("apiGeofencePost: Failed to store geofence (%v)", ret.Error)
+		err := fmt.Errorf("failed to store data to backend")
+		render.Render(w, r, s.httpErrUnexpected(err))
+		return
+	}
+
+	log.Printf("apiGeofencePost: Created geofence %s (%s) on map %s", g.Id, g.Name, g.MapId)
+	render.Status(r, http.StatusCreated)
+	render.Render(w, r, newGeofenceExtView(*g))
+	return
+}
+
+func (s *LocApiServer) apiGeofencePut(w http.ResponseWriter, r *http.Request) {
+	g := r.Context().Value("geofence").(*models.Geofence)
+	if !s.applyGeofenceRequest(w, r, g) {
+		return
+	}
+
+	ret := s.dbConn.WithContext(r.Context()).Save(g)
+	if ret.Error != nil {
+		log.Printf("apiGeofencePut: Failed to store geofence (%v)", ret.Error)
+		err := fmt.Errorf("failed to store data to backend")
+		render.Render(w, r, s.httpErrUnexpected(err))
+		return
+	}
+
+	render.Render(w, r, newGeofenceExtView(*g))
+	return
+}
+
+func (s *LocApiServer) apiGeofenceDelete(w http.ResponseWriter, r *http.Request) {
+	g := r.Context().Value("geofence").(*models.Geofence)
+
+	ret := s.dbConn.WithContext(r.Context()).Delete(&models.Geofence{}, "id = ?", g.Id)
+	if ret.Error != nil {
+		log.Printf("apiGeofenceDelete: Failed to delete geofence (%v)", ret.Error)
+		err := fmt.Errorf("failed to store data to backend")
+		render.Render(w, r, s.httpErrUnexpected(err))
+		return
+	}
+
+	// entities inside leave the deleted geofence now
+	s.closeZoneVisits(r.Context(), "", g.Id, time.Now())
+
+	log.Printf("apiGeofenceDelete: Deleted geofence %s (%s)", g.Id, g.Name)
+	w.WriteHeader(http.StatusNoContent)
+	return
+}
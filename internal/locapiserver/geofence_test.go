@@ -0,0 +1,184 @@
+package locapiserver
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"testing"
+	"time"
+
+	"mist-location-visualization/internal/mistfake"
+	"mist-location-visualization/internal/models"
+)
+
+func (e *testEnv) send(t *testing.T, method string, uri string, token string, body interface{}) (int, []byte) {
+	t.Helper()
+
+	data, err := json.Marshal(body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req, _ := http.NewRequest(method, e.http.URL+uri, bytes.NewReader(data))
+	req.Header.Set("Content-Type", "application/json")
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	respBody, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp.StatusCode, respBody
+}
+
+func TestGeofenceCrud(t *testing.T) {
+	adminSum := sha256.Sum256([]byte("adminkey"))
+	readSum := sha256.Sum256([]byte("readkey"))
+	e := newTestEnv(t, func(cfg *Config) {
+		cfg.Http.ApiKeys = []ApiKeyConfig{
+			{Name: "admin", KeySha256: hex.EncodeToString(adminSum[:]), Scopes: []string{scopeAdmin}},
+			{Name: "kiosk", KeySha256: hex.EncodeToString(readSum[:])},
+		}
+	})
+
+	booth := GeofenceRequest{
+		Name:     "Demo Booth",
+		MapId:    mistfake.MapId11F,
+		Shape:    "polygon",
+		Vertices: []models.Point{{X: 0, Y: 0}, {X: 20, Y: 0}, {X: 20, Y: 20}, {X: 0, Y: 20}},
+	}
+
+	status, _ := e.send(t, http.MethodPost, "/geofence", "readkey", booth)
+	if status != http.StatusForbidden {
+		t.Errorf("POST /geofence with read scope: status %d; want %d", status, http.StatusForbidden)
+	}
+
+	for _, invalid := range []GeofenceRequest{
+		{Name: "no map", Shape: "circle", Center: &models.Point{X: 1, Y: 1}, Radius: 1},
+		{Name: "unknown map", MapId: "nomap", Shape: "circle", Center: &models.Point{X: 1, Y: 1}, Radius: 1},
+		{Name: "line", MapId: mistfake.MapId11F, Shape: "polygon", Vertices: []models.Point{{X: 0, Y: 0}, {X: 1, Y: 1}}},
+		{Name: "no radius", MapId: mistfake.MapId11F, Shape: "circle", Center: &models.Point{X: 1, Y: 1}},
+	} {
+		status, body := e.send(t, http.MethodPost, "/geofence", "adminkey", invalid)
+		if status != http.StatusBadRequest {
+			t.Errorf("POST /geofence %s: status %d; want %d (%s)", invalid.Name, status, http.StatusBadRequest, body)
+		}
+	}
+
+	status, body := e.send(t, http.MethodPost, "/geofence", "adminkey", booth)
+	created := GeofenceExtView{}
+	json.Unmarshal(body, &created)
+	if status != http.StatusCreated || created.Id == "" || created.SiteId != mistfake.SiteId {
+		t.Fatalf("POST /geofence: status %d (%s)", status, body)
+	}
+
+	circle := GeofenceRequest{Name: "Entrance", MapId: mistfake.MapId11F, Shape: "circle", Center: &models.Point{X: 50, Y: 50}, Radius: 5}
+	status, body = e.send(t, http.MethodPut, "/geofence/"+created.Id, "adminkey", circle)
+	updated := GeofenceExtView{}
+	json.Unmarshal(body, &updated)
+	if status != http.StatusOK || updated.Shape != "circle" || updated.Radius != 5 || len(updated.Vertices) != 0 {
+		t.Errorf("PUT /geofence: status %d (%s)", status, body)
+	}
+
+	status, body = e.send(t, http.MethodGet, "/geofence/"+created.Id, "readkey", nil)
+	if status != http.StatusOK || !bytes.Contains(body, []byte(`"Entrance"`)) {
+		t.Errorf("GET /geofence after update: status %d (%s)", status, body)
+	}
+
+	status, _ = e.send(t, http.MethodDelete, "/geofence/"+created.Id, "adminkey", nil)
+	if status != http.StatusNoContent {
+		t.Errorf("DELETE /geofence: status %d; want %d", status, http.StatusNoContent)
+	}
+	status, _ = e.send(t, http.MethodGet, "/geofence/"+created.Id, "readkey", nil)
+	if status != http.StatusNotFound {
+		t.Errorf("GET deleted geofence: status %d; want %d", status, http.StatusNotFound)
+	}
+}
+
+func TestGeofenceEvents(t *testing.T) {
+	e := newTestEnv(t, withAdminKey, func(cfg *Config) {
+		cfg.Visit.MinDwell = 60
+	})
+
+	status, body := e.send(t, http.MethodPost, "/geofence", "adminkey", GeofenceRequest{
+		Name:     "Lounge",
+		MapId:    mistfake.MapId11F,
+		Shape:    "polygon",
+		Vertices: []models.Point{{X: 0, Y: 0}, {X: 20, Y: 0}, {X: 20, Y: 20}, {X: 0, Y: 20}},
+	})
+	lounge := GeofenceExtView{}
+	json.Unmarshal(body, &lounge)
+	if status != http.StatusCreated {
+		t.Fatalf("POST /geofence: status %d (%s)", status, body)
+	}
+
+	// taro walks through the lounge (overlapping the Booth zone), the forklift stays outside
+	for _, ev := range []mistfake.LocationAssetEvent{
+		{Mac: macTaro, SiteId: mistfake.SiteId, MapId: mistfake.MapId11F, X: 10, Y: 10, Timestamp: testTimestamp},
+		{Mac: macForklift, SiteId: mistfake.SiteId, MapId: mistfake.MapId11F, X: 40, Y: 40, Timestamp: testTimestamp},
+		{Mac: macTaro, SiteId: mistfake.SiteId, MapId: mistfake.MapId11F, X: 15, Y: 12, Timestamp: testTimestamp + 60},
+	} {
+		err := e.webhook.PostLocationAsset(ev)
+		if err != nil {
+			t.Fatalf("location-asset webhook: %v", err)
+		}
+	}
+	err := e.webhook.PostZone(
+		mistfake.ZoneEvent{Mac: macTaro, SiteId: mistfake.SiteId, MapId: mistfake.MapId11F, ZoneId: mistfake.ZoneBooth, Trigger: "enter", Timestamp: testTimestamp + 70},
+	)
+	if err != nil {
+		t.Fatalf("zone webhook: %v", err)
+	}
+
+	zones := []ZoneExtView{}
+	status, body = e.get(t, "/map/"+mistfake.MapId11F+"/zone")
+	json.Unmarshal(body, &zones)
+	counts := make(map[string]int64)
+	for _, z := range zones {
+		counts[z.Source+"/"+z.Name] = z.Count
+	}
+	if status != http.StatusOK || counts["geofence/Lounge"] != 1 || counts["mist/Booth"] != 1 {
+		t.Errorf("GET /map/{mapid}/zone: status %d counts %v", status, counts)
+	}
+
+	err = e.webhook.PostLocationAsset(
+		mistfake.LocationAssetEvent{Mac: macTaro, SiteId: mistfake.SiteId, MapId: mistfake.MapId11F, X: 30, Y: 30, Timestamp: testTimestamp + 300},
+	)
+	if err != nil {
+		t.Fatalf("location-asset webhook: %v", err)
+	}
+
+	status, body = e.get(t, "/zone/"+lounge.Id+"/visits")
+	visits := ZoneVisitsExtView{}
+	json.Unmarshal(body, &visits)
+	if status != http.StatusOK || visits.Count != 1 || visits.Visits[0].Dwell != 300 || visits.ZoneName != "Lounge" {
+		t.Errorf("GET /zone/{geofence}/visits: status %d (%s)", status, body)
+	}
+
+	// the Mist zone visit is still open
+	status, body = e.get(t, "/zone/"+mistfake.ZoneBooth+"/visits")
+	json.Unmarshal(body, &visits)
+	if status != http.StatusOK || visits.Count != 1 || visits.Visits[0].ExitAt != 0 {
+		t.Errorf("GET /zone/{zoneid}/visits: status %d (%s)", status, body)
+	}
+
+	err = e.server.sampleOccupancy(context.Background(), time.Unix(testTimestamp+300, 0))
+	if err != nil {
+		t.Fatalf("sampleOccupancy: %v", err)
+	}
+	status, _ = e.get(t, fmt.Sprintf("/zone/%s/occupancy?from=%d&to=%d", lounge.Id, testTimestamp, testTimestamp+600))
+	if status != http.StatusOK {
+		t.Errorf("GET /zone/{geofence}/occupancy: status %d", status)
+	}
+}
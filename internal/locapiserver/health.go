@@ -0,0 +1,92 @@
+package locapiserver
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/go-chi/render"
+)
+
+// Health status values. Degraded still serves requests, down does not.
+const (
+	healthOk       = "ok"
+	healthDegraded = "degraded"
+	healthDown     = "down"
+)
+
+// HealthCheckExtView represents the result of a single dependency check
+type HealthCheckExtView struct {
+	Name   string `json:"name"`
+	Status string `json:"status"`
+	Detail string `json:"detail,omitempty"`
+}
+
+// HealthExtView represents the overall health for API responses
+type HealthExtView struct {
+	Status string                `json:"status"`
+	Checks []*HealthCheckExtView `json:"checks,omitempty"`
+}
+
+func (e *HealthExtView) Render(w http.ResponseWriter, r *http.Request) error {
+	if e.Status == healthDown {
+		render.Status(r, http.StatusServiceUnavailable)
+	}
+	return nil
+}
+
+// add appends a check and lowers the overall status accordingly
+func (e *HealthExtView) add(c *HealthCheckExtView) {
+	e.Checks = append(e.Checks, c)
+
+	switch {
+	case c.Status == healthDown:
+		e.Status = healthDown
+	case c.Status == healthDegraded && e.Status == healthOk:
+		e.Status = healthDegraded
+	}
+}
+
+// apiHealthz reports liveness: the process is able to serve requests
+func (s *LocApiServer) apiHealthz(w http.ResponseWriter, r *http.Request) {
+	render.Render(w, r, &HealthExtView{Status: healthOk})
+	return
+}
+
+// apiReadyz reports readiness with the database and webhook checks
+func (s *LocApiServer) apiReadyz(w http.ResponseWriter, r *http.Request) {
+	o := &HealthExtView{Status: healthOk}
+
+	// database
+	check := &HealthCheckExtView{Name: "database", Status: healthOk}
+	sqlDb, err := s.dbConn.DB()
+	if err == nil {
+		err = sqlDb.PingContext(r.Context())
+	}
+	if err != nil {
+		check.Status = healthDown
+		check.Detail = err.Error()
+	}
+	o.add(check)
+
+	// webhooks from Mist
+	check = &HealthCheckExtView{Name: "webhook", Status: healthOk}
+	last := s.lastWebhook.Load()
+	timeout := time.Duration(s.config().Health.WebhookTimeout) * time.Second
+	if last == 0 {
+		check.Detail = "no webhook received yet"
+		if timeout > 0 && time.Since(s.startedAt) > timeout {
+			check.Status = healthDegraded
+		}
+	} else {
+		age := time.Since(time.Unix(0, last))
+		check.Detail = fmt.Sprintf("last webhook %.0fs ago", age.Seconds())
+		if timeout > 0 && age > timeout {
+			check.Status = healthDegraded
+		}
+	}
+	o.add(check)
+
+	render.Render(w, r, o)
+	return
+}
@@ -0,0 +1,202 @@
+package locapiserver
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"mist-location-visualization/internal/models"
+
+	"github.com/go-chi/render"
+)
+
+// Heatmap cell values
+const (
+	heatmapValueCount = "count"
+	heatmapValueDwell = "dwell"
+)
+
+// HeatmapCellExtView is a non-empty grid cell. Col and Row count cells from the map origin.
+type HeatmapCellExtView struct {
+	Col   int     `json:"col"`
+	Row   int     `json:"row"`
+	Value float64 `json:"value"`
+}
+
+// HeatmapExtView represents the position density of a map for API responses
+type HeatmapExtView struct {
+	MapId string                `json:"map_id"`
+	From  int64                 `json:"from"`
+	To    int64                 `json:"to"`
+	Value string                `json:"value"`
+	Cell  float64               `json:"cell"`
+	Cols  int                   `json:"cols"`
+	Rows  int                   `json:"rows"`
+	Max   float64               `json:"max"`
+	Cells []*HeatmapCellExtView `json:"cells"`
+}
+
+func (e *HeatmapExtView) Render(w http.ResponseWriter, r *http.Request) error {
+	return nil
+}
+
+// heatmapGrid accumulates values per cell of a map divided into cell x cell metre squares
+type heatmapGrid struct {
+	cell   float64
+	cols   int
+	rows   int
+	values map[int]float64
+}
+
+func newHeatmapGrid(m *models.Map, cell float64) *heatmapGrid {
+	return &heatmapGrid{
+		cell:   cell,
+		cols:   int(math.Ceil(float64(m.Width) / m.Ppm / cell)),
+		rows:   int(math.Ceil(float64(m.Height) / m.Ppm / cell)),
+		values: make(map[int]float64),
+	}
+}
+
+// add adds v to the cell containing (x, y); positions off the map are ignored
+func (g *heatmapGrid) add(x float64, y float64, v float64) {
+	col := int(math.Floor(x / g.cell))
+	row := int(math.Floor(y / g.cell))
+	if col < 0 || col >= g.cols || row < 0 || row >= g.rows {
+		return
+	}
+
+	g.values[row*g.cols+col] += v
+}
+
+// cells returns the non-empty cells ordered by row and column, and the largest value
+func (g *heatmapGrid) cells() ([]*HeatmapCellExtView, float64) {
+	outs := []*HeatmapCellExtView{}
+	maxValue := 0.0
+	for i := 0; i < g.rows*g.cols; i++ {
+		v, ok := g.values[i]
+		if !ok {
+			continue
+		}
+
+		outs = append(outs, &HeatmapCellExtView{Col: i % g.cols, Row: i / g.cols, Value: v})
+		maxValue = max(maxValue, v)
+	}
+
+	return outs, maxValue
+}
+
+// addDwell credits each position with the time until the next position of the same entity.
+// Gaps longer than the location timeout mean the entity was gone and are capped.
+func (g *heatmapGrid) addDwell(samples []models.PositionSample, to time.Time, timeout time.Duration) {
+	for i, v := range samples {
+		end := to
+		if i+1 < len(samples) && samples[i+1].Mac == v.Mac {
+			end = samples[i+1].SeenAt
+		}
+
+		dwell := min(end.Sub(v.SeenAt), timeout)
+		if dwell > 0 {
+			g.add(v.X, v.Y, dwell.Seconds())
+		}
+	}
+}
+
+func (s *LocApiServer) apiMapGetHeatmap(w http.ResponseWriter, r *http.Request) {
+	mapId := getCtxValueString(r.Context(), "mapid")
+	from, to, err := getTimeRange(r)
+	if err != nil {
+		render.Render(w, r, s.httpErrInvalidRequest(err))
+		return
+	}
+	if to.IsZero() {
+		to = time.Now()
+	}
+	if from.IsZero() {
+		from = to.Add(-24 * time.Hour)
+	}
+
+	cell := 1.0
+	if param := r.URL.Query().Get("cell"); param != "" {
+		cell, err = strconv.ParseFloat(param, 64)
+		if err != nil || cell <= 0 {
+			err := fmt.Errorf("invalid cell %s", param)
+			render.Render(w, r, s.httpErrInvalidRequest(err))
+			return
+		}
+	}
+
+	value := r.URL.Query().Get("value")
+	switch value {
+	case "":
+		value = heatmapValueCount
+	case heatmapValueCount, heatmapValueDwell:
+	default:
+		err := fmt.Errorf("invalid value %s", value)
+		render.Render(w, r, s.httpErrInvalidRequest(err))
+		return
+	}
+
+	mapEntry := models.Map{}
+	ret := s.dbConn.WithContext(r.Context()).Where("id = ?", mapId).Limit(1).Find(&mapEntry)
+	if ret.Error != nil {
+		log.Printf("apiMapGetHeatmap: Failed to query DB (%v)", ret.Error)
+		err := fmt.Errorf("failed to get data from backend")
+		render.Render(w, r, s.httpErrUnexpected(err))
+		return
+	} else if ret.RowsAffected == 0 {
+		err := fmt.Errorf("map %s not found", mapId)
+		render.Render(w, r, s.httpErrNotFound(err))
+		return
+	} else if mapEntry.Ppm <= 0 {
+		err := fmt.Errorf("map %s has no scale", mapId)
+		render.Render(w, r, s.httpErrInvalidRequest(err))
+		return
+	}
+
+	grid := newHeatmapGrid(&mapEntry, cell)
+	if grid.cols*grid.rows > 1000000 {
+		err := fmt.Errorf("cell %v is too small for map %s", cell, mapId)
+		render.Render(w, r, s.httpErrInvalidRequest(err))
+		return
+	}
+
+	samples := make([]models.PositionSample, 0)
+	ret = restrictEntities(r.Context(), s.dbConn.WithContext(r.Context()), "mac").
+		Where("map_id = ? AND seen_at >= ? AND seen_at < ?", mapId, from, to).
+		Order("mac, seen_at").
+		Find(&samples)
+	if ret.Error != nil {
+		log.Printf("apiMapGetHeatmap: Failed to query DB on positions (%v)", ret.Error)
+		err := fmt.Errorf("failed to get data from backend")
+		render.Render(w, r, s.httpErrUnexpected(err))
+		return
+	}
+
+	switch value {
+	case heatmapValueCount:
+		for _, v := range samples {
+			grid.add(v.X, v.Y, 1)
+		}
+
+	case heatmapValueDwell:
+		timeout := time.Duration(s.config().Mist.LocationTimeout) * time.Second
+		grid.addDwell(samples, to, timeout)
+	}
+
+	o := &HeatmapExtView{
+		MapId: mapId,
+		From:  from.Unix(),
+		To:    to.Unix(),
+		Value: value,
+		Cell:  cell,
+		Cols:  grid.cols,
+		Rows:  grid.rows,
+	}
+	o.Cells, o.Max = grid.cells()
+
+	render.Render(w, r, o)
+	return
+}
@@ -1,64 +1,64 @@
 package locapiserver
 
 import (
-	"fmt"
+	"context"
+	"crypto/tls"
 	"log"
+	"net"
 	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 
-	"gorm.io/driver/mysql"
 	"gorm.io/gorm"
-	"gorm.io/gorm/logger"
 	"github.com/go-chi/chi"
 	"github.com/go-chi/chi/middleware"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 
 	"mist-location-visualization/internal/models"
 )
 
-type LocApiServer struct {
-	cfg    Config
-	dbConn *gorm.DB
-}
-
-/* Main */
-func getDbConn(cfg Config) (*gorm.DB, error) {
-	var db *gorm.DB
-	var err error
+const defaultShutdownTimeout = 30 * time.Second
 
-	switch cfg.Db.Driver {
-	case "mysql":
-		if cfg.Db.Mysql.User == "" || cfg.Db.Mysql.Host == "" || cfg.Db.Mysql.Database == "" {
-			return nil, fmt.Errorf("missing connection info")
-		}
+type LocApiServer struct {
+	cfg     atomic.Pointer[Config] // replaced on reload
+	dbConn  *gorm.DB
+	archive *webhookArchive
+	metrics *apiMetrics
+	tlsCfg  *tls.Config
+	auth    atomic.Pointer[apiAuth]
+	dedupe  atomic.Pointer[eventDeduper]
+	filter  *positionFilter
+	rules   *ruleSet
 
-		dsn := fmt.Sprintf("%s:%s@tcp(%s)/%s?charset=utf8mb4&parseTime=True&loc=Local",
-			cfg.Db.Mysql.User, cfg.Db.Mysql.Password, cfg.Db.Mysql.Host, cfg.Db.Mysql.Database)
-		db, err = gorm.Open(mysql.Open(dsn), &gorm.Config{})
-		if err != nil {
-			return nil, err
-		}
+	loader   func() (Config, error) // reads the configuration again on SIGHUP
+	reloadMu sync.Mutex
 
-	default:
-		return nil, fmt.Errorf("unknown db driver %s", cfg.Db.Driver)
-	}
+	privacyKey []byte // key of pseudonyms
 
-	if cfg.Db.Debug {
-		db.Logger = db.Logger.LogMode(logger.Info)
-	}
+	ruleWebhooks sync.WaitGroup
+	dwellFired   map[uint]map[string]bool // rules fired per open visit
 
-	return db, err
+	startedAt   time.Time
+	lastWebhook atomic.Int64 // unix nanoseconds of the last accepted webhook
 }
 
+/* Main */
 func New(cfg Config) (*LocApiServer, error) {
 	var err error
 
 	// Base Initialization
 	r := &LocApiServer{
-		cfg: cfg,
+		startedAt: time.Now(),
 	}
+	r.cfg.Store(&cfg)
+	r.metrics = newApiMetrics(r)
 
 	// DB Conn Initialization
-	r.dbConn, err = getDbConn(cfg)
+	r.dbConn, err = models.OpenDb(cfg.Db)
 	if err != nil {
 		return nil, err
 	}
@@ -81,11 +81,133 @@ func New(cfg Config) (*LocApiServer, error) {
 		return nil, err
 	}
 
+	err = r.dbConn.Debug().AutoMigrate(&models.Site{})
+	if err != nil {
+		log.Printf("failed to automigrate database %v", err)
+		return nil, err
+	}
+
+	err = r.dbConn.Debug().AutoMigrate(&models.Building{})
+	if err != nil {
+		log.Printf("failed to automigrate database %v", err)
+		return nil, err
+	}
+
+	err = r.dbConn.Debug().AutoMigrate(&models.FloorChange{})
+	if err != nil {
+		log.Printf("failed to automigrate database %v", err)
+		return nil, err
+	}
+
+	err = r.dbConn.Debug().AutoMigrate(&models.Geofence{})
+	if err != nil {
+		log.Printf("failed to automigrate database %v", err)
+		return nil, err
+	}
+
+	err = r.dbConn.Debug().AutoMigrate(&models.ZoneVisit{})
+	if err != nil {
+		log.Printf("failed to automigrate database %v", err)
+		return nil, err
+	}
+
+	err = r.dbConn.Debug().AutoMigrate(&models.OccupancySample{})
+	if err != nil {
+		log.Printf("failed to automigrate database %v", err)
+		return nil, err
+	}
+
+	err = r.dbConn.Debug().AutoMigrate(&models.PositionSample{})
+	if err != nil {
+		log.Printf("failed to automigrate database %v", err)
+		return nil, err
+	}
+
+	err = r.dbConn.Debug().AutoMigrate(&models.Alert{})
+	if err != nil {
+		log.Printf("failed to automigrate database %v", err)
+		return nil, err
+	}
+
+	err = r.dbConn.Debug().AutoMigrate(&models.Contact{})
+	if err != nil {
+		log.Printf("failed to automigrate database %v", err)
+		return nil, err
+	}
+
+	err = r.dbConn.Debug().AutoMigrate(&models.EntityPrivacy{})
+	if err != nil {
+		log.Printf("failed to automigrate database %v", err)
+		return nil, err
+	}
+
+	err = r.dbConn.Debug().AutoMigrate(&models.AuditRecord{})
+	if err != nil {
+		log.Printf("failed to automigrate database %v", err)
+		return nil, err
+	}
+
+	// Auth Initialization
+	auth, err := newApiAuth(cfg)
+	if err != nil {
+		log.Printf("failed to set up API auth %v", err)
+		return nil, err
+	}
+	r.auth.Store(auth)
+	if len(r.webhookSecrets()) == 0 {
+		log.Printf("Warning: mist.secret is not set, webhooks are accepted without authentication")
+	}
+	err = validateOutOfOrder(cfg.Webhook.OutOfOrder)
+	if err != nil {
+		log.Printf("failed to set up webhooks %v", err)
+		return nil, err
+	}
+	r.filter, err = newPositionFilter(cfg)
+	if err != nil {
+		log.Printf("failed to set up position filter %v", err)
+		return nil, err
+	}
+	if cfg.Webhook.DedupeWindow > 0 {
+		r.dedupe.Store(newEventDeduper(time.Duration(cfg.Webhook.DedupeWindow) * time.Second))
+	}
+
+	// Privacy Initialization
+	r.privacyKey, err = newPrivacyKey(cfg)
+	if err != nil {
+		log.Printf("failed to set up privacy %v", err)
+		return nil, err
+	}
+
+	// Rules Initialization
+	if cfg.Rules.File != "" {
+		r.rules, err = newRuleSet(cfg.Rules.File)
+		if err != nil {
+			log.Printf("failed to load rules %v", err)
+			return nil, err
+		}
+		log.Printf("Loaded %d rules from %s", len(r.rules.current()), cfg.Rules.File)
+	}
+
+	// TLS Initialization
+	r.tlsCfg, err = newTlsConfig(cfg)
+	if err != nil {
+		log.Printf("failed to set up TLS %v", err)
+		return nil, err
+	}
+
+	// Webhook Archive Initialization
+	if cfg.Archive.Enabled {
+		r.archive, err = newWebhookArchive(cfg.Archive.Dir, cfg.Archive.MaxSize, cfg.Archive.MaxFiles)
+		if err != nil {
+			log.Printf("failed to open webhook archive %v", err)
+			return nil, err
+		}
+	}
 
 	return r, nil
 }
 
-func (s *LocApiServer) Run() error {
+func (s *LocApiServer) router() http.Handler {
 	r := chi.NewRouter()
 	r.Use(middleware.RequestID)
 	r.Use(middleware.RealIP)
@@ -93,39 +215,221 @@ func (s *LocApiServer) Run() error {
 	r.Use(middleware.Recoverer)
 	r.Use(middleware.Timeout(60 * time.Second))
 
-	if s.cfg.Http.BasicAuth {
-		userdb := make(map[string]string)
-		for _, v := range s.cfg.Http.Users {
-			userdb[v.User] = v.Password
-		}
-		r.Use(middleware.BasicAuth(s.cfg.Http.ServerName, userdb))
-	}
+	// health checks stay reachable for orchestrators without credentials
+	r.Get("/healthz", s.apiHealthz)
+	r.Get("/readyz", s.apiReadyz)
 
-	r.Route("/entity", func(r chi.Router) {
-		r.Mount("/", s.apiEntityRouter())
+	// webhooks are authenticated by their HMAC signature (and client certificate) only
+	r.Route("/mistrecv", func(r chi.Router) {
+		if s.config().Http.Tls.ClientCaFile != "" {
+			r.Use(s.requireClientCert)
+		}
+		r.Mount("/", s.apiMistRecvRouter())
 	})
 
-	r.Route("/zone", func(r chi.Router) {
-		r.Mount("/", s.apiZoneRouter())
-	})
+	r.Group(func(r chi.Router) {
+		r.Use(s.apiAuthenticate)
 
-	r.Route("/search", func(r chi.Router) {
-		r.Mount("/", s.apiSearchRouter())
-	})
+		r.Group(func(r chi.Router) {
+			r.Use(s.apiRequireScope(scopeRead))
 
-	r.Route("/map", func(r chi.Router) {
-		r.Mount("/", s.apiMapRouter())
-	})
+			r.Route("/entity", func(r chi.Router) {
+				r.Mount("/", s.apiEntityRouter())
+			})
 
-	r.Route("/mistrecv", func(r chi.Router) {
-		r.Mount("/", s.apiMistRecvRouter())
+			r.Route("/zone", func(r chi.Router) {
+				r.Mount("/", s.apiZoneRouter())
+			})
+
+			r.Route("/search", func(r chi.Router) {
+				r.Mount("/", s.apiSearchRouter())
+			})
+
+			r.Route("/site", func(r chi.Router) {
+				r.Mount("/", s.apiSiteRouter())
+			})
+
+			r.Route("/map", func(r chi.Router) {
+				r.Mount("/", s.apiMapRouter())
+			})
+
+			r.Route("/geofence", func(r chi.Router) {
+				r.Mount("/", s.apiGeofenceRouter())
+			})
+
+			r.Route("/alert", func(r chi.Router) {
+				r.Mount("/", s.apiAlertRouter())
+			})
+
+			r.Route("/tenant", func(r chi.Router) {
+				r.Mount("/", s.apiTenantRouter())
+			})
+		})
+
+		r.Route("/rule", func(r chi.Router) {
+			r.Use(s.apiRequireScope(scopeAdmin))
+			r.Mount("/", s.apiRuleRouter())
+		})
+
+		r.Route("/audit", func(r chi.Router) {
+			r.Use(s.apiRequireScope(scopeAdmin))
+			r.Mount("/", s.apiAuditRouter())
+		})
+
+		// metrics count the entities of all maps and tenants
+		r.With(s.apiRequireScope(scopeRead), s.apiRequireUnrestricted).Handle("/metrics", promhttp.HandlerFor(s.metrics.registry, promhttp.HandlerOpts{}))
 	})
 
-	// Start HTTP Handler
-	err := http.ListenAndServe(s.cfg.Http.Listen, r)
+	return r
+}
+
+// Run serves the API until SIGINT, SIGQUIT or SIGTERM is received.
+// SIGHUP reloads the configuration.
+func (s *LocApiServer) Run() error {
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGQUIT, syscall.SIGTERM)
+	defer stop()
+
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+	go func() {
+		for {
+			select {
+			case <-hup:
+				log.Printf("Run: SIGHUP received, reloading configuration")
+				s.ReloadConfig()
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	return s.Serve(ctx)
+}
+
+// Serve listens on the configured address until ctx is cancelled, then shuts down gracefully
+func (s *LocApiServer) Serve(ctx context.Context) error {
+	ln, err := net.Listen("tcp", s.config().Http.Listen)
 	if err != nil {
-		log.Fatal(err)
+		return err
+	}
+
+	return s.serve(ctx, ln)
+}
+
+func (s *LocApiServer) serve(ctx context.Context, ln net.Listener) error {
+	workerCtx, stopWorkers := context.WithCancel(context.Background())
+	defer stopWorkers()
+	workers := &sync.WaitGroup{}
+
+	// Start Occupancy Sampler
+	if s.config().Occupancy.Interval > 0 {
+		workers.Add(1)
+		go func() {
+			defer workers.Done()
+			s.runOccupancySampler(workerCtx, time.Duration(s.config().Occupancy.Interval)*time.Second)
+		}()
+	}
+
+	// Start Entity Expiry Worker
+	workers.Add(1)
+	go func() {
+		defer workers.Done()
+		s.runEntityExpiry(workerCtx, entityExpiryInterval)
+	}()
+
+	// Start Rules Worker
+	if s.rules != nil {
+		interval := s.config().Rules.Interval
+		if interval <= 0 {
+			interval = defaultRulesInterval
+		}
+		workers.Add(1)
+		go func() {
+			defer workers.Done()
+			s.runRules(workerCtx, time.Duration(interval)*time.Second)
+		}()
+	}
+
+	// Start Retention Worker
+	if s.retentionEnabled() {
+		interval := s.config().Retention.Interval
+		if interval <= 0 {
+			interval = defaultRetentionInterval
+		}
+		workers.Add(1)
+		go func() {
+			defer workers.Done()
+			s.runRetention(workerCtx, time.Duration(interval)*time.Second)
+		}()
+	}
+
+	// Start HTTP Handler
+	srv := &http.Server{
+		Handler:   s.router(),
+		TLSConfig: s.tlsCfg,
+	}
+	srvErr := make(chan error, 1)
+	go func() {
+		if s.tlsCfg != nil {
+			// certificates come from TLSConfig.GetCertificate
+			srvErr <- srv.ServeTLS(ln, "", "")
+		} else {
+			srvErr <- srv.Serve(ln)
+		}
+	}()
+	log.Printf("Serve: listening on %s", ln.Addr())
+
+	// Main thread to wait until we get a kill signal or something go wrong
+	var err error
+	select {
+	case err = <-srvErr:
+		log.Printf("Serve: HTTP server failed (%v)", err)
+	case <-ctx.Done():
+		log.Printf("Serve: shutting down")
+	}
+
+	// Drain in-flight requests, then stop workers and close storage
+	timeout := time.Duration(s.config().Http.ShutdownTimeout) * time.Second
+	if timeout <= 0 {
+		timeout = defaultShutdownTimeout
+	}
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	shutdownErr := srv.Shutdown(shutdownCtx)
+	if shutdownErr != nil {
+		log.Printf("Serve: failed to drain requests (%v)", shutdownErr)
+	}
+
+	stopWorkers()
+	workers.Wait()
+	s.ruleWebhooks.Wait()
+
+	if s.archive != nil {
+		archiveErr := s.archive.Close()
+		if archiveErr != nil {
+			log.Printf("Serve: failed to close webhook archive (%v)", archiveErr)
+		}
+	}
+
+	sqlDb, dbErr := s.dbConn.DB()
+	if dbErr == nil {
+		dbErr = sqlDb.Close()
 	}
+	if dbErr != nil {
+		log.Printf("Serve: failed to close database (%v)", dbErr)
+	}
+
+	log.Printf("Serve: all threads exited")
+
+	if err == nil {
+		err = shutdownErr
+	}
+	return err
+}
 
-	return nil
+// config returns the current configuration, which is replaced as a whole on reload
+func (s *LocApiServer) config() *Config {
+	return s.cfg.Load()
 }
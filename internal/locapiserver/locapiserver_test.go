@@ -0,0 +1,827 @@
+package locapiserver
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"mist-location-visualization/internal/mistfake"
+	"mist-location-visualization/internal/models"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+var update = flag.Bool("update", false, "update golden files")
+
+const (
+	testSecret    = "testsecret"
+	testTimestamp = 1718080000
+	macTaro       = "fbc721cc3022"
+	macForklift   = "c0ffee000001"
+)
+
+func checkGolden(t *testing.T, name string, got []byte) {
+	t.Helper()
+
+	// normalize formatting so golden files stay readable
+	var v interface{}
+	err := json.Unmarshal(got, &v)
+	if err != nil {
+		t.Fatalf("invalid JSON response: %v (%s)", err, got)
+	}
+	got, _ = json.MarshalIndent(v, "", "  ")
+	got = append(got, '\n')
+
+	path := filepath.Join("testdata", name+".golden")
+	if *update {
+		err = os.WriteFile(path, got, 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	want, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("failed to read golden file (run with -update): %v", err)
+	}
+
+	if !bytes.Equal(got, want) {
+		t.Errorf("%s mismatch\ngot:\n%s\nwant:\n%s", path, got, want)
+	}
+}
+
+type testEnv struct {
+	fake    *mistfake.Server
+	server  *LocApiServer
+	http    *httptest.Server
+	webhook *mistfake.WebhookSender
+}
+
+// withAdminKey lets "adminkey" change things while unauthenticated callers keep reading
+func withAdminKey(cfg *Config) {
+	sum := sha256.Sum256([]byte("adminkey"))
+	cfg.Http.ApiKeys = append(cfg.Http.ApiKeys, ApiKeyConfig{Name: "admin", KeySha256: hex.EncodeToString(sum[:]), Scopes: []string{scopeAdmin}})
+	cfg.Http.Anonymous = true
+}
+
+func newTestEnv(t *testing.T, opts ...func(*Config)) *testEnv {
+	t.Helper()
+
+	fake, err := mistfake.NewServer("testkey")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(fake.Close)
+
+	cfg := Config{}
+	cfg.Db.Driver = "sqlite"
+	cfg.Db.Sqlite.Path = filepath.Join(t.TempDir(), "locapid.db")
+	cfg.Mist.Endpoint = fake.URL
+	cfg.Mist.Apikey = fake.Apikey
+	cfg.Mist.Secret = testSecret
+	cfg.Mist.LocationTimeout = 2000000000 // recorded timestamps never time out
+	cfg.Mist.RefreshTime = 1800
+	for _, opt := range opts {
+		opt(&cfg)
+	}
+
+	s, err := New(cfg)
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+
+	// maps and zones are normally synchronized by mistpolld
+	seeds := []interface{}{
+		&models.Building{Id: "hq", SiteId: mistfake.SiteId, Name: "Headquarters"},
+		&models.Map{Id: mistfake.MapId11F, Name: "11F", SiteId: mistfake.SiteId, BuildingId: "hq", FloorLevel: 11, FloorName: "11F", Width: 1005, Height: 1303, Ppm: 15},
+		&models.Map{Id: mistfake.MapId12F, Name: "12F", SiteId: mistfake.SiteId, BuildingId: "hq", FloorLevel: 12, FloorName: "12F", Width: 1005, Height: 1303, Ppm: 15},
+		&models.Zone{Id: mistfake.ZoneBooth, Name: "Booth", MapId: mistfake.MapId11F, SiteId: mistfake.SiteId},
+		&models.Zone{Id: mistfake.ZoneRoomA, Name: "Meeting Room A", MapId: mistfake.MapId12F, SiteId: mistfake.SiteId},
+	}
+	for _, v := range seeds {
+		r := s.dbConn.Create(v)
+		if r.Error != nil {
+			t.Fatal(r.Error)
+		}
+	}
+
+	ts := httptest.NewServer(s.router())
+	t.Cleanup(ts.Close)
+
+	return &testEnv{
+		fake:    fake,
+		server:  s,
+		http:    ts,
+		webhook: mistfake.NewWebhookSender(ts.URL+"/mistrecv", testSecret),
+	}
+}
+
+func (e *testEnv) get(t *testing.T, uri string) (int, []byte) {
+	t.Helper()
+
+	resp, err := http.Get(e.http.URL + uri)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return resp.StatusCode, body
+}
+
+func TestWebhookLocationAndZone(t *testing.T) {
+	e := newTestEnv(t)
+
+	err := e.webhook.PostLocationAsset(
+		mistfake.LocationAssetEvent{Mac: macTaro, SiteId: mistfake.SiteId, MapId: mistfake.MapId11F, X: 10, Y: 20, Timestamp: testTimestamp},
+		mistfake.LocationAssetEvent{Mac: macForklift, SiteId: mistfake.SiteId, MapId: mistfake.MapId11F, X: 30.5, Y: 4, Timestamp: testTimestamp + 1},
+	)
+	if err != nil {
+		t.Fatalf("location-asset webhook: %v", err)
+	}
+
+	err = e.webhook.PostZone(
+		mistfake.ZoneEvent{Mac: macTaro, SiteId: mistfake.SiteId, MapId: mistfake.MapId11F, ZoneId: mistfake.ZoneBooth, Trigger: "enter", Timestamp: testTimestamp + 2},
+	)
+	if err != nil {
+		t.Fatalf("zone webhook: %v", err)
+	}
+
+	status, body := e.get(t, "/entity")
+	if status != http.StatusOK {
+		t.Fatalf("GET /entity: status %d", status)
+	}
+	checkGolden(t, "entity", body)
+
+	status, body = e.get(t, "/zone")
+	if status != http.StatusOK {
+		t.Fatalf("GET /zone: status %d", status)
+	}
+	checkGolden(t, "zone", body)
+
+	// names are looked up once per refresh period
+	searches := 0
+	for _, uri := range e.fake.Requests() {
+		if uri == "/api/v1/sites/"+mistfake.SiteId+"/stats/assets/search?mac="+macTaro {
+			searches++
+		}
+	}
+	if searches != 1 {
+		t.Errorf("got %d asset searches for %s; want 1", searches, macTaro)
+	}
+
+	err = e.webhook.PostZone(
+		mistfake.ZoneEvent{Mac: macTaro, SiteId: mistfake.SiteId, MapId: mistfake.MapId11F, ZoneId: mistfake.ZoneBooth, Trigger: "exit", Timestamp: testTimestamp + 3},
+	)
+	if err != nil {
+		t.Fatalf("zone webhook: %v", err)
+	}
+
+	_, body = e.get(t, "/entity/" + macTaro)
+	entity := EntityExtView{}
+	json.Unmarshal(body, &entity)
+	if entity.ZoneName != "" {
+		t.Errorf("zone name after exit = %q; want empty", entity.ZoneName)
+	}
+}
+
+func TestWebhookFloorChange(t *testing.T) {
+	e := newTestEnv(t)
+
+	for i, mapId := range []string{mistfake.MapId11F, mistfake.MapId12F} {
+		err := e.webhook.PostLocationAsset(
+			mistfake.LocationAssetEvent{Mac: macTaro, SiteId: mistfake.SiteId, MapId: mapId, X: 10, Y: 20, Timestamp: testTimestamp + float64(i*10)},
+		)
+		if err != nil {
+			t.Fatalf("location-asset webhook: %v", err)
+		}
+	}
+
+	status, body := e.get(t, "/entity/"+macTaro+"/floorchange")
+	if status != http.StatusOK {
+		t.Fatalf("GET floorchange: status %d", status)
+	}
+	checkGolden(t, "floorchange", body)
+
+	status, body = e.get(t, "/site")
+	if status != http.StatusOK {
+		t.Fatalf("GET /site: status %d", status)
+	}
+	checkGolden(t, "site", body)
+}
+
+func TestWebhookSignature(t *testing.T) {
+	e := newTestEnv(t)
+
+	e.webhook.Secret = "wrongsecret"
+	err := e.webhook.PostLocationAsset(
+		mistfake.LocationAssetEvent{Mac: macTaro, SiteId: mistfake.SiteId, MapId: mistfake.MapId11F, X: 10, Y: 20, Timestamp: testTimestamp},
+	)
+	if err == nil {
+		t.Fatal("webhook with invalid signature was accepted")
+	}
+
+	status, _ := e.get(t, "/entity/"+macTaro)
+	if status != http.StatusNotFound {
+		t.Errorf("GET entity after rejected webhook: status %d; want %d", status, http.StatusNotFound)
+	}
+}
+
+func TestWebhookSecretRotation(t *testing.T) {
+	e := newTestEnv(t, func(cfg *Config) {
+		cfg.Mist.Secrets = []string{"nextsecret"}
+	})
+
+	for _, secret := range []string{testSecret, "nextsecret"} {
+		e.webhook.Secret = secret
+		err := e.webhook.PostLocationAsset(
+			mistfake.LocationAssetEvent{Mac: macTaro, SiteId: mistfake.SiteId, MapId: mistfake.MapId11F, X: 10, Y: 20, Timestamp: testTimestamp},
+		)
+		if err != nil {
+			t.Errorf("webhook signed with %s: %v", secret, err)
+		}
+	}
+
+	e.webhook.Secret = "wrongsecret"
+	err := e.webhook.PostLocationAsset(
+		mistfake.LocationAssetEvent{Mac: macTaro, SiteId: mistfake.SiteId, MapId: mistfake.MapId11F, X: 10, Y: 20, Timestamp: testTimestamp},
+	)
+	if err == nil {
+		t.Error("webhook with invalid signature was accepted")
+	}
+}
+
+func TestWebhookBodyLimit(t *testing.T) {
+	e := newTestEnv(t, func(cfg *Config) {
+		cfg.Webhook.MaxBodySize = 256
+	})
+
+	events := make([]mistfake.LocationAssetEvent, 10)
+	for i := range events {
+		events[i] = mistfake.LocationAssetEvent{Mac: macTaro, SiteId: mistfake.SiteId, MapId: mistfake.MapId11F, X: 10, Y: 20, Timestamp: testTimestamp}
+	}
+	err := e.webhook.PostLocationAsset(events...)
+	if err == nil || !strings.Contains(err.Error(), "413") {
+		t.Errorf("oversized webhook: %v; want status 413", err)
+	}
+
+	if v := testutil.ToFloat64(e.server.metrics.webhookRequests.WithLabelValues("too_large")); v != 1 {
+		t.Errorf("too_large requests = %v; want 1", v)
+	}
+}
+
+func TestWebhookFreshnessAndDuplicates(t *testing.T) {
+	e := newTestEnv(t, func(cfg *Config) {
+		cfg.Webhook.MaxEventAge = 300
+		cfg.Webhook.MaxClockSkew = 60
+		cfg.Webhook.DedupeWindow = 300
+	})
+
+	now := float64(time.Now().Unix())
+	err := e.webhook.PostLocationAsset(
+		mistfake.LocationAssetEvent{Mac: macTaro, SiteId: mistfake.SiteId, MapId: mistfake.MapId11F, X: 10, Y: 20, Timestamp: now},
+	)
+	if err != nil {
+		t.Fatalf("location-asset webhook: %v", err)
+	}
+
+	enter := mistfake.ZoneEvent{Mac: macTaro, SiteId: mistfake.SiteId, MapId: mistfake.MapId11F, ZoneId: mistfake.ZoneBooth, Trigger: "enter", Timestamp: now}
+	for _, events := range [][]mistfake.ZoneEvent{
+		{enter},
+		{enter}, // replayed
+		{{Mac: macForklift, SiteId: mistfake.SiteId, MapId: mistfake.MapId11F, ZoneId: mistfake.ZoneBooth, Trigger: "enter", Timestamp: now - 3600}},
+		{{Mac: macForklift, SiteId: mistfake.SiteId, MapId: mistfake.MapId11F, ZoneId: mistfake.ZoneBooth, Trigger: "enter", Timestamp: now + 3600}},
+	} {
+		err := e.webhook.PostZone(events...)
+		if err != nil {
+			t.Fatalf("zone webhook: %v", err)
+		}
+	}
+
+	for outcome, want := range map[string]float64{"processed": 1, "duplicate": 1, "stale": 2} {
+		if v := testutil.ToFloat64(e.server.metrics.webhookEvents.WithLabelValues("zone", outcome)); v != want {
+			t.Errorf("%s zone events = %v; want %v", outcome, v, want)
+		}
+	}
+
+	status, _ := e.get(t, "/entity/"+macForklift)
+	if status != http.StatusNotFound {
+		t.Errorf("GET entity of stale events: status %d; want %d", status, http.StatusNotFound)
+	}
+
+	// identical events without a timestamp are not duplicates of each other
+	for i := 0; i < 2; i++ {
+		err := e.webhook.PostLocationAsset(mistfake.LocationAssetEvent{Mac: macTaro, SiteId: mistfake.SiteId, MapId: mistfake.MapId11F, X: 10, Y: 20})
+		if err != nil {
+			t.Fatalf("location-asset webhook: %v", err)
+		}
+	}
+	if v := testutil.ToFloat64(e.server.metrics.webhookEvents.WithLabelValues("location-asset", "processed")); v != 3 {
+		t.Errorf("processed location-asset events = %v; want 3", v)
+	}
+}
+
+func TestEventDeduperClaim(t *testing.T) {
+	d := newEventDeduper(time.Minute)
+	key := eventKey("zone", []byte(`{"mac":"fbc721cc3022"}`))
+	now := time.Now()
+
+	// concurrent deliveries of one event are claimed once
+	var claimed atomic.Int32
+	wg := sync.WaitGroup{}
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if d.claim(key, now) {
+				claimed.Add(1)
+			}
+		}()
+	}
+	wg.Wait()
+	if claimed.Load() != 1 {
+		t.Errorf("claimed %d times; want 1", claimed.Load())
+	}
+
+	// a failed event can be retried
+	d.release(key)
+	if !d.claim(key, now) {
+		t.Errorf("claim after release failed")
+	}
+	if !d.claim(key, now.Add(time.Minute)) {
+		t.Errorf("claim after the window failed")
+	}
+}
+
+func TestWebhookOutOfOrder(t *testing.T) {
+	for _, mode := range []string{outOfOrderDiscard, outOfOrderHistory} {
+		t.Run(mode, func(t *testing.T) {
+			e := newTestEnv(t, func(cfg *Config) {
+				cfg.Webhook.OutOfOrder = mode
+			})
+
+			// a delayed batch arrives after a newer position
+			for _, ev := range []mistfake.LocationAssetEvent{
+				{Mac: macTaro, SiteId: mistfake.SiteId, MapId: mistfake.MapId11F, X: 10, Y: 20, Timestamp: testTimestamp + 60},
+				{Mac: macTaro, SiteId: mistfake.SiteId, MapId: mistfake.MapId12F, X: 1, Y: 2, Timestamp: testTimestamp},
+			} {
+				err := e.webhook.PostLocationAsset(ev)
+				if err != nil {
+					t.Fatalf("location-asset webhook: %v", err)
+				}
+			}
+
+			status, body := e.get(t, "/entity/"+macTaro)
+			o := EntityExtView{}
+			json.Unmarshal(body, &o)
+			if status != http.StatusOK || o.MapId != mistfake.MapId11F || o.Lastseen != testTimestamp+60 {
+				t.Errorf("entity after late event: map %s lastseen %d; want %s %d", o.MapId, o.Lastseen, mistfake.MapId11F, testTimestamp+60)
+			}
+
+			if v := testutil.ToFloat64(e.server.metrics.webhookEvents.WithLabelValues("location-asset", eventOutcomeOutOfOrder)); v != 1 {
+				t.Errorf("out_of_order events = %v; want 1", v)
+			}
+
+			var samples int64
+			e.server.dbConn.Model(&models.PositionSample{}).Where("mac = ?", macTaro).Count(&samples)
+			want := int64(1)
+			if mode == outOfOrderHistory {
+				want = 2
+			}
+			if samples != want {
+				t.Errorf("position samples = %d; want %d", samples, want)
+			}
+		})
+	}
+}
+
+func TestWebhookLocationWithoutTimestamp(t *testing.T) {
+	e := newTestEnv(t)
+
+	started := time.Now()
+	for _, mapId := range []string{mistfake.MapId11F, mistfake.MapId12F} {
+		err := e.webhook.PostLocationAsset(mistfake.LocationAssetEvent{Mac: macTaro, SiteId: mistfake.SiteId, MapId: mapId, X: 10, Y: 20})
+		if err != nil {
+			t.Fatalf("location-asset webhook: %v", err)
+		}
+	}
+
+	status, body := e.get(t, "/entity/"+macTaro)
+	o := EntityExtView{}
+	json.Unmarshal(body, &o)
+	if status != http.StatusOK || o.MapId != mistfake.MapId12F || o.Lastseen < started.Unix() {
+		t.Errorf("entity without timestamps: status %d (%s)", status, body)
+	}
+
+	// history is dated at the receive time, not 1970
+	sample := models.PositionSample{}
+	e.server.dbConn.Where("mac = ?", macTaro).Order("id DESC").First(&sample)
+	change := models.FloorChange{}
+	e.server.dbConn.Where("mac = ?", macTaro).First(&change)
+	if sample.SeenAt.Before(started.Truncate(time.Second)) || change.ChangedAt.Before(started.Truncate(time.Second)) {
+		t.Errorf("history without timestamps: sample at %v, floor change at %v", sample.SeenAt, change.ChangedAt)
+	}
+}
+
+func TestEntityExpiry(t *testing.T) {
+	e := newTestEnv(t, func(cfg *Config) {
+		cfg.Mist.LocationTimeout = 60
+	})
+
+	err := e.webhook.PostLocationAsset(mistfake.LocationAssetEvent{Mac: macTaro, SiteId: mistfake.SiteId, MapId: mistfake.MapId11F, X: 10, Y: 20, Timestamp: testTimestamp})
+	if err != nil {
+		t.Fatalf("location-asset webhook: %v", err)
+	}
+	err = e.webhook.PostZone(mistfake.ZoneEvent{Mac: macTaro, SiteId: mistfake.SiteId, MapId: mistfake.MapId11F, ZoneId: mistfake.ZoneBooth, Trigger: "enter", Timestamp: testTimestamp + 1})
+	if err != nil {
+		t.Fatalf("zone webhook: %v", err)
+	}
+
+	// reading shows the timeout without storing it
+	_, body := e.get(t, "/entity/"+macTaro)
+	o := EntityExtView{}
+	json.Unmarshal(body, &o)
+	if o.X != -1 || o.MapId != "" {
+		t.Errorf("GET /entity/{mac} of timed out entity: %s", body)
+	}
+	if n := countRows(t, e, &models.ZoneVisit{}, "mac = ? AND exit_at IS NULL", macTaro); n != 1 {
+		t.Errorf("GET /entity/{mac} closed %d visits", 1-n)
+	}
+
+	err = e.server.expireEntities(context.Background(), time.Now())
+	if err != nil {
+		t.Fatalf("expireEntities: %v", err)
+	}
+
+	if n := countRows(t, e, &models.ZoneVisit{}, "mac = ? AND exit_at IS NULL", macTaro); n != 0 {
+		t.Errorf("%d open visits after expiry; want 0", n)
+	}
+	if n := countRows(t, e, &models.Entity{}, "mac = ? AND x = -1 AND map_id = ''", macTaro); n != 1 {
+		t.Errorf("position of taro kept after expiry")
+	}
+	if v := testutil.ToFloat64(e.server.metrics.entityTimeouts); v != 1 {
+		t.Errorf("entity timeouts = %v; want 1", v)
+	}
+
+	// reappearing upstairs is still a floor change
+	err = e.webhook.PostLocationAsset(mistfake.LocationAssetEvent{Mac: macTaro, SiteId: mistfake.SiteId, MapId: mistfake.MapId12F, X: 10, Y: 20, Timestamp: testTimestamp + 600})
+	if err != nil {
+		t.Fatalf("location-asset webhook: %v", err)
+	}
+	if n := countRows(t, e, &models.FloorChange{}, "mac = ? AND from_map_id = ? AND to_map_id = ?", macTaro, mistfake.MapId11F, mistfake.MapId12F); n != 1 {
+		t.Errorf("got %d floor changes after the timeout; want 1", n)
+	}
+}
+
+func TestWebhookClientKinds(t *testing.T) {
+	e := newTestEnv(t)
+
+	err := e.webhook.PostLocationAsset(
+		mistfake.LocationAssetEvent{Mac: macTaro, SiteId: mistfake.SiteId, MapId: mistfake.MapId11F, X: 10, Y: 20, Timestamp: testTimestamp},
+	)
+	if err != nil {
+		t.Fatalf("location-asset webhook: %v", err)
+	}
+
+	posts := []struct {
+		topic string
+		event mistfake.LocationEvent
+	}{
+		{"location", mistfake.LocationEvent{Mac: "5c5f67aa0102", Type: "wifi", SiteId: mistfake.SiteId, MapId: mistfake.MapId11F, X: 15.5, Y: 6.5, Timestamp: testTimestamp}},
+		{"location-unclient", mistfake.LocationEvent{Mac: "8e1d00aa0001", Type: "wifi", SiteId: mistfake.SiteId, MapId: mistfake.MapId12F, X: 3, Y: 4, Timestamp: testTimestamp}},
+		{"location-sdk", mistfake.LocationEvent{Id: "de87bf5d-1c7e-4ce4-8e1a-04d4c2a34c3f", Name: "[Interop] Kiosk App", SiteId: mistfake.SiteId, MapId: mistfake.MapId12F, X: 5, Y: 5, Timestamp: testTimestamp}},
+	}
+	for _, p := range posts {
+		err := e.webhook.PostLocation(p.topic, p.event)
+		if err != nil {
+			t.Fatalf("%s webhook: %v", p.topic, err)
+		}
+	}
+
+	status, body := e.get(t, "/entity?kind=wifi_client,unconnected,sdk")
+	if status != http.StatusOK {
+		t.Fatalf("GET /entity: status %d", status)
+	}
+	checkGolden(t, "entity_kinds", body)
+
+	status, _ = e.get(t, "/entity?kind=printer")
+	if status != http.StatusBadRequest {
+		t.Errorf("GET /entity with unknown kind: status %d; want %d", status, http.StatusBadRequest)
+	}
+}
+
+func TestZoneVisits(t *testing.T) {
+	e := newTestEnv(t, func(cfg *Config) {
+		cfg.Visit.MinDwell = 60
+	})
+
+	err := e.webhook.PostLocationAsset(
+		mistfake.LocationAssetEvent{Mac: macTaro, SiteId: mistfake.SiteId, MapId: mistfake.MapId11F, X: 10, Y: 20, Timestamp: testTimestamp},
+	)
+	if err != nil {
+		t.Fatalf("location-asset webhook: %v", err)
+	}
+
+	zoneEvents := []mistfake.ZoneEvent{
+		// pass-through shorter than the minimum dwell
+		{Mac: macTaro, SiteId: mistfake.SiteId, MapId: mistfake.MapId11F, ZoneId: mistfake.ZoneBooth, Trigger: "enter", Timestamp: testTimestamp + 10},
+		{Mac: macTaro, SiteId: mistfake.SiteId, MapId: mistfake.MapId11F, ZoneId: mistfake.ZoneBooth, Trigger: "exit", Timestamp: testTimestamp + 20},
+		{Mac: macTaro, SiteId: mistfake.SiteId, MapId: mistfake.MapId11F, ZoneId: mistfake.ZoneBooth, Trigger: "enter", Timestamp: testTimestamp + 30},
+		{Mac: macTaro, SiteId: mistfake.SiteId, MapId: mistfake.MapId11F, ZoneId: mistfake.ZoneBooth, Trigger: "exit", Timestamp: testTimestamp + 330},
+		{Mac: macTaro, SiteId: mistfake.SiteId, MapId: mistfake.MapId11F, ZoneId: mistfake.ZoneBooth, Trigger: "enter", Timestamp: testTimestamp + 400},
+	}
+	for _, ev := range zoneEvents {
+		err := e.webhook.PostZone(ev)
+		if err != nil {
+			t.Fatalf("zone webhook: %v", err)
+		}
+	}
+
+	// moving to another floor closes the open visit
+	err = e.webhook.PostLocationAsset(
+		mistfake.LocationAssetEvent{Mac: macTaro, SiteId: mistfake.SiteId, MapId: mistfake.MapId12F, X: 10, Y: 20, Timestamp: testTimestamp + 500},
+	)
+	if err != nil {
+		t.Fatalf("location-asset webhook: %v", err)
+	}
+
+	status, body := e.get(t, "/zone/"+mistfake.ZoneBooth+"/visits")
+	if status != http.StatusOK {
+		t.Fatalf("GET zone visits: status %d", status)
+	}
+	checkGolden(t, "zone_visits", body)
+
+	status, body = e.get(t, "/entity/"+macTaro+"/visits?from=1718080100")
+	if status != http.StatusOK {
+		t.Fatalf("GET entity visits: status %d", status)
+	}
+	checkGolden(t, "entity_visits", body)
+
+	status, _ = e.get(t, "/zone/unknown/visits")
+	if status != http.StatusNotFound {
+		t.Errorf("GET unknown zone visits: status %d; want %d", status, http.StatusNotFound)
+	}
+}
+
+func TestZoneOccupancy(t *testing.T) {
+	e := newTestEnv(t)
+	e.server.dbConn.Create(&models.Site{Id: mistfake.SiteId, Name: "Tokyo Office", Timezone: "Asia/Tokyo"})
+
+	// 1718060400 is 2024-06-11 08:00 JST
+	base := int64(1718060400)
+	steps := []struct {
+		offset int64
+		macs   []string
+	}{
+		{0, []string{macTaro}},
+		{600, []string{macTaro, macForklift}},
+		{1200, nil},
+		{3600, []string{macForklift}},
+		{16 * 3600, []string{macTaro, macForklift}},
+	}
+	for _, st := range steps {
+		ts := base + st.offset
+		for _, mac := range []string{macTaro, macForklift} {
+			ev := mistfake.LocationAssetEvent{Mac: mac, SiteId: mistfake.SiteId, MapId: mistfake.MapId11F, X: 10, Y: 20, Timestamp: float64(ts)}
+			err := e.webhook.PostLocationAsset(ev)
+			if err != nil {
+				t.Fatalf("location-asset webhook: %v", err)
+			}
+
+			trigger := "exit"
+			if slices.Contains(st.macs, mac) {
+				trigger = "enter"
+			}
+			err = e.webhook.PostZone(mistfake.ZoneEvent{Mac: mac, SiteId: mistfake.SiteId, MapId: mistfake.MapId11F, ZoneId: mistfake.ZoneBooth, Trigger: trigger, Timestamp: float64(ts)})
+			if err != nil {
+				t.Fatalf("zone webhook: %v", err)
+			}
+		}
+
+		err := e.server.sampleOccupancy(context.Background(), time.Unix(ts, 0))
+		if err != nil {
+			t.Fatalf("sampleOccupancy: %v", err)
+		}
+	}
+
+	status, body := e.get(t, fmt.Sprintf("/zone/%s/occupancy?from=%d&to=%d&bucket=3600", mistfake.ZoneBooth, base, base+86400))
+	if status != http.StatusOK {
+		t.Fatalf("GET zone occupancy: status %d", status)
+	}
+	checkGolden(t, "zone_occupancy", body)
+
+	status, body = e.get(t, fmt.Sprintf("/map/%s/occupancy?from=%d&to=%d&bucket=86400", mistfake.MapId11F, base, base+86400))
+	if status != http.StatusOK {
+		t.Fatalf("GET map occupancy: status %d", status)
+	}
+	checkGolden(t, "map_occupancy", body)
+
+	status, _ = e.get(t, "/zone/"+mistfake.ZoneBooth+"/occupancy?bucket=0")
+	if status != http.StatusBadRequest {
+		t.Errorf("GET zone occupancy with zero bucket: status %d; want %d", status, http.StatusBadRequest)
+	}
+}
+
+func TestMapHeatmap(t *testing.T) {
+	e := newTestEnv(t)
+
+	events := []mistfake.LocationAssetEvent{
+		{Mac: macTaro, SiteId: mistfake.SiteId, MapId: mistfake.MapId11F, X: 1, Y: 1, Timestamp: testTimestamp},
+		{Mac: macTaro, SiteId: mistfake.SiteId, MapId: mistfake.MapId11F, X: 2, Y: 3, Timestamp: testTimestamp + 30},
+		{Mac: macTaro, SiteId: mistfake.SiteId, MapId: mistfake.MapId11F, X: 12, Y: 7, Timestamp: testTimestamp + 40},
+		{Mac: macForklift, SiteId: mistfake.SiteId, MapId: mistfake.MapId11F, X: 4.9, Y: 0.5, Timestamp: testTimestamp + 10},
+		// off the map
+		{Mac: macForklift, SiteId: mistfake.SiteId, MapId: mistfake.MapId11F, X: 500, Y: 0.5, Timestamp: testTimestamp + 20},
+	}
+	for _, ev := range events {
+		err := e.webhook.PostLocationAsset(ev)
+		if err != nil {
+			t.Fatalf("location-asset webhook: %v", err)
+		}
+	}
+
+	status, body := e.get(t, fmt.Sprintf("/map/%s/heatmap?from=%d&to=%d&cell=5", mistfake.MapId11F, testTimestamp, testTimestamp+100))
+	if status != http.StatusOK {
+		t.Fatalf("GET heatmap: status %d", status)
+	}
+	checkGolden(t, "heatmap_count", body)
+
+	status, body = e.get(t, fmt.Sprintf("/map/%s/heatmap?from=%d&to=%d&cell=5&value=dwell", mistfake.MapId11F, testTimestamp, testTimestamp+100))
+	if status != http.StatusOK {
+		t.Fatalf("GET heatmap: status %d", status)
+	}
+	checkGolden(t, "heatmap_dwell", body)
+
+	status, _ = e.get(t, "/map/"+mistfake.MapId11F+"/heatmap?cell=-1")
+	if status != http.StatusBadRequest {
+		t.Errorf("GET heatmap with negative cell: status %d; want %d", status, http.StatusBadRequest)
+	}
+}
+
+func TestMetrics(t *testing.T) {
+	e := newTestEnv(t)
+
+	err := e.webhook.PostLocationAsset(
+		mistfake.LocationAssetEvent{Mac: macTaro, SiteId: mistfake.SiteId, MapId: mistfake.MapId11F, X: 10, Y: 20, Timestamp: testTimestamp},
+		// unknown map
+		mistfake.LocationAssetEvent{Mac: macForklift, SiteId: mistfake.SiteId, MapId: "unknown", X: 10, Y: 20, Timestamp: testTimestamp},
+	)
+	if err != nil {
+		t.Fatalf("location-asset webhook: %v", err)
+	}
+	err = e.webhook.Post("made-up-topic", []mistfake.ZoneEvent{{Mac: macTaro}})
+	if err != nil {
+		t.Fatalf("webhook of unsupported topic: %v", err)
+	}
+
+	e.webhook.Secret = "wrongsecret"
+	e.webhook.PostZone(mistfake.ZoneEvent{Mac: macTaro, ZoneId: mistfake.ZoneBooth, Trigger: "enter"})
+
+	status, body := e.get(t, "/metrics")
+	if status != http.StatusOK {
+		t.Fatalf("GET /metrics: status %d", status)
+	}
+
+	for _, want := range []string{
+		`locapid_webhook_requests_total{outcome="accepted"} 2`,
+		`locapid_webhook_requests_total{outcome="invalid_signature"} 1`,
+		`locapid_webhook_events_total{outcome="processed",topic="location-asset"} 1`,
+		`locapid_webhook_events_total{outcome="failed",topic="location-asset"} 1`,
+		`locapid_webhook_events_total{outcome="unsupported",topic="other"} 1`,
+		`locapid_mist_api_request_duration_seconds_count{call="asset_search",status="200"} 1`,
+		`locapid_active_entities{id="` + mistfake.MapId11F + `",scope="map"} 1`,
+	} {
+		if !bytes.Contains(body, []byte(want)) {
+			t.Errorf("metrics do not contain %s", want)
+		}
+	}
+}
+
+func TestHealth(t *testing.T) {
+	e := newTestEnv(t, func(cfg *Config) {
+		cfg.Health.WebhookTimeout = 300
+		cfg.Http.BasicAuth = true
+		cfg.Http.Users = append(cfg.Http.Users, UserConfig{User: "admin", Password: "secret"})
+	})
+
+	readyz := func() (int, HealthExtView) {
+		status, body := e.get(t, "/readyz")
+		o := HealthExtView{}
+		err := json.Unmarshal(body, &o)
+		if err != nil {
+			t.Fatalf("invalid readyz response: %v (%s)", err, body)
+		}
+		return status, o
+	}
+
+	// health checks bypass basic authentication
+	status, _ := e.get(t, "/healthz")
+	if status != http.StatusOK {
+		t.Errorf("GET /healthz: status %d; want %d", status, http.StatusOK)
+	}
+	status, _ = e.get(t, "/entity")
+	if status != http.StatusUnauthorized {
+		t.Errorf("GET /entity without credentials: status %d; want %d", status, http.StatusUnauthorized)
+	}
+
+	status, o := readyz()
+	if status != http.StatusOK || o.Status != healthOk {
+		t.Errorf("fresh readyz: status %d %s; want %d %s", status, o.Status, http.StatusOK, healthOk)
+	}
+
+	// no webhook long after start
+	e.server.startedAt = time.Now().Add(-time.Hour)
+	status, o = readyz()
+	if status != http.StatusOK || o.Status != healthDegraded {
+		t.Errorf("readyz without webhooks: status %d %s; want %d %s", status, o.Status, http.StatusOK, healthDegraded)
+	}
+
+	sqlDb, _ := e.server.dbConn.DB()
+	sqlDb.Close()
+	status, o = readyz()
+	if status != http.StatusServiceUnavailable || o.Status != healthDown {
+		t.Errorf("readyz with closed database: status %d %s; want %d %s", status, o.Status, http.StatusServiceUnavailable, healthDown)
+	}
+}
+
+func TestGracefulShutdown(t *testing.T) {
+	e := newTestEnv(t)
+	e.fake.SetDelay(300 * time.Millisecond)
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	served := make(chan error, 1)
+	go func() {
+		served <- e.server.serve(ctx, ln)
+	}()
+
+	// the webhook waits on the slow asset search while shutdown starts
+	posted := make(chan error, 1)
+	go func() {
+		wh := mistfake.NewWebhookSender("http://"+ln.Addr().String()+"/mistrecv", testSecret)
+		posted <- wh.PostLocationAsset(
+			mistfake.LocationAssetEvent{Mac: macTaro, SiteId: mistfake.SiteId, MapId: mistfake.MapId11F, X: 10, Y: 20, Timestamp: testTimestamp},
+		)
+	}()
+	time.Sleep(100 * time.Millisecond)
+	cancel()
+
+	err = <-posted
+	if err != nil {
+		t.Errorf("in-flight webhook failed during shutdown: %v", err)
+	}
+
+	select {
+	case err := <-served:
+		if err != nil {
+			t.Errorf("serve: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("serve did not return after shutdown")
+	}
+}
+
+func TestOpenZoneVisitConcurrent(t *testing.T) {
+	e := newTestEnv(t)
+
+	// retried enter events arriving together open a single visit
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			e.server.openZoneVisit(context.Background(), macTaro, mistfake.ZoneBooth, mistfake.MapId11F, time.Unix(testTimestamp, 0))
+		}()
+	}
+	wg.Wait()
+
+	var open int64
+	e.server.dbConn.Model(&models.ZoneVisit{}).Where("mac = ? AND exit_at IS NULL", macTaro).Count(&open)
+	if open != 1 {
+		t.Errorf("got %d open visits; want 1", open)
+	}
+}
@@ -0,0 +1,133 @@
+package locapiserver
+
+import (
+	"context"
+	"errors"
+	"log"
+	"time"
+
+	"mist-location-visualization/internal/models"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+type apiMetrics struct {
+	registry            *prometheus.Registry
+	webhookRequests     *prometheus.CounterVec
+	webhookEvents       *prometheus.CounterVec
+	webhookLastReceived prometheus.Gauge
+	mistApiCalls        *prometheus.HistogramVec
+	entityTimeouts      prometheus.Counter
+	geofenceEvents      *prometheus.CounterVec
+	ruleMatches         *prometheus.CounterVec
+	ruleActionFailures  *prometheus.CounterVec
+	retentionPurged     *prometheus.CounterVec
+}
+
+func newApiMetrics(s *LocApiServer) *apiMetrics {
+	m := &apiMetrics{
+		registry: prometheus.NewRegistry(),
+		webhookRequests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "locapid_webhook_requests_total",
+			Help: "Webhook requests by outcome (accepted, invalid_signature, invalid_body, too_large, read_error).",
+		}, []string{"outcome"}),
+		webhookEvents: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "locapid_webhook_events_total",
+			Help: "Webhook events by topic (other for unsupported topics) and outcome (processed, failed, unsupported, stale, duplicate, out_of_order, teleport).",
+		}, []string{"topic", "outcome"}),
+		webhookLastReceived: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "locapid_webhook_last_received_timestamp_seconds",
+			Help: "Unix time of the last accepted webhook request.",
+		}),
+		mistApiCalls: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "locapid_mist_api_request_duration_seconds",
+			Help:    "Latency of Mist API calls by call and HTTP status.",
+			Buckets: prometheus.DefBuckets,
+		}, []string{"call", "status"}),
+		entityTimeouts: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "locapid_entity_timeouts_total",
+			Help: "Entities whose position was cleared after the location timeout.",
+		}),
+		geofenceEvents: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "locapid_geofence_events_total",
+			Help: "Entities entering and leaving local geofences by trigger (enter, exit).",
+		}, []string{"trigger"}),
+		ruleMatches: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "locapid_rule_matches_total",
+			Help: "Events matching a rule by rule name.",
+		}, []string{"rule"}),
+		ruleActionFailures: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "locapid_rule_action_failures_total",
+			Help: "Rule actions which failed by rule name and action type (webhook, alert).",
+		}, []string{"rule", "action"}),
+		retentionPurged: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "locapid_retention_purged_rows_total",
+			Help: "Rows deleted after their retention period by table.",
+		}, []string{"table"}),
+	}
+
+	m.registry.MustRegister(
+		m.webhookRequests,
+		m.webhookEvents,
+		m.webhookLastReceived,
+		m.mistApiCalls,
+		m.entityTimeouts,
+		m.geofenceEvents,
+		m.ruleMatches,
+		m.ruleActionFailures,
+		m.retentionPurged,
+		&entityCollector{s: s},
+	)
+
+	return m
+}
+
+func (m *apiMetrics) observeWebhookEvent(topic string, err error) {
+	outcome := "processed"
+	if errors.Is(err, errOutOfOrderEvent) {
+		outcome = eventOutcomeOutOfOrder
+	} else if errors.Is(err, errTeleportEvent) {
+		outcome = eventOutcomeTeleport
+	} else if err != nil {
+		outcome = "failed"
+	}
+
+	m.webhookEvents.WithLabelValues(topic, outcome).Inc()
+}
+
+func (m *apiMetrics) observeMistApiCall(call string, status string, started time.Time) {
+	m.mistApiCalls.WithLabelValues(call, status).Observe(time.Since(started).Seconds())
+}
+
+// entityCollector reports the active entities per map and zone from the database on each scrape
+type entityCollector struct {
+	s *LocApiServer
+}
+
+var activeEntitiesDesc = prometheus.NewDesc(
+	"locapid_active_entities",
+	"Entities seen within the location timeout by scope (map or zone).",
+	[]string{"scope", "id"}, nil,
+)
+
+func (c *entityCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- activeEntitiesDesc
+}
+
+func (c *entityCollector) Collect(ch chan<- prometheus.Metric) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	now := time.Now()
+	for _, scope := range []string{models.OccupancyScopeMap, models.OccupancyScopeZone} {
+		counts, err := c.s.countActiveEntities(ctx, scope, now)
+		if err != nil {
+			log.Printf("entityCollector: Failed to count entities (%v)", err)
+			continue
+		}
+
+		for id, count := range counts {
+			ch <- prometheus.MustNewConstMetric(activeEntitiesDesc, prometheus.GaugeValue, float64(count), scope, id)
+		}
+	}
+}
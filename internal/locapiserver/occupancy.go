@@ -0,0 +1,315 @@
+package locapiserver
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"mist-location-visualization/internal/models"
+
+	"github.com/go-chi/render"
+)
+
+const defaultOccupancyBucket = 3600
+
+// OccupancyBucketExtView represents occupancy statistics within one time bucket
+type OccupancyBucketExtView struct {
+	Start   int64   `json:"start"`
+	Min     int64   `json:"min"`
+	Avg     float64 `json:"avg"`
+	Max     int64   `json:"max"`
+	Samples int     `json:"samples"`
+}
+
+// OccupancyPeakExtView represents the highest occupancy of a day (in the site timezone)
+type OccupancyPeakExtView struct {
+	Date string `json:"date"`
+	Max  int64  `json:"max"`
+	At   int64  `json:"at"`
+}
+
+// OccupancyExtView represents the occupancy time series of a zone or map for API responses
+type OccupancyExtView struct {
+	Scope      string                    `json:"scope"`
+	Id         string                    `json:"id"`
+	Name       string                    `json:"name"`
+	From       int64                     `json:"from"`
+	To         int64                     `json:"to"`
+	Bucket     int64                     `json:"bucket"`
+	Buckets    []*OccupancyBucketExtView `json:"buckets"`
+	DailyPeaks []*OccupancyPeakExtView   `json:"daily_peaks"`
+}
+
+func (e *OccupancyExtView) Render(w http.ResponseWriter, r *http.Request) error {
+	return nil
+}
+
+// runOccupancySampler samples occupancy every interval until ctx is cancelled
+func (s *LocApiServer) runOccupancySampler(ctx context.Context, interval time.Duration) {
+	log.Printf("runOccupancySampler: Sampling occupancy every %s", interval)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			log.Printf("runOccupancySampler: Stopped")
+			return
+		case t := <-ticker.C:
+			err := s.sampleOccupancy(ctx, t)
+			if err != nil {
+				log.Printf("runOccupancySampler: Failed to sample occupancy (%v)", err)
+			}
+		}
+	}
+}
+
+// occupancyColumns maps occupancy scopes to the entity column holding the scope id
+var occupancyColumns = map[string]string{
+	models.OccupancyScopeZone: "zone_id",
+	models.OccupancyScopeMap:  "map_id",
+}
+
+// countActiveEntities counts entities per zone or map at t.
+// Entities not seen within the location timeout are not counted.
+func (s *LocApiServer) countActiveEntities(ctx context.Context, scope string, t time.Time) (map[string]int64, error) {
+	column := occupancyColumns[scope]
+	cutoff := float64(t.Unix() - int64(s.config().Mist.LocationTimeout))
+
+	counts := make([]struct {
+		Id    string
+		Count int64
+	}, 0)
+	ret := s.dbConn.WithContext(ctx).Model(&models.Entity{}).
+		Select(column+" AS id, COUNT(*) AS count").
+		Where(column+" <> '' AND lastseen >= ?", cutoff).
+		Group(column).
+		Scan(&counts)
+	if ret.Error != nil {
+		return nil, ret.Error
+	}
+
+	countIdx := make(map[string]int64)
+	for _, c := range counts {
+		countIdx[c.Id] = c.Count
+	}
+
+	// entities may be in several geofences, which are tracked by their open visits
+	if scope == models.OccupancyScopeZone {
+		counts = counts[:0]
+		ret := s.dbConn.WithContext(ctx).Model(&models.ZoneVisit{}).
+			Select("zone_visits.zone_id AS id, COUNT(*) AS count").
+			Joins("JOIN entities ON entities.mac = zone_visits.mac").
+			Where("zone_visits.geofence = ? AND zone_visits.exit_at IS NULL AND entities.lastseen >= ?", true, cutoff).
+			Group("zone_visits.zone_id").
+			Scan(&counts)
+		if ret.Error != nil {
+			return nil, ret.Error
+		}
+
+		for _, c := range counts {
+			countIdx[c.Id] = c.Count
+		}
+	}
+
+	return countIdx, nil
+}
+
+// sampleOccupancy stores the current entity count of every zone and map
+func (s *LocApiServer) sampleOccupancy(ctx context.Context, t time.Time) error {
+	samples := make([]models.OccupancySample, 0)
+	for _, scope := range []struct {
+		name  string
+		model interface{}
+	}{
+		{models.OccupancyScopeZone, &models.Zone{}},
+		{models.OccupancyScopeMap, &models.Map{}},
+	} {
+		ids := make([]string, 0)
+		ret := s.dbConn.WithContext(ctx).Model(scope.model).Pluck("id", &ids)
+		if ret.Error != nil {
+			return ret.Error
+		}
+
+		if scope.name == models.OccupancyScopeZone {
+			geofenceIds := make([]string, 0)
+			ret := s.dbConn.WithContext(ctx).Model(&models.Geofence{}).Pluck("id", &geofenceIds)
+			if ret.Error != nil {
+				return ret.Error
+			}
+			ids = append(ids, geofenceIds...)
+		}
+
+		counts, err := s.countActiveEntities(ctx, scope.name, t)
+		if err != nil {
+			return err
+		}
+
+		for _, id := range ids {
+			samples = append(samples, models.OccupancySample{
+				Scope:     scope.name,
+				ScopeId:   id,
+				Count:     counts[id],
+				SampledAt: t,
+			})
+		}
+	}
+
+	if len(samples) == 0 {
+		return nil
+	}
+
+	return s.dbConn.WithContext(ctx).Create(&samples).Error
+}
+
+// getSiteLocation returns the timezone of a site, or UTC when it is unknown
+func (s *LocApiServer) getSiteLocation(ctx context.Context, siteId string) *time.Location {
+	site := models.Site{}
+	ret := s.dbConn.WithContext(ctx).Where("id = ?", siteId).Limit(1).Find(&site)
+	if ret.Error != nil || site.Timezone == "" {
+		return time.UTC
+	}
+
+	loc, err := time.LoadLocation(site.Timezone)
+	if err != nil {
+		log.Printf("getSiteLocation: Unknown timezone %s of site %s (%v)", site.Timezone, siteId, err)
+		return time.UTC
+	}
+
+	return loc
+}
+
+// aggregateOccupancy groups samples (sorted by time) into buckets and finds the peak of each day.
+// Buckets are aligned to the local time of loc so that daily buckets start at midnight.
+func aggregateOccupancy(samples []models.OccupancySample, bucket int64, loc *time.Location) ([]*OccupancyBucketExtView, []*OccupancyPeakExtView) {
+	buckets := []*OccupancyBucketExtView{}
+	peaks := []*OccupancyPeakExtView{}
+
+	var cur *OccupancyBucketExtView
+	var peak *OccupancyPeakExtView
+	var sum int64
+	for _, v := range samples {
+		_, offset := v.SampledAt.In(loc).Zone()
+		local := v.SampledAt.Unix() + int64(offset)
+		start := local - local%bucket - int64(offset)
+		if cur == nil || cur.Start != start {
+			cur = &OccupancyBucketExtView{Start: start, Min: v.Count, Max: v.Count}
+			buckets = append(buckets, cur)
+			sum = 0
+		}
+		cur.Min = min(cur.Min, v.Count)
+		cur.Max = max(cur.Max, v.Count)
+		cur.Samples++
+		sum += v.Count
+		cur.Avg = float64(sum) / float64(cur.Samples)
+
+		date := v.SampledAt.In(loc).Format(time.DateOnly)
+		if peak == nil || peak.Date != date {
+			peak = &OccupancyPeakExtView{Date: date, Max: v.Count, At: v.SampledAt.Unix()}
+			peaks = append(peaks, peak)
+		} else if v.Count > peak.Max {
+			peak.Max = v.Count
+			peak.At = v.SampledAt.Unix()
+		}
+	}
+
+	return buckets, peaks
+}
+
+// apiGetOccupancy serves the occupancy of the zone or map in the request context
+func (s *LocApiServer) apiGetOccupancy(scope string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		// samples count the entities of all tenants
+		if p := getPrincipal(r.Context()); p != nil && p.tenanted {
+			err := fmt.Errorf("occupancy is not available to tenants")
+			render.Render(w, r, s.httpErrForbidden(err))
+			return
+		}
+
+		from, to, err := getTimeRange(r)
+		if err != nil {
+			render.Render(w, r, s.httpErrInvalidRequest(err))
+			return
+		}
+		if to.IsZero() {
+			to = time.Now()
+		}
+		if from.IsZero() {
+			from = to.Add(-24 * time.Hour)
+		}
+
+		bucket := int64(defaultOccupancyBucket)
+		if param := r.URL.Query().Get("bucket"); param != "" {
+			bucket, err = strconv.ParseInt(param, 10, 64)
+			if err != nil || bucket <= 0 {
+				err := fmt.Errorf("invalid bucket %s", param)
+				render.Render(w, r, s.httpErrInvalidRequest(err))
+				return
+			}
+		}
+
+		o := &OccupancyExtView{
+			Scope:  scope,
+			From:   from.Unix(),
+			To:     to.Unix(),
+			Bucket: bucket,
+		}
+
+		// look up the zone or map for its name and site
+		var siteId string
+		switch scope {
+		case models.OccupancyScopeZone:
+			o.Id = getCtxValueString(r.Context(), "zoneid")
+			zone, err := s.findZone(r.Context(), o.Id)
+			if err != nil {
+				log.Printf("apiGetOccupancy: Failed to query DB (%v)", err)
+				err := fmt.Errorf("failed to get data from backend")
+				render.Render(w, r, s.httpErrUnexpected(err))
+				return
+			} else if zone == nil {
+				err := fmt.Errorf("zone %s not found", o.Id)
+				render.Render(w, r, s.httpErrNotFound(err))
+				return
+			}
+			o.Name = zone.Name
+			siteId = zone.SiteId
+
+		case models.OccupancyScopeMap:
+			mapEntry := models.Map{}
+			o.Id = getCtxValueString(r.Context(), "mapid")
+			res := s.dbConn.WithContext(r.Context()).Where("id = ?", o.Id).Limit(1).Find(&mapEntry)
+			if res.Error != nil {
+				log.Printf("apiGetOccupancy: Failed to query DB (%v)", res.Error)
+				err := fmt.Errorf("failed to get data from backend")
+				render.Render(w, r, s.httpErrUnexpected(err))
+				return
+			} else if res.RowsAffected == 0 {
+				err := fmt.Errorf("map %s not found", o.Id)
+				render.Render(w, r, s.httpErrNotFound(err))
+				return
+			}
+			o.Name = mapEntry.Name
+			siteId = mapEntry.SiteId
+		}
+
+		samples := make([]models.OccupancySample, 0)
+		res := s.dbConn.WithContext(r.Context()).Where("scope = ? AND scope_id = ? AND sampled_at >= ? AND sampled_at < ?", scope, o.Id, from, to).
+			Order("sampled_at").
+			Find(&samples)
+		if res.Error != nil {
+			log.Printf("apiGetOccupancy: Failed to query DB on samples (%v)", res.Error)
+			err := fmt.Errorf("failed to get data from backend")
+			render.Render(w, r, s.httpErrUnexpected(err))
+			return
+		}
+
+		o.Buckets, o.DailyPeaks = aggregateOccupancy(samples, bucket, s.getSiteLocation(r.Context(), siteId))
+
+		render.Render(w, r, o)
+		return
+	}
+}
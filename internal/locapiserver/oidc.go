@@ -0,0 +1,353 @@
+package locapiserver
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"math/big"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+const (
+	defaultJwksRefresh = 3600 * time.Second
+	// minimum interval between JWKS downloads triggered by unknown key ids
+	jwksMissRefresh = 60 * time.Second
+)
+
+// jsonWebKey is a public key of a JWKS (RFC 7517)
+type jsonWebKey struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	Crv string `json:"crv"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+func decodeJwkInt(v string) (*big.Int, error) {
+	b, err := base64.RawURLEncoding.DecodeString(v)
+	if err != nil {
+		return nil, err
+	}
+	return new(big.Int).SetBytes(b), nil
+}
+
+func (k *jsonWebKey) publicKey() (crypto.PublicKey, error) {
+	switch k.Kty {
+	case "RSA":
+		n, err := decodeJwkInt(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := decodeJwkInt(k.E)
+		if err != nil {
+			return nil, err
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+
+	case "EC":
+		curves := map[string]elliptic.Curve{
+			"P-256": elliptic.P256(),
+			"P-384": elliptic.P384(),
+			"P-521": elliptic.P521(),
+		}
+		curve, ok := curves[k.Crv]
+		if !ok {
+			return nil, fmt.Errorf("unsupported curve %s", k.Crv)
+		}
+		x, err := decodeJwkInt(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := decodeJwkInt(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		if !curve.IsOnCurve(x, y) {
+			return nil, fmt.Errorf("point is not on curve %s", k.Crv)
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+
+	case "OKP":
+		if k.Crv != "Ed25519" {
+			return nil, fmt.Errorf("unsupported curve %s", k.Crv)
+		}
+		x, err := base64.RawURLEncoding.DecodeString(k.X)
+		if err != nil {
+			return nil, err
+		}
+		if len(x) != ed25519.PublicKeySize {
+			return nil, fmt.Errorf("invalid Ed25519 key size")
+		}
+		return ed25519.PublicKey(x), nil
+	}
+
+	return nil, fmt.Errorf("unsupported key type %s", k.Kty)
+}
+
+// parseJwks returns the signing keys of a JWKS document by key id
+func parseJwks(data []byte) (map[string]crypto.PublicKey, error) {
+	doc := struct {
+		Keys []jsonWebKey `json:"keys"`
+	}{}
+	err := json.Unmarshal(data, &doc)
+	if err != nil {
+		return nil, err
+	}
+
+	keys := make(map[string]crypto.PublicKey)
+	for _, k := range doc.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+
+		pub, err := k.publicKey()
+		if err != nil {
+			log.Printf("parseJwks: Skipped key %s (%v)", k.Kid, err)
+			continue
+		}
+		keys[k.Kid] = pub
+	}
+
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("no usable signing keys")
+	}
+
+	return keys, nil
+}
+
+// jwksCache holds the keys of a JWKS file or URL and downloads them again when they are
+// older than the refresh interval or a token refers to an unknown key id
+type jwksCache struct {
+	file    string
+	url     string
+	refresh time.Duration
+	client  *http.Client
+
+	mu        sync.Mutex
+	keys      map[string]crypto.PublicKey
+	fetchedAt time.Time
+}
+
+func (c *jwksCache) load(ctx context.Context) error {
+	var data []byte
+	var err error
+
+	if c.file != "" {
+		data, err = os.ReadFile(c.file)
+		if err != nil {
+			return err
+		}
+	} else {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.url, nil)
+		if err != nil {
+			return err
+		}
+
+		resp, err := c.client.Do(req)
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+
+		if resp.StatusCode != http.StatusOK {
+			return fmt.Errorf("unexpected status %d", resp.StatusCode)
+		}
+
+		data, err = io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+		if err != nil {
+			return err
+		}
+	}
+
+	keys, err := parseJwks(data)
+	if err != nil {
+		return err
+	}
+
+	c.keys = keys
+	c.fetchedAt = time.Now()
+
+	return nil
+}
+
+// key returns the public key with kid, reloading the JWKS when needed
+func (c *jwksCache) key(ctx context.Context, kid string) (crypto.PublicKey, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	age := time.Since(c.fetchedAt)
+	_, found := c.keys[kid]
+	if age > c.refresh || (!found && age > jwksMissRefresh) {
+		err := c.load(ctx)
+		if err != nil {
+			// keep the previous keys while the issuer is unreachable
+			log.Printf("jwksCache: Failed to load JWKS (%v)", err)
+		}
+	}
+
+	if kid == "" && len(c.keys) == 1 {
+		for _, v := range c.keys {
+			return v, nil
+		}
+	}
+
+	pub, found := c.keys[kid]
+	if !found {
+		return nil, fmt.Errorf("unknown key id %s", kid)
+	}
+
+	return pub, nil
+}
+
+// oidcVerifier validates JWT bearer tokens of an OpenID Connect issuer and maps their claims
+type oidcVerifier struct {
+	cfg    OidcConfig
+	jwks   *jwksCache
+	parser *jwt.Parser
+}
+
+func newOidcVerifier(cfg OidcConfig) (*oidcVerifier, error) {
+	if cfg.JwksFile == "" && cfg.JwksUrl == "" {
+		return nil, fmt.Errorf("jwks_file or jwks_url is required")
+	}
+
+	for _, v := range cfg.Roles {
+		err := validateScopes(v.Scopes, nil, nil)
+		if err != nil {
+			return nil, fmt.Errorf("role %s: %w", v.Role, err)
+		}
+	}
+
+	refresh := time.Duration(cfg.JwksRefresh) * time.Second
+	if refresh <= 0 {
+		refresh = defaultJwksRefresh
+	}
+
+	opts := []jwt.ParserOption{
+		jwt.WithValidMethods([]string{"RS256", "RS384", "RS512", "PS256", "PS384", "PS512", "ES256", "ES384", "ES512", "EdDSA"}),
+		jwt.WithExpirationRequired(),
+		jwt.WithLeeway(time.Duration(cfg.Leeway) * time.Second),
+	}
+	if cfg.Issuer != "" {
+		opts = append(opts, jwt.WithIssuer(cfg.Issuer))
+	}
+	if cfg.Audience != "" {
+		opts = append(opts, jwt.WithAudience(cfg.Audience))
+	}
+
+	v := &oidcVerifier{
+		cfg: cfg,
+		jwks: &jwksCache{
+			file:    cfg.JwksFile,
+			url:     cfg.JwksUrl,
+			refresh: refresh,
+			client:  &http.Client{Timeout: 10 * time.Second},
+		},
+		parser: jwt.NewParser(opts...),
+	}
+
+	// fail early on a broken JWKS file; an unreachable issuer is retried on the first token
+	v.jwks.mu.Lock()
+	err := v.jwks.load(context.Background())
+	v.jwks.mu.Unlock()
+	if err != nil {
+		if cfg.JwksFile != "" {
+			return nil, fmt.Errorf("failed to load %s: %w", cfg.JwksFile, err)
+		}
+		log.Printf("newOidcVerifier: Failed to load JWKS from %s (%v)", cfg.JwksUrl, err)
+	}
+
+	return v, nil
+}
+
+// claimStrings returns a claim as a list of strings. Dots in name walk into nested
+// objects (e.g. "realm_access.roles"), and a space separated string is split.
+func claimStrings(claims jwt.MapClaims, name string) []string {
+	var v interface{} = map[string]interface{}(claims)
+	for _, part := range strings.Split(name, ".") {
+		obj, ok := v.(map[string]interface{})
+		if !ok {
+			return nil
+		}
+		v = obj[part]
+	}
+
+	switch val := v.(type) {
+	case string:
+		return strings.Fields(val)
+	case []interface{}:
+		outs := make([]string, 0, len(val))
+		for _, e := range val {
+			if s, ok := e.(string); ok {
+				outs = append(outs, s)
+			}
+		}
+		return outs
+	}
+
+	return nil
+}
+
+// verify validates a token and returns its principal. Callers without a mapped role get no scopes.
+func (v *oidcVerifier) verify(ctx context.Context, token string) (*Principal, error) {
+	claims := jwt.MapClaims{}
+	_, err := v.parser.ParseWithClaims(token, claims, func(t *jwt.Token) (interface{}, error) {
+		kid, _ := t.Header["kid"].(string)
+		return v.jwks.key(ctx, kid)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	p := &Principal{Scopes: []string{}}
+	nameClaim := v.cfg.NameClaim
+	if nameClaim == "" {
+		nameClaim = "sub"
+	}
+	p.Name, _ = claims[nameClaim].(string)
+
+	roles := claimStrings(claims, v.cfg.RolesClaim)
+	for _, r := range v.cfg.Roles {
+		for _, role := range roles {
+			if role == r.Role {
+				p.Scopes = append(p.Scopes, r.Scopes...)
+			}
+		}
+	}
+
+	// admins see everything; others only the organisations and maps listed in their claims
+	if !p.hasScope(scopeAdmin) && (v.cfg.OrgsClaim != "" || v.cfg.MapsClaim != "") {
+		p.restricted = true
+		if v.cfg.OrgsClaim != "" {
+			p.Orgs = claimStrings(claims, v.cfg.OrgsClaim)
+		}
+		if v.cfg.MapsClaim != "" {
+			p.Maps = claimStrings(claims, v.cfg.MapsClaim)
+		}
+	}
+
+	// a token without tenants sees no entities at all
+	if !p.hasScope(scopeAdmin) && v.cfg.TenantsClaim != "" {
+		p.tenanted = true
+		p.Tenants = claimStrings(claims, v.cfg.TenantsClaim)
+	}
+
+	return p, nil
+}
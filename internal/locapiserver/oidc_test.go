@@ -0,0 +1,214 @@
+package locapiserver
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+
+	"mist-location-visualization/internal/mistfake"
+	"mist-location-visualization/internal/models"
+)
+
+const testIssuer = "https://idp.example.com"
+
+// testIssuerKey is a local OIDC issuer signing tokens with an RSA key
+type testIssuerKey struct {
+	kid string
+	key *rsa.PrivateKey
+}
+
+func newTestIssuerKey(t *testing.T, kid string) *testIssuerKey {
+	t.Helper()
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testIssuerKey{kid: kid, key: key}
+}
+
+func (k *testIssuerKey) jwks(t *testing.T) []byte {
+	t.Helper()
+
+	data, err := json.Marshal(map[string]interface{}{
+		"keys": []map[string]string{{
+			"kty": "RSA",
+			"kid": k.kid,
+			"use": "sig",
+			"n":   base64.RawURLEncoding.EncodeToString(k.key.N.Bytes()),
+			"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(k.key.E)).Bytes()),
+		}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func (k *testIssuerKey) sign(t *testing.T, claims jwt.MapClaims) string {
+	t.Helper()
+
+	base := jwt.MapClaims{
+		"iss": testIssuer,
+		"aud": "locapid",
+		"sub": "user1",
+		"exp": time.Now().Add(time.Hour).Unix(),
+	}
+	for k, v := range claims {
+		base[k] = v
+	}
+
+	token := jwt.NewWithClaims(jwt.SigningMethodRS256, base)
+	token.Header["kid"] = k.kid
+	signed, err := token.SignedString(k.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signed
+}
+
+func getWithToken(t *testing.T, url string, token string) (int, []byte) {
+	t.Helper()
+
+	req, _ := http.NewRequest(http.MethodGet, url, nil)
+	req.Header.Set("Authorization", "Bearer "+token)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp.StatusCode, body
+}
+
+func testOidcConfig(cfg *Config) {
+	cfg.Http.Oidc.Issuer = testIssuer
+	cfg.Http.Oidc.Audience = "locapid"
+	cfg.Http.Oidc.RolesClaim = "roles"
+	cfg.Http.Oidc.OrgsClaim = "orgs"
+	cfg.Http.Oidc.MapsClaim = "maps"
+	cfg.Http.Oidc.Roles = []OidcRoleConfig{
+		{Role: "locapid-viewer", Scopes: []string{scopeRead}},
+		{Role: "locapid-admin", Scopes: []string{scopeAdmin}},
+	}
+}
+
+func TestOidcAuth(t *testing.T) {
+	key := newTestIssuerKey(t, "key1")
+	jwksFile := filepath.Join(t.TempDir(), "jwks.json")
+	err := os.WriteFile(jwksFile, key.jwks(t), 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	e := newTestEnv(t, func(cfg *Config) {
+		testOidcConfig(cfg)
+		cfg.Http.Oidc.JwksFile = jwksFile
+	})
+
+	e.server.dbConn.Create(&models.Site{Id: mistfake.SiteId, OrgId: mistfake.OrgId, Name: "Tokyo"})
+	err = e.webhook.PostLocationAsset(
+		mistfake.LocationAssetEvent{Mac: macTaro, SiteId: mistfake.SiteId, MapId: mistfake.MapId11F, X: 10, Y: 20, Timestamp: testTimestamp},
+		mistfake.LocationAssetEvent{Mac: macForklift, SiteId: mistfake.SiteId, MapId: mistfake.MapId12F, X: 30.5, Y: 4, Timestamp: testTimestamp},
+	)
+	if err != nil {
+		t.Fatalf("location-asset webhook: %v", err)
+	}
+
+	countEntities := func(token string) int {
+		status, body := getWithToken(t, e.http.URL+"/entity", token)
+		if status != http.StatusOK {
+			t.Fatalf("GET /entity: status %d (%s)", status, body)
+		}
+		outs := []EntityExtView{}
+		json.Unmarshal(body, &outs)
+		return len(outs)
+	}
+
+	admin := key.sign(t, jwt.MapClaims{"roles": []string{"locapid-admin"}})
+	if n := countEntities(admin); n != 2 {
+		t.Errorf("admin sees %d entities; want 2", n)
+	}
+
+	orgViewer := key.sign(t, jwt.MapClaims{"roles": []string{"locapid-viewer"}, "orgs": []string{mistfake.OrgId}})
+	if n := countEntities(orgViewer); n != 2 {
+		t.Errorf("viewer of the organisation sees %d entities; want 2", n)
+	}
+
+	mapViewer := key.sign(t, jwt.MapClaims{"roles": "locapid-viewer", "maps": []string{mistfake.MapId11F}})
+	if n := countEntities(mapViewer); n != 1 {
+		t.Errorf("viewer of 11F sees %d entities; want 1", n)
+	}
+
+	for _, c := range []struct {
+		uri    string
+		token  string
+		status int
+	}{
+		{"/map/" + mistfake.MapId11F + "/zone", mapViewer, http.StatusOK},
+		{"/map/" + mistfake.MapId12F + "/zone", mapViewer, http.StatusNotFound},
+		{"/zone/" + mistfake.ZoneRoomA + "/visits", mapViewer, http.StatusNotFound},
+		{"/entity/" + macForklift, mapViewer, http.StatusNotFound},
+		{"/entity/" + macTaro, mapViewer, http.StatusOK},
+		{"/entity", key.sign(t, jwt.MapClaims{"roles": []string{"other"}}), http.StatusForbidden},
+		{"/entity", key.sign(t, jwt.MapClaims{"roles": []string{"locapid-admin"}, "iss": "https://other.example.com"}), http.StatusUnauthorized},
+		{"/entity", key.sign(t, jwt.MapClaims{"roles": []string{"locapid-admin"}, "exp": time.Now().Add(-time.Hour).Unix()}), http.StatusUnauthorized},
+		{"/entity", newTestIssuerKey(t, "key1").sign(t, jwt.MapClaims{"roles": []string{"locapid-admin"}}), http.StatusUnauthorized},
+	} {
+		status, body := getWithToken(t, e.http.URL+c.uri, c.token)
+		if status != c.status {
+			t.Errorf("GET %s: status %d; want %d (%s)", c.uri, status, c.status, body)
+		}
+	}
+
+	status, body := getWithToken(t, e.http.URL+"/map", mapViewer)
+	maps := []MapExtView{}
+	json.Unmarshal(body, &maps)
+	if status != http.StatusOK || len(maps) != 1 || maps[0].Id != mistfake.MapId11F {
+		t.Errorf("GET /map as viewer of 11F: status %d %s", status, body)
+	}
+}
+
+func TestOidcJwksUrlRotation(t *testing.T) {
+	key := newTestIssuerKey(t, "key1")
+	jwks := key.jwks(t)
+	idp := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(jwks)
+	}))
+	t.Cleanup(idp.Close)
+
+	e := newTestEnv(t, func(cfg *Config) {
+		testOidcConfig(cfg)
+		cfg.Http.Oidc.JwksUrl = idp.URL
+	})
+
+	status, _ := getWithToken(t, e.http.URL+"/entity", key.sign(t, jwt.MapClaims{"roles": []string{"locapid-viewer"}}))
+	if status != http.StatusOK {
+		t.Errorf("GET /entity with key1: status %d; want %d", status, http.StatusOK)
+	}
+
+	// the issuer rotates to a new key, which is fetched on the first token using it
+	rotated := newTestIssuerKey(t, "key2")
+	jwks = rotated.jwks(t)
+	e.server.auth.Load().oidc.jwks.fetchedAt = time.Now().Add(-2 * jwksMissRefresh)
+
+	status, _ = getWithToken(t, e.http.URL+"/entity", rotated.sign(t, jwt.MapClaims{"roles": []string{"locapid-viewer"}}))
+	if status != http.StatusOK {
+		t.Errorf("GET /entity with rotated key: status %d; want %d", status, http.StatusOK)
+	}
+}
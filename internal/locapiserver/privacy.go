@@ -0,0 +1,363 @@
+package locapiserver
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"net/http"
+	"slices"
+	"time"
+
+	"mist-location-visualization/internal/models"
+
+	"github.com/go-chi/render"
+)
+
+var privacyVisibilities = []string{models.PrivacyVisible, models.PrivacyZoneOnly, models.PrivacyAnonymous, models.PrivacyHidden}
+
+// EntityPrivacyExtView represents the privacy settings of an entity for API responses
+type EntityPrivacyExtView struct {
+	Mac        string   `json:"mac"`
+	Visibility string   `json:"visibility"`
+	Days       []string `json:"days"`
+	From       string   `json:"from"`
+	To         string   `json:"to"`
+	Timezone   string   `json:"timezone"`
+}
+
+func (e *EntityPrivacyExtView) Render(w http.ResponseWriter, r *http.Request) error {
+	return nil
+}
+
+// EntityPrivacyRequest sets the privacy of an entity. With From and To (and optionally Days)
+// the entity is only shown within that time of day range.
+type EntityPrivacyRequest struct {
+	Visibility string   `json:"visibility"`
+	Days       []string `json:"days"`
+	From       string   `json:"from"`
+	To         string   `json:"to"`
+	Timezone   string   `json:"timezone"`
+}
+
+func (e *EntityPrivacyRequest) Bind(r *http.Request) error {
+	if !slices.Contains(privacyVisibilities, e.Visibility) {
+		return fmt.Errorf("invalid visibility %s", e.Visibility)
+	}
+
+	if len(e.Days) > 0 && e.From == "" && e.To == "" {
+		return fmt.Errorf("days require from and to")
+	}
+
+	_, err := compileEntityPrivacy(models.EntityPrivacy{Visibility: e.Visibility, Days: e.Days, From: e.From, To: e.To, Timezone: e.Timezone})
+	return err
+}
+
+func newEntityPrivacyExtView(p models.EntityPrivacy) *EntityPrivacyExtView {
+	o := &EntityPrivacyExtView{
+		Mac:        p.Mac,
+		Visibility: p.Visibility,
+		Days:       p.Days,
+		From:       p.From,
+		To:         p.To,
+		Timezone:   p.Timezone,
+	}
+
+	if o.Days == nil {
+		o.Days = []string{}
+	}
+
+	return o
+}
+
+// entityPrivacy is a compiled EntityPrivacy
+type entityPrivacy struct {
+	visibility string
+	schedule   *ruleSchedule
+}
+
+func compileEntityPrivacy(p models.EntityPrivacy) (*entityPrivacy, error) {
+	ep := &entityPrivacy{visibility: p.Visibility}
+
+	if p.From != "" || p.To != "" {
+		var err error
+		ep.schedule, err = compileSchedule(&RuleScheduleConfig{Days: p.Days, From: p.From, To: p.To, Timezone: p.Timezone})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return ep, nil
+}
+
+// visibilityAt returns the visibility at t; outside the schedule the entity is hidden
+func (ep *entityPrivacy) visibilityAt(t time.Time) string {
+	if ep.schedule != nil {
+		if ep.schedule.loc != nil {
+			t = t.In(ep.schedule.loc)
+		}
+		if !ep.schedule.contains(t) {
+			return models.PrivacyHidden
+		}
+	}
+
+	return ep.visibility
+}
+
+// privacyPolicy applies the privacy settings of all entities to one request
+type privacyPolicy struct {
+	s        *LocApiServer
+	settings map[string]*entityPrivacy
+	exempt   bool
+	now      time.Time
+}
+
+// newPrivacyKey returns the key of pseudonyms, random when no salt is configured
+func newPrivacyKey(cfg Config) ([]byte, error) {
+	if cfg.Privacy.Salt != "" {
+		return []byte(cfg.Privacy.Salt), nil
+	} else if cfg.Privacy.Pseudonymize {
+		return nil, fmt.Errorf("privacy.salt is required for stable pseudonyms")
+	}
+
+	key := make([]byte, 32)
+	_, err := rand.Read(key)
+	if err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// pseudonym returns the stable hashed id standing in for mac
+func (s *LocApiServer) pseudonym(mac string) string {
+	h := hmac.New(sha256.New, s.privacyKey)
+	h.Write([]byte(mac))
+	return "anon-" + hex.EncodeToString(h.Sum(nil))[:16]
+}
+
+// loadPrivacy returns the privacy policy for the caller in ctx. Admins are exempt
+// when privacy.exempt_admin is set.
+func (s *LocApiServer) loadPrivacy(ctx context.Context) (*privacyPolicy, error) {
+	pp := &privacyPolicy{
+		s:        s,
+		settings: make(map[string]*entityPrivacy),
+		now:      time.Now(),
+	}
+
+	if s.config().Privacy.ExemptAdmin {
+		if p := getPrincipal(ctx); p != nil && p.hasScope(scopeAdmin) {
+			pp.exempt = true
+			return pp, nil
+		}
+	}
+
+	settings := make([]models.EntityPrivacy, 0)
+	ret := s.dbConn.WithContext(ctx).Find(&settings)
+	if ret.Error != nil {
+		return nil, ret.Error
+	}
+
+	for _, v := range settings {
+		ep, err := compileEntityPrivacy(v)
+		if err != nil {
+			// settings are validated when stored, so hide the entity to be safe
+			log.Printf("loadPrivacy: Invalid privacy settings of %s (%v)", v.Mac, err)
+			ep = &entityPrivacy{visibility: models.PrivacyHidden}
+		}
+		pp.settings[v.Mac] = ep
+	}
+
+	return pp, nil
+}
+
+func (pp *privacyPolicy) visibility(mac string) string {
+	ep, ok := pp.settings[mac]
+	if pp.exempt || !ok {
+		return models.PrivacyVisible
+	}
+
+	return ep.visibilityAt(pp.now)
+}
+
+// pseudonymized reports whether names are replaced by pseudonyms for this caller
+func (pp *privacyPolicy) pseudonymized() bool {
+	return !pp.exempt && pp.s.config().Privacy.Pseudonymize
+}
+
+// name returns the name of mac to show, a pseudonym in pseudonymization mode
+func (pp *privacyPolicy) name(mac string, name string) string {
+	if !pp.pseudonymized() || name == "" {
+		return name
+	}
+
+	return pp.s.pseudonym(mac)
+}
+
+// mac returns the id of mac to show in lists of other entities, or false when it is hidden
+func (pp *privacyPolicy) mac(mac string) (string, bool) {
+	switch pp.visibility(mac) {
+	case models.PrivacyHidden:
+		return "", false
+	case models.PrivacyAnonymous:
+		return pp.s.pseudonym(mac), true
+	}
+
+	return mac, true
+}
+
+// entityView returns the view of e allowed by its privacy settings, or nil when it is hidden
+func (pp *privacyPolicy) entityView(e models.Entity, maps map[string]models.Map) *EntityExtView {
+	o := newEntityExtView(e, maps)
+
+	switch pp.visibility(e.Mac) {
+	case models.PrivacyHidden:
+		return nil
+
+	case models.PrivacyAnonymous:
+		o.Id = pp.s.pseudonym(e.Mac)
+		o.DisplayName = ""
+		o.DisplayOrg = ""
+		return o
+
+	case models.PrivacyZoneOnly:
+		o.X = -1
+		o.Y = -1
+		o.RawX = -1
+		o.RawY = -1
+	}
+
+	o.DisplayName = pp.name(e.Mac, o.DisplayName)
+	return o
+}
+
+// anonymousRuleEvent returns ev with the mac and name of its entity replaced by the pseudonym
+func (s *LocApiServer) anonymousRuleEvent(ev RuleEvent) RuleEvent {
+	ev.Mac = s.pseudonym(ev.Mac)
+	ev.Name = ev.Mac
+	ev.Org = ""
+	return ev
+}
+
+// ruleEvent returns ev as allowed by the privacy settings of its entity, or false when it is hidden
+func (pp *privacyPolicy) ruleEvent(ev RuleEvent) (RuleEvent, bool) {
+	switch pp.visibility(ev.Mac) {
+	case models.PrivacyHidden:
+		return RuleEvent{}, false
+
+	case models.PrivacyAnonymous:
+		return pp.s.anonymousRuleEvent(ev), true
+	}
+
+	ev.Name = pp.name(ev.Mac, ev.Name)
+	return ev, true
+}
+
+// alertView returns the view of a allowed by the privacy settings of its entity, or nil when it is hidden
+func (pp *privacyPolicy) alertView(a models.Alert) *AlertExtView {
+	o := newAlertExtView(a)
+
+	switch pp.visibility(a.Mac) {
+	case models.PrivacyHidden:
+		return nil
+
+	case models.PrivacyAnonymous:
+		o.Mac = pp.s.pseudonym(a.Mac)
+		o.Message = a.AnonMessage
+		return o
+	}
+
+	if pp.pseudonymized() {
+		o.Message = a.AnonMessage
+	}
+	return o
+}
+
+// apiEntityVisibleCtx answers 404 for entities whose visibility is not one of allowed
+func (s *LocApiServer) apiEntityVisibleCtx(allowed ...string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			mac := getCtxValueString(r.Context(), "mac")
+			pp, err := s.loadPrivacy(r.Context())
+			if err != nil {
+				log.Printf("apiEntityVisibleCtx: Failed to query DB (%v)", err)
+				err := fmt.Errorf("failed to get data from backend")
+				render.Render(w, r, s.httpErrUnexpected(err))
+				return
+			}
+
+			if !slices.Contains(allowed, pp.visibility(mac)) {
+				err := fmt.Errorf("entity %s not found", mac)
+				render.Render(w, r, s.httpErrNotFound(err))
+				return
+			}
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+func (s *LocApiServer) apiEntityGetPrivacy(w http.ResponseWriter, r *http.Request) {
+	mac := getCtxValueString(r.Context(), "mac")
+	p := models.EntityPrivacy{Mac: mac, Visibility: models.PrivacyVisible}
+	ret := s.dbConn.WithContext(r.Context()).Where("mac = ?", mac).Limit(1).Find(&p)
+	if ret.Error != nil {
+		log.Printf("apiEntityGetPrivacy: Failed to query DB (%v)", ret.Error)
+		err := fmt.Errorf("failed to get data from backend")
+		render.Render(w, r, s.httpErrUnexpected(err))
+		return
+	}
+
+	render.Render(w, r, newEntityPrivacyExtView(p))
+	return
+}
+
+// apiEntityPutPrivacy stores the privacy settings of an entity, which need not have been seen yet
+func (s *LocApiServer) apiEntityPutPrivacy(w http.ResponseWriter, r *http.Request) {
+	mac := getCtxValueString(r.Context(), "mac")
+	data := &EntityPrivacyRequest{}
+	r.Body = http.MaxBytesReader(w, r.Body, defaultWebhookMaxBodySize)
+	err := render.Bind(r, data)
+	if err != nil {
+		render.Render(w, r, s.httpErrInvalidRequest(err))
+		return
+	}
+
+	p := models.EntityPrivacy{
+		Mac:        mac,
+		Visibility: data.Visibility,
+		Days:       data.Days,
+		From:       data.From,
+		To:         data.To,
+		Timezone:   data.Timezone,
+	}
+	ret := s.dbConn.WithContext(r.Context()).Save(&p)
+	if ret.Error != nil {
+		log.Printf("apiEntityPutPrivacy: Failed to store privacy settings (%v)", ret.Error)
+		err := fmt.Errorf("failed to store data to backend")
+		render.Render(w, r, s.httpErrUnexpected(err))
+		return
+	}
+
+	log.Printf("apiEntityPutPrivacy: Set visibility of %s to %s", mac, p.Visibility)
+	render.Render(w, r, newEntityPrivacyExtView(p))
+	return
+}
+
+// apiEntityDeletePrivacy makes an entity visible again
+func (s *LocApiServer) apiEntityDeletePrivacy(w http.ResponseWriter, r *http.Request) {
+	mac := getCtxValueString(r.Context(), "mac")
+	ret := s.dbConn.WithContext(r.Context()).Delete(&models.EntityPrivacy{}, "mac = ?", mac)
+	if ret.Error != nil {
+		log.Printf("apiEntityDeletePrivacy: Failed to delete privacy settings (%v)", ret.Error)
+		err := fmt.Errorf("failed to store data to backend")
+		render.Render(w, r, s.httpErrUnexpected(err))
+		return
+	}
+
+	log.Printf("apiEntityDeletePrivacy: Cleared privacy settings of %s", mac)
+	w.WriteHeader(http.StatusNoContent)
+	return
+}
@@ -0,0 +1,188 @@
+package locapiserver
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"mist-location-visualization/internal/mistfake"
+	"mist-location-visualization/internal/models"
+)
+
+func TestEntityPrivacy(t *testing.T) {
+	adminSum := sha256.Sum256([]byte("adminkey"))
+	readSum := sha256.Sum256([]byte("readkey"))
+	e := newTestEnv(t, func(cfg *Config) {
+		cfg.Http.ApiKeys = []ApiKeyConfig{
+			{Name: "admin", KeySha256: hex.EncodeToString(adminSum[:]), Scopes: []string{scopeAdmin}},
+			{Name: "kiosk", KeySha256: hex.EncodeToString(readSum[:])},
+		}
+	})
+
+	for _, ev := range []mistfake.LocationAssetEvent{
+		{Mac: macTaro, SiteId: mistfake.SiteId, MapId: mistfake.MapId11F, X: 10, Y: 20, Timestamp: testTimestamp},
+		{Mac: macForklift, SiteId: mistfake.SiteId, MapId: mistfake.MapId11F, X: 30, Y: 40, Timestamp: testTimestamp},
+	} {
+		err := e.webhook.PostLocationAsset(ev)
+		if err != nil {
+			t.Fatalf("location-asset webhook: %v", err)
+		}
+	}
+
+	entities := func() map[string]EntityExtView {
+		status, body := e.send(t, http.MethodGet, "/entity", "readkey", nil)
+		if status != http.StatusOK {
+			t.Fatalf("GET /entity: status %d (%s)", status, body)
+		}
+		list := []EntityExtView{}
+		json.Unmarshal(body, &list)
+		o := make(map[string]EntityExtView)
+		for _, v := range list {
+			o[v.Id] = v
+		}
+		return o
+	}
+
+	// only admins manage privacy settings
+	status, _ := e.send(t, http.MethodPut, "/entity/"+macTaro+"/privacy", "readkey", EntityPrivacyRequest{Visibility: models.PrivacyHidden})
+	if status != http.StatusForbidden {
+		t.Errorf("PUT /entity/{mac}/privacy with read scope: status %d; want %d", status, http.StatusForbidden)
+	}
+	status, _ = e.send(t, http.MethodPut, "/entity/"+macTaro+"/privacy", "adminkey", EntityPrivacyRequest{Visibility: "secret"})
+	if status != http.StatusBadRequest {
+		t.Errorf("PUT /entity/{mac}/privacy with invalid visibility: status %d; want %d", status, http.StatusBadRequest)
+	}
+	status, _ = e.send(t, http.MethodPut, "/entity/"+macTaro+"/privacy", "adminkey", EntityPrivacyRequest{Visibility: models.PrivacyVisible, Days: []string{"mon"}})
+	if status != http.StatusBadRequest {
+		t.Errorf("PUT /entity/{mac}/privacy with days only: status %d; want %d", status, http.StatusBadRequest)
+	}
+
+	// hidden
+	status, body := e.send(t, http.MethodPut, "/entity/"+macTaro+"/privacy", "adminkey", EntityPrivacyRequest{Visibility: models.PrivacyHidden})
+	if status != http.StatusOK {
+		t.Fatalf("PUT /entity/{mac}/privacy: status %d (%s)", status, body)
+	}
+	if _, ok := entities()[macTaro]; ok {
+		t.Errorf("GET /entity: hidden entity listed")
+	}
+	for _, uri := range []string{"/entity/" + macTaro, "/entity/" + macTaro + "/visits", "/entity/" + macTaro + "/contacts"} {
+		status, _ = e.send(t, http.MethodGet, uri, "readkey", nil)
+		if status != http.StatusNotFound {
+			t.Errorf("GET %s of hidden entity: status %d; want %d", uri, status, http.StatusNotFound)
+		}
+	}
+
+	// anonymous
+	e.send(t, http.MethodPut, "/entity/"+macTaro+"/privacy", "adminkey", EntityPrivacyRequest{Visibility: models.PrivacyAnonymous})
+	anon := e.server.pseudonym(macTaro)
+	v, ok := entities()[anon]
+	if !ok || v.DisplayName != "" || v.DisplayOrg != "" || v.X != 150 {
+		t.Errorf("GET /entity: anonymous entity %+v", v)
+	}
+	status, _ = e.send(t, http.MethodGet, "/entity/"+macTaro, "readkey", nil)
+	if status != http.StatusNotFound {
+		t.Errorf("GET /entity/{mac} of anonymous entity: status %d; want %d", status, http.StatusNotFound)
+	}
+
+	// zone level only
+	e.send(t, http.MethodPut, "/entity/"+macTaro+"/privacy", "adminkey", EntityPrivacyRequest{Visibility: models.PrivacyZoneOnly})
+	status, body = e.send(t, http.MethodGet, "/entity/"+macTaro, "readkey", nil)
+	v = EntityExtView{}
+	json.Unmarshal(body, &v)
+	if status != http.StatusOK || v.Id != macTaro || v.MapId != mistfake.MapId11F || v.X != -1 || v.Y != -1 || v.RawX != -1 {
+		t.Errorf("GET /entity/{mac} of zone level entity: status %d (%s)", status, body)
+	}
+
+	status, body = e.send(t, http.MethodGet, "/entity/"+macTaro+"/privacy", "adminkey", nil)
+	if status != http.StatusOK || !strings.Contains(string(body), `"visibility":"zone"`) {
+		t.Errorf("GET /entity/{mac}/privacy: status %d (%s)", status, body)
+	}
+
+	status, _ = e.send(t, http.MethodDelete, "/entity/"+macTaro+"/privacy", "adminkey", nil)
+	if status != http.StatusNoContent {
+		t.Errorf("DELETE /entity/{mac}/privacy: status %d; want %d", status, http.StatusNoContent)
+	}
+	if v := entities()[macTaro]; v.X != 150 {
+		t.Errorf("GET /entity after DELETE /entity/{mac}/privacy: %+v", v)
+	}
+}
+
+func TestEntityPrivacyPseudonymize(t *testing.T) {
+	adminSum := sha256.Sum256([]byte("adminkey"))
+	e := newTestEnv(t, func(cfg *Config) {
+		cfg.Privacy.Pseudonymize = true
+		cfg.Privacy.Salt = "pepper"
+		cfg.Privacy.ExemptAdmin = true
+		cfg.Http.ApiKeys = []ApiKeyConfig{
+			{Name: "admin", KeySha256: hex.EncodeToString(adminSum[:]), Scopes: []string{scopeAdmin}},
+		}
+		cfg.Http.Anonymous = true
+	})
+
+	err := e.webhook.PostLocationAsset(
+		mistfake.LocationAssetEvent{Mac: macTaro, SiteId: mistfake.SiteId, MapId: mistfake.MapId11F, X: 10, Y: 20, Timestamp: testTimestamp},
+	)
+	if err != nil {
+		t.Fatalf("location-asset webhook: %v", err)
+	}
+
+	// the salt makes pseudonyms stable across restarts
+	other, err := newPrivacyKey(*e.server.config())
+	if err != nil || string(other) != string(e.server.privacyKey) {
+		t.Errorf("newPrivacyKey: %q, %v", other, err)
+	}
+
+	status, body := e.get(t, "/entity/"+macTaro)
+	v := EntityExtView{}
+	json.Unmarshal(body, &v)
+	if status != http.StatusOK || v.Id != macTaro || v.DisplayName != e.server.pseudonym(macTaro) {
+		t.Errorf("GET /entity/{mac}: status %d (%s)", status, body)
+	}
+
+	status, body = e.send(t, http.MethodGet, "/entity/"+macTaro, "adminkey", nil)
+	v = EntityExtView{}
+	json.Unmarshal(body, &v)
+	if status != http.StatusOK || strings.HasPrefix(v.DisplayName, "anon-") {
+		t.Errorf("GET /entity/{mac} as exempt admin: status %d (%s)", status, body)
+	}
+
+	cfg := Config{}
+	cfg.Privacy.Pseudonymize = true
+	_, err = newPrivacyKey(cfg)
+	if err == nil {
+		t.Errorf("newPrivacyKey without salt: no error")
+	}
+}
+
+func TestEntityPrivacySchedule(t *testing.T) {
+	ep, err := compileEntityPrivacy(models.EntityPrivacy{
+		Visibility: models.PrivacyZoneOnly,
+		Days:       []string{"mon", "tue", "wed", "thu", "fri"},
+		From:       "08:00",
+		To:         "18:00",
+		Timezone:   "Asia/Tokyo",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tokyo, _ := time.LoadLocation("Asia/Tokyo")
+	for _, c := range []struct {
+		t    time.Time
+		want string
+	}{
+		{time.Date(2024, 6, 11, 9, 0, 0, 0, tokyo), models.PrivacyZoneOnly},
+		{time.Date(2024, 6, 11, 19, 0, 0, 0, tokyo), models.PrivacyHidden},
+		{time.Date(2024, 6, 15, 9, 0, 0, 0, tokyo), models.PrivacyHidden},
+		{time.Date(2024, 6, 11, 0, 30, 0, 0, time.UTC), models.PrivacyZoneOnly}, // 09:30 in Tokyo
+	} {
+		got := ep.visibilityAt(c.t)
+		if got != c.want {
+			t.Errorf("visibilityAt(%v) = %s; want %s", c.t, got, c.want)
+		}
+	}
+}
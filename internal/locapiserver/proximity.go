@@ -0,0 +1,321 @@
+package locapiserver
+
+import (
+	"context"
+	"encoding/csv"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"mist-location-visualization/internal/models"
+
+	"github.com/go-chi/render"
+)
+
+const (
+	defaultProximityDistance = 2.0
+	defaultProximityMaxGap   = 60
+)
+
+// ContactExtView represents a proximity episode with another entity for API responses.
+// Ongoing is true while the episode has not been closed.
+type ContactExtView struct {
+	Mac         string  `json:"mac"`
+	Name        string  `json:"name"`
+	MapId       string  `json:"map_id"`
+	StartAt     int64   `json:"start_at"`
+	EndAt       int64   `json:"end_at"`
+	Duration    float64 `json:"duration"`
+	MinDistance float64 `json:"min_distance"`
+	Ongoing     bool    `json:"ongoing"`
+}
+
+func (e *ContactExtView) Render(w http.ResponseWriter, r *http.Request) error {
+	return nil
+}
+
+func (s *LocApiServer) proximityDistance() float64 {
+	if s.config().Proximity.Distance <= 0 {
+		return defaultProximityDistance
+	}
+	return s.config().Proximity.Distance
+}
+
+func (s *LocApiServer) proximityMinDuration() time.Duration {
+	return time.Duration(max(s.config().Proximity.MinDuration, 0)) * time.Second
+}
+
+func (s *LocApiServer) proximityMaxGap() time.Duration {
+	if s.config().Proximity.MaxGap <= 0 {
+		return defaultProximityMaxGap * time.Second
+	}
+	return time.Duration(s.config().Proximity.MaxGap) * time.Second
+}
+
+// contactPair orders two macs the way contacts store them
+func contactPair(mac string, other string) (string, string) {
+	if other < mac {
+		return other, mac
+	}
+	return mac, other
+}
+
+func contactPartner(c *models.Contact, mac string) string {
+	if c.MacA == mac {
+		return c.MacB
+	}
+	return c.MacA
+}
+
+// updateContacts extends, opens and closes the contacts of mac for its position (in metres)
+// on m at ts. Other entities count while their last position is within the maximum gap of ts.
+func (s *LocApiServer) updateContacts(ctx context.Context, mac string, m *models.Map, x float64, y float64, ts float64) {
+	if !s.config().Proximity.Enabled || m.Ppm <= 0 {
+		return
+	}
+
+	t := eventTime(ts)
+	maxGap := s.proximityMaxGap()
+	gap := maxGap.Seconds()
+
+	others := make([]models.Entity, 0)
+	ret := s.dbConn.WithContext(ctx).
+		Where("map_id = ? AND mac <> ? AND lastseen >= ? AND lastseen <= ? AND x >= 0", m.Id, mac, ts-gap, ts+gap).
+		Find(&others)
+	if ret.Error != nil {
+		log.Printf("updateContacts: Failed to query DB (%v)", ret.Error)
+		return
+	}
+
+	near := make(map[string]float64)
+	for _, o := range others {
+		d := math.Hypot(x-o.X/m.Ppm, y-o.Y/m.Ppm)
+		if d <= s.proximityDistance() {
+			near[o.Mac] = d
+		}
+	}
+
+	open := make([]models.Contact, 0)
+	ret = s.dbConn.WithContext(ctx).Where("(mac_a = ? OR mac_b = ?) AND closed = ?", mac, mac, false).Find(&open)
+	if ret.Error != nil {
+		log.Printf("updateContacts: Failed to query DB on contacts (%v)", ret.Error)
+		return
+	}
+
+	openIdx := make(map[string]*models.Contact)
+	for i := range open {
+		openIdx[contactPartner(&open[i], mac)] = &open[i]
+	}
+
+	for other, d := range near {
+		c, found := openIdx[other]
+		delete(openIdx, other)
+
+		if found && c.MapId == m.Id && t.Sub(c.LastAt) <= maxGap {
+			if t.After(c.LastAt) {
+				c.LastAt = t
+			}
+			c.MinDistance = min(c.MinDistance, d)
+			ret := s.dbConn.WithContext(ctx).Save(c)
+			if ret.Error != nil {
+				log.Printf("updateContacts: Failed to store contact (%v)", ret.Error)
+			}
+			continue
+		}
+
+		// apart for too long, this is a new episode
+		if found {
+			s.closeContact(ctx, c)
+		}
+
+		macA, macB := contactPair(mac, other)
+		c = &models.Contact{
+			MacA:        macA,
+			MacB:        macB,
+			MapId:       m.Id,
+			StartAt:     t,
+			LastAt:      t,
+			MinDistance: d,
+		}
+		ret := s.dbConn.WithContext(ctx).Create(c)
+		if ret.Error != nil {
+			log.Printf("updateContacts: Failed to store contact (%v)", ret.Error)
+		}
+	}
+
+	// everyone else is out of range now
+	for _, c := range openIdx {
+		s.closeContact(ctx, c)
+	}
+
+	return
+}
+
+// closeContacts ends the open contacts of mac, e.g. when its position timed out
+func (s *LocApiServer) closeContacts(ctx context.Context, mac string) {
+	open := make([]models.Contact, 0)
+	ret := s.dbConn.WithContext(ctx).Where("(mac_a = ? OR mac_b = ?) AND closed = ?", mac, mac, false).Find(&open)
+	if ret.Error != nil {
+		log.Printf("closeContacts: Failed to query DB (%v)", ret.Error)
+		return
+	}
+
+	for i := range open {
+		s.closeContact(ctx, &open[i])
+	}
+
+	return
+}
+
+// closeContact ends a contact at its last time together.
+// Episodes shorter than the minimum duration are dropped.
+func (s *LocApiServer) closeContact(ctx context.Context, c *models.Contact) {
+	if c.LastAt.Sub(c.StartAt) < s.proximityMinDuration() {
+		ret := s.dbConn.WithContext(ctx).Delete(&models.Contact{}, "id = ?", c.Id)
+		if ret.Error != nil {
+			log.Printf("closeContact: Failed to drop contact (%v)", ret.Error)
+		}
+		return
+	}
+
+	c.Closed = true
+	ret := s.dbConn.WithContext(ctx).Save(c)
+	if ret.Error != nil {
+		log.Printf("closeContact: Failed to store contact (%v)", ret.Error)
+	}
+
+	return
+}
+
+// apiEntityGetContacts reports the entities which stayed close to the entity in the request
+// context for at least the minimum duration within the optional from/to range.
+// format=csv returns the report as a CSV file.
+func (s *LocApiServer) apiEntityGetContacts(w http.ResponseWriter, r *http.Request) {
+	mac := getCtxValueString(r.Context(), "mac")
+	from, to, err := getTimeRange(r)
+	if err != nil {
+		render.Render(w, r, s.httpErrInvalidRequest(err))
+		return
+	}
+
+	format := r.URL.Query().Get("format")
+	if format != "" && format != "json" && format != "csv" {
+		err := fmt.Errorf("invalid format %s", format)
+		render.Render(w, r, s.httpErrInvalidRequest(err))
+		return
+	}
+
+	q := restrictMaps(r.Context(), s.dbConn.WithContext(r.Context()), "map_id").
+		Where("(mac_a = ? OR mac_b = ?)", mac, mac)
+	if !from.IsZero() {
+		q = q.Where("last_at >= ?", from)
+	}
+	if !to.IsZero() {
+		q = q.Where("start_at < ?", to)
+	}
+
+	contacts := make([]models.Contact, 0)
+	ret := q.Order("start_at").Find(&contacts)
+	if ret.Error != nil {
+		log.Printf("apiEntityGetContacts: Failed to query DB (%v)", ret.Error)
+		err := fmt.Errorf("failed to get data from backend")
+		render.Render(w, r, s.httpErrUnexpected(err))
+		return
+	}
+
+	partners := make([]string, 0, len(contacts))
+	for i := range contacts {
+		partners = append(partners, contactPartner(&contacts[i], mac))
+	}
+	entities := make([]models.Entity, 0)
+	ret = s.dbConn.WithContext(r.Context()).Where("mac IN ?", partners).Find(&entities)
+	if ret.Error != nil {
+		log.Printf("apiEntityGetContacts: Failed to query DB on entities (%v)", ret.Error)
+		err := fmt.Errorf("failed to get data from backend")
+		render.Render(w, r, s.httpErrUnexpected(err))
+		return
+	}
+	pp, err := s.loadPrivacy(r.Context())
+	if err != nil {
+		log.Printf("apiEntityGetContacts: Failed to query DB on privacy settings (%v)", err)
+		err := fmt.Errorf("failed to get data from backend")
+		render.Render(w, r, s.httpErrUnexpected(err))
+		return
+	}
+
+	names := make(map[string]string)
+	tenants := make(map[string]bool)
+	for _, e := range entities {
+		names[e.Mac] = e.Name
+		if e.DisplayName != "" {
+			names[e.Mac] = e.DisplayName
+		}
+		tenants[e.Mac] = getPrincipal(r.Context()).allowsTenant(e.DisplayOrg)
+	}
+
+	views := make([]*ContactExtView, 0)
+	for i, c := range contacts {
+		duration := c.LastAt.Sub(c.StartAt)
+		if duration < s.proximityMinDuration() {
+			// still open and too short so far
+			continue
+		}
+
+		// hidden entities and those of other tenants are left out, anonymous ones shown by their pseudonym
+		partner, ok := pp.mac(partners[i])
+		if !ok || !tenants[partners[i]] {
+			continue
+		}
+		name := pp.name(partners[i], names[partners[i]])
+		if partner != partners[i] {
+			name = ""
+		}
+
+		views = append(views, &ContactExtView{
+			Mac:         partner,
+			Name:        name,
+			MapId:       c.MapId,
+			StartAt:     c.StartAt.Unix(),
+			EndAt:       c.LastAt.Unix(),
+			Duration:    duration.Seconds(),
+			MinDistance: math.Round(c.MinDistance*100) / 100,
+			Ongoing:     !c.Closed,
+		})
+	}
+
+	if format == "csv" {
+		w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"contacts-%s.csv\"", mac))
+
+		cw := csv.NewWriter(w)
+		cw.Write([]string{"mac", "name", "map_id", "start_at", "end_at", "duration", "min_distance", "ongoing"})
+		for _, v := range views {
+			cw.Write([]string{
+				v.Mac,
+				v.Name,
+				v.MapId,
+				time.Unix(v.StartAt, 0).UTC().Format(time.RFC3339),
+				time.Unix(v.EndAt, 0).UTC().Format(time.RFC3339),
+				strconv.FormatFloat(v.Duration, 'f', -1, 64),
+				strconv.FormatFloat(v.MinDistance, 'f', -1, 64),
+				strconv.FormatBool(v.Ongoing),
+			})
+		}
+		cw.Flush()
+		if err := cw.Error(); err != nil {
+			log.Printf("apiEntityGetContacts: Failed to write CSV (%v)", err)
+		}
+		return
+	}
+
+	outs := []render.Renderer{}
+	for _, v := range views {
+		outs = append(outs, v)
+	}
+
+	render.RenderList(w, r, outs)
+	return
+}
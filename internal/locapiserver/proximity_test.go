@@ -0,0 +1,87 @@
+package locapiserver
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+
+	"mist-location-visualization/internal/mistfake"
+)
+
+func TestProximityContacts(t *testing.T) {
+	const macVisitor = "c0ffee000002"
+
+	e := newTestEnv(t, func(cfg *Config) {
+		cfg.Proximity.Enabled = true
+		cfg.Proximity.Distance = 2
+		cfg.Proximity.MinDuration = 300
+		cfg.Proximity.MaxGap = 60
+	})
+
+	// taro and the forklift stay a metre apart for six minutes, the visitor passes by briefly
+	events := make([]mistfake.LocationAssetEvent, 0)
+	for i := 0; i <= 12; i++ {
+		ts := float64(testTimestamp + i*30)
+		events = append(events,
+			mistfake.LocationAssetEvent{Mac: macTaro, SiteId: mistfake.SiteId, MapId: mistfake.MapId11F, X: 10, Y: 20, Timestamp: ts},
+			mistfake.LocationAssetEvent{Mac: macForklift, SiteId: mistfake.SiteId, MapId: mistfake.MapId11F, X: 11, Y: 20, Timestamp: ts + 1},
+		)
+		if i == 3 || i == 4 {
+			events = append(events, mistfake.LocationAssetEvent{Mac: macVisitor, SiteId: mistfake.SiteId, MapId: mistfake.MapId11F, X: 10, Y: 21.5, Timestamp: ts + 2})
+		}
+	}
+	events = append(events,
+		mistfake.LocationAssetEvent{Mac: macForklift, SiteId: mistfake.SiteId, MapId: mistfake.MapId11F, X: 40, Y: 40, Timestamp: testTimestamp + 400},
+		mistfake.LocationAssetEvent{Mac: macVisitor, SiteId: mistfake.SiteId, MapId: mistfake.MapId11F, X: 40, Y: 5, Timestamp: testTimestamp + 401},
+	)
+	for _, ev := range events {
+		err := e.webhook.PostLocationAsset(ev)
+		if err != nil {
+			t.Fatalf("location-asset webhook: %v", err)
+		}
+	}
+
+	status, body := e.get(t, "/entity/"+macTaro+"/contacts")
+	contacts := []ContactExtView{}
+	json.Unmarshal(body, &contacts)
+	if status != http.StatusOK || len(contacts) != 1 {
+		t.Fatalf("GET /entity/{mac}/contacts: status %d (%s)", status, body)
+	}
+	c := contacts[0]
+	if c.Mac != macForklift || c.StartAt != testTimestamp+1 || c.EndAt != testTimestamp+361 || c.Duration != 360 || c.MinDistance != 1 || c.Ongoing {
+		t.Errorf("contact of taro: %+v", c)
+	}
+
+	// the report of the forklift shows the same episode from its side
+	status, body = e.get(t, "/entity/"+macForklift+"/contacts")
+	contacts = []ContactExtView{}
+	json.Unmarshal(body, &contacts)
+	if status != http.StatusOK || len(contacts) != 1 || contacts[0].Mac != macTaro {
+		t.Errorf("GET /entity/{forklift}/contacts: status %d (%s)", status, body)
+	}
+
+	status, body = e.get(t, "/entity/"+macVisitor+"/contacts")
+	if status != http.StatusOK || strings.TrimSpace(string(body)) != "[]" {
+		t.Errorf("GET /entity/{visitor}/contacts: status %d (%s)", status, body)
+	}
+
+	status, body = e.get(t, "/entity/"+macTaro+"/contacts?from=1718090000")
+	if status != http.StatusOK || strings.TrimSpace(string(body)) != "[]" {
+		t.Errorf("GET /entity/{mac}/contacts?from=: status %d (%s)", status, body)
+	}
+
+	status, body = e.get(t, "/entity/"+macTaro+"/contacts?format=csv")
+	lines := strings.Split(strings.TrimSpace(string(body)), "\n")
+	if status != http.StatusOK || len(lines) != 2 ||
+		lines[0] != "mac,name,map_id,start_at,end_at,duration,min_distance,ongoing" ||
+		!strings.HasPrefix(lines[1], macForklift+",") ||
+		!strings.HasSuffix(lines[1], ","+mistfake.MapId11F+",2024-06-11T04:26:41Z,2024-06-11T04:32:41Z,360,1,false") {
+		t.Errorf("GET /entity/{mac}/contacts?format=csv: status %d (%s)", status, body)
+	}
+
+	status, _ = e.get(t, "/entity/"+macTaro+"/contacts?format=xml")
+	if status != http.StatusBadRequest {
+		t.Errorf("GET /entity/{mac}/contacts?format=xml: status %d; want %d", status, http.StatusBadRequest)
+	}
+}
@@ -0,0 +1,138 @@
+package locapiserver
+
+import (
+	"log"
+	"reflect"
+	"time"
+
+	"mist-location-visualization/internal/configdiff"
+)
+
+// restartOnly are the configuration sections which are read once at startup.
+// Changes to them are logged on reload but take effect after a restart.
+var restartOnly = []string{
+	"db",
+	"http.listen",
+	"http.tls",
+	"http.debug",
+	"occupancy",
+	"filter",
+	"privacy",
+	"rules",
+	"retention",
+	"archive",
+}
+
+// SetConfigLoader sets the function ReloadConfig uses to read the configuration again
+func (s *LocApiServer) SetConfigLoader(load func() (Config, error)) {
+	s.reloadMu.Lock()
+	defer s.reloadMu.Unlock()
+
+	s.loader = load
+}
+
+// ReloadConfig reads the configuration with the loader and applies it
+func (s *LocApiServer) ReloadConfig() error {
+	s.reloadMu.Lock()
+	load := s.loader
+	s.reloadMu.Unlock()
+
+	if load == nil {
+		log.Printf("ReloadConfig: No configuration loader, ignoring reload")
+		return nil
+	}
+
+	cfg, err := load()
+	if err != nil {
+		log.Printf("ReloadConfig: Failed to read configuration (%v)", err)
+		return err
+	}
+
+	return s.Reload(cfg)
+}
+
+// Reload validates cfg and applies it to the running server. Users, API keys, OIDC,
+// webhook secrets and limits, timeouts and the remaining live settings change in place,
+// while the sections in restartOnly keep their current values. The configuration in
+// use is left untouched if cfg is invalid.
+func (s *LocApiServer) Reload(cfg Config) error {
+	s.reloadMu.Lock()
+	defer s.reloadMu.Unlock()
+
+	old := s.config()
+
+	err := validateOutOfOrder(cfg.Webhook.OutOfOrder)
+	if err != nil {
+		log.Printf("Reload: Invalid configuration (%v)", err)
+		return err
+	}
+
+	// keep the OIDC verifier and its cached keys unless its settings changed
+	var auth *apiAuth
+	if reflect.DeepEqual(cfg.Http.Oidc, old.Http.Oidc) {
+		oidc := cfg.Http.Oidc
+		cfg.Http.Oidc = OidcConfig{}
+		auth, err = newApiAuth(cfg)
+		cfg.Http.Oidc = oidc
+		if err == nil {
+			auth.oidc = s.auth.Load().oidc
+		}
+	} else {
+		auth, err = newApiAuth(cfg)
+	}
+	if err != nil {
+		log.Printf("Reload: Invalid configuration (%v)", err)
+		return err
+	}
+
+	changes := configdiff.Diff(*old, cfg)
+	if len(changes) == 0 {
+		log.Printf("Reload: Configuration unchanged")
+		return nil
+	}
+
+	next := cfg
+	next.Db = old.Db
+	next.Http.Listen = old.Http.Listen
+	next.Http.Tls = old.Http.Tls
+	next.Http.Debug = old.Http.Debug
+	next.Occupancy = old.Occupancy
+	next.Filter = old.Filter
+	next.Privacy = old.Privacy
+	next.Rules = old.Rules
+	next.Retention = old.Retention
+	next.Archive = old.Archive
+
+	if next.Webhook.DedupeWindow != old.Webhook.DedupeWindow {
+		if next.Webhook.DedupeWindow > 0 {
+			s.dedupe.Store(newEventDeduper(time.Duration(next.Webhook.DedupeWindow) * time.Second))
+		} else {
+			s.dedupe.Store(nil)
+		}
+	}
+
+	s.cfg.Store(&next)
+	s.auth.Store(auth)
+
+	for _, c := range changes {
+		if requiresRestart(c) {
+			log.Printf("Reload: %s changed, requires a restart", c.Path)
+		} else {
+			log.Printf("Reload: %s", c)
+		}
+	}
+	if len(s.webhookSecrets()) == 0 {
+		log.Printf("Reload: Warning: mist.secret is not set, webhooks are accepted without authentication")
+	}
+
+	return nil
+}
+
+func requiresRestart(c configdiff.Change) bool {
+	for _, v := range restartOnly {
+		if c.Under(v) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,66 @@
+package locapiserver
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"testing"
+
+	"mist-location-visualization/internal/mistfake"
+)
+
+func TestReload(t *testing.T) {
+	oldSum := sha256.Sum256([]byte("oldkey"))
+	newSum := sha256.Sum256([]byte("newkey"))
+	e := newTestEnv(t, func(cfg *Config) {
+		cfg.Http.ApiKeys = []ApiKeyConfig{{Name: "old", KeySha256: hex.EncodeToString(oldSum[:])}}
+		cfg.Webhook.DedupeWindow = 600
+	})
+
+	cfg := *e.server.config()
+	cfg.Http.ApiKeys = []ApiKeyConfig{{Name: "new", KeySha256: hex.EncodeToString(newSum[:])}}
+	cfg.Mist.Secret = "rotated"
+	cfg.Webhook.DedupeWindow = 0
+	cfg.Db.Sqlite.Path = "elsewhere.db"
+
+	// invalid configurations are rejected as a whole
+	bad := cfg
+	bad.Webhook.OutOfOrder = "reorder"
+	if err := e.server.Reload(bad); err == nil {
+		t.Errorf("Reload with invalid webhook.out_of_order succeeded")
+	}
+	if status, _ := e.send(t, http.MethodGet, "/entity", "oldkey", nil); status != http.StatusOK {
+		t.Errorf("GET /entity with old key after failed reload: status %d; want %d", status, http.StatusOK)
+	}
+
+	err := e.server.Reload(cfg)
+	if err != nil {
+		t.Fatalf("Reload: %v", err)
+	}
+
+	for _, c := range []struct {
+		key    string
+		status int
+	}{
+		{"oldkey", http.StatusUnauthorized},
+		{"newkey", http.StatusOK},
+	} {
+		status, body := e.send(t, http.MethodGet, "/entity", c.key, nil)
+		if status != c.status {
+			t.Errorf("GET /entity with %s after reload: status %d; want %d (%s)", c.key, status, c.status, body)
+		}
+	}
+
+	// webhooks signed with the old secret are refused
+	err = e.webhook.PostLocationAsset(mistfake.LocationAssetEvent{Mac: macTaro, SiteId: mistfake.SiteId, MapId: mistfake.MapId11F, X: 10, Y: 20, Timestamp: testTimestamp})
+	if err == nil {
+		t.Errorf("webhook with the old secret accepted after reload")
+	}
+
+	if e.server.dedupe.Load() != nil {
+		t.Errorf("deduper kept after webhook.dedupe_window was set to 0")
+	}
+	if e.server.config().Db.Sqlite.Path == "elsewhere.db" {
+		t.Errorf("db.sqlite.path applied without a restart")
+	}
+}
@@ -0,0 +1,139 @@
+package locapiserver
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// ReplayOptions controls how archived webhooks are sent again
+type ReplayOptions struct {
+	Target string  // URL of the receiving /mistrecv endpoint
+	Speed  float64 // 1 keeps the original pace, 0 sends as fast as possible
+	Secret string  // when set, bodies are signed again with this secret
+}
+
+// headers which belong to the original connection and must not be replayed
+var replaySkipHeaders = map[string]bool{
+	"content-length":    true,
+	"host":              true,
+	"connection":        true,
+	"accept-encoding":   true,
+	"transfer-encoding": true,
+}
+
+func readWebhookArchive(path string, fn func(rec *WebhookRecord) error) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	sc := bufio.NewScanner(f)
+	sc.Buffer(make([]byte, 64*1024), 64*1024*1024)
+	line := 0
+	for sc.Scan() {
+		line++
+		if len(bytes.TrimSpace(sc.Bytes())) == 0 {
+			continue
+		}
+
+		rec := &WebhookRecord{}
+		err := json.Unmarshal(sc.Bytes(), rec)
+		if err != nil {
+			return fmt.Errorf("%s:%d: %w", path, line, err)
+		}
+
+		err = fn(rec)
+		if err != nil {
+			return err
+		}
+	}
+
+	return sc.Err()
+}
+
+func replayWebhook(client *http.Client, rec *WebhookRecord, opts ReplayOptions) error {
+	body := []byte(rec.Body)
+	req, err := http.NewRequest(http.MethodPost, opts.Target, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+
+	for k, v := range rec.Headers {
+		if !replaySkipHeaders[strings.ToLower(k)] {
+			req.Header.Set(k, v)
+		}
+	}
+
+	if opts.Secret != "" {
+		req.Header.Set("X-Mist-Signature-v2", signWebhookBody(opts.Secret, body))
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("invalid status code %d", resp.StatusCode)
+	}
+
+	return nil
+}
+
+// Replay sends archived webhooks from files to a locapid instance in their original order
+func Replay(files []string, opts ReplayOptions) error {
+	if opts.Target == "" {
+		return fmt.Errorf("missing replay target")
+	} else if opts.Speed < 0 {
+		return fmt.Errorf("invalid speed %v", opts.Speed)
+	}
+
+	client := &http.Client{Timeout: 30 * time.Second}
+	var first time.Time
+	var start time.Time
+	sent := 0
+	failed := 0
+
+	for _, path := range files {
+		err := readWebhookArchive(path, func(rec *WebhookRecord) error {
+			// keep the original spacing between webhooks, scaled by speed
+			if first.IsZero() {
+				first = rec.ReceivedAt
+				start = time.Now()
+			} else if opts.Speed > 0 {
+				due := time.Duration(float64(rec.ReceivedAt.Sub(first)) / opts.Speed)
+				wait := due - time.Since(start)
+				if wait > 0 {
+					time.Sleep(wait)
+				}
+			}
+
+			err := replayWebhook(client, rec, opts)
+			if err != nil {
+				log.Printf("Replay: webhook received at %s failed (%v)", rec.ReceivedAt.Format(time.RFC3339Nano), err)
+				failed++
+			} else {
+				sent++
+			}
+
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	log.Printf("Replay: sent %d webhooks (%d failed)", sent, failed)
+	return nil
+}
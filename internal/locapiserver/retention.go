@@ -0,0 +1,323 @@
+package locapiserver
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"mist-location-visualization/internal/models"
+
+	"github.com/go-chi/chi"
+	"github.com/go-chi/render"
+	"gorm.io/gorm"
+)
+
+const defaultRetentionInterval = 3600
+
+// retentionPolicy deletes rows of a table once column is older than days.
+// Lastseen of entities is a unix timestamp, the other columns are times.
+type retentionPolicy struct {
+	table  string
+	days   int
+	model  interface{}
+	where  string
+	column string
+}
+
+func (s *LocApiServer) retentionPolicies() []retentionPolicy {
+	return []retentionPolicy{
+		{"entities", s.config().Retention.Entities, &models.Entity{}, "", "lastseen"},
+		{"zone_visits", s.config().Retention.Visits, &models.ZoneVisit{}, "exit_at IS NOT NULL", "exit_at"},
+		{"floor_changes", s.config().Retention.FloorChanges, &models.FloorChange{}, "", "changed_at"},
+		{"position_samples", s.config().Retention.Positions, &models.PositionSample{}, "", "seen_at"},
+		{"occupancy_samples", s.config().Retention.Occupancy, &models.OccupancySample{}, "", "sampled_at"},
+		{"contacts", s.config().Retention.Contacts, &models.Contact{}, "closed = true", "last_at"},
+		{"alerts", s.config().Retention.Alerts, &models.Alert{}, "", "created_at"},
+		{"audit_records", s.config().Retention.Audit, &models.AuditRecord{}, "", "created_at"},
+	}
+}
+
+// retentionEnabled reports whether any data type has a retention period
+func (s *LocApiServer) retentionEnabled() bool {
+	for _, p := range s.retentionPolicies() {
+		if p.days > 0 {
+			return true
+		}
+	}
+	return s.archive != nil && s.config().Retention.Archive > 0
+}
+
+func (s *LocApiServer) runRetention(ctx context.Context, interval time.Duration) {
+	log.Printf("runRetention: Purging expired data every %s", interval)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		err := s.purgeExpired(ctx, time.Now())
+		if err != nil {
+			log.Printf("runRetention: Failed to purge expired data (%v)", err)
+		}
+
+		select {
+		case <-ctx.Done():
+			log.Printf("runRetention: Stopped")
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// purgeExpired deletes the rows older than the retention period of their data type at now
+func (s *LocApiServer) purgeExpired(ctx context.Context, now time.Time) error {
+	for _, p := range s.retentionPolicies() {
+		if p.days <= 0 {
+			continue
+		}
+
+		var cutoff interface{} = now.AddDate(0, 0, -p.days)
+		if p.column == "lastseen" {
+			cutoff = float64(now.AddDate(0, 0, -p.days).Unix())
+		}
+
+		q := s.dbConn.WithContext(ctx).Where(p.column+" < ?", cutoff)
+		if p.where != "" {
+			q = q.Where(p.where)
+		}
+		ret := q.Delete(p.model)
+		if ret.Error != nil {
+			return fmt.Errorf("%s: %w", p.table, ret.Error)
+		}
+
+		if ret.RowsAffected > 0 {
+			log.Printf("purgeExpired: Deleted %d rows from %s older than %d days", ret.RowsAffected, p.table, p.days)
+			s.metrics.retentionPurged.WithLabelValues(p.table).Add(float64(ret.RowsAffected))
+		}
+	}
+
+	// rotated webhook archives are removed as whole files
+	if days := s.config().Retention.Archive; s.archive != nil && days > 0 {
+		n, err := s.archive.purge(now.AddDate(0, 0, -days))
+		if err != nil {
+			return fmt.Errorf("webhook archive: %w", err)
+		}
+
+		if n > 0 {
+			log.Printf("purgeExpired: Deleted %d webhook archive files older than %d days", n, days)
+			s.metrics.retentionPurged.WithLabelValues("webhook_archive").Add(float64(n))
+		}
+	}
+
+	return nil
+}
+
+// EntityDeleteExtView reports the rows removed for an entity per table.
+// Excluded lists stores which may still hold the entity after a purge.
+type EntityDeleteExtView struct {
+	Mac      string           `json:"mac"`
+	Purge    bool             `json:"purge"`
+	Deleted  map[string]int64 `json:"deleted"`
+	Excluded []string         `json:"excluded,omitempty"`
+}
+
+func (e *EntityDeleteExtView) Render(w http.ResponseWriter, r *http.Request) error {
+	return nil
+}
+
+// purgeEntity removes mac from every table and in-memory state. The event deduper only
+// keeps hashes of events, which expire with its window. The raw webhook archive is not
+// scrubbed; its files expire with retention.archive.
+func (s *LocApiServer) purgeEntity(ctx context.Context, mac string) (map[string]int64, error) {
+	deleted := make(map[string]int64)
+	err := s.dbConn.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		for _, v := range []struct {
+			table string
+			model interface{}
+			where string
+			args  []interface{}
+		}{
+			{"entities", &models.Entity{}, "mac = ?", []interface{}{mac}},
+			{"zone_visits", &models.ZoneVisit{}, "mac = ?", []interface{}{mac}},
+			{"floor_changes", &models.FloorChange{}, "mac = ?", []interface{}{mac}},
+			{"position_samples", &models.PositionSample{}, "mac = ?", []interface{}{mac}},
+			{"contacts", &models.Contact{}, "mac_a = ? OR mac_b = ?", []interface{}{mac, mac}},
+			{"alerts", &models.Alert{}, "mac = ?", []interface{}{mac}},
+			{"entity_privacies", &models.EntityPrivacy{}, "mac = ?", []interface{}{mac}},
+		} {
+			ret := tx.Where(v.where, v.args...).Delete(v.model)
+			if ret.Error != nil {
+				return fmt.Errorf("%s: %w", v.table, ret.Error)
+			}
+			deleted[v.table] = ret.RowsAffected
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// open visits are gone, so checkDwellRules forgets them on its next run
+	s.filter.reset(mac)
+	if s.rules != nil {
+		s.rules.forget(mac)
+	}
+
+	return deleted, nil
+}
+
+// deleteEntity removes the current state of mac and keeps its history
+func (s *LocApiServer) deleteEntity(ctx context.Context, mac string) (map[string]int64, error) {
+	e := models.Entity{}
+	ret := s.dbConn.WithContext(ctx).Where("mac = ?", mac).Limit(1).Find(&e)
+	if ret.Error != nil {
+		return nil, ret.Error
+	}
+	if ret.RowsAffected > 0 {
+		s.closeZoneVisits(ctx, mac, "", eventTime(e.Lastseen))
+		s.closeContacts(ctx, mac)
+	}
+
+	ret = s.dbConn.WithContext(ctx).Delete(&models.Entity{}, "mac = ?", mac)
+	if ret.Error != nil {
+		return nil, ret.Error
+	}
+
+	s.filter.reset(mac)
+	return map[string]int64{"entities": ret.RowsAffected}, nil
+}
+
+// apiEntityDelete removes an entity. With purge=all every record of the entity is erased
+// (e.g. for a right to erasure request), otherwise only its current state. Each deletion
+// leaves an audit record.
+func (s *LocApiServer) apiEntityDelete(w http.ResponseWriter, r *http.Request) {
+	mac := getCtxValueString(r.Context(), "mac")
+	purge := r.URL.Query().Get("purge")
+	if purge != "" && purge != "all" {
+		err := fmt.Errorf("invalid purge %s", purge)
+		render.Render(w, r, s.httpErrInvalidRequest(err))
+		return
+	}
+
+	var deleted map[string]int64
+	var excluded []string
+	var err error
+	action := models.AuditDeleteEntity
+	if purge == "all" {
+		action = models.AuditPurgeEntity
+		deleted, err = s.purgeEntity(r.Context(), mac)
+		if dir := s.config().Archive.Dir; dir != "" && len(archiveFiles(dir)) > 0 {
+			excluded = append(excluded, "webhook_archive")
+		}
+	} else {
+		deleted, err = s.deleteEntity(r.Context(), mac)
+	}
+	if err != nil {
+		log.Printf("apiEntityDelete: Failed to delete entity (%v)", err)
+		err := fmt.Errorf("failed to store data to backend")
+		render.Render(w, r, s.httpErrUnexpected(err))
+		return
+	}
+
+	rec := &models.AuditRecord{
+		Action: action,
+		Target: mac,
+		Detail: formatDeleted(deleted),
+	}
+	if len(excluded) > 0 {
+		rec.Detail += " excluded=" + strings.Join(excluded, ",")
+	}
+	if p := getPrincipal(r.Context()); p != nil {
+		rec.Actor = p.Name
+	}
+	ret := s.dbConn.WithContext(r.Context()).Create(rec)
+	if ret.Error != nil {
+		// the data is gone already, so only the trail is missing
+		log.Printf("apiEntityDelete: Failed to store audit record (%v)", ret.Error)
+	}
+
+	log.Printf("apiEntityDelete: %s of %s by %s (%s)", action, mac, rec.Actor, rec.Detail)
+	render.Render(w, r, &EntityDeleteExtView{Mac: mac, Purge: purge == "all", Deleted: deleted, Excluded: excluded})
+	return
+}
+
+// formatDeleted lists the deleted rows per table in a stable order
+func formatDeleted(deleted map[string]int64) string {
+	parts := make([]string, 0, len(deleted))
+	for _, table := range []string{"entities", "zone_visits", "floor_changes", "position_samples", "contacts", "alerts", "entity_privacies"} {
+		if n, ok := deleted[table]; ok {
+			parts = append(parts, fmt.Sprintf("%s=%d", table, n))
+		}
+	}
+	return strings.Join(parts, " ")
+}
+
+// AuditRecordExtView represents the external view of an audit record for API responses
+type AuditRecordExtView struct {
+	Id        uint   `json:"id"`
+	Action    string `json:"action"`
+	Target    string `json:"target"`
+	Actor     string `json:"actor"`
+	Detail    string `json:"detail"`
+	CreatedAt int64  `json:"created_at"`
+}
+
+func (e *AuditRecordExtView) Render(w http.ResponseWriter, r *http.Request) error {
+	return nil
+}
+
+func (s *LocApiServer) apiAuditRouter() chi.Router {
+	r := chi.NewRouter()
+	r.Get("/", s.apiAuditGetAll)
+
+	return r
+}
+
+// apiAuditGetAll lists audit records newest first, optionally within from/to and by action or target
+func (s *LocApiServer) apiAuditGetAll(w http.ResponseWriter, r *http.Request) {
+	from, to, err := getTimeRange(r)
+	if err != nil {
+		render.Render(w, r, s.httpErrInvalidRequest(err))
+		return
+	}
+
+	q := s.dbConn.WithContext(r.Context())
+	if !from.IsZero() {
+		q = q.Where("created_at >= ?", from)
+	}
+	if !to.IsZero() {
+		q = q.Where("created_at < ?", to)
+	}
+	if action := r.URL.Query().Get("action"); action != "" {
+		q = q.Where("action = ?", action)
+	}
+	if target := r.URL.Query().Get("target"); target != "" {
+		q = q.Where("target = ?", target)
+	}
+
+	records := make([]models.AuditRecord, 0)
+	ret := q.Order("created_at DESC, id DESC").Find(&records)
+	if ret.Error != nil {
+		log.Printf("apiAuditGetAll: Failed to query DB (%v)", ret.Error)
+		err := fmt.Errorf("failed to get data from backend")
+		render.Render(w, r, s.httpErrUnexpected(err))
+		return
+	}
+
+	outs := []render.Renderer{}
+	for _, v := range records {
+		outs = append(outs, &AuditRecordExtView{
+			Id:        v.Id,
+			Action:    v.Action,
+			Target:    v.Target,
+			Actor:     v.Actor,
+			Detail:    v.Detail,
+			CreatedAt: v.CreatedAt.Unix(),
+		})
+	}
+
+	render.RenderList(w, r, outs)
+	return
+}
@@ -0,0 +1,212 @@
+package locapiserver
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"mist-location-visualization/internal/mistfake"
+	"mist-location-visualization/internal/models"
+)
+
+func countRows(t *testing.T, e *testEnv, model interface{}, where string, args ...interface{}) int64 {
+	t.Helper()
+
+	var n int64
+	ret := e.server.dbConn.Model(model).Where(where, args...).Count(&n)
+	if ret.Error != nil {
+		t.Fatal(ret.Error)
+	}
+	return n
+}
+
+func TestEntityPurge(t *testing.T) {
+	adminSum := sha256.Sum256([]byte("adminkey"))
+	readSum := sha256.Sum256([]byte("readkey"))
+	e := newTestEnv(t, func(cfg *Config) {
+		cfg.Http.ApiKeys = []ApiKeyConfig{
+			{Name: "admin", KeySha256: hex.EncodeToString(adminSum[:]), Scopes: []string{scopeAdmin}},
+			{Name: "kiosk", KeySha256: hex.EncodeToString(readSum[:])},
+		}
+		cfg.Proximity.Enabled = true
+		cfg.Archive.Enabled = true
+		cfg.Archive.Dir = t.TempDir()
+	})
+
+	// taro visits the booth next to the forklift, then goes upstairs
+	for i := 0; i <= 2; i++ {
+		ts := float64(testTimestamp + i*30)
+		for _, ev := range []mistfake.LocationAssetEvent{
+			{Mac: macTaro, SiteId: mistfake.SiteId, MapId: mistfake.MapId11F, X: 10, Y: 20, Timestamp: ts},
+			{Mac: macForklift, SiteId: mistfake.SiteId, MapId: mistfake.MapId11F, X: 11, Y: 20, Timestamp: ts + 1},
+		} {
+			err := e.webhook.PostLocationAsset(ev)
+			if err != nil {
+				t.Fatalf("location-asset webhook: %v", err)
+			}
+		}
+	}
+	err := e.webhook.PostZone(mistfake.ZoneEvent{Mac: macTaro, SiteId: mistfake.SiteId, MapId: mistfake.MapId11F, ZoneId: mistfake.ZoneBooth, Trigger: "enter", Timestamp: testTimestamp + 61})
+	if err != nil {
+		t.Fatalf("zone webhook: %v", err)
+	}
+	err = e.webhook.PostLocationAsset(mistfake.LocationAssetEvent{Mac: macTaro, SiteId: mistfake.SiteId, MapId: mistfake.MapId12F, X: 10, Y: 20, Timestamp: testTimestamp + 120})
+	if err != nil {
+		t.Fatalf("location-asset webhook: %v", err)
+	}
+	e.server.dbConn.Create(&models.Alert{Rule: "test", Mac: macTaro, CreatedAt: time.Now()})
+	e.send(t, http.MethodPut, "/entity/"+macTaro+"/privacy", "adminkey", EntityPrivacyRequest{Visibility: models.PrivacyZoneOnly})
+
+	for _, c := range []struct {
+		name  string
+		model interface{}
+	}{
+		{"zone_visits", &models.ZoneVisit{}},
+		{"floor_changes", &models.FloorChange{}},
+		{"position_samples", &models.PositionSample{}},
+	} {
+		if countRows(t, e, c.model, "mac = ?", macTaro) == 0 {
+			t.Fatalf("no %s of taro before the purge", c.name)
+		}
+	}
+	if countRows(t, e, &models.Contact{}, "mac_a = ? OR mac_b = ?", macTaro, macTaro) == 0 {
+		t.Fatalf("no contacts of taro before the purge")
+	}
+
+	status, _ := e.send(t, http.MethodDelete, "/entity/"+macTaro+"?purge=all", "readkey", nil)
+	if status != http.StatusForbidden {
+		t.Errorf("DELETE /entity/{mac} with read scope: status %d; want %d", status, http.StatusForbidden)
+	}
+	status, _ = e.send(t, http.MethodDelete, "/entity/"+macTaro+"?purge=some", "adminkey", nil)
+	if status != http.StatusBadRequest {
+		t.Errorf("DELETE /entity/{mac}?purge=some: status %d; want %d", status, http.StatusBadRequest)
+	}
+
+	// deleting keeps the history
+	status, body := e.send(t, http.MethodDelete, "/entity/"+macForklift, "adminkey", nil)
+	o := EntityDeleteExtView{}
+	json.Unmarshal(body, &o)
+	if status != http.StatusOK || o.Purge || o.Deleted["entities"] != 1 {
+		t.Errorf("DELETE /entity/{forklift}: status %d (%s)", status, body)
+	}
+	if countRows(t, e, &models.PositionSample{}, "mac = ?", macForklift) == 0 {
+		t.Errorf("DELETE /entity/{forklift} removed its positions")
+	}
+
+	status, body = e.send(t, http.MethodDelete, "/entity/"+macTaro+"?purge=all", "adminkey", nil)
+	o = EntityDeleteExtView{}
+	json.Unmarshal(body, &o)
+	if status != http.StatusOK || !o.Purge || o.Deleted["entities"] != 1 || o.Deleted["zone_visits"] == 0 || o.Deleted["contacts"] == 0 || o.Deleted["alerts"] != 1 || o.Deleted["entity_privacies"] != 1 ||
+		len(o.Excluded) != 1 || o.Excluded[0] != "webhook_archive" {
+		t.Errorf("DELETE /entity/{mac}?purge=all: status %d (%s)", status, body)
+	}
+
+	for _, c := range []struct {
+		name  string
+		model interface{}
+	}{
+		{"entities", &models.Entity{}},
+		{"zone_visits", &models.ZoneVisit{}},
+		{"floor_changes", &models.FloorChange{}},
+		{"position_samples", &models.PositionSample{}},
+		{"alerts", &models.Alert{}},
+		{"entity_privacies", &models.EntityPrivacy{}},
+	} {
+		if n := countRows(t, e, c.model, "mac = ?", macTaro); n != 0 {
+			t.Errorf("%d %s of taro left after the purge", n, c.name)
+		}
+	}
+	if n := countRows(t, e, &models.Contact{}, "mac_a = ? OR mac_b = ?", macTaro, macTaro); n != 0 {
+		t.Errorf("%d contacts of taro left after the purge", n)
+	}
+
+	status, _ = e.send(t, http.MethodGet, "/entity/"+macTaro, "readkey", nil)
+	if status != http.StatusNotFound {
+		t.Errorf("GET /entity/{mac} after the purge: status %d; want %d", status, http.StatusNotFound)
+	}
+
+	status, body = e.send(t, http.MethodGet, "/audit?action="+models.AuditPurgeEntity, "adminkey", nil)
+	records := []AuditRecordExtView{}
+	json.Unmarshal(body, &records)
+	if status != http.StatusOK || len(records) != 1 || records[0].Target != macTaro || records[0].Actor != "admin" || !strings.HasSuffix(records[0].Detail, "excluded=webhook_archive") {
+		t.Errorf("GET /audit: status %d (%s)", status, body)
+	}
+	status, _ = e.send(t, http.MethodGet, "/audit", "readkey", nil)
+	if status != http.StatusForbidden {
+		t.Errorf("GET /audit with read scope: status %d; want %d", status, http.StatusForbidden)
+	}
+}
+
+func TestRetentionPurge(t *testing.T) {
+	dir := t.TempDir()
+	e := newTestEnv(t, func(cfg *Config) {
+		cfg.Retention.Entities = 30
+		cfg.Retention.Visits = 7
+		cfg.Retention.Positions = 7
+		cfg.Retention.Archive = 7
+		cfg.Archive.Enabled = true
+		cfg.Archive.Dir = dir
+	})
+
+	now := time.Unix(testTimestamp, 0)
+	old := now.AddDate(0, 0, -10)
+	exitOld := old.Add(time.Minute)
+	seeds := []interface{}{
+		&models.Entity{Mac: "aa0000000001", Lastseen: float64(now.AddDate(0, 0, -40).Unix())},
+		&models.Entity{Mac: "aa0000000002", Lastseen: float64(old.Unix())},
+		&models.ZoneVisit{Mac: "aa0000000002", ZoneId: mistfake.ZoneBooth, EnterAt: old, ExitAt: &exitOld},
+		&models.ZoneVisit{Mac: "aa0000000002", ZoneId: mistfake.ZoneBooth, EnterAt: old},
+		&models.ZoneVisit{Mac: "aa0000000002", ZoneId: mistfake.ZoneBooth, EnterAt: now},
+		&models.PositionSample{Mac: "aa0000000002", MapId: mistfake.MapId11F, SeenAt: old},
+		&models.PositionSample{Mac: "aa0000000002", MapId: mistfake.MapId11F, SeenAt: now},
+		&models.FloorChange{Mac: "aa0000000002", ChangedAt: old},
+	}
+	for _, v := range seeds {
+		ret := e.server.dbConn.Create(v)
+		if ret.Error != nil {
+			t.Fatal(ret.Error)
+		}
+	}
+
+	for _, name := range []string{"webhooks-old.jsonl", "webhooks-new.jsonl"} {
+		err := os.WriteFile(filepath.Join(dir, name), []byte("{}\n"), 0640)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	os.Chtimes(filepath.Join(dir, "webhooks-old.jsonl"), old, old)
+	os.Chtimes(filepath.Join(dir, "webhooks-new.jsonl"), now, now)
+
+	err := e.server.purgeExpired(context.Background(), now)
+	if err != nil {
+		t.Fatalf("purgeExpired: %v", err)
+	}
+
+	for _, c := range []struct {
+		name  string
+		model interface{}
+		want  int64
+	}{
+		{"entities", &models.Entity{}, 1},
+		{"zone_visits", &models.ZoneVisit{}, 2}, // the open visit stays
+		{"position_samples", &models.PositionSample{}, 1},
+		{"floor_changes", &models.FloorChange{}, 1}, // no retention
+	} {
+		if n := countRows(t, e, c.model, "1 = 1"); n != c.want {
+			t.Errorf("%s after purgeExpired: %d rows; want %d", c.name, n, c.want)
+		}
+	}
+
+	// the current archive file is kept
+	files := archiveFiles(dir)
+	if len(files) != 2 || filepath.Base(files[0]) != "webhooks-new.jsonl" || filepath.Base(files[1]) != archiveFileName {
+		t.Errorf("webhook archive after purgeExpired: %v", files)
+	}
+}
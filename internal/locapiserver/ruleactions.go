@@ -0,0 +1,605 @@
+package locapiserver
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"mist-location-visualization/internal/models"
+
+	"github.com/go-chi/chi"
+	"github.com/go-chi/render"
+)
+
+const (
+	defaultAlertSeverity = "info"
+	ruleWebhookTimeout   = 10 * time.Second
+)
+
+// ruleWebhookPayload is posted by webhook actions. The body is signed like Mist webhooks
+// in X-Locapid-Signature when the action has a secret.
+type ruleWebhookPayload struct {
+	Rule     string    `json:"rule"`
+	Severity string    `json:"severity,omitempty"`
+	Message  string    `json:"message"`
+	Event    RuleEvent `json:"event"`
+}
+
+// buildRuleEvent describes a visit for rules, with dwell in seconds
+func (s *LocApiServer) buildRuleEvent(ctx context.Context, trigger string, v *models.ZoneVisit, t time.Time, dwell float64) RuleEvent {
+	ev := RuleEvent{
+		Trigger:  trigger,
+		Mac:      v.Mac,
+		ZoneId:   v.ZoneId,
+		Geofence: v.Geofence,
+		MapId:    v.MapId,
+		Dwell:    dwell,
+		Time:     t.Unix(),
+	}
+
+	e := models.Entity{}
+	ret := s.dbConn.WithContext(ctx).Where("mac = ?", v.Mac).Limit(1).Find(&e)
+	if ret.Error != nil {
+		log.Printf("buildRuleEvent: Failed to query DB (%v)", ret.Error)
+	}
+	ev.Name = e.Name
+	if e.DisplayName != "" {
+		ev.Name = e.DisplayName
+	}
+	ev.Kind = e.Kind
+	ev.Org = e.DisplayOrg
+
+	zone, err := s.findZone(ctx, v.ZoneId)
+	if err != nil {
+		log.Printf("buildRuleEvent: Failed to query DB on zones (%v)", err)
+	} else if zone != nil {
+		ev.ZoneName = zone.Name
+		ev.SiteId = zone.SiteId
+	}
+
+	m := models.Map{}
+	ret = s.dbConn.WithContext(ctx).Where("id = ?", v.MapId).Limit(1).Find(&m)
+	if ret.Error != nil {
+		log.Printf("buildRuleEvent: Failed to query DB on maps (%v)", ret.Error)
+	}
+	ev.MapName = m.Name
+	if ev.SiteId == "" {
+		ev.SiteId = m.SiteId
+	}
+
+	site := models.Site{}
+	ret = s.dbConn.WithContext(ctx).Where("id = ?", ev.SiteId).Limit(1).Find(&site)
+	if ret.Error != nil {
+		log.Printf("buildRuleEvent: Failed to query DB on sites (%v)", ret.Error)
+	}
+	ev.Timezone = site.Timezone
+
+	return ev
+}
+
+// fireZoneRules runs the rules matching a visit event, except those in skip, and returns the matches
+func (s *LocApiServer) fireZoneRules(ctx context.Context, trigger string, v *models.ZoneVisit, t time.Time, dwell float64, skip map[string]bool) []ruleMatch {
+	if s.rules == nil {
+		return nil
+	}
+
+	matches := s.rules.evaluate(s.buildRuleEvent(ctx, trigger, v, t, dwell), skip)
+	for _, m := range matches {
+		s.runRuleActions(ctx, m)
+	}
+
+	return matches
+}
+
+func (s *LocApiServer) runRuleActions(ctx context.Context, m ruleMatch) {
+	s.metrics.ruleMatches.WithLabelValues(m.rule.Name).Inc()
+
+	for _, a := range m.rule.actions {
+		msg := a.render(&m.event)
+
+		switch a.Type {
+		case ruleActionLog:
+			log.Printf("runRuleActions: Rule %s matched (%s)", m.rule.Name, msg)
+
+		case ruleActionAlert:
+			severity := a.Severity
+			if severity == "" {
+				severity = defaultAlertSeverity
+			}
+			// the anonymous message is shown when the privacy settings of the entity call for it
+			anon := s.anonymousRuleEvent(m.event)
+			alert := &models.Alert{
+				Rule:        m.rule.Name,
+				Severity:    severity,
+				Message:     msg,
+				AnonMessage: a.render(&anon),
+				Trigger:     m.event.Trigger,
+				Mac:         m.event.Mac,
+				ZoneId:      m.event.ZoneId,
+				MapId:       m.event.MapId,
+			}
+			ret := s.dbConn.WithContext(ctx).Create(alert)
+			if ret.Error != nil {
+				log.Printf("runRuleActions: Failed to store alert of rule %s (%v)", m.rule.Name, ret.Error)
+				s.metrics.ruleActionFailures.WithLabelValues(m.rule.Name, a.Type).Inc()
+			}
+
+		case ruleActionWebhook:
+			// receivers get the entity as the privacy settings allow, nothing when it is hidden
+			pp, err := s.loadPrivacy(ctx)
+			if err != nil {
+				log.Printf("runRuleActions: Failed to query DB on privacy settings (%v)", err)
+				s.metrics.ruleActionFailures.WithLabelValues(m.rule.Name, a.Type).Inc()
+				continue
+			}
+			ev, ok := pp.ruleEvent(m.event)
+			if !ok {
+				continue
+			}
+
+			payload := ruleWebhookPayload{
+				Rule:     m.rule.Name,
+				Severity: a.Severity,
+				Message:  a.render(&ev),
+				Event:    ev,
+			}
+
+			// receivers must not hold up the Mist webhook being processed
+			s.ruleWebhooks.Add(1)
+			go func(a ruleAction) {
+				defer s.ruleWebhooks.Done()
+
+				err := s.postRuleWebhook(a, payload)
+				if err != nil {
+					log.Printf("runRuleActions: Failed to post webhook of rule %s to %s (%v)", m.rule.Name, a.Url, err)
+					s.metrics.ruleActionFailures.WithLabelValues(m.rule.Name, a.Type).Inc()
+				}
+			}(a)
+		}
+	}
+}
+
+func (s *LocApiServer) postRuleWebhook(a ruleAction, payload ruleWebhookPayload) error {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), ruleWebhookTimeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, a.Url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if a.Secret != "" {
+		req.Header.Set("X-Locapid-Signature", signWebhookBody(a.Secret, body))
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("unexpected status %d", resp.StatusCode)
+	}
+
+	return nil
+}
+
+// runRules reloads the rules file when it changes and checks dwell rules every interval until ctx is cancelled
+func (s *LocApiServer) runRules(ctx context.Context, interval time.Duration) {
+	log.Printf("runRules: Checking rules every %s", interval)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			log.Printf("runRules: Stopped")
+			return
+		case t := <-ticker.C:
+			err := s.rules.reload(false)
+			if err != nil {
+				log.Printf("runRules: Failed to reload rules, keeping the previous ones (%v)", err)
+			}
+
+			s.checkDwellRules(ctx, t)
+			s.rules.sweep(t)
+		}
+	}
+}
+
+// checkDwellRules fires dwell rules once per visit of active entities staying long enough
+func (s *LocApiServer) checkDwellRules(ctx context.Context, now time.Time) {
+	minDwell := 0.0
+	for _, r := range s.rules.current() {
+		if r.Trigger == ruleTriggerDwell && (minDwell == 0 || r.MinDwell < minDwell) {
+			minDwell = r.MinDwell
+		}
+	}
+	if minDwell == 0 {
+		s.dwellFired = make(map[uint]map[string]bool)
+		return
+	}
+
+	cutoff := float64(now.Unix() - int64(s.config().Mist.LocationTimeout))
+	open := make([]models.ZoneVisit, 0)
+	ret := s.dbConn.WithContext(ctx).Model(&models.ZoneVisit{}).
+		Select("zone_visits.*").
+		Joins("JOIN entities ON entities.mac = zone_visits.mac").
+		Where("zone_visits.exit_at IS NULL AND zone_visits.enter_at <= ? AND entities.lastseen >= ?", now.Add(-time.Duration(minDwell*float64(time.Second))), cutoff).
+		Find(&open)
+	if ret.Error != nil {
+		log.Printf("checkDwellRules: Failed to query DB (%v)", ret.Error)
+		return
+	}
+
+	fired := make(map[uint]map[string]bool)
+	for _, v := range open {
+		done := s.dwellFired[v.Id]
+		if done == nil {
+			done = make(map[string]bool)
+		}
+
+		for _, m := range s.fireZoneRules(ctx, ruleTriggerDwell, &v, now, now.Sub(v.EnterAt).Seconds(), done) {
+			done[m.rule.Name] = true
+		}
+		fired[v.Id] = done
+	}
+
+	// closed visits are forgotten
+	s.dwellFired = fired
+}
+
+// AlertExtView represents the external view of an alert for API responses
+type AlertExtView struct {
+	Id        uint   `json:"id"`
+	Rule      string `json:"rule"`
+	Severity  string `json:"severity"`
+	Message   string `json:"message"`
+	Trigger   string `json:"trigger"`
+	Mac       string `json:"mac"`
+	ZoneId    string `json:"zone_id"`
+	MapId     string `json:"map_id"`
+	CreatedAt int64  `json:"created_at"`
+	AckedAt   int64  `json:"acked_at"`
+	AckedBy   string `json:"acked_by"`
+}
+
+func (e *AlertExtView) Render(w http.ResponseWriter, r *http.Request) error {
+	return nil
+}
+
+func newAlertExtView(a models.Alert) *AlertExtView {
+	o := &AlertExtView{
+		Id:        a.Id,
+		Rule:      a.Rule,
+		Severity:  a.Severity,
+		Message:   a.Message,
+		Trigger:   a.Trigger,
+		Mac:       a.Mac,
+		ZoneId:    a.ZoneId,
+		MapId:     a.MapId,
+		CreatedAt: a.CreatedAt.Unix(),
+		AckedBy:   a.AckedBy,
+	}
+
+	if a.AckedAt != nil {
+		o.AckedAt = a.AckedAt.Unix()
+	}
+
+	return o
+}
+
+// RulesExtView represents the loaded rules for API responses. Webhook secrets are left out.
+type RulesExtView struct {
+	File     string       `json:"file"`
+	LoadedAt int64        `json:"loaded_at"`
+	Error    string       `json:"error"`
+	Rules    []RuleConfig `json:"rules"`
+}
+
+func (e *RulesExtView) Render(w http.ResponseWriter, r *http.Request) error {
+	return nil
+}
+
+func newRulesExtView(rs *ruleSet) *RulesExtView {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+
+	o := &RulesExtView{
+		File:     rs.path,
+		LoadedAt: rs.loadedAt.Unix(),
+		Rules:    []RuleConfig{},
+	}
+	if rs.loadErr != nil {
+		o.Error = rs.loadErr.Error()
+	}
+
+	for _, r := range rs.rules {
+		cfg := r.RuleConfig
+		cfg.Actions = make([]RuleActionConfig, len(r.Actions))
+		for i, a := range r.Actions {
+			a.Secret = ""
+			cfg.Actions[i] = a
+		}
+		o.Rules = append(o.Rules, cfg)
+	}
+
+	return o
+}
+
+func (s *LocApiServer) apiAlertIdCtx(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key := chi.URLParam(r, "alertid")
+		id, err := strconv.ParseUint(key, 10, 64)
+		if err != nil {
+			err := fmt.Errorf("invalid alertid %s", key)
+			render.Render(w, r, s.httpErrInvalidRequest(err))
+			return
+		}
+
+		a := models.Alert{}
+		ret := restrictEntities(r.Context(), s.dbConn.WithContext(r.Context()), "mac").Where("id = ?", id).Limit(1).Find(&a)
+		if ret.Error != nil {
+			log.Printf("apiAlertIdCtx: Failed to query DB (%v)", ret.Error)
+			err := fmt.Errorf("failed to get data from backend")
+			render.Render(w, r, s.httpErrUnexpected(err))
+			return
+		} else if ret.RowsAffected == 0 || !getPrincipal(r.Context()).allowsMap(a.MapId) {
+			err := fmt.Errorf("alert %s not found", key)
+			render.Render(w, r, s.httpErrNotFound(err))
+			return
+		}
+
+		pp, err := s.loadPrivacy(r.Context())
+		if err != nil {
+			log.Printf("apiAlertIdCtx: Failed to query DB on privacy settings (%v)", err)
+			err := fmt.Errorf("failed to get data from backend")
+			render.Render(w, r, s.httpErrUnexpected(err))
+			return
+		} else if pp.alertView(a) == nil {
+			err := fmt.Errorf("alert %s not found", key)
+			render.Render(w, r, s.httpErrNotFound(err))
+			return
+		}
+
+		ctx := context.WithValue(r.Context(), "alert", &a)
+		ctx = context.WithValue(ctx, "privacy", pp)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+func (s *LocApiServer) apiAlertRouter() chi.Router {
+	r := chi.NewRouter()
+	r.Get("/", s.apiAlertGetAll)
+	r.Route("/{alertid}", func(r chi.Router) {
+		r.Use(s.apiAlertIdCtx)
+		r.Get("/", s.apiAlertGet)
+		r.With(s.apiRequireScope(scopeAdmin)).Post("/ack", s.apiAlertAck)
+	})
+
+	return r
+}
+
+// apiAlertGetAll lists alerts created within the optional from/to range, newest first.
+// rule and mac filter the alerts, and open=true leaves out acknowledged ones.
+func (s *LocApiServer) apiAlertGetAll(w http.ResponseWriter, r *http.Request) {
+	from, to, err := getTimeRange(r)
+	if err != nil {
+		render.Render(w, r, s.httpErrInvalidRequest(err))
+		return
+	}
+
+	pp, err := s.loadPrivacy(r.Context())
+	if err != nil {
+		log.Printf("apiAlertGetAll: Failed to query DB on privacy settings (%v)", err)
+		err := fmt.Errorf("failed to get data from backend")
+		render.Render(w, r, s.httpErrUnexpected(err))
+		return
+	}
+
+	q := restrictMaps(r.Context(), s.dbConn.WithContext(r.Context()), "map_id")
+	q = restrictEntities(r.Context(), q, "mac")
+	if !from.IsZero() {
+		q = q.Where("created_at >= ?", from)
+	}
+	if !to.IsZero() {
+		q = q.Where("created_at < ?", to)
+	}
+	if rule := r.URL.Query().Get("rule"); rule != "" {
+		q = q.Where("rule = ?", rule)
+	}
+	if mac := r.URL.Query().Get("mac"); mac != "" {
+		// anonymous entities cannot be looked up by their mac
+		if pp.visibility(mac) == models.PrivacyAnonymous {
+			mac = ""
+		}
+		q = q.Where("mac = ?", mac)
+	}
+	if r.URL.Query().Get("open") == "true" {
+		q = q.Where("acked_at IS NULL")
+	}
+
+	alerts := make([]models.Alert, 0)
+	ret := q.Order("created_at DESC, id DESC").Find(&alerts)
+	if ret.Error != nil {
+		log.Printf("apiAlertGetAll: Failed to query DB (%v)", ret.Error)
+		err := fmt.Errorf("failed to get data from backend")
+		render.Render(w, r, s.httpErrUnexpected(err))
+		return
+	}
+
+	// alerts of hidden entities are left out, those of anonymous ones show the pseudonym
+	outs := []render.Renderer{}
+	for _, a := range alerts {
+		if o := pp.alertView(a); o != nil {
+			outs = append(outs, o)
+		}
+	}
+
+	render.RenderList(w, r, outs)
+	return
+}
+
+func (s *LocApiServer) apiAlertGet(w http.ResponseWriter, r *http.Request) {
+	a := r.Context().Value("alert").(*models.Alert)
+	pp := r.Context().Value("privacy").(*privacyPolicy)
+
+	render.Render(w, r, pp.alertView(*a))
+	return
+}
+
+func (s *LocApiServer) apiAlertAck(w http.ResponseWriter, r *http.Request) {
+	a := r.Context().Value("alert").(*models.Alert)
+
+	if a.AckedAt == nil {
+		t := time.Now()
+		a.AckedAt = &t
+		if p := getPrincipal(r.Context()); p != nil {
+			a.AckedBy = p.Name
+		}
+
+		ret := s.dbConn.WithContext(r.Context()).Save(a)
+		if ret.Error != nil {
+			log.Printf("apiAlertAck: Failed to store alert (%v)", ret.Error)
+			err := fmt.Errorf("failed to store data to backend")
+			render.Render(w, r, s.httpErrUnexpected(err))
+			return
+		}
+	}
+
+	pp := r.Context().Value("privacy").(*privacyPolicy)
+	render.Render(w, r, pp.alertView(*a))
+	return
+}
+
+func (s *LocApiServer) apiRuleRouter() chi.Router {
+	r := chi.NewRouter()
+	r.Use(func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if s.rules == nil {
+				err := fmt.Errorf("rules are not configured")
+				render.Render(w, r, s.httpErrNotFound(err))
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	})
+	r.Get("/", s.apiRuleGetAll)
+	r.Post("/reload", s.apiRuleReload)
+
+	return r
+}
+
+func (s *LocApiServer) apiRuleGetAll(w http.ResponseWriter, r *http.Request) {
+	render.Render(w, r, newRulesExtView(s.rules))
+	return
+}
+
+// apiRuleReload loads the rules file now, whether or not it has changed
+func (s *LocApiServer) apiRuleReload(w http.ResponseWriter, r *http.Request) {
+	err := s.rules.reload(true)
+	if err != nil {
+		log.Printf("apiRuleReload: Failed to reload rules (%v)", err)
+		render.Render(w, r, s.httpErrInvalidRequest(err))
+		return
+	}
+
+	render.Render(w, r, newRulesExtView(s.rules))
+	return
+}
+
+// readRuleEvents reads events from a file holding JSON objects or arrays of them, e.g. one per line
+func readRuleEvents(path string) ([]RuleEvent, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	events := make([]RuleEvent, 0)
+	dec := json.NewDecoder(f)
+	for {
+		raw := json.RawMessage{}
+		err := dec.Decode(&raw)
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+
+		raw = bytes.TrimSpace(raw)
+		if len(raw) > 0 && raw[0] == '[' {
+			evs := make([]RuleEvent, 0)
+			err = json.Unmarshal(raw, &evs)
+			events = append(events, evs...)
+		} else {
+			ev := RuleEvent{}
+			err = json.Unmarshal(raw, &ev)
+			events = append(events, ev)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+	}
+
+	return events, nil
+}
+
+// CheckRules validates a rules file and prints the rules and action messages matching each
+// event of the event files without running the actions. Events are evaluated in order, so
+// cooldowns apply as they would in the server.
+func CheckRules(rulesFile string, eventFiles []string, w io.Writer) error {
+	rs, err := newRuleSet(rulesFile)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(w, "%s: %d rules\n", rulesFile, len(rs.current()))
+
+	for _, path := range eventFiles {
+		events, err := readRuleEvents(path)
+		if err != nil {
+			return err
+		}
+
+		for i, ev := range events {
+			if ev.Time == 0 {
+				ev.Time = time.Now().Unix()
+			}
+
+			zone := ev.ZoneName
+			if zone == "" {
+				zone = ev.ZoneId
+			}
+			fmt.Fprintf(w, "%s[%d] %s %s %s:", path, i, ev.Trigger, ev.Mac, zone)
+			matches := rs.evaluate(ev, nil)
+			if len(matches) == 0 {
+				fmt.Fprintf(w, " no match\n")
+				continue
+			}
+			fmt.Fprintf(w, "\n")
+
+			for _, m := range matches {
+				for _, a := range m.rule.actions {
+					fmt.Fprintf(w, "  %s: %s %q\n", m.rule.Name, a.Type, a.render(&m.event))
+				}
+			}
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,561 @@
+package locapiserver
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+
+	"github.com/expr-lang/expr"
+	"github.com/expr-lang/expr/vm"
+)
+
+// Rule triggers
+const (
+	ruleTriggerEnter = "enter"
+	ruleTriggerExit  = "exit"
+	ruleTriggerDwell = "dwell"
+)
+
+// Rule action types
+const (
+	ruleActionLog     = "log"
+	ruleActionWebhook = "webhook"
+	ruleActionAlert   = "alert"
+)
+
+const (
+	defaultRulesInterval = 30
+	// upper bound of the size of a rule condition
+	ruleConditionMaxNodes = 500
+)
+
+var ruleWeekdays = map[string]time.Weekday{
+	"sun": time.Sunday,
+	"mon": time.Monday,
+	"tue": time.Tuesday,
+	"wed": time.Wednesday,
+	"thu": time.Thursday,
+	"fri": time.Friday,
+	"sat": time.Saturday,
+}
+
+// RuleEvent is an entity entering, leaving or dwelling in a zone or geofence.
+// Timezone is the timezone of the site, used by schedules without their own timezone.
+type RuleEvent struct {
+	Trigger  string  `json:"trigger"`
+	Mac      string  `json:"mac"`
+	Name     string  `json:"name"`
+	Kind     string  `json:"kind"`
+	Org      string  `json:"org"`
+	ZoneId   string  `json:"zone_id"`
+	ZoneName string  `json:"zone_name"`
+	Geofence bool    `json:"geofence"`
+	MapId    string  `json:"map_id"`
+	MapName  string  `json:"map_name"`
+	SiteId   string  `json:"site_id"`
+	Timezone string  `json:"timezone"`
+	Dwell    float64 `json:"dwell"`
+	Time     int64   `json:"time"`
+}
+
+// ruleEnv is what rule conditions can refer to
+type ruleEnv struct {
+	Trigger  string  `expr:"trigger"`
+	Mac      string  `expr:"mac"`
+	Name     string  `expr:"name"`
+	Kind     string  `expr:"kind"`
+	Org      string  `expr:"org"`
+	ZoneId   string  `expr:"zone_id"`
+	Zone     string  `expr:"zone"`
+	Geofence bool    `expr:"geofence"`
+	MapId    string  `expr:"map_id"`
+	Map      string  `expr:"map"`
+	SiteId   string  `expr:"site_id"`
+	Dwell    float64 `expr:"dwell"`
+	Hour     int     `expr:"hour"`
+	Minute   int     `expr:"minute"`
+	Weekday  string  `expr:"weekday"`
+}
+
+// RuleScheduleConfig limits a rule to days of the week and a time of day range
+// (e.g. 20:00 to 06:00 over midnight)
+type RuleScheduleConfig struct {
+	Days     []string `json:"days"`
+	From     string   `json:"from"`
+	To       string   `json:"to"`
+	Timezone string   `json:"timezone"`
+}
+
+// RuleActionConfig is an action run when a rule matches.
+// Message is a text/template over RuleEvent.
+type RuleActionConfig struct {
+	Type     string `json:"type"`
+	Url      string `json:"url"`
+	Secret   string `json:"secret"`
+	Severity string `json:"severity"`
+	Message  string `json:"message"`
+}
+
+// RuleConfig is a rule of the rules file. Empty lists match anything; entities match the
+// mac or name, zones and maps their id or name.
+type RuleConfig struct {
+	Name      string              `json:"name"`
+	Trigger   string              `json:"trigger"`
+	Entities  []string            `json:"entities"`
+	Kinds     []string            `json:"kinds"`
+	Orgs      []string            `json:"orgs"`
+	Zones     []string            `json:"zones"`
+	Maps      []string            `json:"maps"`
+	Schedule  *RuleScheduleConfig `json:"schedule"`
+	MinDwell  float64             `json:"min_dwell"`
+	MaxDwell  float64             `json:"max_dwell"`
+	Condition string              `json:"condition"`
+	Cooldown  int                 `json:"cooldown"`
+	Actions   []RuleActionConfig  `json:"actions"`
+}
+
+type ruleAction struct {
+	RuleActionConfig
+	message *template.Template
+}
+
+type ruleSchedule struct {
+	days map[time.Weekday]bool
+	from int // minutes after midnight
+	to   int
+	loc  *time.Location
+}
+
+// rule is a compiled RuleConfig
+type rule struct {
+	RuleConfig
+	schedule  *ruleSchedule
+	condition *vm.Program
+	actions   []ruleAction
+}
+
+func parseClock(v string) (int, error) {
+	t, err := time.Parse("15:04", v)
+	if err != nil {
+		return 0, fmt.Errorf("invalid time of day %s", v)
+	}
+	return t.Hour()*60 + t.Minute(), nil
+}
+
+func compileSchedule(cfg *RuleScheduleConfig) (*ruleSchedule, error) {
+	sc := &ruleSchedule{from: 0, to: 24 * 60}
+
+	if len(cfg.Days) > 0 {
+		sc.days = make(map[time.Weekday]bool)
+		for _, d := range cfg.Days {
+			wd, ok := ruleWeekdays[strings.ToLower(d)]
+			if !ok {
+				return nil, fmt.Errorf("invalid day %s", d)
+			}
+			sc.days[wd] = true
+		}
+	}
+
+	var err error
+	if cfg.From != "" {
+		sc.from, err = parseClock(cfg.From)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if cfg.To != "" {
+		sc.to, err = parseClock(cfg.To)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if cfg.Timezone != "" {
+		sc.loc, err = time.LoadLocation(cfg.Timezone)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return sc, nil
+}
+
+// contains reports whether t falls into the schedule. A range over midnight belongs to
+// the day it starts on.
+func (sc *ruleSchedule) contains(t time.Time) bool {
+	minute := t.Hour()*60 + t.Minute()
+	day := t.Weekday()
+
+	if sc.from <= sc.to {
+		if minute < sc.from || minute >= sc.to {
+			return false
+		}
+	} else if minute < sc.to {
+		day = (day + 6) % 7
+	} else if minute < sc.from {
+		return false
+	}
+
+	return sc.days == nil || sc.days[day]
+}
+
+func compileRule(cfg RuleConfig) (*rule, error) {
+	if cfg.Name == "" {
+		return nil, fmt.Errorf("name is required")
+	}
+
+	switch cfg.Trigger {
+	case ruleTriggerEnter, ruleTriggerExit:
+	case ruleTriggerDwell:
+		if cfg.MinDwell <= 0 {
+			return nil, fmt.Errorf("dwell trigger requires min_dwell")
+		}
+	default:
+		return nil, fmt.Errorf("invalid trigger %s", cfg.Trigger)
+	}
+
+	if len(cfg.Actions) == 0 {
+		return nil, fmt.Errorf("no actions")
+	}
+
+	r := &rule{RuleConfig: cfg}
+
+	var err error
+	if cfg.Schedule != nil {
+		r.schedule, err = compileSchedule(cfg.Schedule)
+		if err != nil {
+			return nil, fmt.Errorf("schedule: %w", err)
+		}
+	}
+
+	// conditions see the event only and cannot call out of the sandbox
+	if cfg.Condition != "" {
+		r.condition, err = expr.Compile(cfg.Condition,
+			expr.Env(ruleEnv{}),
+			expr.AsBool(),
+			expr.MaxNodes(ruleConditionMaxNodes),
+			expr.DisableBuiltin("now"),
+		)
+		if err != nil {
+			return nil, fmt.Errorf("condition: %w", err)
+		}
+	}
+
+	for i, a := range cfg.Actions {
+		act := ruleAction{RuleActionConfig: a}
+		switch a.Type {
+		case ruleActionLog, ruleActionAlert:
+		case ruleActionWebhook:
+			if a.Url == "" {
+				return nil, fmt.Errorf("action %d: webhook requires url", i)
+			}
+		default:
+			return nil, fmt.Errorf("action %d: invalid type %s", i, a.Type)
+		}
+
+		msg := a.Message
+		if msg == "" {
+			msg = `{{if .Name}}{{.Name}}{{else}}{{.Mac}}{{end}} {{.Trigger}} {{if .ZoneName}}{{.ZoneName}}{{else}}{{.ZoneId}}{{end}}`
+		}
+		act.message, err = template.New(cfg.Name).Option("missingkey=error").Parse(msg)
+		if err != nil {
+			return nil, fmt.Errorf("action %d: message: %w", i, err)
+		}
+
+		r.actions = append(r.actions, act)
+	}
+
+	return r, nil
+}
+
+func matchAny(values []string, candidates ...string) bool {
+	if len(values) == 0 {
+		return true
+	}
+
+	for _, v := range values {
+		for _, c := range candidates {
+			if c != "" && strings.EqualFold(v, c) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// eventLocation returns the timezone the schedule and time of day conditions of r apply in
+func (r *rule) eventLocation(ev *RuleEvent) *time.Location {
+	if r.schedule != nil && r.schedule.loc != nil {
+		return r.schedule.loc
+	}
+
+	if ev.Timezone != "" {
+		loc, err := time.LoadLocation(ev.Timezone)
+		if err == nil {
+			return loc
+		}
+	}
+
+	return time.UTC
+}
+
+// match reports whether ev satisfies all conditions of r
+func (r *rule) match(ev *RuleEvent) (bool, error) {
+	if ev.Trigger != r.Trigger {
+		return false, nil
+	}
+
+	if !matchAny(r.Entities, ev.Mac, ev.Name) ||
+		!matchAny(r.Kinds, ev.Kind) ||
+		!matchAny(r.Orgs, ev.Org) ||
+		!matchAny(r.Zones, ev.ZoneId, ev.ZoneName) ||
+		!matchAny(r.Maps, ev.MapId, ev.MapName) {
+		return false, nil
+	}
+
+	// enter events have no dwell yet
+	if ev.Trigger != ruleTriggerEnter {
+		if r.MinDwell > 0 && ev.Dwell < r.MinDwell {
+			return false, nil
+		}
+		if r.MaxDwell > 0 && ev.Dwell > r.MaxDwell {
+			return false, nil
+		}
+	}
+
+	t := time.Unix(ev.Time, 0).In(r.eventLocation(ev))
+	if r.schedule != nil && !r.schedule.contains(t) {
+		return false, nil
+	}
+
+	if r.condition != nil {
+		env := ruleEnv{
+			Trigger:  ev.Trigger,
+			Mac:      ev.Mac,
+			Name:     ev.Name,
+			Kind:     ev.Kind,
+			Org:      ev.Org,
+			ZoneId:   ev.ZoneId,
+			Zone:     ev.ZoneName,
+			Geofence: ev.Geofence,
+			MapId:    ev.MapId,
+			Map:      ev.MapName,
+			SiteId:   ev.SiteId,
+			Dwell:    ev.Dwell,
+			Hour:     t.Hour(),
+			Minute:   t.Minute(),
+			Weekday:  strings.ToLower(t.Weekday().String()[:3]),
+		}
+		out, err := expr.Run(r.condition, env)
+		if err != nil {
+			return false, err
+		}
+		if ok, _ := out.(bool); !ok {
+			return false, nil
+		}
+	}
+
+	return true, nil
+}
+
+// message renders the message of action a for ev
+func (a *ruleAction) render(ev *RuleEvent) string {
+	b := &strings.Builder{}
+	err := a.message.Execute(b, ev)
+	if err != nil {
+		return fmt.Sprintf("%s (%v)", b.String(), err)
+	}
+	return b.String()
+}
+
+// loadRules reads and compiles a rules file
+func loadRules(path string) ([]*rule, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	doc := struct {
+		Rules []RuleConfig `json:"rules"`
+	}{}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	err = dec.Decode(&doc)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+
+	rules := make([]*rule, 0, len(doc.Rules))
+	names := make(map[string]bool)
+	for i, cfg := range doc.Rules {
+		r, err := compileRule(cfg)
+		if err != nil {
+			return nil, fmt.Errorf("%s: rule %d (%s): %w", path, i, cfg.Name, err)
+		}
+		if names[r.Name] {
+			return nil, fmt.Errorf("%s: duplicate rule name %s", path, r.Name)
+		}
+		names[r.Name] = true
+		rules = append(rules, r)
+	}
+
+	return rules, nil
+}
+
+// ruleMatch is a rule matching an event
+type ruleMatch struct {
+	rule  *rule
+	event RuleEvent
+}
+
+// ruleSet holds the rules of a file and loads them again when it changes.
+// A broken file keeps the previous rules in place.
+type ruleSet struct {
+	path string
+
+	mu       sync.Mutex
+	rules    []*rule
+	modTime  time.Time
+	loadErr  error
+	loadedAt time.Time
+	lastFire map[string]time.Time // rule and mac of the last match, for cooldowns
+}
+
+func newRuleSet(path string) (*ruleSet, error) {
+	rs := &ruleSet{
+		path:     path,
+		lastFire: make(map[string]time.Time),
+	}
+
+	err := rs.reload(false)
+	if err != nil {
+		return nil, err
+	}
+
+	return rs, nil
+}
+
+// reload loads the rules file if it changed since the last load, or always when force is set
+func (rs *ruleSet) reload(force bool) error {
+	modTime, err := fileModTime(rs.path)
+	if err != nil {
+		rs.setLoadErr(err)
+		return err
+	}
+
+	rs.mu.Lock()
+	unchanged := !rs.loadedAt.IsZero() && modTime.Equal(rs.modTime)
+	rs.mu.Unlock()
+	if unchanged && !force {
+		return nil
+	}
+
+	rules, err := loadRules(rs.path)
+	if err != nil {
+		rs.setLoadErr(err)
+		return err
+	}
+
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+
+	if !rs.loadedAt.IsZero() {
+		log.Printf("ruleSet: Reloaded %d rules from %s", len(rules), rs.path)
+	}
+	rs.rules = rules
+	rs.modTime = modTime
+	rs.loadErr = nil
+	rs.loadedAt = time.Now()
+
+	return nil
+}
+
+func (rs *ruleSet) setLoadErr(err error) {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+
+	rs.loadErr = err
+}
+
+func (rs *ruleSet) current() []*rule {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+
+	return rs.rules
+}
+
+// evaluate returns the rules matching ev, leaving out rules in skip and rules still in
+// their cooldown for the entity
+func (rs *ruleSet) evaluate(ev RuleEvent, skip map[string]bool) []ruleMatch {
+	matches := make([]ruleMatch, 0)
+	for _, r := range rs.current() {
+		if skip[r.Name] {
+			continue
+		}
+
+		ok, err := r.match(&ev)
+		if err != nil {
+			log.Printf("ruleSet: Condition of rule %s failed (%v)", r.Name, err)
+			continue
+		}
+		if !ok {
+			continue
+		}
+
+		if r.Cooldown > 0 {
+			key := r.Name + "/" + ev.Mac
+			t := time.Unix(ev.Time, 0)
+			rs.mu.Lock()
+			last, found := rs.lastFire[key]
+			inCooldown := found && t.Sub(last) < time.Duration(r.Cooldown)*time.Second
+			if !inCooldown {
+				rs.lastFire[key] = t
+			}
+			rs.mu.Unlock()
+			if inCooldown {
+				continue
+			}
+		}
+
+		matches = append(matches, ruleMatch{rule: r, event: ev})
+	}
+
+	return matches
+}
+
+// forget drops the cooldowns of mac
+func (rs *ruleSet) forget(mac string) {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+
+	for key := range rs.lastFire {
+		if key[strings.LastIndex(key, "/")+1:] == mac {
+			delete(rs.lastFire, key)
+		}
+	}
+}
+
+// sweep forgets matches whose cooldown is over
+func (rs *ruleSet) sweep(now time.Time) {
+	cooldowns := make(map[string]time.Duration)
+	for _, r := range rs.current() {
+		cooldowns[r.Name] = time.Duration(r.Cooldown) * time.Second
+	}
+
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+
+	for key, last := range rs.lastFire {
+		name := key[:strings.LastIndex(key, "/")]
+		if now.Sub(last) >= cooldowns[name] {
+			delete(rs.lastFire, key)
+		}
+	}
+}
@@ -0,0 +1,380 @@
+package locapiserver
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"mist-location-visualization/internal/mistfake"
+	"mist-location-visualization/internal/models"
+)
+
+func writeRulesFile(t *testing.T, path string, rules ...RuleConfig) {
+	t.Helper()
+
+	data, err := json.Marshal(map[string]interface{}{"rules": rules})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.WriteFile(path, data, 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRuleMatch(t *testing.T) {
+	logAction := []RuleActionConfig{{Type: ruleActionLog}}
+	// Monday 2024-06-10 21:30 in Tokyo
+	monEvening := time.Date(2024, 6, 10, 21, 30, 0, 0, time.FixedZone("JST", 9*3600)).Unix()
+	// Tuesday 2024-06-11 05:00 in Tokyo, still Monday night
+	tueMorning := time.Date(2024, 6, 11, 5, 0, 0, 0, time.FixedZone("JST", 9*3600)).Unix()
+	afterHours := &RuleScheduleConfig{Days: []string{"mon"}, From: "20:00", To: "06:00", Timezone: "Asia/Tokyo"}
+
+	enter := RuleEvent{Trigger: ruleTriggerEnter, Mac: macTaro, Name: "Taro", Kind: "ble_asset", Org: "Juniper", ZoneId: mistfake.ZoneBooth, ZoneName: "Booth", MapId: mistfake.MapId11F, MapName: "11F", Timezone: "Asia/Tokyo", Time: monEvening}
+	exit := enter
+	exit.Trigger = ruleTriggerExit
+	exit.Dwell = 600
+
+	for _, c := range []struct {
+		name  string
+		rule  RuleConfig
+		event RuleEvent
+		want  bool
+	}{
+		{"trigger", RuleConfig{Trigger: ruleTriggerEnter}, enter, true},
+		{"other trigger", RuleConfig{Trigger: ruleTriggerExit}, enter, false},
+		{"entity by name", RuleConfig{Trigger: ruleTriggerEnter, Entities: []string{"taro"}}, enter, true},
+		{"entity by mac", RuleConfig{Trigger: ruleTriggerEnter, Entities: []string{macTaro}}, enter, true},
+		{"other entity", RuleConfig{Trigger: ruleTriggerEnter, Entities: []string{"Hanako"}}, enter, false},
+		{"org and zone", RuleConfig{Trigger: ruleTriggerEnter, Orgs: []string{"Juniper"}, Zones: []string{"Booth"}, Maps: []string{mistfake.MapId11F}}, enter, true},
+		{"other org", RuleConfig{Trigger: ruleTriggerEnter, Orgs: []string{"Mist"}}, enter, false},
+		{"other kind", RuleConfig{Trigger: ruleTriggerEnter, Kinds: []string{"wifi_client"}}, enter, false},
+		{"after hours", RuleConfig{Trigger: ruleTriggerEnter, Schedule: afterHours}, enter, true},
+		{"after hours past midnight", RuleConfig{Trigger: ruleTriggerEnter, Schedule: afterHours}, RuleEvent{Trigger: ruleTriggerEnter, Time: tueMorning}, true},
+		{"office hours", RuleConfig{Trigger: ruleTriggerEnter, Schedule: &RuleScheduleConfig{From: "09:00", To: "18:00"}}, RuleEvent{Trigger: ruleTriggerEnter, Time: monEvening, Timezone: "Asia/Tokyo"}, false},
+		{"site timezone", RuleConfig{Trigger: ruleTriggerEnter, Schedule: &RuleScheduleConfig{From: "12:00", To: "13:00"}}, RuleEvent{Trigger: ruleTriggerEnter, Time: monEvening}, true},
+		{"min dwell", RuleConfig{Trigger: ruleTriggerExit, MinDwell: 300}, exit, true},
+		{"max dwell", RuleConfig{Trigger: ruleTriggerExit, MaxDwell: 300}, exit, false},
+		{"condition", RuleConfig{Trigger: ruleTriggerExit, Condition: `zone == "Booth" && dwell >= 600 && hour >= 20 && weekday == "mon"`}, exit, true},
+		{"false condition", RuleConfig{Trigger: ruleTriggerExit, Condition: `name startsWith "Hana"`}, exit, false},
+	} {
+		c.rule.Name = c.name
+		c.rule.Actions = logAction
+		r, err := compileRule(c.rule)
+		if err != nil {
+			t.Errorf("%s: compileRule: %v", c.name, err)
+			continue
+		}
+
+		got, err := r.match(&c.event)
+		if err != nil || got != c.want {
+			t.Errorf("%s: match = %v, %v; want %v", c.name, got, err, c.want)
+		}
+	}
+}
+
+func TestRuleCompileErrors(t *testing.T) {
+	logAction := []RuleActionConfig{{Type: ruleActionLog}}
+
+	for _, c := range []struct {
+		name string
+		rule RuleConfig
+	}{
+		{"no name", RuleConfig{Trigger: ruleTriggerEnter, Actions: logAction}},
+		{"unknown trigger", RuleConfig{Name: "r", Trigger: "move", Actions: logAction}},
+		{"dwell without min_dwell", RuleConfig{Name: "r", Trigger: ruleTriggerDwell, Actions: logAction}},
+		{"no actions", RuleConfig{Name: "r", Trigger: ruleTriggerEnter}},
+		{"unknown action", RuleConfig{Name: "r", Trigger: ruleTriggerEnter, Actions: []RuleActionConfig{{Type: "email"}}}},
+		{"webhook without url", RuleConfig{Name: "r", Trigger: ruleTriggerEnter, Actions: []RuleActionConfig{{Type: ruleActionWebhook}}}},
+		{"bad day", RuleConfig{Name: "r", Trigger: ruleTriggerEnter, Schedule: &RuleScheduleConfig{Days: []string{"funday"}}, Actions: logAction}},
+		{"bad time", RuleConfig{Name: "r", Trigger: ruleTriggerEnter, Schedule: &RuleScheduleConfig{From: "25:00"}, Actions: logAction}},
+		{"syntax", RuleConfig{Name: "r", Trigger: ruleTriggerEnter, Condition: "dwell >", Actions: logAction}},
+		{"not a bool", RuleConfig{Name: "r", Trigger: ruleTriggerEnter, Condition: "dwell + 1", Actions: logAction}},
+		{"unknown variable", RuleConfig{Name: "r", Trigger: ruleTriggerEnter, Condition: `os != nil`, Actions: logAction}},
+		{"clock", RuleConfig{Name: "r", Trigger: ruleTriggerEnter, Condition: `now().Hour() > 20`, Actions: logAction}},
+		{"bad template", RuleConfig{Name: "r", Trigger: ruleTriggerEnter, Actions: []RuleActionConfig{{Type: ruleActionLog, Message: "{{.Mac"}}}},
+	} {
+		_, err := compileRule(c.rule)
+		if err == nil {
+			t.Errorf("%s: compileRule succeeded; want error", c.name)
+		}
+	}
+}
+
+func TestCheckRules(t *testing.T) {
+	dir := t.TempDir()
+	rulesFile := filepath.Join(dir, "rules.json")
+	writeRulesFile(t, rulesFile, RuleConfig{
+		Name:     "lab-after-hours",
+		Trigger:  ruleTriggerEnter,
+		Zones:    []string{"Lab"},
+		Schedule: &RuleScheduleConfig{From: "20:00", To: "06:00"},
+		Cooldown: 600,
+		Actions:  []RuleActionConfig{{Type: ruleActionAlert, Message: "{{.Name}} entered {{.ZoneName}}"}},
+	})
+
+	eventsFile := filepath.Join(dir, "events.json")
+	events := `{"trigger": "enter", "mac": "aa", "name": "Taro", "zone_name": "Lab", "time": 1718017200, "timezone": "Asia/Tokyo"}
+{"trigger": "enter", "mac": "aa", "name": "Taro", "zone_name": "Lab", "time": 1718017300, "timezone": "Asia/Tokyo"}
+[{"trigger": "enter", "mac": "bb", "name": "Hanako", "zone_name": "Lab", "time": 1718067600, "timezone": "Asia/Tokyo"}]
+`
+	err := os.WriteFile(eventsFile, []byte(events), 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	out := &strings.Builder{}
+	err = CheckRules(rulesFile, []string{eventsFile}, out)
+	if err != nil {
+		t.Fatalf("CheckRules: %v", err)
+	}
+
+	// 20:00 JST is after hours, the repeat is in the cooldown and 10:00 JST is office hours
+	want := rulesFile + ": 1 rules\n" +
+		eventsFile + "[0] enter aa Lab:\n" +
+		"  lab-after-hours: alert \"Taro entered Lab\"\n" +
+		eventsFile + "[1] enter aa Lab: no match\n" +
+		eventsFile + "[2] enter bb Lab: no match\n"
+	if out.String() != want {
+		t.Errorf("CheckRules output:\n%s\nwant:\n%s", out, want)
+	}
+
+	writeRulesFile(t, rulesFile, RuleConfig{Name: "broken", Trigger: ruleTriggerEnter})
+	err = CheckRules(rulesFile, nil, io.Discard)
+	if err == nil {
+		t.Errorf("CheckRules on a broken file succeeded; want error")
+	}
+}
+
+func TestRuleActions(t *testing.T) {
+	type received struct {
+		signature string
+		payload   ruleWebhookPayload
+	}
+	hooks := make(chan received, 10)
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		p := ruleWebhookPayload{}
+		json.Unmarshal(body, &p)
+		if r.Header.Get("X-Locapid-Signature") == signWebhookBody("hooksecret", body) {
+			hooks <- received{signature: "valid", payload: p}
+		} else {
+			hooks <- received{signature: "invalid", payload: p}
+		}
+	}))
+	t.Cleanup(receiver.Close)
+
+	rulesFile := filepath.Join(t.TempDir(), "rules.json")
+	writeRulesFile(t, rulesFile,
+		RuleConfig{
+			Name:    "booth-enter",
+			Trigger: ruleTriggerEnter,
+			Zones:   []string{"Booth"},
+			Actions: []RuleActionConfig{{Type: ruleActionAlert, Severity: "warning", Message: "{{.Mac}} entered {{.ZoneName}}"}},
+		},
+		RuleConfig{
+			Name:    "booth-exit",
+			Trigger: ruleTriggerExit,
+			Zones:   []string{mistfake.ZoneBooth},
+			Actions: []RuleActionConfig{{Type: ruleActionWebhook, Url: receiver.URL, Secret: "hooksecret"}},
+		},
+		RuleConfig{
+			Name:     "long-stay",
+			Trigger:  ruleTriggerDwell,
+			MinDwell: 600,
+			Actions:  []RuleActionConfig{{Type: ruleActionAlert}},
+		},
+	)
+
+	e := newTestEnv(t, withAdminKey, func(cfg *Config) {
+		cfg.Rules.File = rulesFile
+	})
+
+	err := e.webhook.PostLocationAsset(
+		mistfake.LocationAssetEvent{Mac: macTaro, SiteId: mistfake.SiteId, MapId: mistfake.MapId11F, X: 10, Y: 20, Timestamp: testTimestamp},
+	)
+	if err != nil {
+		t.Fatalf("location-asset webhook: %v", err)
+	}
+	err = e.webhook.PostZone(
+		mistfake.ZoneEvent{Mac: macTaro, SiteId: mistfake.SiteId, MapId: mistfake.MapId11F, ZoneId: mistfake.ZoneBooth, Trigger: "enter", Timestamp: testTimestamp + 1},
+	)
+	if err != nil {
+		t.Fatalf("zone webhook: %v", err)
+	}
+
+	status, body := e.get(t, "/alert")
+	alerts := []AlertExtView{}
+	json.Unmarshal(body, &alerts)
+	if status != http.StatusOK || len(alerts) != 1 || alerts[0].Rule != "booth-enter" || alerts[0].Severity != "warning" || alerts[0].Message != macTaro+" entered Booth" {
+		t.Fatalf("GET /alert: status %d (%s)", status, body)
+	}
+
+	// the dwell rule fires once per visit
+	e.server.checkDwellRules(context.Background(), time.Unix(testTimestamp+700, 0))
+	e.server.checkDwellRules(context.Background(), time.Unix(testTimestamp+800, 0))
+	status, body = e.get(t, "/alert?rule=long-stay&open=true")
+	alerts = []AlertExtView{}
+	json.Unmarshal(body, &alerts)
+	if status != http.StatusOK || len(alerts) != 1 || alerts[0].Trigger != ruleTriggerDwell {
+		t.Fatalf("GET /alert?rule=long-stay: status %d (%s)", status, body)
+	}
+
+	status, body = e.send(t, http.MethodPost, fmt.Sprintf("/alert/%d/ack", alerts[0].Id), "adminkey", nil)
+	acked := AlertExtView{}
+	json.Unmarshal(body, &acked)
+	if status != http.StatusOK || acked.AckedAt == 0 {
+		t.Errorf("POST /alert/{id}/ack: status %d (%s)", status, body)
+	}
+	_, body = e.get(t, "/alert?open=true")
+	alerts = []AlertExtView{}
+	json.Unmarshal(body, &alerts)
+	if len(alerts) != 1 || alerts[0].Rule != "booth-enter" {
+		t.Errorf("GET /alert?open=true after ack: %s", body)
+	}
+
+	err = e.webhook.PostZone(
+		mistfake.ZoneEvent{Mac: macTaro, SiteId: mistfake.SiteId, MapId: mistfake.MapId11F, ZoneId: mistfake.ZoneBooth, Trigger: "exit", Timestamp: testTimestamp + 900},
+	)
+	if err != nil {
+		t.Fatalf("zone webhook: %v", err)
+	}
+
+	select {
+	case h := <-hooks:
+		if h.signature != "valid" || h.payload.Rule != "booth-exit" || h.payload.Event.Dwell != 899 || h.payload.Event.ZoneName != "Booth" {
+			t.Errorf("rule webhook: %+v", h)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("rule webhook was not posted")
+	}
+
+	// a broken file keeps the loaded rules
+	writeRulesFile(t, rulesFile, RuleConfig{Name: "broken", Trigger: "move"})
+	status, _ = e.send(t, http.MethodPost, "/rule/reload", "adminkey", nil)
+	if status != http.StatusBadRequest {
+		t.Errorf("POST /rule/reload with a broken file: status %d; want %d", status, http.StatusBadRequest)
+	}
+	status, body = e.send(t, http.MethodGet, "/rule", "adminkey", nil)
+	view := RulesExtView{}
+	json.Unmarshal(body, &view)
+	if status != http.StatusOK || len(view.Rules) != 3 || view.Error == "" || view.Rules[1].Actions[0].Secret != "" {
+		t.Errorf("GET /rule after a failed reload: status %d (%s)", status, body)
+	}
+
+	writeRulesFile(t, rulesFile, RuleConfig{Name: "only", Trigger: ruleTriggerEnter, Actions: []RuleActionConfig{{Type: ruleActionLog}}})
+	status, body = e.send(t, http.MethodPost, "/rule/reload", "adminkey", nil)
+	view = RulesExtView{}
+	json.Unmarshal(body, &view)
+	if status != http.StatusOK || len(view.Rules) != 1 || view.Error != "" {
+		t.Errorf("POST /rule/reload: status %d (%s)", status, body)
+	}
+}
+
+func TestRuleActionsPrivacy(t *testing.T) {
+	hooks := make(chan ruleWebhookPayload, 10)
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		p := ruleWebhookPayload{}
+		json.NewDecoder(r.Body).Decode(&p)
+		hooks <- p
+	}))
+	t.Cleanup(receiver.Close)
+
+	rulesFile := filepath.Join(t.TempDir(), "rules.json")
+	writeRulesFile(t, rulesFile, RuleConfig{
+		Name:    "booth-enter",
+		Trigger: ruleTriggerEnter,
+		Zones:   []string{mistfake.ZoneBooth},
+		Actions: []RuleActionConfig{
+			{Type: ruleActionAlert, Message: "{{.Name}} ({{.Mac}}) entered {{.ZoneName}}"},
+			{Type: ruleActionWebhook, Url: receiver.URL, Message: "{{.Name}} ({{.Mac}}) entered {{.ZoneName}}"},
+		},
+	})
+
+	e := newTestEnv(t, withAdminKey, func(cfg *Config) {
+		cfg.Rules.File = rulesFile
+	})
+	enter := func(ts int) {
+		for _, trigger := range []string{"exit", "enter"} {
+			err := e.webhook.PostZone(
+				mistfake.ZoneEvent{Mac: macTaro, SiteId: mistfake.SiteId, MapId: mistfake.MapId11F, ZoneId: mistfake.ZoneBooth, Trigger: trigger, Timestamp: float64(ts)},
+			)
+			if err != nil {
+				t.Fatalf("zone webhook: %v", err)
+			}
+		}
+		e.server.ruleWebhooks.Wait()
+	}
+
+	err := e.webhook.PostLocationAsset(
+		mistfake.LocationAssetEvent{Mac: macTaro, SiteId: mistfake.SiteId, MapId: mistfake.MapId11F, X: 10, Y: 20, Timestamp: testTimestamp},
+	)
+	if err != nil {
+		t.Fatalf("location-asset webhook: %v", err)
+	}
+
+	// anonymous entities are shown by their pseudonym in alerts and rule webhooks
+	status, body := e.send(t, http.MethodPut, "/entity/"+macTaro+"/privacy", "adminkey", EntityPrivacyRequest{Visibility: models.PrivacyAnonymous})
+	if status != http.StatusOK {
+		t.Fatalf("PUT /entity/{mac}/privacy: status %d (%s)", status, body)
+	}
+	anon := e.server.pseudonym(macTaro)
+	enter(testTimestamp + 1)
+
+	status, body = e.get(t, "/alert")
+	alerts := []AlertExtView{}
+	json.Unmarshal(body, &alerts)
+	if status != http.StatusOK || len(alerts) != 1 || alerts[0].Mac != anon || alerts[0].Message != anon+" ("+anon+") entered Booth" {
+		t.Fatalf("GET /alert of anonymous entity: status %d (%s)", status, body)
+	}
+	_, body = e.get(t, "/alert?mac="+macTaro)
+	if string(body) != "[]\n" {
+		t.Errorf("GET /alert?mac= of anonymous entity: %s", body)
+	}
+
+	select {
+	case p := <-hooks:
+		if p.Event.Mac != anon || p.Event.Name != anon || p.Event.Org != "" || strings.Contains(p.Message, macTaro) {
+			t.Errorf("rule webhook of anonymous entity: %+v", p)
+		}
+	default:
+		t.Fatalf("rule webhook was not posted")
+	}
+
+	// hidden entities are left out of alerts and rule webhooks are not posted for them
+	e.send(t, http.MethodPut, "/entity/"+macTaro+"/privacy", "adminkey", EntityPrivacyRequest{Visibility: models.PrivacyHidden})
+	enter(testTimestamp + 100)
+
+	_, body = e.get(t, "/alert")
+	if string(body) != "[]\n" {
+		t.Errorf("GET /alert of hidden entity: %s", body)
+	}
+	status, _ = e.get(t, fmt.Sprintf("/alert/%d", alerts[0].Id))
+	if status != http.StatusNotFound {
+		t.Errorf("GET /alert/{id} of hidden entity: status %d; want %d", status, http.StatusNotFound)
+	}
+	select {
+	case p := <-hooks:
+		t.Errorf("rule webhook of hidden entity: %+v", p)
+	default:
+	}
+
+	// admins keep seeing the raw alerts when exempt, privacy needs a restart so the config is swapped
+	cfg := *e.server.config()
+	cfg.Privacy.ExemptAdmin = true
+	e.server.cfg.Store(&cfg)
+	_, body = e.send(t, http.MethodGet, "/alert", "adminkey", nil)
+	alerts = []AlertExtView{}
+	json.Unmarshal(body, &alerts)
+	if len(alerts) != 2 || alerts[0].Mac != macTaro || !strings.Contains(alerts[0].Message, macTaro) {
+		t.Errorf("GET /alert as exempt admin: %s", body)
+	}
+}
@@ -0,0 +1,218 @@
+package locapiserver
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"slices"
+	"sort"
+
+	"mist-location-visualization/internal/models"
+
+	"github.com/go-chi/chi"
+	"github.com/go-chi/render"
+)
+
+// FloorExtView represents a single floor (map) inside the site hierarchy
+type FloorExtView struct {
+	MapId string `json:"map_id"`
+	Name  string `json:"name"`
+	Level int    `json:"level"`
+	Count int64  `json:"count"`
+}
+
+// BuildingExtView represents a building and its floors for API responses
+type BuildingExtView struct {
+	Id     string          `json:"id"`
+	Name   string          `json:"name"`
+	Floors []*FloorExtView `json:"floors"`
+}
+
+// SiteExtView represents the external view of a site hierarchy for API responses.
+// Floors holds maps of the site which are not assigned to any building.
+type SiteExtView struct {
+	Id        string             `json:"id"`
+	Name      string             `json:"name"`
+	Buildings []*BuildingExtView `json:"buildings"`
+	Floors    []*FloorExtView    `json:"floors"`
+}
+
+func (e *SiteExtView) Render(w http.ResponseWriter, r *http.Request) error {
+	return nil
+}
+
+func (s *LocApiServer) apiSiteIdCtx(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key := chi.URLParam(r, "siteid")
+		if key == "" {
+			err := fmt.Errorf("Missing siteid param")
+			render.Render(w, r, s.httpErrInvalidRequest(err))
+			return
+		}
+
+		ctx := context.WithValue(r.Context(), "siteid", key)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+func (s *LocApiServer) apiSiteRouter() chi.Router {
+	r := chi.NewRouter()
+	r.Get("/", s.apiSiteGetAll)
+	r.Route("/{siteid}", func(r chi.Router) {
+		r.Use(s.apiSiteIdCtx)
+		r.Get("/", s.apiSiteGet)
+	})
+
+	return r
+}
+
+// buildSiteHierarchy assembles the site -> building -> floor tree from the database
+func (s *LocApiServer) buildSiteHierarchy(ctx context.Context) ([]*SiteExtView, error) {
+	sites := make([]models.Site, 0)
+	ret := s.dbConn.WithContext(ctx).Find(&sites)
+	if ret.Error != nil {
+		return nil, ret.Error
+	}
+
+	buildings := make([]models.Building, 0)
+	ret = s.dbConn.WithContext(ctx).Find(&buildings)
+	if ret.Error != nil {
+		return nil, ret.Error
+	}
+
+	maps := make([]models.Map, 0)
+	ret = restrictMaps(ctx, s.dbConn.WithContext(ctx), "id").Order("floor_level").Find(&maps)
+	if ret.Error != nil {
+		return nil, ret.Error
+	}
+
+	type mapCount struct {
+		MapId string
+		Count int64
+	}
+	counts := make([]mapCount, 0)
+	ret = s.entityQuery(ctx, nil).Select("map_id, count(*) as count").Where("map_id <> ''").Group("map_id").Scan(&counts)
+	if ret.Error != nil {
+		return nil, ret.Error
+	}
+	countIdx := make(map[string]int64)
+	for _, c := range counts {
+		countIdx[c.MapId] = c.Count
+	}
+
+	// sites are known either from the sites datasource or from maps referring to them
+	siteIdx := make(map[string]*SiteExtView)
+	getSite := func(id string) *SiteExtView {
+		v, ok := siteIdx[id]
+		if !ok {
+			v = &SiteExtView{
+				Id:        id,
+				Buildings: []*BuildingExtView{},
+				Floors:    []*FloorExtView{},
+			}
+			siteIdx[id] = v
+		}
+		return v
+	}
+
+	for _, e := range sites {
+		getSite(e.Id).Name = e.Name
+	}
+
+	buildingIdx := make(map[string]*BuildingExtView)
+	for _, e := range buildings {
+		b := &BuildingExtView{
+			Id:     e.Id,
+			Name:   e.Name,
+			Floors: []*FloorExtView{},
+		}
+		buildingIdx[e.Id] = b
+
+		site := getSite(e.SiteId)
+		site.Buildings = append(site.Buildings, b)
+	}
+
+	for _, e := range maps {
+		f := &FloorExtView{
+			MapId: e.Id,
+			Name:  e.FloorName,
+			Level: e.FloorLevel,
+			Count: countIdx[e.Id],
+		}
+		if f.Name == "" {
+			f.Name = e.Name
+		}
+
+		if b, ok := buildingIdx[e.BuildingId]; ok {
+			b.Floors = append(b.Floors, f)
+		} else {
+			site := getSite(e.SiteId)
+			site.Floors = append(site.Floors, f)
+		}
+	}
+
+	// restricted callers only see the sites and buildings of their maps
+	restricted := false
+	if p := getPrincipal(ctx); p != nil {
+		restricted = p.restricted
+	}
+
+	outs := make([]*SiteExtView, 0, len(siteIdx))
+	for _, v := range siteIdx {
+		if restricted {
+			v.Buildings = slices.DeleteFunc(v.Buildings, func(b *BuildingExtView) bool {
+				return len(b.Floors) == 0
+			})
+			if len(v.Buildings) == 0 && len(v.Floors) == 0 {
+				continue
+			}
+		}
+		outs = append(outs, v)
+	}
+	sort.Slice(outs, func(i, j int) bool {
+		return outs[i].Id < outs[j].Id
+	})
+
+	return outs, nil
+}
+
+func (s *LocApiServer) apiSiteGetAll(w http.ResponseWriter, r *http.Request) {
+	sites, err := s.buildSiteHierarchy(r.Context())
+	if err != nil {
+		log.Printf("apiSiteGetAll: Failed to query DB (%v)", err)
+		err := fmt.Errorf("failed to get data from backend")
+		render.Render(w, r, s.httpErrUnexpected(err))
+		return
+	}
+
+	outs := []render.Renderer{}
+	for _, e := range sites {
+		outs = append(outs, e)
+	}
+
+	render.RenderList(w, r, outs)
+	return
+}
+
+func (s *LocApiServer) apiSiteGet(w http.ResponseWriter, r *http.Request) {
+	siteId := getCtxValueString(r.Context(), "siteid")
+	sites, err := s.buildSiteHierarchy(r.Context())
+	if err != nil {
+		log.Printf("apiSiteGet: Failed to query DB (%v)", err)
+		err := fmt.Errorf("failed to get data from backend")
+		render.Render(w, r, s.httpErrUnexpected(err))
+		return
+	}
+
+	for _, e := range sites {
+		if e.Id == siteId {
+			render.Render(w, r, e)
+			return
+		}
+	}
+
+	err = fmt.Errorf("site %s not found", siteId)
+	render.Render(w, r, s.httpErrNotFound(err))
+	return
+}
@@ -0,0 +1,111 @@
+package locapiserver
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/go-chi/chi"
+	"github.com/go-chi/render"
+)
+
+// TenantExtView represents the entity counts of one organisation for API responses.
+// Active entities were seen within the location timeout and are counted per map and zone.
+type TenantExtView struct {
+	Tenant   string           `json:"tenant"`
+	Entities int64            `json:"entities"`
+	Active   int64            `json:"active"`
+	Maps     map[string]int64 `json:"maps"`
+	Zones    map[string]int64 `json:"zones"`
+}
+
+func (e *TenantExtView) Render(w http.ResponseWriter, r *http.Request) error {
+	return nil
+}
+
+func (s *LocApiServer) apiTenantRouter() chi.Router {
+	r := chi.NewRouter()
+	r.Get("/", s.apiTenantGetAll)
+
+	return r
+}
+
+// countTenants counts the entities the caller of ctx may see per organisation at t
+func (s *LocApiServer) countTenants(ctx context.Context, t time.Time) ([]*TenantExtView, error) {
+	cutoff := float64(t.Unix() - int64(s.config().Mist.LocationTimeout))
+	idx := make(map[string]*TenantExtView)
+	tenant := func(org string) *TenantExtView {
+		o, ok := idx[org]
+		if !ok {
+			o = &TenantExtView{Tenant: org, Maps: make(map[string]int64), Zones: make(map[string]int64)}
+			idx[org] = o
+		}
+		return o
+	}
+
+	type orgCount struct {
+		Org   string
+		Id    string
+		Count int64
+	}
+
+	counts := make([]orgCount, 0)
+	ret := s.entityQuery(ctx, nil).Select("display_org AS org, COUNT(*) AS count").Group("display_org").Scan(&counts)
+	if ret.Error != nil {
+		return nil, ret.Error
+	}
+	for _, c := range counts {
+		tenant(c.Org).Entities = c.Count
+	}
+
+	for _, column := range []string{"map_id", "zone_id"} {
+		counts = counts[:0]
+		ret := s.entityQuery(ctx, nil).
+			Select("display_org AS org, "+column+" AS id, COUNT(*) AS count").
+			Where(column+" <> '' AND lastseen >= ?", cutoff).
+			Group("display_org, " + column).
+			Scan(&counts)
+		if ret.Error != nil {
+			return nil, ret.Error
+		}
+
+		for _, c := range counts {
+			if column == "map_id" {
+				tenant(c.Org).Maps[c.Id] = c.Count
+				tenant(c.Org).Active += c.Count
+			} else {
+				tenant(c.Org).Zones[c.Id] = c.Count
+			}
+		}
+	}
+
+	outs := make([]*TenantExtView, 0, len(idx))
+	for _, o := range idx {
+		outs = append(outs, o)
+	}
+	sort.Slice(outs, func(i, j int) bool { return outs[i].Tenant < outs[j].Tenant })
+
+	return outs, nil
+}
+
+// apiTenantGetAll lists entity counts per organisation. Tenant bound callers only get their own.
+func (s *LocApiServer) apiTenantGetAll(w http.ResponseWriter, r *http.Request) {
+	tenants, err := s.countTenants(r.Context(), time.Now())
+	if err != nil {
+		log.Printf("apiTenantGetAll: Failed to query DB (%v)", err)
+		err := fmt.Errorf("failed to get data from backend")
+		render.Render(w, r, s.httpErrUnexpected(err))
+		return
+	}
+
+	outs := []render.Renderer{}
+	for _, v := range tenants {
+		outs = append(outs, v)
+	}
+
+	render.RenderList(w, r, outs)
+	return
+}
@@ -0,0 +1,144 @@
+package locapiserver
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	"mist-location-visualization/internal/mistfake"
+)
+
+func TestTenantViews(t *testing.T) {
+	const macHanako = "e2c56db5dffb"
+
+	juniperSum := sha256.Sum256([]byte("juniperkey"))
+	interopSum := sha256.Sum256([]byte("interopkey"))
+	staffSum := sha256.Sum256([]byte("staffkey"))
+	e := newTestEnv(t, func(cfg *Config) {
+		cfg.Http.ApiKeys = []ApiKeyConfig{
+			{Name: "juniper", KeySha256: hex.EncodeToString(juniperSum[:]), Tenants: []string{"Juniper"}},
+			{Name: "interop", KeySha256: hex.EncodeToString(interopSum[:]), Tenants: []string{"Interop"}, Maps: []string{mistfake.MapId11F}},
+			{Name: "staff", KeySha256: hex.EncodeToString(staffSum[:])},
+		}
+		cfg.Proximity.Enabled = true
+	})
+
+	// taro (Juniper) and hanako (Interop) meet in the booth, the forklift has no organisation
+	for i := 0; i <= 2; i++ {
+		ts := float64(testTimestamp + i*30)
+		for _, ev := range []mistfake.LocationAssetEvent{
+			{Mac: macTaro, SiteId: mistfake.SiteId, MapId: mistfake.MapId11F, X: 10, Y: 20, Timestamp: ts},
+			{Mac: macHanako, SiteId: mistfake.SiteId, MapId: mistfake.MapId11F, X: 11, Y: 20, Timestamp: ts + 1},
+			{Mac: macForklift, SiteId: mistfake.SiteId, MapId: mistfake.MapId11F, X: 40, Y: 40, Timestamp: ts + 2},
+		} {
+			err := e.webhook.PostLocationAsset(ev)
+			if err != nil {
+				t.Fatalf("location-asset webhook: %v", err)
+			}
+		}
+	}
+	for _, mac := range []string{macTaro, macHanako} {
+		err := e.webhook.PostZone(mistfake.ZoneEvent{Mac: mac, SiteId: mistfake.SiteId, MapId: mistfake.MapId11F, ZoneId: mistfake.ZoneBooth, Trigger: "enter", Timestamp: testTimestamp + 70})
+		if err != nil {
+			t.Fatalf("zone webhook: %v", err)
+		}
+	}
+
+	entityIds := func(key string) []string {
+		status, body := e.send(t, http.MethodGet, "/entity", key, nil)
+		if status != http.StatusOK {
+			t.Fatalf("GET /entity as %s: status %d (%s)", key, status, body)
+		}
+		list := []EntityExtView{}
+		json.Unmarshal(body, &list)
+		ids := make([]string, 0)
+		for _, v := range list {
+			ids = append(ids, v.Id)
+		}
+		return ids
+	}
+
+	if ids := entityIds("juniperkey"); len(ids) != 1 || ids[0] != macTaro {
+		t.Errorf("GET /entity as juniper: %v", ids)
+	}
+	if ids := entityIds("interopkey"); len(ids) != 1 || ids[0] != macHanako {
+		t.Errorf("GET /entity as interop: %v", ids)
+	}
+	if ids := entityIds("staffkey"); len(ids) != 3 {
+		t.Errorf("GET /entity as staff: %v", ids)
+	}
+
+	for _, c := range []struct {
+		uri    string
+		status int
+	}{
+		{"/entity/" + macTaro, http.StatusOK},
+		{"/entity/" + macHanako, http.StatusNotFound},
+		{"/entity/" + macHanako + "/visits", http.StatusNotFound},
+		{"/zone/" + mistfake.ZoneBooth + "/occupancy", http.StatusForbidden},
+		{"/metrics", http.StatusForbidden},
+	} {
+		status, body := e.send(t, http.MethodGet, c.uri, "juniperkey", nil)
+		if status != c.status {
+			t.Errorf("GET %s as juniper: status %d; want %d (%s)", c.uri, status, c.status, body)
+		}
+	}
+
+	// zone counts and visits only include the tenant's own entities
+	status, body := e.send(t, http.MethodGet, "/zone", "juniperkey", nil)
+	zones := []ZoneExtView{}
+	json.Unmarshal(body, &zones)
+	for _, z := range zones {
+		if z.Id == mistfake.ZoneBooth && z.Count != 1 {
+			t.Errorf("GET /zone as juniper: booth count %d; want 1", z.Count)
+		}
+	}
+	if status != http.StatusOK || len(zones) == 0 {
+		t.Errorf("GET /zone as juniper: status %d (%s)", status, body)
+	}
+
+	status, body = e.send(t, http.MethodGet, "/zone/"+mistfake.ZoneBooth+"/visits", "juniperkey", nil)
+	visits := ZoneVisitsExtView{}
+	json.Unmarshal(body, &visits)
+	if status != http.StatusOK || visits.Count != 1 || len(visits.Visits) != 1 || visits.Visits[0].Mac != macTaro {
+		t.Errorf("GET /zone/{zoneid}/visits as juniper: status %d (%s)", status, body)
+	}
+
+	// contacts with other tenants are not reported to either
+	status, body = e.send(t, http.MethodGet, "/entity/"+macTaro+"/contacts", "juniperkey", nil)
+	if status != http.StatusOK || string(body) != "[]\n" {
+		t.Errorf("GET /entity/{mac}/contacts as juniper: status %d (%s)", status, body)
+	}
+	status, body = e.send(t, http.MethodGet, "/entity/"+macTaro+"/contacts", "staffkey", nil)
+	contacts := []ContactExtView{}
+	json.Unmarshal(body, &contacts)
+	if status != http.StatusOK || len(contacts) != 1 || contacts[0].Mac != macHanako {
+		t.Errorf("GET /entity/{mac}/contacts as staff: status %d (%s)", status, body)
+	}
+
+	status, body = e.send(t, http.MethodGet, "/tenant", "juniperkey", nil)
+	tenants := []TenantExtView{}
+	json.Unmarshal(body, &tenants)
+	if status != http.StatusOK || len(tenants) != 1 || tenants[0].Tenant != "Juniper" || tenants[0].Entities != 1 ||
+		tenants[0].Active != 1 || tenants[0].Maps[mistfake.MapId11F] != 1 || tenants[0].Zones[mistfake.ZoneBooth] != 1 {
+		t.Errorf("GET /tenant as juniper: status %d (%s)", status, body)
+	}
+
+	status, body = e.send(t, http.MethodGet, "/metrics", "interopkey", nil)
+	if status != http.StatusForbidden {
+		t.Errorf("GET /metrics as interop: status %d; want %d (%s)", status, http.StatusForbidden, body)
+	}
+	status, body = e.send(t, http.MethodGet, "/metrics", "staffkey", nil)
+	if status != http.StatusOK {
+		t.Errorf("GET /metrics as staff: status %d (%s)", status, body)
+	}
+
+	status, body = e.send(t, http.MethodGet, "/tenant", "staffkey", nil)
+	tenants = []TenantExtView{}
+	json.Unmarshal(body, &tenants)
+	if status != http.StatusOK || len(tenants) != 3 || tenants[0].Tenant != "" || tenants[1].Tenant != "Interop" || tenants[2].Tenant != "Juniper" {
+		t.Errorf("GET /tenant as staff: status %d (%s)", status, body)
+	}
+}
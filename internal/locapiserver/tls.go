@@ -0,0 +1,163 @@
+package locapiserver
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/go-chi/render"
+)
+
+// certReloader serves a certificate and key pair from disk and loads them
+// again when either file changes, so renewed certificates apply without restart
+type certReloader struct {
+	certFile string
+	keyFile  string
+
+	mu      sync.Mutex
+	cert    *tls.Certificate
+	certMod time.Time
+	keyMod  time.Time
+}
+
+func newCertReloader(certFile string, keyFile string) (*certReloader, error) {
+	c := &certReloader{
+		certFile: certFile,
+		keyFile:  keyFile,
+	}
+
+	err := c.reload()
+	if err != nil {
+		return nil, err
+	}
+
+	return c, nil
+}
+
+func fileModTime(path string) (time.Time, error) {
+	st, err := os.Stat(path)
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	return st.ModTime(), nil
+}
+
+// reload loads the pair if a file has changed since the last load
+func (c *certReloader) reload() error {
+	certMod, err := fileModTime(c.certFile)
+	if err != nil {
+		return err
+	}
+	keyMod, err := fileModTime(c.keyFile)
+	if err != nil {
+		return err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.cert != nil && certMod.Equal(c.certMod) && keyMod.Equal(c.keyMod) {
+		return nil
+	}
+
+	cert, err := tls.LoadX509KeyPair(c.certFile, c.keyFile)
+	if err != nil {
+		return err
+	}
+
+	if c.cert != nil {
+		log.Printf("certReloader: Reloaded certificate %s", c.certFile)
+	}
+	c.cert = &cert
+	c.certMod = certMod
+	c.keyMod = keyMod
+	return nil
+}
+
+func (c *certReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	// keep serving the previous pair while a renewal is half written
+	err := c.reload()
+	if err != nil {
+		log.Printf("certReloader: Failed to reload certificate (%v)", err)
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.cert, nil
+}
+
+var tlsVersions = map[string]uint16{
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// newTlsConfig builds the server TLS configuration, or returns nil when TLS is not configured
+func newTlsConfig(cfg Config) (*tls.Config, error) {
+	t := cfg.Http.Tls
+	if t.CertFile == "" && t.KeyFile == "" {
+		// client certificates are only checked on TLS connections
+		if t.ClientCaFile != "" {
+			return nil, fmt.Errorf("tls client_ca_file requires cert_file and key_file")
+		}
+		return nil, nil
+	} else if t.CertFile == "" || t.KeyFile == "" {
+		return nil, fmt.Errorf("both tls cert_file and key_file are required")
+	}
+
+	minVersion := "1.2"
+	if t.MinVersion != "" {
+		minVersion = t.MinVersion
+	}
+	version, ok := tlsVersions[minVersion]
+	if !ok {
+		return nil, fmt.Errorf("unsupported tls min_version %s", minVersion)
+	}
+
+	certs, err := newCertReloader(t.CertFile, t.KeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load certificate: %w", err)
+	}
+
+	tlsCfg := &tls.Config{
+		MinVersion:     version,
+		GetCertificate: certs.GetCertificate,
+	}
+
+	// client certificates are optional at handshake and enforced per route
+	if t.ClientCaFile != "" {
+		pem, err := os.ReadFile(t.ClientCaFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read client CA: %w", err)
+		}
+
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %s", t.ClientCaFile)
+		}
+
+		tlsCfg.ClientCAs = pool
+		tlsCfg.ClientAuth = tls.VerifyClientCertIfGiven
+	}
+
+	return tlsCfg, nil
+}
+
+// requireClientCert rejects requests without a client certificate signed by the configured CA
+func (s *LocApiServer) requireClientCert(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 {
+			err := fmt.Errorf("missing client certificate")
+			render.Render(w, r, s.httpErrUnauthorized(err))
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
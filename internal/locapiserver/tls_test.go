@@ -0,0 +1,185 @@
+package locapiserver
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"mist-location-visualization/internal/mistfake"
+)
+
+type testCert struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+}
+
+// newTestCert issues a certificate signed by parent (self-signed when parent is nil)
+func newTestCert(t *testing.T, serial int64, isCA bool, parent *testCert) *testCert {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(serial),
+		Subject:               pkix.Name{CommonName: "locapid-test"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  isCA,
+		BasicConstraintsValid: true,
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1")},
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+
+	signer := &testCert{cert: tmpl, key: key}
+	if parent != nil {
+		signer = parent
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, signer.cert, &key.PublicKey, signer.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return &testCert{cert: cert, key: key}
+}
+
+func (c *testCert) write(t *testing.T, certFile string, keyFile string) {
+	t.Helper()
+
+	keyDer, err := x509.MarshalECPrivateKey(c.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: c.cert.Raw}), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func (c *testCert) tlsCertificate() tls.Certificate {
+	return tls.Certificate{Certificate: [][]byte{c.cert.Raw}, PrivateKey: c.key}
+}
+
+func TestTlsAndClientCert(t *testing.T) {
+	dir := t.TempDir()
+	certFile := filepath.Join(dir, "server.crt")
+	keyFile := filepath.Join(dir, "server.key")
+	caFile := filepath.Join(dir, "ca.crt")
+
+	ca := newTestCert(t, 1, true, nil)
+	ca.write(t, caFile, filepath.Join(dir, "ca.key"))
+	newTestCert(t, 2, false, ca).write(t, certFile, keyFile)
+	client := newTestCert(t, 3, false, ca)
+
+	e := newTestEnv(t, func(cfg *Config) {
+		cfg.Http.Tls.CertFile = certFile
+		cfg.Http.Tls.KeyFile = keyFile
+		cfg.Http.Tls.MinVersion = "1.3"
+		cfg.Http.Tls.ClientCaFile = caFile
+	})
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go e.server.serve(ctx, ln)
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.cert)
+	newClient := func(certs ...tls.Certificate) *http.Client {
+		return &http.Client{Transport: &http.Transport{
+			TLSClientConfig:   &tls.Config{RootCAs: roots, Certificates: certs},
+			DisableKeepAlives: true,
+		}}
+	}
+	baseURL := "https://" + ln.Addr().String()
+
+	// API routes do not need a client certificate
+	resp, err := newClient().Get(baseURL + "/healthz")
+	if err != nil {
+		t.Fatalf("GET /healthz: %v", err)
+	}
+	resp.Body.Close()
+	if resp.TLS.Version != tls.VersionTLS13 || resp.TLS.PeerCertificates[0].SerialNumber.Int64() != 2 {
+		t.Errorf("unexpected TLS state: version %x, serial %v", resp.TLS.Version, resp.TLS.PeerCertificates[0].SerialNumber)
+	}
+
+	// webhooks need one
+	ev := mistfake.LocationAssetEvent{Mac: macTaro, SiteId: mistfake.SiteId, MapId: mistfake.MapId11F, X: 10, Y: 20, Timestamp: testTimestamp}
+	wh := mistfake.NewWebhookSender(baseURL+"/mistrecv", testSecret)
+	wh.Client = newClient()
+	err = wh.PostLocationAsset(ev)
+	if err == nil {
+		t.Error("webhook without client certificate was accepted")
+	}
+
+	wh.Client = newClient(client.tlsCertificate())
+	err = wh.PostLocationAsset(ev)
+	if err != nil {
+		t.Errorf("webhook with client certificate: %v", err)
+	}
+
+	// a renewed certificate is picked up without restart
+	newTestCert(t, 4, false, ca).write(t, certFile, keyFile)
+	later := time.Now().Add(time.Minute)
+	os.Chtimes(certFile, later, later)
+	os.Chtimes(keyFile, later, later)
+
+	resp, err = newClient().Get(baseURL + "/healthz")
+	if err != nil {
+		t.Fatalf("GET /healthz after renewal: %v", err)
+	}
+	resp.Body.Close()
+	if serial := resp.TLS.PeerCertificates[0].SerialNumber.Int64(); serial != 4 {
+		t.Errorf("got certificate serial %d after renewal; want 4", serial)
+	}
+}
+
+func TestTlsConfigErrors(t *testing.T) {
+	for _, c := range []struct {
+		name string
+		tls  func(cfg *Config)
+	}{
+		{"cert without key", func(cfg *Config) { cfg.Http.Tls.CertFile = "server.crt" }},
+		{"client CA without TLS", func(cfg *Config) { cfg.Http.Tls.ClientCaFile = "ca.crt" }},
+		{"unsupported version", func(cfg *Config) {
+			cfg.Http.Tls.CertFile = "server.crt"
+			cfg.Http.Tls.KeyFile = "server.key"
+			cfg.Http.Tls.MinVersion = "1.1"
+		}},
+	} {
+		cfg := Config{}
+		c.tls(&cfg)
+		tlsCfg, err := newTlsConfig(cfg)
+		if err == nil || tlsCfg != nil {
+			t.Errorf("newTlsConfig with %s: got %v; want error", c.name, tlsCfg)
+		}
+	}
+}
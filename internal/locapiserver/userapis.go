@@ -5,40 +5,263 @@ import (
 	"fmt"
 	"log"
 	"net/http"
+	"slices"
+	"strings"
 	"time"
 
 	"mist-location-visualization/internal/models"
 
 	"github.com/go-chi/chi"
 	"github.com/go-chi/render"
+	"gorm.io/gorm"
 )
 
 // EntityExtView represents the external view of an entity for API responses
 type EntityExtView struct {
 	Id          string  `json:"id"`
+	Kind        string  `json:"kind"`
 	MapId       string  `json:"map_id"`
 	X           float64 `json:"x"`
 	Y           float64 `json:"y"`
+	RawX        float64 `json:"raw_x"`
+	RawY        float64 `json:"raw_y"`
 	Lastseen    int64   `json:"last_seen"`
 	ZoneName    string  `json:"zone_name"`
 	DisplayName string  `json:"display_name"`
 	DisplayOrg  string  `json:"display_org"`
+	BuildingId  string  `json:"building_id"`
+	FloorLevel  int     `json:"floor_level"`
+	FloorName   string  `json:"floor_name"`
 }
 
 func (e *EntityExtView) Render(w http.ResponseWriter, r *http.Request) error {
 	return nil
 }
 
+// FloorChangeExtView represents the external view of a floor change for API responses
+type FloorChangeExtView struct {
+	FromMapId  string `json:"from_map_id"`
+	ToMapId    string `json:"to_map_id"`
+	FromLevel  int    `json:"from_level"`
+	ToLevel    int    `json:"to_level"`
+	BuildingId string `json:"building_id"`
+	ChangedAt  int64  `json:"changed_at"`
+}
+
+func (e *FloorChangeExtView) Render(w http.ResponseWriter, r *http.Request) error {
+	return nil
+}
+
+func (s *LocApiServer) apiEntityMacCtx(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key := chi.URLParam(r, "mac")
+		if key == "" {
+			err := fmt.Errorf("Missing mac param")
+			render.Render(w, r, s.httpErrInvalidRequest(err))
+			return
+		}
+
+		if p := getPrincipal(r.Context()); p != nil && (p.restricted || p.tenanted) {
+			e := models.Entity{}
+			ret := s.dbConn.WithContext(r.Context()).Where("mac = ?", key).Limit(1).Find(&e)
+			if ret.Error != nil {
+				log.Printf("apiEntityMacCtx: Failed to query DB (%v)", ret.Error)
+				err := fmt.Errorf("failed to get data from backend")
+				render.Render(w, r, s.httpErrUnexpected(err))
+				return
+			} else if ret.RowsAffected == 0 || !p.allowsMap(e.MapId) || !p.allowsTenant(e.DisplayOrg) {
+				err := fmt.Errorf("entity %s not found", key)
+				render.Render(w, r, s.httpErrNotFound(err))
+				return
+			}
+		}
+
+		ctx := context.WithValue(r.Context(), "mac", key)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
 func (s *LocApiServer) apiEntityRouter() chi.Router {
 	r := chi.NewRouter()
 	r.Get("/", s.apiEntityGetAll)
+	r.Route("/{mac}", func(r chi.Router) {
+		r.Use(s.apiEntityMacCtx)
+
+		// anonymous entities cannot be looked up by their mac, and zone level ones
+		// have no precise positions to derive contacts from
+		r.Group(func(r chi.Router) {
+			r.Use(s.apiEntityVisibleCtx(models.PrivacyVisible, models.PrivacyZoneOnly))
+			r.Get("/", s.apiEntityGet)
+			r.Get("/floorchange", s.apiEntityGetFloorChange)
+			r.Get("/visits", s.apiEntityGetVisits)
+		})
+		r.With(s.apiEntityVisibleCtx(models.PrivacyVisible)).Get("/contacts", s.apiEntityGetContacts)
+		r.With(s.apiRequireScope(scopeAdmin)).Delete("/", s.apiEntityDelete)
+
+		r.Route("/privacy", func(r chi.Router) {
+			r.Use(s.apiRequireScope(scopeAdmin))
+			r.Get("/", s.apiEntityGetPrivacy)
+			r.Put("/", s.apiEntityPutPrivacy)
+			r.Delete("/", s.apiEntityDeletePrivacy)
+		})
+	})
 
 	return r
 }
 
+// entityExpiryInterval is how often entities are checked for the location timeout
+const entityExpiryInterval = 10 * time.Second
+
+// timedOut reports whether e has a position but was not seen within the location timeout at now
+func (s *LocApiServer) timedOut(e *models.Entity, now time.Time) bool {
+	timeoutDuration := time.Duration(s.config().Mist.LocationTimeout) * time.Second
+	tExpire := eventTime(e.Lastseen).Add(timeoutDuration)
+	return now.After(tExpire) && e.X != -1 && e.Y != -1
+}
+
+// clearPosition marks e as not located
+func clearPosition(e *models.Entity) {
+	e.X = -1
+	e.Y = -1
+	e.RawX = -1
+	e.RawY = -1
+	e.MapId = ""
+	e.ZoneId = ""
+	e.ZoneName = ""
+}
+
+// expireEntity clears the position of an entity which has not been seen within the location timeout,
+// and closes its visits and contacts
+func (s *LocApiServer) expireEntity(ctx context.Context, e *models.Entity, now time.Time) {
+	if !s.timedOut(e, now) {
+		return
+	}
+
+	log.Printf("expireEntity: Mac %s has timed out", e.Mac)
+	s.metrics.entityTimeouts.Inc()
+	s.closeZoneVisits(ctx, e.Mac, "", eventTime(e.Lastseen))
+
+	s.filter.reset(e.Mac)
+	s.closeContacts(ctx, e.Mac)
+
+	clearPosition(e)
+	s.dbConn.WithContext(ctx).Debug().Save(e)
+}
+
+// expireEntities expires the located entities not seen within the location timeout at now
+func (s *LocApiServer) expireEntities(ctx context.Context, now time.Time) error {
+	cutoff := float64(now.Unix() - int64(s.config().Mist.LocationTimeout))
+	entities := make([]models.Entity, 0)
+	ret := s.dbConn.WithContext(ctx).Where("x <> -1 AND y <> -1 AND lastseen < ?", cutoff).Find(&entities)
+	if ret.Error != nil {
+		return ret.Error
+	}
+
+	for _, e := range entities {
+		s.expireEntity(ctx, &e, now)
+	}
+
+	return nil
+}
+
+// runEntityExpiry expires timed out entities every interval until ctx is cancelled
+func (s *LocApiServer) runEntityExpiry(ctx context.Context, interval time.Duration) {
+	log.Printf("runEntityExpiry: Checking location timeouts every %s", interval)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			log.Printf("runEntityExpiry: Stopped")
+			return
+		case t := <-ticker.C:
+			err := s.expireEntities(ctx, t)
+			if err != nil {
+				log.Printf("runEntityExpiry: Failed to expire entities (%v)", err)
+			}
+		}
+	}
+}
+
+func (s *LocApiServer) getMapIndex(ctx context.Context) (map[string]models.Map, error) {
+	maps := make([]models.Map, 0)
+	ret := s.dbConn.WithContext(ctx).Find(&maps)
+	if ret.Error != nil {
+		return nil, ret.Error
+	}
+
+	idx := make(map[string]models.Map)
+	for _, m := range maps {
+		idx[m.Id] = m
+	}
+
+	return idx, nil
+}
+
+// getKindFilter parses the comma separated "kind" query parameter
+func getKindFilter(r *http.Request) ([]string, error) {
+	param := r.URL.Query().Get("kind")
+	if param == "" {
+		return nil, nil
+	}
+
+	kinds := strings.Split(param, ",")
+	for _, k := range kinds {
+		if !slices.Contains(models.EntityKinds, k) {
+			return nil, fmt.Errorf("unknown kind %s", k)
+		}
+	}
+
+	return kinds, nil
+}
+
+// entityQuery returns a query on entities restricted to kinds (all kinds when empty)
+// and to the maps and tenants the caller may see
+func (s *LocApiServer) entityQuery(ctx context.Context, kinds []string) *gorm.DB {
+	q := restrictMaps(ctx, s.dbConn.WithContext(ctx).Model(&models.Entity{}), "map_id")
+	q = restrictTenants(ctx, q, "display_org")
+	if len(kinds) > 0 {
+		q = q.Where("kind IN ?", kinds)
+	}
+
+	return q
+}
+
+func newEntityExtView(e models.Entity, maps map[string]models.Map) *EntityExtView {
+	o := &EntityExtView{
+		Id:          e.Mac,
+		Kind:        e.Kind,
+		MapId:       e.MapId,
+		X:           e.X,
+		Y:           e.Y,
+		RawX:        e.RawX,
+		RawY:        e.RawY,
+		Lastseen:    int64(e.Lastseen),
+		ZoneName:    e.ZoneName,
+		DisplayName: e.DisplayName,
+		DisplayOrg:  e.DisplayOrg,
+	}
+
+	if m, ok := maps[e.MapId]; ok {
+		o.BuildingId = m.BuildingId
+		o.FloorLevel = m.FloorLevel
+		o.FloorName = m.FloorName
+	}
+
+	return o
+}
+
 func (s *LocApiServer) apiEntityGetAll(w http.ResponseWriter, r *http.Request) {
+	kinds, err := getKindFilter(r)
+	if err != nil {
+		render.Render(w, r, s.httpErrInvalidRequest(err))
+		return
+	}
+
 	entities := make([]models.Entity, 0)
-	ret := s.dbConn.Find(&entities)
+	ret := s.entityQuery(r.Context(), kinds).Find(&entities)
 	if ret.Error != nil {
 		log.Printf("apiEntityGetAll: Failed to query DB (%v)", ret.Error)
 		err := fmt.Errorf("failed to get data from backend")
@@ -46,32 +269,98 @@ func (s *LocApiServer) apiEntityGetAll(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	maps, err := s.getMapIndex(r.Context())
+	if err != nil {
+		log.Printf("apiEntityGetAll: Failed to query DB on maps (%v)", err)
+		err := fmt.Errorf("failed to get data from backend")
+		render.Render(w, r, s.httpErrUnexpected(err))
+		return
+	}
+
+	pp, err := s.loadPrivacy(r.Context())
+	if err != nil {
+		log.Printf("apiEntityGetAll: Failed to query DB on privacy settings (%v)", err)
+		err := fmt.Errorf("failed to get data from backend")
+		render.Render(w, r, s.httpErrUnexpected(err))
+		return
+	}
+
+	// timed out entities are shown without a position until runEntityExpiry stores it
+	now := time.Now()
 	outs := []render.Renderer{}
 	for _, e := range entities {
-		// check timeout
-		tNow := time.Now()
-		timeoutDuration := time.Duration(s.cfg.Mist.LocationTimeout) * time.Second
-		tExpire := time.Unix(int64(e.Lastseen), 0).Add(timeoutDuration)
-		if tNow.After(tExpire) && e.X != -1 && e.Y != -1 {
-			log.Printf("apiEntityGetAll: Mac %s has timed out", e.Mac)
-
-			e.X = -1
-			e.Y = -1
-			e.MapId = ""
-			e.ZoneId = ""
-			e.ZoneName = ""
-			s.dbConn.Debug().Save(&e)
+		if s.timedOut(&e, now) {
+			clearPosition(&e)
+		}
+
+		if o := pp.entityView(e, maps); o != nil {
+			outs = append(outs, o)
 		}
+	}
+
+	render.RenderList(w, r, outs)
+	return
+}
+
+func (s *LocApiServer) apiEntityGet(w http.ResponseWriter, r *http.Request) {
+	mac := getCtxValueString(r.Context(), "mac")
+	e := models.Entity{}
+	ret := s.dbConn.WithContext(r.Context()).Where(&models.Entity{Mac: mac}).Limit(1).Find(&e)
+	if ret.Error != nil {
+		log.Printf("apiEntityGet: Failed to query DB (%v)", ret.Error)
+		err := fmt.Errorf("failed to get data from backend")
+		render.Render(w, r, s.httpErrUnexpected(err))
+		return
+	} else if ret.RowsAffected == 0 {
+		err := fmt.Errorf("entity %s not found", mac)
+		render.Render(w, r, s.httpErrNotFound(err))
+		return
+	}
+
+	maps, err := s.getMapIndex(r.Context())
+	if err != nil {
+		log.Printf("apiEntityGet: Failed to query DB on maps (%v)", err)
+		err := fmt.Errorf("failed to get data from backend")
+		render.Render(w, r, s.httpErrUnexpected(err))
+		return
+	}
+
+	pp, err := s.loadPrivacy(r.Context())
+	if err != nil {
+		log.Printf("apiEntityGet: Failed to query DB on privacy settings (%v)", err)
+		err := fmt.Errorf("failed to get data from backend")
+		render.Render(w, r, s.httpErrUnexpected(err))
+		return
+	}
+
+	if s.timedOut(&e, time.Now()) {
+		clearPosition(&e)
+	}
+
+	render.Render(w, r, pp.entityView(e, maps))
+	return
+}
+
+func (s *LocApiServer) apiEntityGetFloorChange(w http.ResponseWriter, r *http.Request) {
+	mac := getCtxValueString(r.Context(), "mac")
+	changes := make([]models.FloorChange, 0)
+	ret := restrictMaps(r.Context(), s.dbConn.WithContext(r.Context()), "to_map_id").Where("mac = ?", mac).Order("changed_at desc").Find(&changes)
+	if ret.Error != nil {
+		log.Printf("apiEntityGetFloorChange: Failed to query DB (%v)", ret.Error)
+		err := fmt.Errorf("failed to get data from backend")
+		render.Render(w, r, s.httpErrUnexpected(err))
+		return
+	}
 
-		o := &EntityExtView{
-			Id:          e.Mac,
-			MapId:       e.MapId,
-			X:           e.X,
-			Y:           e.Y,
-			Lastseen:    int64(e.Lastseen),
-			ZoneName:    e.ZoneName,
-			DisplayName: e.DisplayName,
-			DisplayOrg:  e.DisplayOrg,
+	outs := []render.Renderer{}
+	for _, e := range changes {
+		o := &FloorChangeExtView{
+			FromMapId:  e.FromMapId,
+			ToMapId:    e.ToMapId,
+			FromLevel:  e.FromLevel,
+			ToLevel:    e.ToLevel,
+			BuildingId: e.BuildingId,
+			ChangedAt:  e.ChangedAt.Unix(),
 		}
 
 		outs = append(outs, o)
@@ -89,10 +378,14 @@ func (s *LocApiServer) apiSearchRouter() chi.Router {
 
 // MapExtView represents the external view of a map for API responses
 type MapExtView struct {
-	Id     string `json:"id"`
-	Name   string `json:"name"`
-	Width  int64  `json:"width"`
-	Height int64  `json:"height"`
+	Id         string `json:"id"`
+	Name       string `json:"name"`
+	Width      int64  `json:"width"`
+	Height     int64  `json:"height"`
+	SiteId     string `json:"site_id"`
+	BuildingId string `json:"building_id"`
+	FloorLevel int    `json:"floor_level"`
+	FloorName  string `json:"floor_name"`
 }
 
 func (e *MapExtView) Render(w http.ResponseWriter, r *http.Request) error {
@@ -108,6 +401,12 @@ func (s *LocApiServer) apiMapIdCtx(next http.Handler) http.Handler {
 			return
 		}
 
+		if !getPrincipal(r.Context()).allowsMap(key) {
+			err := fmt.Errorf("map %s not found", key)
+			render.Render(w, r, s.httpErrNotFound(err))
+			return
+		}
+
 		ctx := context.WithValue(r.Context(), "mapid", key)
 		next.ServeHTTP(w, r.WithContext(ctx))
 	})
@@ -119,6 +418,8 @@ func (s *LocApiServer) apiMapRouter() chi.Router {
 	r.Route("/{mapid}", func(r chi.Router) {
 		r.Use(s.apiMapIdCtx)
 		r.Get("/zone", s.apiMapGetZone)
+		r.Get("/occupancy", s.apiGetOccupancy(models.OccupancyScopeMap))
+		r.Get("/heatmap", s.apiMapGetHeatmap)
 	})
 
 	return r
@@ -126,7 +427,7 @@ func (s *LocApiServer) apiMapRouter() chi.Router {
 
 func (s *LocApiServer) apiMapGetAll(w http.ResponseWriter, r *http.Request) {
 	maps := make([]models.Map, 0)
-	ret := s.dbConn.Find(&maps)
+	ret := restrictMaps(r.Context(), s.dbConn.WithContext(r.Context()), "id").Find(&maps)
 	if ret.Error != nil {
 		log.Printf("apiMapGetAll: Failed to query DB (%v)", ret.Error)
 		err := fmt.Errorf("Failed to get data from backend")
@@ -137,10 +438,14 @@ func (s *LocApiServer) apiMapGetAll(w http.ResponseWriter, r *http.Request) {
 	outs := []render.Renderer{}
 	for _, e := range maps {
 		o := &MapExtView{
-			Id:     e.Id,
-			Name:   e.Name,
-			Height: e.Height,
-			Width:  e.Width,
+			Id:         e.Id,
+			Name:       e.Name,
+			Height:     e.Height,
+			Width:      e.Width,
+			SiteId:     e.SiteId,
+			BuildingId: e.BuildingId,
+			FloorLevel: e.FloorLevel,
+			FloorName:  e.FloorName,
 		}
 
 		outs = append(outs, o)
@@ -152,8 +457,14 @@ func (s *LocApiServer) apiMapGetAll(w http.ResponseWriter, r *http.Request) {
 
 func (s *LocApiServer) apiMapGetZone(w http.ResponseWriter, r *http.Request) {
 	mapId := getCtxValueString(r.Context(), "mapid")
+	kinds, err := getKindFilter(r)
+	if err != nil {
+		render.Render(w, r, s.httpErrInvalidRequest(err))
+		return
+	}
+
 	zones := make([]models.Zone, 0)
-	ret := s.dbConn.Where("map_id = ?", mapId).Find(&zones)
+	ret := s.dbConn.WithContext(r.Context()).Where("map_id = ?", mapId).Find(&zones)
 	if ret.Error != nil {
 		log.Printf("apiMapGetZone: Failed to query DB (%v)", ret.Error)
 		err := fmt.Errorf("failed to get data from backend")
@@ -161,36 +472,56 @@ func (s *LocApiServer) apiMapGetZone(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	geofences := make([]models.Geofence, 0)
+	ret = s.dbConn.WithContext(r.Context()).Where("map_id = ?", mapId).Order("name").Find(&geofences)
+	if ret.Error != nil {
+		log.Printf("apiMapGetZone: Failed to query DB on geofences (%v)", ret.Error)
+		err := fmt.Errorf("failed to get data from backend")
+		render.Render(w, r, s.httpErrUnexpected(err))
+		return
+	}
+
 	outs := []render.Renderer{}
 	for _, e := range zones {
 		var count int64
 
-		result := s.dbConn.Model(&models.Entity{}).Where("zone_id = ?", e.Id).Count(&count)
+		result := s.entityQuery(r.Context(), kinds).Where("zone_id = ?", e.Id).Count(&count)
 		if result.Error != nil {
 			log.Printf("apiMapGetZone: Failed to query DB on count (%v)", result.Error)
 			count = 0
 		}
 
 		o := &ZoneExtView{
-			Id:    e.Id,
-			Name:  e.Name,
-			MapId: e.MapId,
-			Count: count,
+			Id:     e.Id,
+			Name:   e.Name,
+			MapId:  e.MapId,
+			Source: zoneSourceMist,
+			Count:  count,
 		}
 
 		outs = append(outs, o)
 	}
+	for _, e := range geofences {
+		outs = append(outs, s.newGeofenceZoneExtView(r.Context(), e, kinds))
+	}
 
 	render.RenderList(w, r, outs)
 	return
 }
 
-// ZoneExtView represents the external view of a zone for API responses
+// Sources of zones
+const (
+	zoneSourceMist     = "mist"
+	zoneSourceGeofence = "geofence"
+)
+
+// ZoneExtView represents the external view of a zone or geofence for API responses
 type ZoneExtView struct {
-	Id    string `json:"id"`
-	Name  string `json:"name"`
-	MapId string `json:"map_id"`
-	Count int64  `json:"count"`
+	Id     string `json:"id"`
+	Name   string `json:"name"`
+	MapId  string `json:"map_id"`
+	Source string `json:"source"`
+	Count  int64  `json:"count"`
 }
 
 func (e *ZoneExtView) Render(w http.ResponseWriter, r *http.Request) error {
@@ -200,13 +531,24 @@ func (e *ZoneExtView) Render(w http.ResponseWriter, r *http.Request) error {
 func (s *LocApiServer) apiZoneRouter() chi.Router {
 	r := chi.NewRouter()
 	r.Get("/", s.apiZoneGetAll)
+	r.Route("/{zoneid}", func(r chi.Router) {
+		r.Use(s.apiZoneIdCtx)
+		r.Get("/visits", s.apiZoneGetVisits)
+		r.Get("/occupancy", s.apiGetOccupancy(models.OccupancyScopeZone))
+	})
 
 	return r
 }
 
 func (s *LocApiServer) apiZoneGetAll(w http.ResponseWriter, r *http.Request) {
+	kinds, err := getKindFilter(r)
+	if err != nil {
+		render.Render(w, r, s.httpErrInvalidRequest(err))
+		return
+	}
+
 	zones := make([]models.Zone, 0)
-	ret := s.dbConn.Find(&zones)
+	ret := restrictMaps(r.Context(), s.dbConn.WithContext(r.Context()), "map_id").Find(&zones)
 	if ret.Error != nil {
 		log.Printf("apiZoneGetAll: Failed to query DB (%v)", ret.Error)
 		err := fmt.Errorf("failed to get data from backend")
@@ -214,25 +556,38 @@ func (s *LocApiServer) apiZoneGetAll(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	geofences := make([]models.Geofence, 0)
+	ret = restrictMaps(r.Context(), s.dbConn.WithContext(r.Context()), "map_id").Order("name").Find(&geofences)
+	if ret.Error != nil {
+		log.Printf("apiZoneGetAll: Failed to query DB on geofences (%v)", ret.Error)
+		err := fmt.Errorf("failed to get data from backend")
+		render.Render(w, r, s.httpErrUnexpected(err))
+		return
+	}
+
 	outs := []render.Renderer{}
 	for _, e := range zones {
 		var count int64
 
-		result := s.dbConn.Model(&models.Entity{}).Where("zone_id = ?", e.Id).Count(&count)
+		result := s.entityQuery(r.Context(), kinds).Where("zone_id = ?", e.Id).Count(&count)
 		if result.Error != nil {
 			log.Printf("apiZoneGetAll: Failed to query DB on count (%v)", result.Error)
 			count = 0
 		}
 
 		o := &ZoneExtView{
-			Id:    e.Id,
-			Name:  e.Name,
-			MapId: e.MapId,
-			Count: count,
+			Id:     e.Id,
+			Name:   e.Name,
+			MapId:  e.MapId,
+			Source: zoneSourceMist,
+			Count:  count,
 		}
 
 		outs = append(outs, o)
 	}
+	for _, e := range geofences {
+		outs = append(outs, s.newGeofenceZoneExtView(r.Context(), e, kinds))
+	}
 
 	render.RenderList(w, r, outs)
 	return
@@ -0,0 +1,362 @@
+package locapiserver
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"mist-location-visualization/internal/models"
+
+	"github.com/go-chi/chi"
+	"github.com/go-chi/render"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// ZoneVisitExtView represents the external view of a zone visit for API responses.
+// ExitAt and Dwell are 0 while the entity is still in the zone.
+type ZoneVisitExtView struct {
+	Id       uint    `json:"id"`
+	Mac      string  `json:"mac"`
+	ZoneId   string  `json:"zone_id"`
+	ZoneName string  `json:"zone_name"`
+	MapId    string  `json:"map_id"`
+	EnterAt  int64   `json:"enter_at"`
+	ExitAt   int64   `json:"exit_at"`
+	Dwell    float64 `json:"dwell"`
+}
+
+func (e *ZoneVisitExtView) Render(w http.ResponseWriter, r *http.Request) error {
+	return nil
+}
+
+// ZoneVisitsExtView represents the visits of a zone with dwell statistics over closed visits
+type ZoneVisitsExtView struct {
+	ZoneId   string              `json:"zone_id"`
+	ZoneName string              `json:"zone_name"`
+	Count    int                 `json:"count"`
+	AvgDwell float64             `json:"avg_dwell"`
+	MaxDwell float64             `json:"max_dwell"`
+	Visits   []*ZoneVisitExtView `json:"visits"`
+}
+
+func (e *ZoneVisitsExtView) Render(w http.ResponseWriter, r *http.Request) error {
+	return nil
+}
+
+func newZoneVisitExtView(v models.ZoneVisit, zoneName string) *ZoneVisitExtView {
+	o := &ZoneVisitExtView{
+		Id:       v.Id,
+		Mac:      v.Mac,
+		ZoneId:   v.ZoneId,
+		ZoneName: zoneName,
+		MapId:    v.MapId,
+		EnterAt:  v.EnterAt.Unix(),
+		Dwell:    v.Dwell,
+	}
+
+	if v.ExitAt != nil {
+		o.ExitAt = v.ExitAt.Unix()
+	}
+
+	return o
+}
+
+// openZoneVisit starts a visit of mac in zoneId. An entity is in one Mist zone at a time,
+// so visits still open in other Mist zones are closed first. The check and the insert run
+// in one transaction on the locked open visits, so concurrent enter events open one visit.
+func (s *LocApiServer) openZoneVisit(ctx context.Context, mac string, zoneId string, mapId string, t time.Time) {
+	var visit *models.ZoneVisit
+	closed := make([]models.ZoneVisit, 0)
+	err := s.dbConn.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		open := make([]models.ZoneVisit, 0)
+		ret := tx.Clauses(clause.Locking{Strength: "UPDATE"}).Where("mac = ? AND exit_at IS NULL AND geofence = ?", mac, false).Find(&open)
+		if ret.Error != nil {
+			return ret.Error
+		}
+
+		duplicate := false
+		for _, v := range open {
+			if v.ZoneId == zoneId {
+				// duplicate enter event
+				duplicate = true
+				continue
+			}
+
+			err := s.endZoneVisit(tx, &v, t)
+			if err != nil {
+				return err
+			}
+			closed = append(closed, v)
+		}
+		if duplicate {
+			return nil
+		}
+
+		visit = &models.ZoneVisit{
+			Mac:     mac,
+			ZoneId:  zoneId,
+			MapId:   mapId,
+			EnterAt: t,
+		}
+		return tx.Create(visit).Error
+	})
+	if err != nil {
+		log.Printf("openZoneVisit: Failed to store zone visit (%v)", err)
+		return
+	}
+
+	// rules run after the commit, their actions must not hold the transaction open
+	for i := range closed {
+		s.fireZoneRules(ctx, ruleTriggerExit, &closed[i], t, visitDwell(&closed[i], t), nil)
+	}
+	if visit != nil {
+		s.fireZoneRules(ctx, ruleTriggerEnter, visit, t, 0, nil)
+	}
+
+	return
+}
+
+// closeZoneVisits ends the open visits of mac at t (in any zone when zoneId is empty,
+// of any entity when mac is empty)
+func (s *LocApiServer) closeZoneVisits(ctx context.Context, mac string, zoneId string, t time.Time) {
+	q := s.dbConn.WithContext(ctx).Where("exit_at IS NULL")
+	if mac != "" {
+		q = q.Where("mac = ?", mac)
+	}
+	if zoneId != "" {
+		q = q.Where("zone_id = ?", zoneId)
+	}
+
+	open := make([]models.ZoneVisit, 0)
+	ret := q.Find(&open)
+	if ret.Error != nil {
+		log.Printf("closeZoneVisits: Failed to query DB (%v)", ret.Error)
+		return
+	}
+
+	for _, v := range open {
+		s.closeZoneVisit(ctx, &v, t)
+	}
+
+	return
+}
+
+// closeZoneVisit stores the exit time and dwell of a visit.
+// Visits shorter than the minimum dwell are pass-throughs and are dropped.
+func (s *LocApiServer) closeZoneVisit(ctx context.Context, v *models.ZoneVisit, t time.Time) {
+	// pass-throughs are exits as well as far as rules are concerned
+	s.fireZoneRules(ctx, ruleTriggerExit, v, t, visitDwell(v, t), nil)
+
+	err := s.endZoneVisit(s.dbConn.WithContext(ctx), v, t)
+	if err != nil {
+		log.Printf("closeZoneVisit: Failed to store zone visit (%v)", err)
+	}
+
+	return
+}
+
+// endZoneVisit stores the end of v at t in db, or drops v when it is a pass-through
+func (s *LocApiServer) endZoneVisit(db *gorm.DB, v *models.ZoneVisit, t time.Time) error {
+	dwell := visitDwell(v, t)
+	if dwell < float64(s.config().Visit.MinDwell) {
+		return db.Delete(&models.ZoneVisit{}, "id = ?", v.Id).Error
+	}
+
+	v.ExitAt = &t
+	v.Dwell = dwell
+	return db.Save(v).Error
+}
+
+// visitDwell returns the seconds from the start of v to t
+func visitDwell(v *models.ZoneVisit, t time.Time) float64 {
+	return max(t.Sub(v.EnterAt).Seconds(), 0)
+}
+
+// getTimeRange parses the optional "from" and "to" query parameters (unix seconds)
+func getTimeRange(r *http.Request) (from time.Time, to time.Time, err error) {
+	for _, p := range []struct {
+		name string
+		t    *time.Time
+	}{{"from", &from}, {"to", &to}} {
+		param := r.URL.Query().Get(p.name)
+		if param == "" {
+			continue
+		}
+
+		sec, err := strconv.ParseInt(param, 10, 64)
+		if err != nil {
+			return from, to, fmt.Errorf("invalid %s %s", p.name, param)
+		}
+		*p.t = time.Unix(sec, 0)
+	}
+
+	return from, to, nil
+}
+
+// visitQuery returns a query on visits which entered within [from, to) on maps the caller may see
+// by entities of the tenants the caller may see
+func (s *LocApiServer) visitQuery(ctx context.Context, from time.Time, to time.Time) *gorm.DB {
+	q := restrictMaps(ctx, s.dbConn.WithContext(ctx).Model(&models.ZoneVisit{}), "map_id")
+	q = restrictEntities(ctx, q, "mac")
+	if !from.IsZero() {
+		q = q.Where("enter_at >= ?", from)
+	}
+	if !to.IsZero() {
+		q = q.Where("enter_at < ?", to)
+	}
+
+	return q
+}
+
+func (s *LocApiServer) apiZoneIdCtx(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key := chi.URLParam(r, "zoneid")
+		if key == "" {
+			err := fmt.Errorf("Missing zoneid param")
+			render.Render(w, r, s.httpErrInvalidRequest(err))
+			return
+		}
+
+		if p := getPrincipal(r.Context()); p != nil && p.restricted {
+			zone, err := s.findZone(r.Context(), key)
+			if err != nil {
+				log.Printf("apiZoneIdCtx: Failed to query DB (%v)", err)
+				err := fmt.Errorf("failed to get data from backend")
+				render.Render(w, r, s.httpErrUnexpected(err))
+				return
+			} else if zone == nil || !p.allowsMap(zone.MapId) {
+				err := fmt.Errorf("zone %s not found", key)
+				render.Render(w, r, s.httpErrNotFound(err))
+				return
+			}
+		}
+
+		ctx := context.WithValue(r.Context(), "zoneid", key)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+func (s *LocApiServer) apiZoneGetVisits(w http.ResponseWriter, r *http.Request) {
+	zoneId := getCtxValueString(r.Context(), "zoneid")
+	from, to, err := getTimeRange(r)
+	if err != nil {
+		render.Render(w, r, s.httpErrInvalidRequest(err))
+		return
+	}
+
+	zone, err := s.findZone(r.Context(), zoneId)
+	if err != nil {
+		log.Printf("apiZoneGetVisits: Failed to query DB (%v)", err)
+		err := fmt.Errorf("failed to get data from backend")
+		render.Render(w, r, s.httpErrUnexpected(err))
+		return
+	} else if zone == nil {
+		err := fmt.Errorf("zone %s not found", zoneId)
+		render.Render(w, r, s.httpErrNotFound(err))
+		return
+	}
+
+	visits := make([]models.ZoneVisit, 0)
+	ret := s.visitQuery(r.Context(), from, to).Where("zone_id = ?", zoneId).Order("enter_at desc").Find(&visits)
+	if ret.Error != nil {
+		log.Printf("apiZoneGetVisits: Failed to query DB on visits (%v)", ret.Error)
+		err := fmt.Errorf("failed to get data from backend")
+		render.Render(w, r, s.httpErrUnexpected(err))
+		return
+	}
+
+	pp, err := s.loadPrivacy(r.Context())
+	if err != nil {
+		log.Printf("apiZoneGetVisits: Failed to query DB on privacy settings (%v)", err)
+		err := fmt.Errorf("failed to get data from backend")
+		render.Render(w, r, s.httpErrUnexpected(err))
+		return
+	}
+
+	o := &ZoneVisitsExtView{
+		ZoneId:   zone.Id,
+		ZoneName: zone.Name,
+		Visits:   []*ZoneVisitExtView{},
+	}
+
+	// hidden entities are left out of the list but still count in the statistics
+	closed := 0
+	total := 0.0
+	for _, v := range visits {
+		if mac, ok := pp.mac(v.Mac); ok {
+			view := newZoneVisitExtView(v, zone.Name)
+			view.Mac = mac
+			o.Visits = append(o.Visits, view)
+		}
+
+		if v.ExitAt != nil {
+			closed++
+			total += v.Dwell
+			o.MaxDwell = max(o.MaxDwell, v.Dwell)
+		}
+	}
+
+	o.Count = len(visits)
+	if closed > 0 {
+		o.AvgDwell = total / float64(closed)
+	}
+
+	render.Render(w, r, o)
+	return
+}
+
+func (s *LocApiServer) apiEntityGetVisits(w http.ResponseWriter, r *http.Request) {
+	mac := getCtxValueString(r.Context(), "mac")
+	from, to, err := getTimeRange(r)
+	if err != nil {
+		render.Render(w, r, s.httpErrInvalidRequest(err))
+		return
+	}
+
+	visits := make([]models.ZoneVisit, 0)
+	ret := s.visitQuery(r.Context(), from, to).Where("mac = ?", mac).Order("enter_at desc").Find(&visits)
+	if ret.Error != nil {
+		log.Printf("apiEntityGetVisits: Failed to query DB (%v)", ret.Error)
+		err := fmt.Errorf("failed to get data from backend")
+		render.Render(w, r, s.httpErrUnexpected(err))
+		return
+	}
+
+	zones := make([]models.Zone, 0)
+	ret = restrictMaps(r.Context(), s.dbConn.WithContext(r.Context()), "map_id").Find(&zones)
+	if ret.Error != nil {
+		log.Printf("apiEntityGetVisits: Failed to query DB on zones (%v)", ret.Error)
+		err := fmt.Errorf("failed to get data from backend")
+		render.Render(w, r, s.httpErrUnexpected(err))
+		return
+	}
+
+	geofences := make([]models.Geofence, 0)
+	ret = restrictMaps(r.Context(), s.dbConn.WithContext(r.Context()), "map_id").Find(&geofences)
+	if ret.Error != nil {
+		log.Printf("apiEntityGetVisits: Failed to query DB on geofences (%v)", ret.Error)
+		err := fmt.Errorf("failed to get data from backend")
+		render.Render(w, r, s.httpErrUnexpected(err))
+		return
+	}
+
+	zoneNames := make(map[string]string)
+	for _, z := range zones {
+		zoneNames[z.Id] = z.Name
+	}
+	for _, g := range geofences {
+		zoneNames[g.Id] = g.Name
+	}
+
+	outs := []render.Renderer{}
+	for _, v := range visits {
+		outs = append(outs, newZoneVisitExtView(v, zoneNames[v.ZoneId]))
+	}
+
+	render.RenderList(w, r, outs)
+	return
+}
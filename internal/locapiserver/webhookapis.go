@@ -1,15 +1,19 @@
 package locapiserver
 
 import (
+	"context"
 	"crypto/hmac"
 	"crypto/sha256"
 	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log"
+	"math"
 	"net/http"
 	"regexp"
+	"strconv"
 	"strings"
 	"time"
 
@@ -26,9 +30,12 @@ type MistWebhookData struct {
 	Events []json.RawMessage `json:"events"`
 }
 
-// MistWhDataLocationAsset represents location data for an asset
-type MistWhDataLocationAsset struct {
+// MistWhDataLocation represents location data for an asset, a Wi-Fi client or an SDK client
+type MistWhDataLocation struct {
 	Mac       string      `json:"mac"`
+	Id        string      `json:"id"`
+	Name      string      `json:"name"`
+	Type      string      `json:"type"`
 	SiteId    string      `json:"site_id"`
 	MapId     string      `json:"map_id"`
 	X         json.Number `json:"x"`
@@ -38,11 +45,20 @@ type MistWhDataLocationAsset struct {
 
 // MistWhDataZone represents zone entry/exit data for an asset
 type MistWhDataZone struct {
-	Mac     string `json:"mac"`
-	AssetId string `json:"asset_id"`
-	MapId   string `json:"map_id"`
-	Trigger string `json:"trigger"`
-	ZoneId  string `json:"zone_id"`
+	Mac       string      `json:"mac"`
+	AssetId   string      `json:"asset_id"`
+	MapId     string      `json:"map_id"`
+	Trigger   string      `json:"trigger"`
+	ZoneId    string      `json:"zone_id"`
+	Timestamp json.Number `json:"timestamp"`
+}
+
+// locationTopicKinds maps location webhook topics to the kind of entity they report
+var locationTopicKinds = map[string]string{
+	"location-asset":    models.EntityKindBleAsset,
+	"location":          models.EntityKindWifiClient,
+	"location-unclient": models.EntityKindUnconnected,
+	"location-sdk":      models.EntityKindSdk,
 }
 
 func (s *LocApiServer) apiMistRecvRouter() chi.Router {
@@ -60,30 +76,32 @@ func buildURL(endpoint string, uri string) string {
 	return endpoint + uri
 }
 
-func (s *LocApiServer) doMistAssetSearchCall(siteid string, mac string) (string, error) {
+func (s *LocApiServer) doMistApiGet(ctx context.Context, call string, uri string) (string, error) {
 	// build request
-	uri := fmt.Sprintf("/api/v1/sites/%s/stats/assets/search?mac=%s", siteid, mac)
-	reqURL := buildURL(s.cfg.Mist.Endpoint, uri)
+	reqURL := buildURL(s.config().Mist.Endpoint, uri)
 	
-	req, err := http.NewRequest(http.MethodGet, reqURL, nil)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, reqURL, nil)
 	if err != nil {
 		return "", err
 	}
 
 	// set authentication header
-	tokenStr := fmt.Sprintf("token %s", s.cfg.Mist.Apikey)
+	tokenStr := fmt.Sprintf("token %s", s.config().Mist.Apikey)
 	req.Header.Set("Authorization", tokenStr)
 
 	// start requet
 	client := new(http.Client)
+	started := time.Now()
 	resp, err := client.Do(req)
 	if err != nil {
+		s.metrics.observeMistApiCall(call, "error", started)
 		return "", err
 	}
 	defer resp.Body.Close()
+	s.metrics.observeMistApiCall(call, strconv.Itoa(resp.StatusCode), started)
 
 	// read response
-	log.Printf("doMistAssetSearchCall: GET %s (response %-v)", reqURL, resp)
+	log.Printf("doMistApiGet: GET %s (response %-v)", reqURL, resp)
 
 	if resp.StatusCode != http.StatusOK {
 		return "", fmt.Errorf("invalid status code %d", resp.StatusCode)
@@ -97,8 +115,33 @@ func (s *LocApiServer) doMistAssetSearchCall(siteid string, mac string) (string,
 	return string(body), nil
 }
 
-func (s *LocApiServer) fetchAssetData(siteid string, mac string) (*mistdatafmt.ApiDataAssetEntry, error) {
-	r, err := s.doMistAssetSearchCall(siteid, mac)
+func (s *LocApiServer) doMistAssetSearchCall(ctx context.Context, siteid string, mac string) (string, error) {
+	uri := fmt.Sprintf("/api/v1/sites/%s/stats/assets/search?mac=%s", siteid, mac)
+	return s.doMistApiGet(ctx, "asset_search", uri)
+}
+
+func (s *LocApiServer) fetchClientData(ctx context.Context, siteid string, mac string) (*mistdatafmt.WsMsgClientStat, error) {
+	uri := fmt.Sprintf("/api/v1/sites/%s/stats/clients/%s", siteid, mac)
+	r, err := s.doMistApiGet(ctx, "client_stats", uri)
+	if err != nil {
+		return nil, fmt.Errorf("client stats call failed: %w", err)
+	}
+
+	apiResult := mistdatafmt.WsMsgClientStat{}
+	err = json.Unmarshal([]byte(r), &apiResult)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse client data: %w", err)
+	}
+
+	if s.config().Mist.Debug {
+		log.Printf("Client data: %s", r)
+	}
+
+	return &apiResult, nil
+}
+
+func (s *LocApiServer) fetchAssetData(ctx context.Context, siteid string, mac string) (*mistdatafmt.ApiDataAssetEntry, error) {
+	r, err := s.doMistAssetSearchCall(ctx, siteid, mac)
 	if err != nil {
 		return nil, fmt.Errorf("asset search call failed: %w", err)
 	}
@@ -114,7 +157,7 @@ func (s *LocApiServer) fetchAssetData(siteid string, mac string) (*mistdatafmt.A
 		log.Printf("fetchAssetData: Warning: More than 1 asset found for mac %s in site %s", mac, siteid)
 	}
 
-	if s.cfg.Mist.Debug {
+	if s.config().Mist.Debug {
 		log.Printf("Asset data: %s", r)
 	}
 	
@@ -127,168 +170,396 @@ func (s *LocApiServer) fetchAssetData(siteid string, mac string) (*mistdatafmt.A
 	return &(apiResult.Results[0]), nil
 }
 
-func (s *LocApiServer) handleWhInLocationAsset(dataIn MistWhDataLocationAsset) {
+// fetchEntityName looks up the name of an entity depending on its kind
+func (s *LocApiServer) fetchEntityName(ctx context.Context, kind string, dataIn *MistWhDataLocation) (string, error) {
+	switch kind {
+	case models.EntityKindBleAsset:
+		apidata, err := s.fetchAssetData(ctx, dataIn.SiteId, dataIn.Mac)
+		if err != nil {
+			return "", err
+		}
+		return apidata.Name, nil
+
+	case models.EntityKindWifiClient:
+		apidata, err := s.fetchClientData(ctx, dataIn.SiteId, dataIn.Mac)
+		if err != nil {
+			return "", err
+		}
+		if apidata.Hostname != "" {
+			return apidata.Hostname, nil
+		}
+		return apidata.Username, nil
+
+	case models.EntityKindSdk:
+		return dataIn.Name, nil
+
+	default:
+		return "", fmt.Errorf("no name source for %s", kind)
+	}
+}
+
+// setEntityName stores the name and splits "[Org] Name" into display name and org
+func setEntityName(dbEntry *models.Entity, name string) {
+	// poor man's display name
+	regPattern := `\[(?P<org>.+)\] (?P<name>.+)`
+	re, err := regexp.Compile(regPattern)
+	if err != nil {
+		log.Printf("setEntityName: failed to compile regexp (%v)", err)
+	} else {
+		reMatch := re.FindAllStringSubmatch(name, -1)
+		if len(reMatch) > 0 {
+			dbEntry.DisplayName = reMatch[0][re.SubexpIndex("name")]
+			dbEntry.DisplayOrg = reMatch[0][re.SubexpIndex("org")]
+		}
+	}
+
+	dbEntry.Name = name
+}
+
+func (s *LocApiServer) handleWhInLocation(ctx context.Context, kind string, dataIn MistWhDataLocation) error {
+	// SDK clients are identified by their client id
+	if dataIn.Mac == "" {
+		dataIn.Mac = dataIn.Id
+	}
+	if dataIn.Mac == "" {
+		log.Printf("handleWhInLocation: Missing identifier in %s event", kind)
+		return fmt.Errorf("missing identifier")
+	}
+
 	// Make sure we have Map information
 	mapEntry := models.Map{}
-	ret := s.dbConn.Where(&models.Map{Id: dataIn.MapId}).First(&mapEntry)
+	ret := s.dbConn.WithContext(ctx).Where(&models.Map{Id: dataIn.MapId}).First(&mapEntry)
 	if ret.Error != nil {
-		log.Printf("handleWhInLocationAsset: Failed to query DB (%v)", ret.Error)
-		return
+		log.Printf("handleWhInLocation: Failed to query DB (%v)", ret.Error)
+		return ret.Error
 	}
 
 	// Update or Create?
 	dbEntry := models.Entity{}
-	s.dbConn.Where(&models.Entity{Mac: dataIn.Mac}).First(&dbEntry)
+	s.dbConn.WithContext(ctx).Where(&models.Entity{Mac: dataIn.Mac}).First(&dbEntry)
 
 	x, _ := dataIn.X.Float64()
 	y, _ := dataIn.Y.Float64()
 	px := x * mapEntry.Ppm
 	py := y * mapEntry.Ppm
+	// events without a timestamp are taken as current
+	ts, _ := dataIn.Timestamp.Float64()
+	if ts <= 0 {
+		ts = float64(time.Now().UnixNano()) / 1e9
+	}
+	tEvent := eventTime(ts)
+
+	// A delayed event must not move the entity back to an older position
+	if ts < dbEntry.Lastseen {
+		log.Printf("handleWhInLocation: Mac %s event at %.3f is older than last seen %.3f", dataIn.Mac, ts, dbEntry.Lastseen)
+		if s.config().Webhook.OutOfOrder == outOfOrderHistory {
+			s.storePositionSample(ctx, dataIn.Mac, dataIn.MapId, x, y, x, y, ts)
+		}
+		return errOutOfOrderEvent
+	}
+
+	// Smooth the position and drop jumps faster than the entity can move
+	sx, sy, err := s.filter.apply(dataIn.Mac, dataIn.MapId, x, y, ts)
+	if err != nil {
+		log.Printf("handleWhInLocation: Mac %s rejected (%v)", dataIn.Mac, err)
+		return err
+	}
+
+	// Moved to another floor? Zones of the previous map are left as well.
+	// MapId is cleared on timeout, LastMapId also covers reappearing elsewhere.
+	lastMapId := dbEntry.MapId
+	if lastMapId == "" {
+		lastMapId = dbEntry.LastMapId
+	}
+	if lastMapId != "" && lastMapId != dataIn.MapId {
+		s.recordFloorChange(ctx, dataIn.Mac, lastMapId, &mapEntry, ts)
+		s.closeZoneVisits(ctx, dataIn.Mac, "", tEvent)
+		dbEntry.ZoneId = ""
+		dbEntry.ZoneName = ""
+	}
 
 	dbEntry.Mac = dataIn.Mac
+	dbEntry.Kind = kind
 	dbEntry.MapId = dataIn.MapId
-	dbEntry.X = px
-	dbEntry.Y = py
-	dbEntry.Lastseen, _ = dataIn.Timestamp.Float64()
-
-	// Fetch name
+	dbEntry.LastMapId = dataIn.MapId
+	dbEntry.X = sx * mapEntry.Ppm
+	dbEntry.Y = sy * mapEntry.Ppm
+	dbEntry.RawX = px
+	dbEntry.RawY = py
+	dbEntry.Lastseen = ts
+
+	// Fetch name (unconnected clients are only known by MAC)
 	tNow := time.Now()
-	refreshDuration := time.Duration(s.cfg.Mist.RefreshTime) * time.Second
+	refreshDuration := time.Duration(s.config().Mist.RefreshTime) * time.Second
 	tExpire := dbEntry.LastRefresh.Add(refreshDuration)
-	if tNow.After(tExpire) {
-		apidata, err := s.fetchAssetData(dataIn.SiteId, dataIn.Mac)
+	if kind != models.EntityKindUnconnected && tNow.After(tExpire) {
+		name, err := s.fetchEntityName(ctx, kind, &dataIn)
 		if err != nil {
-			log.Printf("handleWhInLocationAsset: Failed to fetch client name (%v)", err)
+			log.Printf("handleWhInLocation: Failed to fetch client name (%v)", err)
 		} else {
-			// poor man's display name
-			regPattern := `\[(?P<org>.+)\] (?P<name>.+)`
-			re, err := regexp.Compile(regPattern)
-			if err != nil {
-				log.Printf("handleWhInLocationAsset: failed to compile regexp (%v)", err)
-			} else {
-				reMatch := re.FindAllStringSubmatch(apidata.Name, -1)
-				if len(reMatch) > 0 {
-					dbEntry.DisplayName = reMatch[0][re.SubexpIndex("name")]
-					dbEntry.DisplayOrg = reMatch[0][re.SubexpIndex("org")]
-				}
-			}
-			
-			dbEntry.Name = apidata.Name
+			setEntityName(&dbEntry, name)
 		}
 		dbEntry.LastRefresh = tNow
 	}
 
-	s.dbConn.Debug().Save(&dbEntry)
+	s.dbConn.WithContext(ctx).Debug().Save(&dbEntry)
+
+	// Keep position history for heatmaps
+	s.storePositionSample(ctx, dataIn.Mac, dataIn.MapId, sx, sy, x, y, ts)
+
+	s.evaluateGeofences(ctx, dataIn.Mac, dataIn.MapId, sx, sy, tEvent)
+
+	s.updateContacts(ctx, dataIn.Mac, &mapEntry, sx, sy, ts)
+
+	return nil
+}
+
+// eventTime converts a Mist timestamp in unix seconds, keeping the fraction
+func eventTime(ts float64) time.Time {
+	sec, frac := math.Modf(ts)
+	return time.Unix(int64(sec), int64(frac*1e9))
+}
+
+func (s *LocApiServer) storePositionSample(ctx context.Context, mac string, mapId string, x float64, y float64, rawX float64, rawY float64, ts float64) {
+	sample := &models.PositionSample{
+		Mac:    mac,
+		MapId:  mapId,
+		X:      x,
+		Y:      y,
+		RawX:   rawX,
+		RawY:   rawY,
+		SeenAt: eventTime(ts),
+	}
+	ret := s.dbConn.WithContext(ctx).Create(sample)
+	if ret.Error != nil {
+		log.Printf("storePositionSample: Failed to store position (%v)", ret.Error)
+	}
+
+	return
+}
+
+func (s *LocApiServer) recordFloorChange(ctx context.Context, mac string, fromMapId string, toMap *models.Map, ts float64) {
+	fromMap := models.Map{}
+	ret := s.dbConn.WithContext(ctx).Where(&models.Map{Id: fromMapId}).Limit(1).Find(&fromMap)
+	if ret.Error != nil {
+		log.Printf("recordFloorChange: Failed to query DB (%v)", ret.Error)
+	}
+
+	change := &models.FloorChange{
+		Mac:        mac,
+		FromMapId:  fromMapId,
+		ToMapId:    toMap.Id,
+		FromLevel:  fromMap.FloorLevel,
+		ToLevel:    toMap.FloorLevel,
+		BuildingId: toMap.BuildingId,
+		ChangedAt:  eventTime(ts),
+	}
+
+	log.Printf("recordFloorChange: Mac %s moved from map %s to %s", mac, fromMapId, toMap.Id)
+	ret = s.dbConn.WithContext(ctx).Create(change)
+	if ret.Error != nil {
+		log.Printf("recordFloorChange: Failed to store floor change (%v)", ret.Error)
+	}
 
 	return
 }
 
-func (s *LocApiServer) handleWhInZone(dataIn MistWhDataZone) {
+func (s *LocApiServer) handleWhInZone(ctx context.Context, dataIn MistWhDataZone) error {
 	dbEntry := models.Entity{}
-	ret := s.dbConn.Where(&models.Entity{Mac: dataIn.Mac}).First(&dbEntry)
+	ret := s.dbConn.WithContext(ctx).Where(&models.Entity{Mac: dataIn.Mac}).First(&dbEntry)
 	if ret.Error != nil {
 		log.Printf("handleWhInZone: Failed to query DB (%v)", ret.Error)
-		return
+		return ret.Error
+	}
+
+	// events without a timestamp are taken as current
+	tEvent := time.Now()
+	if ts, err := dataIn.Timestamp.Float64(); err == nil && ts > 0 {
+		tEvent = eventTime(ts)
 	}
 
 	switch dataIn.Trigger {
 	case "enter":
 		zone := models.Zone{}
-		result := s.dbConn.Where(&models.Zone{Id: dataIn.ZoneId}).First(&zone)
+		result := s.dbConn.WithContext(ctx).Where(&models.Zone{Id: dataIn.ZoneId}).First(&zone)
 		if result.Error != nil {
 			log.Printf("handleWhInZone: Failed to query zone data (%v)", result.Error)
-			return
+			return result.Error
 		}
 		dbEntry.ZoneName = zone.Name
 		dbEntry.ZoneId = dataIn.ZoneId
+		s.openZoneVisit(ctx, dataIn.Mac, dataIn.ZoneId, zone.MapId, tEvent)
 
 	case "exit":
-		dbEntry.ZoneName = ""
-		dbEntry.ZoneId = ""
+		// a late exit must not clear the zone entered since
+		if dbEntry.ZoneId == dataIn.ZoneId {
+			dbEntry.ZoneName = ""
+			dbEntry.ZoneId = ""
+		}
+		s.closeZoneVisits(ctx, dataIn.Mac, dataIn.ZoneId, tEvent)
 	}
 
-	s.dbConn.Debug().Save(&dbEntry)
+	s.dbConn.WithContext(ctx).Debug().Save(&dbEntry)
 
-	return
+	return nil
 }
 
-func (s *LocApiServer) apiMistRecvAuthenticate(inputSig string, body []byte) bool {
-	secret := []byte(s.cfg.Mist.Secret)
-
-	// Create an HMAC hasher, write the body to it, and compute the expected signature
-	h := hmac.New(sha256.New, secret)
+// signWebhookBody computes the x-mist-signature-v2 value of a webhook body
+func signWebhookBody(secret string, body []byte) string {
+	// Create an HMAC hasher, write the body to it, and compute the signature
+	h := hmac.New(sha256.New, []byte(secret))
 	h.Write(body)
-	expectedSig := hex.EncodeToString(h.Sum(nil))
+	return hex.EncodeToString(h.Sum(nil))
+}
 
-	if inputSig != expectedSig {
+// webhookSecrets returns the active webhook secrets. Several secrets are accepted
+// while Mist.Secret is rotated.
+func (s *LocApiServer) webhookSecrets() []string {
+	secrets := make([]string, 0, len(s.config().Mist.Secrets)+1)
+	for _, v := range append([]string{s.config().Mist.Secret}, s.config().Mist.Secrets...) {
+		if v != "" {
+			secrets = append(secrets, v)
+		}
+	}
+
+	return secrets
+}
+
+func (s *LocApiServer) apiMistRecvAuthenticate(inputSig string, body []byte) bool {
+	sig, err := hex.DecodeString(inputSig)
+	if err != nil {
 		log.Printf("unexpected signature %s", inputSig)
 		return false
 	}
-	
-	return true
+
+	for _, secret := range s.webhookSecrets() {
+		h := hmac.New(sha256.New, []byte(secret))
+		h.Write(body)
+		if hmac.Equal(sig, h.Sum(nil)) {
+			return true
+		}
+	}
+
+	log.Printf("unexpected signature %s", inputSig)
+	return false
+}
+
+// processWebhookEvents runs handle on each event which is fresh and not a duplicate
+func (s *LocApiServer) processWebhookEvents(topic string, events []json.RawMessage, handle func(ev json.RawMessage) error) {
+	now := time.Now()
+	dedupe := s.dedupe.Load()
+	for _, ev := range events {
+		if outcome := s.checkWebhookEvent(ev, now); outcome != "" {
+			s.metrics.webhookEvents.WithLabelValues(topic, outcome).Inc()
+			continue
+		}
+
+		// claimed before handling, so a concurrent retry of the same event is a duplicate.
+		// Events without a timestamp cannot be told apart from a repeat of the same data and are always handled.
+		key := eventKey(topic, ev)
+		_, timed := webhookEventTimestamp(ev)
+		claimed := timed && dedupe != nil
+		if claimed && !dedupe.claim(key, now) {
+			s.metrics.webhookEvents.WithLabelValues(topic, eventOutcomeDuplicate).Inc()
+			continue
+		}
+
+		err := handle(ev)
+		s.metrics.observeWebhookEvent(topic, err)
+		if err != nil && claimed {
+			dedupe.release(key)
+		}
+	}
 }
 
 func (s *LocApiServer) apiMistRecvPost(w http.ResponseWriter, r *http.Request) {
 	// get data
-	body, err := io.ReadAll(r.Body)
-	if err != nil {
+	maxBodySize := int64(s.config().Webhook.MaxBodySize)
+	if maxBodySize <= 0 {
+		maxBodySize = defaultWebhookMaxBodySize
+	}
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxBodySize))
+	var maxBytesErr *http.MaxBytesError
+	if errors.As(err, &maxBytesErr) {
+		log.Printf("apiMistRecvPost: Request body exceeds %d bytes", maxBodySize)
+		s.metrics.webhookRequests.WithLabelValues("too_large").Inc()
+		render.Render(w, r, s.httpErrTooLarge(err))
+		return
+	} else if err != nil {
 		log.Printf("apiMistRecvPost: Failed to read request body: %v", err)
+		s.metrics.webhookRequests.WithLabelValues("read_error").Inc()
 		render.Render(w, r, s.httpErrUnexpected(err))
 		return
 	}
 
 	// authenticate
-	if s.cfg.Mist.Secret != "" {
+	if len(s.webhookSecrets()) > 0 {
 		sig := r.Header.Get("x-mist-signature-v2")
 		if !s.apiMistRecvAuthenticate(sig, body) {
 			err := fmt.Errorf("invalid signature")
+			s.metrics.webhookRequests.WithLabelValues("invalid_signature").Inc()
 			render.Render(w, r, s.httpErrUnauthorized(err))
 			return
 		}
 	}
 
+	// archive raw request, rejected ones are only counted
+	if s.archive != nil {
+		err := s.archive.Write(newWebhookRecord(r, body))
+		if err != nil {
+			log.Printf("apiMistRecvPost: Failed to archive webhook: %v", err)
+		}
+	}
+
 	// process data
 	dataIn := MistWebhookData{}
 	err = json.Unmarshal(body, &dataIn)
 	if err != nil {
 		log.Printf("apiMistRecvPost: Failed to parse webhook data: %v", err)
+		s.metrics.webhookRequests.WithLabelValues("invalid_body").Inc()
 		render.Render(w, r, s.httpErrInvalidRequest(err))
 		return
 	}
+	s.metrics.webhookRequests.WithLabelValues("accepted").Inc()
+	s.metrics.webhookLastReceived.SetToCurrentTime()
+	s.lastWebhook.Store(time.Now().UnixNano())
 
 	switch dataIn.Topic {
-	case "location-asset":
-		for _, ev := range dataIn.Events {
-			evData := MistWhDataLocationAsset{}
+	case "location-asset", "location", "location-unclient", "location-sdk":
+		kind := locationTopicKinds[dataIn.Topic]
+		s.processWebhookEvents(dataIn.Topic, dataIn.Events, func(ev json.RawMessage) error {
+			evData := MistWhDataLocation{}
 			err := json.Unmarshal(ev, &evData)
 			if err != nil {
 				log.Printf("failed to decode webhook input %s (%v)", string(ev), err)
-				continue
+				return err
 			}
 
-			s.handleWhInLocationAsset(evData)
-		}
+			return s.handleWhInLocation(r.Context(), kind, evData)
+		})
 
 		w.WriteHeader(http.StatusOK)
 		w.Write(nil)
 
 	case "zone":
-		for _, ev := range dataIn.Events {
+		s.processWebhookEvents(dataIn.Topic, dataIn.Events, func(ev json.RawMessage) error {
 			evData := MistWhDataZone{}
 			err := json.Unmarshal(ev, &evData)
 			if err != nil {
 				log.Printf("failed to decode webhook input %s (%v)", string(ev), err)
-				continue
+				return err
 			}
 
-			s.handleWhInZone(evData)
-		}
+			return s.handleWhInZone(r.Context(), evData)
+		})
 
 		w.WriteHeader(http.StatusOK)
 		w.Write(nil)
 
 	default:
+		// the topic comes from the sender, so unsupported ones share one label value
 		log.Printf("unsupported topic: %s", dataIn.Topic)
+		s.metrics.webhookEvents.WithLabelValues("other", "unsupported").Add(float64(len(dataIn.Events)))
 		w.WriteHeader(http.StatusOK)
 		w.Write(nil)
 	}
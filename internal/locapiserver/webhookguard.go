@@ -0,0 +1,128 @@
+package locapiserver
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+const defaultWebhookMaxBodySize = 1 << 20
+
+// Outcomes of events rejected before processing
+const (
+	eventOutcomeStale      = "stale"
+	eventOutcomeDuplicate  = "duplicate"
+	eventOutcomeOutOfOrder = "out_of_order"
+	eventOutcomeTeleport   = "teleport"
+)
+
+// Handling of location events older than the last position of their entity
+const (
+	outOfOrderDiscard = "discard"
+	outOfOrderHistory = "history" // kept in the position history only
+)
+
+func validateOutOfOrder(v string) error {
+	switch v {
+	case "", outOfOrderDiscard, outOfOrderHistory:
+		return nil
+	}
+	return fmt.Errorf("invalid webhook.out_of_order %s", v)
+}
+
+// errOutOfOrderEvent is returned by handlers for events older than the stored state
+var errOutOfOrderEvent = errors.New("event is older than the last seen position")
+
+// eventDeduper remembers processed webhook events for a window so that replayed
+// or retried copies are not applied twice
+type eventDeduper struct {
+	window time.Duration
+
+	mu        sync.Mutex
+	seen      map[[sha256.Size]byte]time.Time
+	lastSweep time.Time
+}
+
+func newEventDeduper(window time.Duration) *eventDeduper {
+	return &eventDeduper{
+		window: window,
+		seen:   make(map[[sha256.Size]byte]time.Time),
+	}
+}
+
+func eventKey(topic string, ev []byte) [sha256.Size]byte {
+	h := sha256.New()
+	h.Write([]byte(topic))
+	h.Write([]byte{0})
+	h.Write(ev)
+
+	var key [sha256.Size]byte
+	copy(key[:], h.Sum(nil))
+	return key
+}
+
+// claim records the event and reports whether it was new, i.e. not seen within the window.
+// Concurrent deliveries of the same event are claimed only once.
+func (d *eventDeduper) claim(key [sha256.Size]byte, now time.Time) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if t, ok := d.seen[key]; ok && now.Sub(t) < d.window {
+		return false
+	}
+	d.seen[key] = now
+	d.sweep(now)
+	return true
+}
+
+// release forgets a claimed event which failed, so that a retry is processed
+func (d *eventDeduper) release(key [sha256.Size]byte) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	delete(d.seen, key)
+}
+
+// sweep drops the events older than the window, d.mu must be held
+func (d *eventDeduper) sweep(now time.Time) {
+	if now.Sub(d.lastSweep) < d.window {
+		return
+	}
+	for k, t := range d.seen {
+		if now.Sub(t) >= d.window {
+			delete(d.seen, k)
+		}
+	}
+	d.lastSweep = now
+}
+
+// webhookEventTimestamp returns the timestamp of ev, or false when it has none
+func webhookEventTimestamp(ev []byte) (float64, bool) {
+	evTime := struct {
+		Timestamp json.Number `json:"timestamp"`
+	}{}
+	json.Unmarshal(ev, &evTime)
+
+	ts, err := evTime.Timestamp.Float64()
+	return ts, err == nil && ts > 0
+}
+
+// checkWebhookEvent returns the outcome of an event which is too old to be processed, or ""
+func (s *LocApiServer) checkWebhookEvent(ev []byte, now time.Time) string {
+	maxAge := time.Duration(s.config().Webhook.MaxEventAge) * time.Second
+	if maxAge > 0 {
+		// events without a timestamp are left to the handlers
+		if ts, ok := webhookEventTimestamp(ev); ok {
+			t := time.Unix(0, int64(ts*float64(time.Second)))
+			skew := time.Duration(s.config().Webhook.MaxClockSkew) * time.Second
+			if now.Sub(t) > maxAge || t.Sub(now) > skew {
+				return eventOutcomeStale
+			}
+		}
+	}
+
+	return ""
+}
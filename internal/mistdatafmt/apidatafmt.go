@@ -2,7 +2,6 @@ package mistdatafmt
 
 import (
 	"encoding/json"
-	"fmt"
 )
 
 /*
@@ -16,7 +15,7 @@ type ApiDataMapEntry struct {
 	Width			json.Number	`json:"width"`
 	Height			json.Number	`json:"height"`
 	PPM			json.Number	`json:"ppm"`
-	Type			string		`json:"image"`
+	Type			string		`json:"type"`
 	Orientation		json.Number	`json:"orientation"`
 	OccupancyLimit		json.Number	`json:"occupancy_limit"`
 	Locked			bool		`json:"locked"`
@@ -30,157 +29,68 @@ type ApiDataMapEntry struct {
 	Url			string		`json:"url"`
 	ThumbnailUrl		string		`json:"thumbnail_url"`
 
-	// wallpath, sitesurvey_path, wayfinding_path are skipped..
-}
+	// wallpath, sitesurvey_path, wayfinding_path are not modeled (see Unknown)
 
-func (d *ApiDataMapEntry) GetJsonKeyValue(key string) (interface{}, error) {
-	switch key {
-	case "name":
-		return d.Name, nil
-	case "type":
-		return d.Name, nil
-	case "id":
-		return d.Id, nil
-	case "site_id":
-		return d.SiteId, nil
-	case "org_id":
-		return d.OrgId, nil
-	case "url":
-		return d.Url, nil
-	case "thumbnail_url":
-		return d.ThumbnailUrl, nil
-	case "locked":
-		return d.Locked, nil
-	case "use_auto_orientation":
-		return d.UseAutoOrientation, nil
-	case "use_auto_placement":
-		return d.UseAutoPlacement, nil
-	case "width_m":
-		return d.WidthM, nil
-	case "height_m":
-		return d.HeightM, nil
-	case "width":
-		return d.Width, nil
-	case "height":
-		return d.Height, nil
-	case "ppm":
-		return d.PPM, nil
-	case "orientation":
-		return d.Orientation, nil
-	case "occupancy_limit":
-		return d.OccupancyLimit, nil
-	case "created_time":
-		return d.CreatedTime, nil
-	case "modified_time":
-		return d.ModifiedTime, nil
-	default:
-		return "", fmt.Errorf("Specified key not found")
-	}
-
-	return "", fmt.Errorf("Specified key not found")
+	Unknown			Unknown		`json:"-"`
 }
 
+func (d *ApiDataMapEntry) UnmarshalJSON(b []byte) error {
+	type plain ApiDataMapEntry
+	return unmarshalKeepUnknown(b, (*plain)(d), &d.Unknown)
+}
 
+func (d *ApiDataMapEntry) GetJsonKeyValue(key string) (interface{}, error) {
+	return getJsonKeyValue(d, key)
+}
 
 func (d *ApiDataMapEntry) GetJsonKeyValueAsStr(key string) (string, error) {
-	switch key {
-	case "name":
-		return d.Name, nil
-	case "type":
-		return d.Name, nil
-	case "id":
-		return d.Id, nil
-	case "site_id":
-		return d.SiteId, nil
-	case "org_id":
-		return d.OrgId, nil
-	case "url":
-		return d.Url, nil
-	case "thumbnail_url":
-		return d.ThumbnailUrl, nil
-	case "locked":
-		return fmt.Sprintf("%v", d.Locked), nil
-	case "use_auto_orientation":
-		return fmt.Sprintf("%v", d.UseAutoOrientation), nil
-	case "use_auto_placement":
-		return fmt.Sprintf("%v", d.UseAutoPlacement), nil
-	case "width_m":
-		return string(d.WidthM), nil
-	case "height_m":
-		return string(d.HeightM), nil
-	case "width":
-		return string(d.Width), nil
-	case "height":
-		return string(d.Height), nil
-	case "ppm":
-		return string(d.PPM), nil
-	case "orientation":
-		return string(d.Orientation), nil
-	case "occupancy_limit":
-		return string(d.OccupancyLimit), nil
-	case "created_time":
-		return string(d.CreatedTime), nil
-	case "modified_time":
-		return string(d.ModifiedTime), nil
-	default:
-		return "", fmt.Errorf("Specified key not found")
-	}
-
-	return "", fmt.Errorf("Specified key not found")
+	return getJsonKeyValueAsStr(d, key)
 }
 
 func (d *ApiDataMapEntry) GetJsonKeyValueAsFloat64(key string) (float64, error) {
-	switch key {
-	case "width_m":
-		return d.WidthM.Float64()
-	case "height_m":
-		return d.HeightM.Float64()
-	case "width":
-		return d.Width.Float64()
-	case "height":
-		return d.Height.Float64()
-	case "ppm":
-		return d.PPM.Float64()
-	case "orientation":
-		return d.Orientation.Float64()
-	case "occupancy_limit":
-		return d.OccupancyLimit.Float64()
-	case "created_time":
-		return d.CreatedTime.Float64()
-	case "modified_time":
-		return d.ModifiedTime.Float64()
-	default:
-		return 0, fmt.Errorf("Specified key not found")
-	}
-
-	return 0, fmt.Errorf("Specified key not found")
+	return getJsonKeyValueAsFloat64(d, key)
 }
 
 func (d *ApiDataMapEntry) GetJsonKeyValueAsInt64(key string) (int64, error) {
-	switch key {
-	case "width_m":
-		return d.WidthM.Int64()
-	case "height_m":
-		return d.HeightM.Int64()
-	case "width":
-		return d.Width.Int64()
-	case "height":
-		return d.Height.Int64()
-	case "ppm":
-		return d.PPM.Int64()
-	case "orientation":
-		return d.Orientation.Int64()
-	case "occupancy_limit":
-		return d.OccupancyLimit.Int64()
-	case "created_time":
-		return d.CreatedTime.Int64()
-	case "modified_time":
-		return d.ModifiedTime.Int64()
-	default:
-		return 0, fmt.Errorf("Specified key not found")
-	}
-
-	return 0, fmt.Errorf("Specified key not found")
+	return getJsonKeyValueAsInt64(d, key)
+}
+
+/*
+ * Sites API call data format (partial)
+ * /orgs/:org_id/sites
+ */
+type ApiDataSiteEntry struct {
+	Name			string		`json:"name"`
+	Id			string		`json:"id"`
+	OrgId			string		`json:"org_id"`
+	Timezone		string		`json:"timezone"`
+	CountryCode		string		`json:"country_code"`
+	Address			string		`json:"address"`
+	CreatedTime		json.Number	`json:"created_time"`
+	ModifiedTime		json.Number	`json:"modified_time"`
+
+	Unknown			Unknown		`json:"-"`
+}
+
+func (d *ApiDataSiteEntry) UnmarshalJSON(b []byte) error {
+	type plain ApiDataSiteEntry
+	return unmarshalKeepUnknown(b, (*plain)(d), &d.Unknown)
+}
+
+func (d *ApiDataSiteEntry) GetJsonKeyValue(key string) (interface{}, error) {
+	return getJsonKeyValue(d, key)
+}
+
+func (d *ApiDataSiteEntry) GetJsonKeyValueAsStr(key string) (string, error) {
+	return getJsonKeyValueAsStr(d, key)
+}
+
+func (d *ApiDataSiteEntry) GetJsonKeyValueAsFloat64(key string) (float64, error) {
+	return getJsonKeyValueAsFloat64(d, key)
+}
+
+func (d *ApiDataSiteEntry) GetJsonKeyValueAsInt64(key string) (int64, error) {
+	return getJsonKeyValueAsInt64(d, key)
 }
 
 /*
@@ -199,147 +109,57 @@ type ApiDataZoneEntry struct {
 	
 	Vertices		[]ApiDataZoneVertice	`json:"vertices"`
 	VerticesM		[]ApiDataZoneVertice	`json:"vertices_m"`
+
+	Unknown			Unknown		`json:"-"`
 }
 
-type ApiDataZoneVertice struct {
-	X			json.Number		`json:"x"`
-	Y			json.Number		`json:"y"`
+func (d *ApiDataZoneEntry) UnmarshalJSON(b []byte) error {
+	type plain ApiDataZoneEntry
+	return unmarshalKeepUnknown(b, (*plain)(d), &d.Unknown)
 }
 
 func (d *ApiDataZoneEntry) GetJsonKeyValue(key string) (interface{}, error) {
-	switch key {
-	case "name":
-		return d.Name, nil
-	case "id":
-		return d.Id, nil
-	case "map_id":
-		return d.MapId, nil
-	case "site_id":
-		return d.SiteId, nil
-	case "org_id":
-		return d.OrgId, nil
-	case "occupancy_limit":
-		return d.OccupancyLimit, nil
-	case "created_time":
-		return d.CreatedTime, nil
-	case "modified_time":
-		return d.ModifiedTime, nil
-	case "vertices":
-		return d.Vertices, nil
-	case "vertices_m":
-		return d.VerticesM, nil
-	default:
-		return "", fmt.Errorf("Specified key not found")
-	}
-
-	return "", fmt.Errorf("Specified key not found")
+	return getJsonKeyValue(d, key)
 }
 
 func (d *ApiDataZoneEntry) GetJsonKeyValueAsStr(key string) (string, error) {
-	switch key {
-	case "name":
-		return d.Name, nil
-	case "id":
-		return d.Id, nil
-	case "map_id":
-		return d.MapId, nil
-	case "site_id":
-		return d.SiteId, nil
-	case "org_id":
-		return d.OrgId, nil
-	case "occupancy_limit":
-		return string(d.OccupancyLimit), nil
-	case "created_time":
-		return string(d.CreatedTime), nil
-	case "modified_time":
-		return string(d.ModifiedTime), nil
-	default:
-		return "", fmt.Errorf("Specified key not found")
-	}
-
-	return "", fmt.Errorf("Specified key not found")
+	return getJsonKeyValueAsStr(d, key)
 }
 
 func (d *ApiDataZoneEntry) GetJsonKeyValueAsFloat64(key string) (float64, error) {
-	switch key {
-	case "occupancy_limit":
-		return d.OccupancyLimit.Float64()
-	case "created_time":
-		return d.CreatedTime.Float64()
-	case "modified_time":
-		return d.ModifiedTime.Float64()
-	default:
-		return 0, fmt.Errorf("Specified key not found")
-	}
-
-	return 0, fmt.Errorf("Specified key not found")
+	return getJsonKeyValueAsFloat64(d, key)
 }
 
 func (d *ApiDataZoneEntry) GetJsonKeyValueAsInt64(key string) (int64, error) {
-	switch key {
-	case "occupancy_limit":
-		return d.OccupancyLimit.Int64()
-	case "created_time":
-		return d.CreatedTime.Int64()
-	case "modified_time":
-		return d.ModifiedTime.Int64()
-	default:
-		return 0, fmt.Errorf("Specified key not found")
-	}
+	return getJsonKeyValueAsInt64(d, key)
+}
 
-	return 0, fmt.Errorf("Specified key not found")
+type ApiDataZoneVertice struct {
+	X			json.Number		`json:"x"`
+	Y			json.Number		`json:"y"`
+
+	Unknown			Unknown		`json:"-"`
 }
 
-func (d *ApiDataZoneVertice) GetJsonKeyValue(key string) (interface{}, error) {
-	switch key {
-	case "x":
-		return d.X, nil
-	case "y":
-		return d.Y, nil
-	default:
-		return "", fmt.Errorf("Specified key not found")
-	}
+func (d *ApiDataZoneVertice) UnmarshalJSON(b []byte) error {
+	type plain ApiDataZoneVertice
+	return unmarshalKeepUnknown(b, (*plain)(d), &d.Unknown)
+}
 
-	return "", fmt.Errorf("Specified key not found")
+func (d *ApiDataZoneVertice) GetJsonKeyValue(key string) (interface{}, error) {
+	return getJsonKeyValue(d, key)
 }
 
 func (d *ApiDataZoneVertice) GetJsonKeyValueAsStr(key string) (string, error) {
-	switch key {
-	case "x":
-		return string(d.X), nil
-	case "y":
-		return string(d.Y), nil
-	default:
-		return "", fmt.Errorf("Specified key not found")
-	}
-
-	return "", fmt.Errorf("Specified key not found")
+	return getJsonKeyValueAsStr(d, key)
 }
 
 func (d *ApiDataZoneVertice) GetJsonKeyValueAsFloat64(key string) (float64, error) {
-	switch key {
-	case "x":
-		return d.X.Float64()
-	case "y":
-		return d.Y.Float64()
-	default:
-		return 0, fmt.Errorf("Specified key not found")
-	}
-
-	return 0, fmt.Errorf("Specified key not found")
+	return getJsonKeyValueAsFloat64(d, key)
 }
 
 func (d *ApiDataZoneVertice) GetJsonKeyValueAsInt64(key string) (int64, error) {
-	switch key {
-	case "x":
-		return d.X.Int64()
-	case "y":
-		return d.Y.Int64()
-	default:
-		return 0, fmt.Errorf("Specified key not found")
-	}
-
-	return 0, fmt.Errorf("Specified key not found")
+	return getJsonKeyValueAsInt64(d, key)
 }
 
 /*
@@ -353,6 +173,29 @@ type ApiDataAssetSearchResult struct {
 	Total			json.Number		`json:"total"`
 	
 	Results			[]ApiDataAssetEntry	`json:"results"`
+
+	Unknown			Unknown		`json:"-"`
+}
+
+func (d *ApiDataAssetSearchResult) UnmarshalJSON(b []byte) error {
+	type plain ApiDataAssetSearchResult
+	return unmarshalKeepUnknown(b, (*plain)(d), &d.Unknown)
+}
+
+func (d *ApiDataAssetSearchResult) GetJsonKeyValue(key string) (interface{}, error) {
+	return getJsonKeyValue(d, key)
+}
+
+func (d *ApiDataAssetSearchResult) GetJsonKeyValueAsStr(key string) (string, error) {
+	return getJsonKeyValueAsStr(d, key)
+}
+
+func (d *ApiDataAssetSearchResult) GetJsonKeyValueAsFloat64(key string) (float64, error) {
+	return getJsonKeyValueAsFloat64(d, key)
+}
+
+func (d *ApiDataAssetSearchResult) GetJsonKeyValueAsInt64(key string) (int64, error) {
+	return getJsonKeyValueAsInt64(d, key)
 }
 
 type ApiDataAssetEntry struct {
@@ -373,6 +216,27 @@ type ApiDataAssetEntry struct {
 	ApMac			string		`json:"ap_mac"`
 	Lastseen		json.Number	`json:"last_seen"`
 	Timestamp		json.Number	`json:"_timestamp"`
+
+	Unknown			Unknown		`json:"-"`
 }
 
+func (d *ApiDataAssetEntry) UnmarshalJSON(b []byte) error {
+	type plain ApiDataAssetEntry
+	return unmarshalKeepUnknown(b, (*plain)(d), &d.Unknown)
+}
 
+func (d *ApiDataAssetEntry) GetJsonKeyValue(key string) (interface{}, error) {
+	return getJsonKeyValue(d, key)
+}
+
+func (d *ApiDataAssetEntry) GetJsonKeyValueAsStr(key string) (string, error) {
+	return getJsonKeyValueAsStr(d, key)
+}
+
+func (d *ApiDataAssetEntry) GetJsonKeyValueAsFloat64(key string) (float64, error) {
+	return getJsonKeyValueAsFloat64(d, key)
+}
+
+func (d *ApiDataAssetEntry) GetJsonKeyValueAsInt64(key string) (int64, error) {
+	return getJsonKeyValueAsInt64(d, key)
+}
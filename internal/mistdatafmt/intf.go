@@ -1,10 +1,206 @@
 package mistdatafmt
 
-// TODO; rewrite using mapstructure..
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+)
 
+// MistDataFmtIntf provides key based access to Mist data using the JSON key names.
+// Nested values are addressed with dots (e.g. "service_data.uuid" or "vertices.0.x").
 type MistDataFmtIntf interface {
 	GetJsonKeyValue(key string) (interface{}, error)
 	GetJsonKeyValueAsStr(key string) (string, error)
 	GetJsonKeyValueAsFloat64(key string) (float64, error)
 	GetJsonKeyValueAsInt64(key string) (int64, error)
 }
+
+// Unknown keeps JSON fields which are not modeled by the data format structures
+type Unknown map[string]interface{}
+
+var unknownType = reflect.TypeOf(Unknown{})
+
+// unmarshalKeepUnknown decodes b into v and stores fields which v does not declare into unknown
+func unmarshalKeepUnknown(b []byte, v interface{}, unknown *Unknown) error {
+	err := json.Unmarshal(b, v)
+	if err != nil {
+		return err
+	}
+
+	all := make(map[string]interface{})
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.UseNumber()
+	err = dec.Decode(&all)
+	if err != nil {
+		return err
+	}
+
+	t := reflect.TypeOf(v).Elem()
+	for i := 0; i < t.NumField(); i++ {
+		name, ok := jsonFieldName(t.Field(i))
+		if ok {
+			delete(all, name)
+		}
+	}
+
+	if len(all) > 0 {
+		*unknown = all
+	} else {
+		*unknown = nil
+	}
+
+	return nil
+}
+
+// jsonFieldName returns the JSON key of a struct field
+func jsonFieldName(f reflect.StructField) (string, bool) {
+	if !f.IsExported() {
+		return "", false
+	}
+
+	tag := f.Tag.Get("json")
+	if tag == "-" {
+		return "", false
+	}
+
+	name, _, _ := strings.Cut(tag, ",")
+	if name == "" {
+		name = f.Name
+	}
+
+	return name, true
+}
+
+func lookupJsonField(v reflect.Value, name string) (reflect.Value, bool) {
+	for v.Kind() == reflect.Pointer || v.Kind() == reflect.Interface {
+		if v.IsNil() {
+			return reflect.Value{}, false
+		}
+		v = v.Elem()
+	}
+
+	switch v.Kind() {
+	case reflect.Struct:
+		t := v.Type()
+		for i := 0; i < t.NumField(); i++ {
+			fname, ok := jsonFieldName(t.Field(i))
+			if ok && fname == name {
+				return v.Field(i), true
+			}
+		}
+
+		// fall back to fields that are not modeled
+		for i := 0; i < t.NumField(); i++ {
+			if t.Field(i).Type == unknownType {
+				return lookupJsonField(v.Field(i), name)
+			}
+		}
+
+	case reflect.Map:
+		if v.Type().Key().Kind() != reflect.String {
+			return reflect.Value{}, false
+		}
+
+		r := v.MapIndex(reflect.ValueOf(name).Convert(v.Type().Key()))
+		if r.IsValid() {
+			return r, true
+		}
+
+	case reflect.Slice, reflect.Array:
+		idx, err := strconv.Atoi(name)
+		if err == nil && idx >= 0 && idx < v.Len() {
+			return v.Index(idx), true
+		}
+	}
+
+	return reflect.Value{}, false
+}
+
+func getJsonKeyValue(d interface{}, key string) (interface{}, error) {
+	v := reflect.ValueOf(d)
+	for _, name := range strings.Split(key, ".") {
+		var ok bool
+		v, ok = lookupJsonField(v, name)
+		if !ok {
+			return "", fmt.Errorf("Specified key not found")
+		}
+	}
+
+	if v.Kind() == reflect.Interface && v.IsNil() {
+		return nil, nil
+	}
+
+	return v.Interface(), nil
+}
+
+func getJsonKeyValueAsStr(d interface{}, key string) (string, error) {
+	val, err := getJsonKeyValue(d, key)
+	if err != nil {
+		return "", err
+	}
+
+	switch r := val.(type) {
+	case nil:
+		return "", nil
+	case string:
+		return r, nil
+	case json.Number:
+		return string(r), nil
+	case bool, int, int32, int64, uint, uint32, uint64, float32, float64:
+		return fmt.Sprintf("%v", r), nil
+	default:
+		// objects and arrays are returned in their JSON form
+		b, err := json.Marshal(r)
+		if err != nil {
+			return "", err
+		}
+		return string(b), nil
+	}
+}
+
+func getJsonKeyValueAsFloat64(d interface{}, key string) (float64, error) {
+	val, err := getJsonKeyValue(d, key)
+	if err != nil {
+		return 0, err
+	}
+
+	if r, ok := val.(json.Number); ok {
+		return r.Float64()
+	}
+
+	v := reflect.ValueOf(val)
+	switch v.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return float64(v.Int()), nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return float64(v.Uint()), nil
+	case reflect.Float32, reflect.Float64:
+		return v.Float(), nil
+	}
+
+	return 0, fmt.Errorf("Specified key is not a number")
+}
+
+func getJsonKeyValueAsInt64(d interface{}, key string) (int64, error) {
+	val, err := getJsonKeyValue(d, key)
+	if err != nil {
+		return 0, err
+	}
+
+	if r, ok := val.(json.Number); ok {
+		return r.Int64()
+	}
+
+	v := reflect.ValueOf(val)
+	switch v.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return v.Int(), nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return int64(v.Uint()), nil
+	}
+
+	return 0, fmt.Errorf("Specified key is not an integer")
+}
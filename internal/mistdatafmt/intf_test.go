@@ -0,0 +1,121 @@
+package mistdatafmt
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func loadTestData(t *testing.T, name string, v interface{}) {
+	t.Helper()
+
+	b, err := os.ReadFile(filepath.Join("testdata", name))
+	if err != nil {
+		t.Fatalf("failed to read %s: %v", name, err)
+	}
+
+	err = json.Unmarshal(b, v)
+	if err != nil {
+		t.Fatalf("failed to parse %s: %v", name, err)
+	}
+}
+
+func TestGetJsonKeyValue(t *testing.T) {
+	maps := make([]*ApiDataMapEntry, 0)
+	loadTestData(t, "maps.json", &maps)
+	zones := make([]*ApiDataZoneEntry, 0)
+	loadTestData(t, "zones.json", &zones)
+	search := &ApiDataAssetSearchResult{}
+	loadTestData(t, "asset_search.json", search)
+	asset := &WsMsgMapBleAsset{}
+	loadTestData(t, "ws_map_ble_asset.json", asset)
+	client := &WsMsgMapClient{}
+	loadTestData(t, "ws_map_client.json", client)
+
+	tests := []struct {
+		name    string
+		data    MistDataFmtIntf
+		key     string
+		str     string
+		float   float64
+		int     int64
+		noFloat bool
+		noInt   bool
+	}{
+		{name: "map string", data: maps[0], key: "name", str: "11F", noFloat: true, noInt: true},
+		{name: "map type", data: maps[0], key: "type", str: "image", noFloat: true, noInt: true},
+		{name: "map bool", data: maps[0], key: "locked", str: "true", noFloat: true, noInt: true},
+		{name: "map number", data: maps[0], key: "width", str: "1005", float: 1005, int: 1005},
+		{name: "map decimal", data: maps[0], key: "height_m", str: "86.87", float: 86.87, noInt: true},
+		{name: "map unknown", data: maps[0], key: "wayfinding.snap_to_path", str: "false", noFloat: true, noInt: true},
+		{name: "map unknown nested number", data: maps[0], key: "wayfinding.micello.default_level_id", str: "0", float: 0, int: 0},
+		{name: "zone vertex", data: zones[0], key: "vertices.2.x", str: "360", float: 360, int: 360},
+		{name: "zone vertex metres", data: zones[0], key: "vertices_m.1.y", str: "16.0", float: 16, noInt: true},
+		{name: "search total", data: search, key: "total", str: "1", float: 1, int: 1},
+		{name: "search result", data: search, key: "results.0.name", str: "[Juniper] Taro Yamada", noFloat: true, noInt: true},
+		{name: "search result unknown", data: search, key: "results.0.site_id", str: "a84f4847-cdc2-4e96-9117-a6747edf32f1", noFloat: true, noInt: true},
+		{name: "asset nested", data: asset, key: "service_data.uuid", str: "feaa", noFloat: true, noInt: true},
+		{name: "asset nested number", data: asset, key: "service_data.rx_cnt", str: "42", float: 42, int: 42},
+		{name: "asset underscore key", data: asset, key: "_timestamp", str: "1718080001.102", float: 1718080001.102, noInt: true},
+		{name: "asset unknown array", data: asset, key: "zones.0.since", str: "1718079000", float: 1718079000, int: 1718079000},
+		{name: "client", data: client, key: "connected_ap", str: "d420b0000002", noFloat: true, noInt: true},
+		{name: "client unknown", data: client, key: "is_guest", str: "false", noFloat: true, noInt: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := tt.data.GetJsonKeyValue(tt.key)
+			if err != nil {
+				t.Fatalf("GetJsonKeyValue(%q): %v", tt.key, err)
+			}
+
+			str, err := tt.data.GetJsonKeyValueAsStr(tt.key)
+			if err != nil || str != tt.str {
+				t.Errorf("GetJsonKeyValueAsStr(%q) = %q, %v; want %q", tt.key, str, err, tt.str)
+			}
+
+			f, err := tt.data.GetJsonKeyValueAsFloat64(tt.key)
+			if tt.noFloat {
+				if err == nil {
+					t.Errorf("GetJsonKeyValueAsFloat64(%q) = %v; want error", tt.key, f)
+				}
+			} else if err != nil || f != tt.float {
+				t.Errorf("GetJsonKeyValueAsFloat64(%q) = %v, %v; want %v", tt.key, f, err, tt.float)
+			}
+
+			i, err := tt.data.GetJsonKeyValueAsInt64(tt.key)
+			if tt.noInt {
+				if err == nil {
+					t.Errorf("GetJsonKeyValueAsInt64(%q) = %v; want error", tt.key, i)
+				}
+			} else if err != nil || i != tt.int {
+				t.Errorf("GetJsonKeyValueAsInt64(%q) = %v, %v; want %v", tt.key, i, err, tt.int)
+			}
+		})
+	}
+}
+
+func TestGetJsonKeyValueNotFound(t *testing.T) {
+	maps := make([]*ApiDataMapEntry, 0)
+	loadTestData(t, "maps.json", &maps)
+
+	for _, key := range []string{"no_such_key", "name.first", "wayfinding.no_such_key", "sitesurvey_path.0", ""} {
+		_, err := maps[0].GetJsonKeyValue(key)
+		if err == nil {
+			t.Errorf("GetJsonKeyValue(%q): want error", key)
+		}
+	}
+}
+
+func TestUnknownIsEmptyWhenFullyModeled(t *testing.T) {
+	v := &ApiDataZoneVertice{}
+	err := json.Unmarshal([]byte(`{"x": 1, "y": 2}`), v)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if v.Unknown != nil {
+		t.Errorf("Unknown = %v; want nil", v.Unknown)
+	}
+}
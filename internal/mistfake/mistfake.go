@@ -0,0 +1,213 @@
+// Package mistfake provides a fake Juniper Mist API server which serves
+// recorded responses, and a webhook sender which signs and posts events
+// the same way Mist does. It is used to run mistpolld and locapid offline.
+package mistfake
+
+import (
+	"bytes"
+	"embed"
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-chi/chi"
+)
+
+// Identifiers used in the recorded corpus
+const (
+	OrgId     = "a82eebc1-65d0-4355-8122-39733cd47d34"
+	SiteId    = "a84f4847-cdc2-4e96-9117-a6747edf32f1"
+	MapId11F  = "cd7c2682-4588-4eca-a23c-067c758472f9"
+	MapId12F  = "3f1e0a27-9d8c-4b6a-8e25-5d7f9c1b2a40"
+	ZoneBooth = "5b0c8a2e-3c5e-4b0e-9b1e-6a3c2f1d9e01"
+	ZoneRoomA = "9e2d4c61-7a3b-4f1e-b5c8-0d6e2a9f3b12"
+)
+
+//go:embed recorded/*.json
+var recorded embed.FS
+
+type response struct {
+	status int
+	body   []byte
+}
+
+// Server is a fake Mist REST API
+type Server struct {
+	URL    string
+	Apikey string
+
+	srv       *httptest.Server
+	mu        sync.Mutex
+	corpus    map[string][]map[string]interface{}
+	overrides map[string]response
+	requests  []string
+	delay     time.Duration
+}
+
+// NewServer starts a fake Mist API serving the recorded corpus.
+// Requests must carry the "token <apikey>" authorization header.
+func NewServer(apikey string) (*Server, error) {
+	s := &Server{
+		Apikey:    apikey,
+		corpus:    make(map[string][]map[string]interface{}),
+		overrides: make(map[string]response),
+		requests:  make([]string, 0),
+	}
+
+	for _, name := range []string{"sites", "maps", "zones", "assets", "clients"} {
+		entries, err := loadCorpus(recorded, "recorded/"+name+".json")
+		if err != nil {
+			return nil, err
+		}
+		s.corpus[name] = entries
+	}
+
+	r := chi.NewRouter()
+	r.Use(s.logRequest)
+	r.Use(s.authenticate)
+	r.Get("/api/v1/orgs/{orgid}/sites", s.getSites)
+	r.Get("/api/v1/sites/{siteid}/maps", s.getSiteEntries("maps"))
+	r.Get("/api/v1/sites/{siteid}/zones", s.getSiteEntries("zones"))
+	r.Get("/api/v1/sites/{siteid}/stats/assets/search", s.searchAssets)
+	r.Get("/api/v1/sites/{siteid}/stats/clients/{mac}", s.getClient)
+
+	s.srv = httptest.NewServer(r)
+	s.URL = s.srv.URL
+
+	return s, nil
+}
+
+func loadCorpus(fsys fs.FS, name string) ([]map[string]interface{}, error) {
+	b, err := fs.ReadFile(fsys, name)
+	if err != nil {
+		return nil, err
+	}
+
+	entries := make([]map[string]interface{}, 0)
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.UseNumber()
+	err = dec.Decode(&entries)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %w", name, err)
+	}
+
+	return entries, nil
+}
+
+// Close shuts down the server
+func (s *Server) Close() {
+	s.srv.Close()
+}
+
+// SetResponse overrides the response for a request URI (path and query)
+func (s *Server) SetResponse(uri string, status int, body []byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.overrides[uri] = response{status: status, body: body}
+}
+
+// SetDelay makes every following response wait for d, like a slow Mist API
+func (s *Server) SetDelay(d time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.delay = d
+}
+
+// Requests returns the request URIs received so far
+func (s *Server) Requests() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return append([]string{}, s.requests...)
+}
+
+func (s *Server) logRequest(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.mu.Lock()
+		s.requests = append(s.requests, r.URL.RequestURI())
+		override, ok := s.overrides[r.URL.RequestURI()]
+		delay := s.delay
+		s.mu.Unlock()
+
+		time.Sleep(delay)
+
+		if ok {
+			w.WriteHeader(override.status)
+			w.Write(override.body)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (s *Server) authenticate(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "token "+s.Apikey {
+			writeJson(w, http.StatusUnauthorized, map[string]string{"detail": "Authentication credentials were not provided."})
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+func writeJson(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func filterEntries(entries []map[string]interface{}, key string, value string) []map[string]interface{} {
+	outs := make([]map[string]interface{}, 0)
+	for _, e := range entries {
+		if v, ok := e[key].(string); ok && strings.EqualFold(v, value) {
+			outs = append(outs, e)
+		}
+	}
+
+	return outs
+}
+
+func (s *Server) getSites(w http.ResponseWriter, r *http.Request) {
+	writeJson(w, http.StatusOK, filterEntries(s.corpus["sites"], "org_id", chi.URLParam(r, "orgid")))
+}
+
+func (s *Server) getSiteEntries(name string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		writeJson(w, http.StatusOK, filterEntries(s.corpus[name], "site_id", chi.URLParam(r, "siteid")))
+	}
+}
+
+func (s *Server) searchAssets(w http.ResponseWriter, r *http.Request) {
+	results := filterEntries(s.corpus["assets"], "site_id", chi.URLParam(r, "siteid"))
+	if mac := r.URL.Query().Get("mac"); mac != "" {
+		results = filterEntries(results, "mac", mac)
+	}
+
+	writeJson(w, http.StatusOK, map[string]interface{}{
+		"start":   1718000000,
+		"end":     1718086400,
+		"limit":   1000,
+		"total":   len(results),
+		"results": results,
+	})
+}
+
+func (s *Server) getClient(w http.ResponseWriter, r *http.Request) {
+	results := filterEntries(s.corpus["clients"], "site_id", chi.URLParam(r, "siteid"))
+	results = filterEntries(results, "mac", chi.URLParam(r, "mac"))
+	if len(results) == 0 {
+		writeJson(w, http.StatusNotFound, map[string]string{"detail": "Not found."})
+		return
+	}
+
+	writeJson(w, http.StatusOK, results[0])
+}
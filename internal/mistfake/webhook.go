@@ -0,0 +1,116 @@
+package mistfake
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+)
+
+// LocationAssetEvent is a single event of the location-asset webhook topic
+type LocationAssetEvent struct {
+	Mac       string  `json:"mac"`
+	SiteId    string  `json:"site_id"`
+	MapId     string  `json:"map_id"`
+	X         float64 `json:"x"`
+	Y         float64 `json:"y"`
+	Timestamp float64 `json:"timestamp"`
+}
+
+// LocationEvent is a single event of the location (Wi-Fi client), location-unclient
+// and location-sdk webhook topics. SDK clients carry an id and name instead of a MAC.
+type LocationEvent struct {
+	Mac       string  `json:"mac,omitempty"`
+	Id        string  `json:"id,omitempty"`
+	Name      string  `json:"name,omitempty"`
+	Type      string  `json:"type,omitempty"`
+	SiteId    string  `json:"site_id"`
+	MapId     string  `json:"map_id"`
+	X         float64 `json:"x"`
+	Y         float64 `json:"y"`
+	Timestamp float64 `json:"timestamp"`
+}
+
+// ZoneEvent is a single event of the zone webhook topic
+type ZoneEvent struct {
+	Mac       string  `json:"mac"`
+	AssetId   string  `json:"asset_id"`
+	SiteId    string  `json:"site_id"`
+	MapId     string  `json:"map_id"`
+	ZoneId    string  `json:"zone_id"`
+	Trigger   string  `json:"trigger"`
+	Timestamp float64 `json:"timestamp"`
+}
+
+// WebhookSender posts webhooks signed with the shared secret like Mist does
+type WebhookSender struct {
+	URL    string
+	Secret string
+	Client *http.Client
+}
+
+func NewWebhookSender(url string, secret string) *WebhookSender {
+	return &WebhookSender{
+		URL:    url,
+		Secret: secret,
+		Client: new(http.Client),
+	}
+}
+
+// Sign returns the x-mist-signature-v2 header value for body
+func Sign(secret string, body []byte) string {
+	h := hmac.New(sha256.New, []byte(secret))
+	h.Write(body)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// Post sends events (a slice) under topic and fails unless the receiver returns 200
+func (w *WebhookSender) Post(topic string, events interface{}) error {
+	body, err := json.Marshal(map[string]interface{}{
+		"topic":  topic,
+		"events": events,
+	})
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest(http.MethodPost, w.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if w.Secret != "" {
+		req.Header.Set("X-Mist-Signature-v2", Sign(w.Secret, body))
+	}
+
+	resp, err := w.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("invalid status code %d", resp.StatusCode)
+	}
+
+	return nil
+}
+
+func (w *WebhookSender) PostLocationAsset(events ...LocationAssetEvent) error {
+	return w.Post("location-asset", events)
+}
+
+func (w *WebhookSender) PostZone(events ...ZoneEvent) error {
+	return w.Post("zone", events)
+}
+
+// PostLocation sends client location events under topic
+// ("location", "location-unclient" or "location-sdk")
+func (w *WebhookSender) PostLocation(topic string, events ...LocationEvent) error {
+	return w.Post(topic, events)
+}
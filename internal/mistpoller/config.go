@@ -1,24 +1,36 @@
 package mistpoller
 
+import (
+	"mist-location-visualization/internal/models"
+)
+
 type Config struct {
-	Db struct {
-		Driver			string	  `mapstructure:"driver"`
-		Debug			bool	  `mapstructure:"debug"`
-		Mysql			struct {
-			User		string	  `mapstructure:"user"`
-			Password	string	  `mapstructure:"password"`
-			Host		string	  `mapstructure:"host"`
-			Database	string	  `mapstructure:"database"`
-		}                                 `mapstructure:"mysql"`
-	}                                         `mapstructure:"db"`
+	Db models.DbConfig `mapstructure:"db"`
 	Mist struct {
 		Endpoint		string	  `mapstructure:"endpoint"`
 		Apikey			string	  `mapstructure:"apikey"`
 		Debug			bool	  `mapstructure:"debug"`
+		Timeout			int	  `mapstructure:"timeout"`	// seconds per request
 	}                                         `mapstructure:"mist"`
+	Http struct {
+		Listen			string	  `mapstructure:"listen"`
+	}                                         `mapstructure:"http"`
+	Health struct {
+		StaleAfter		int	  `mapstructure:"stale_after"`	// seconds without any successful poll, 0 disables
+	}                                         `mapstructure:"health"`
 	Datasource []struct {
 		Uri			string	  `mapstructure:"uri"`
 		Datalayout		string	  `mapstructure:"data_layout"`
 		Interval		int       `mapstructure:"interval"`
 	}                                         `mapstructure:"datasource"`
+	Buildings []struct {
+		Id			string	  `mapstructure:"id"`
+		SiteId			string	  `mapstructure:"site_id"`
+		Name			string	  `mapstructure:"name"`
+		Floors			[]struct {
+			MapId		string	  `mapstructure:"map_id"`
+			Level		int	  `mapstructure:"level"`
+			Name		string	  `mapstructure:"name"`
+		}                                 `mapstructure:"floors"`
+	}                                         `mapstructure:"buildings"`
 }
@@ -0,0 +1,157 @@
+package mistpoller
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// Health status values. Degraded still serves requests, down does not.
+const (
+	healthOk	= "ok"
+	healthDegraded	= "degraded"
+	healthDown	= "down"
+)
+
+// agents are considered stale after missing this many poll intervals
+const staleIntervals = 3
+
+type healthCheck struct {
+	Name		string		`json:"name"`
+	Status		string		`json:"status"`
+	Detail		string		`json:"detail,omitempty"`
+	LastSuccess	int64		`json:"last_success,omitempty"`
+}
+
+type healthReport struct {
+	Status		string		`json:"status"`
+	Checks		[]*healthCheck	`json:"checks,omitempty"`
+}
+
+func (r *healthReport) add(c *healthCheck) {
+	r.Checks = append(r.Checks, c)
+
+	switch {
+	case c.Status == healthDown:
+		r.Status = healthDown
+	case c.Status == healthDegraded && r.Status == healthOk:
+		r.Status = healthDegraded
+	}
+}
+
+// agentHealth reports an agent as degraded when it has not succeeded within staleIntervals polls
+func (s *PollAgent) agentHealth(now time.Time, startedAt time.Time) *healthCheck {
+	c := &healthCheck {
+		Name:	fmt.Sprintf("agent#%d (%s)", s.Id, s.Layout),
+		Status:	healthOk,
+	}
+
+	staleAfter := time.Duration(s.Interval * staleIntervals) * time.Second
+	last := s.lastSuccess.Load()
+	if last == 0 {
+		c.Detail = "no successful poll yet"
+		if now.Sub(startedAt) > staleAfter {
+			c.Status = healthDegraded
+		}
+		return c
+	}
+
+	age := now.Sub(time.Unix(0, last))
+	c.LastSuccess = time.Unix(0, last).Unix()
+	c.Detail = fmt.Sprintf("last successful poll %.0fs ago", age.Seconds())
+	if age > staleAfter {
+		c.Status = healthDegraded
+	}
+
+	return c
+}
+
+// pollingHealth reports the poller as down when no agent has succeeded within staleAfter
+func pollingHealth(agents []*PollAgent, now time.Time, startedAt time.Time, staleAfter time.Duration) *healthCheck {
+	c := &healthCheck {
+		Name:	"polling",
+		Status:	healthOk,
+	}
+
+	latest := int64(0)
+	for _, agent := range(agents) {
+		latest = max(latest, agent.lastSuccess.Load())
+	}
+
+	since := startedAt
+	if latest != 0 {
+		since = time.Unix(0, latest)
+		c.LastSuccess = since.Unix()
+	}
+	if staleAfter > 0 && now.Sub(since) > staleAfter {
+		c.Status = healthDown
+		c.Detail = fmt.Sprintf("no successful poll for %.0fs", now.Sub(since).Seconds())
+	}
+
+	return c
+}
+
+func (s *Poller) readiness(r *http.Request) *healthReport {
+	report := &healthReport{Status: healthOk}
+
+	// database
+	check := &healthCheck{Name: "database", Status: healthOk}
+	sqlDb, err := s.dbConn.DB()
+	if err == nil {
+		err = sqlDb.PingContext(r.Context())
+	}
+	if err != nil {
+		check.Status = healthDown
+		check.Detail = err.Error()
+	}
+	report.add(check)
+
+	// poll agents
+	now := time.Now()
+	s.mu.Lock()
+	agents := s.agents
+	staleAfter := time.Duration(s.cfg.Health.StaleAfter) * time.Second
+	s.mu.Unlock()
+	if len(agents) > 0 {
+		report.add(pollingHealth(agents, now, s.startedAt, staleAfter))
+	}
+	for _, agent := range(agents) {
+		report.add(agent.agentHealth(now, s.startedAt))
+	}
+
+	return report
+}
+
+func writeHealth(w http.ResponseWriter, report *healthReport) {
+	w.Header().Set("Content-Type", "application/json")
+	if report.Status == healthDown {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	json.NewEncoder(w).Encode(report)
+}
+
+func (s *Poller) handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.HandlerFor(s.metrics.registry, promhttp.HandlerOpts{}))
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		writeHealth(w, &healthReport{Status: healthOk})
+	})
+	mux.HandleFunc("/readyz", func(w http.ResponseWriter, r *http.Request) {
+		writeHealth(w, s.readiness(r))
+	})
+
+	return mux
+}
+
+// serveHttp exposes metrics and health checks on listen until the process exits
+func (s *Poller) serveHttp(listen string) {
+	log.Printf("http: listening on %s", listen)
+	err := http.ListenAndServe(listen, s.handler())
+	if err != nil {
+		log.Printf("http: listener failed (%v)", err)
+	}
+}
@@ -2,6 +2,7 @@ package mistpoller
 
 import (
 	"encoding/json"
+	"fmt"
 	"log"
 
 	"mist-location-visualization/internal/mistdatafmt"
@@ -19,6 +20,13 @@ func (s *PollAgent) updateDbEntryMap(mapData *mistdatafmt.ApiDataMapEntry) {
 		Ppm:    ppm,
 	}
 
+	// building and floor come from local configuration
+	if floor, ok := s.Floors[mapData.Id]; ok {
+		mapEntry.BuildingId = floor.BuildingId
+		mapEntry.FloorLevel = floor.Level
+		mapEntry.FloorName = floor.Name
+	}
+
 	w, err := mapData.Width.Int64()
 	if err != nil {
 		log.Printf("map_engine: failed to convert width %v to int64 (%v)", mapData.Width, err)
@@ -44,13 +52,13 @@ func (s *PollAgent) updateDbEntryMap(mapData *mistdatafmt.ApiDataMapEntry) {
 	return
 }
 
-func (s *PollAgent) processDataMap(data string) {
+func (s *PollAgent) processDataMap(data string) error {
 	// Get API response
 	apiEntries := make([]*mistdatafmt.ApiDataMapEntry, 0)
 	err := json.Unmarshal([]byte(data), &apiEntries)
 	if err != nil {
 		log.Printf("agent#%d: failed to parse JSON (%v)", s.Id, err)
-		return
+		return fmt.Errorf("%w: %v", errPollData, err)
 	}
 
 	if s.Debug {
@@ -63,7 +71,7 @@ func (s *PollAgent) processDataMap(data string) {
 	r := s.DbConn.Find(&dbEntries)
 	if r.Error != nil {
 		log.Printf("agent#%d: failed to fetch map data in DB (%v)", s.Id, r.Error)
-		return
+		return fmt.Errorf("%w: %v", errPollData, r.Error)
 	}
 
 	for _, dbEntry := range(dbEntries) {
@@ -78,17 +86,25 @@ func (s *PollAgent) processDataMap(data string) {
 		log.Printf("agent#%d: map id = %s has been updated", s.Id, id)
 		delKeys[id] = false
 	}
+	s.Metrics.addRows(s, rowsSaved, len(apiEntries))
 
 	// Delete keys if necesary
+	deleted := 0
 	for key, flag := range delKeys {
 		if flag {
-			err := s.DbConn.Delete(&models.Map{}, key)
-			if err != nil {
-				log.Printf("agent%d: failed to delete key %s", s.Id, key)
-			} else if s.Debug {
-				log.Printf("agent%d: deleted key %s", s.Id, key)
+			r := s.DbConn.Delete(&models.Map{}, "id = ?", key)
+			if r.Error != nil {
+				log.Printf("agent#%d: failed to delete key %s (%v)", s.Id, key, r.Error)
+			} else {
+				deleted++
+				if s.Debug {
+					log.Printf("agent%d: deleted key %s", s.Id, key)
+				}
 			}
 		}
 	}
+	s.Metrics.addRows(s, rowsDeleted, deleted)
+
+	return nil
 }
 
@@ -0,0 +1,87 @@
+package mistpoller
+
+import (
+	"errors"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Row operations counted in mistpolld_rows_changed_total
+const (
+	rowsSaved	= "saved"
+	rowsDeleted	= "deleted"
+)
+
+// errHttpStatus marks a poll which reached Mist but got an error response,
+// errPollData a response which could not be parsed or stored
+var (
+	errHttpStatus	= errors.New("unexpected HTTP status")
+	errPollData	= errors.New("failed to process data")
+)
+
+type pollMetrics struct {
+	registry	*prometheus.Registry
+	polls		*prometheus.CounterVec
+	pollDuration	*prometheus.HistogramVec
+	lastSuccess	*prometheus.GaugeVec
+	rowsChanged	*prometheus.CounterVec
+}
+
+func newPollMetrics() *pollMetrics {
+	m := &pollMetrics {
+		registry:	prometheus.NewRegistry(),
+		polls:		prometheus.NewCounterVec(prometheus.CounterOpts {
+			Name:	"mistpolld_polls_total",
+			Help:	"Polls of the Mist API by agent and outcome (success, http_error, status_error, data_error).",
+		}, []string{"agent", "layout", "outcome"}),
+		pollDuration:	prometheus.NewHistogramVec(prometheus.HistogramOpts {
+			Name:	"mistpolld_poll_duration_seconds",
+			Help:	"Time taken by a poll including the database update.",
+			Buckets:	prometheus.DefBuckets,
+		}, []string{"agent", "layout"}),
+		lastSuccess:	prometheus.NewGaugeVec(prometheus.GaugeOpts {
+			Name:	"mistpolld_last_success_timestamp_seconds",
+			Help:	"Unix time of the last successful poll.",
+		}, []string{"agent", "layout"}),
+		rowsChanged:	prometheus.NewCounterVec(prometheus.CounterOpts {
+			Name:	"mistpolld_rows_changed_total",
+			Help:	"Database rows saved or deleted by polls.",
+		}, []string{"agent", "layout", "op"}),
+	}
+
+	m.registry.MustRegister(m.polls, m.pollDuration, m.lastSuccess, m.rowsChanged)
+
+	return m
+}
+
+func (m *pollMetrics) observePoll(agent *PollAgent, started time.Time, err error) {
+	if m == nil {
+		return
+	}
+
+	id := strconv.Itoa(agent.Id)
+	outcome := "success"
+	switch {
+	case err == nil:
+		m.lastSuccess.WithLabelValues(id, agent.Layout).SetToCurrentTime()
+	case errors.Is(err, errHttpStatus):
+		outcome = "status_error"
+	case errors.Is(err, errPollData):
+		outcome = "data_error"
+	default:
+		outcome = "http_error"
+	}
+
+	m.polls.WithLabelValues(id, agent.Layout, outcome).Inc()
+	m.pollDuration.WithLabelValues(id, agent.Layout).Observe(time.Since(started).Seconds())
+}
+
+func (m *pollMetrics) addRows(agent *PollAgent, op string, n int) {
+	if m == nil || n == 0 {
+		return
+	}
+
+	m.rowsChanged.WithLabelValues(strconv.Itoa(agent.Id), agent.Layout, op).Add(float64(n))
+}
@@ -1,16 +1,14 @@
 package mistpoller
 
 import (
-	"fmt"
 	"log"
 	"os"
 	"os/signal"
 	"sync"
 	"syscall"
+	"time"
 
-	"gorm.io/driver/mysql"
 	"gorm.io/gorm"
-	"gorm.io/gorm/logger"
 
 	"mist-location-visualization/internal/models"
 )
@@ -20,35 +18,15 @@ type Poller struct {
 
 	dbConn *gorm.DB
 	agents	[]*PollAgent
+	metrics	*pollMetrics
 	wg	*sync.WaitGroup
-}
-
-func getDbConn(cfg Config) (*gorm.DB, error) {
-	var db *gorm.DB
-	var err error
-
-	switch cfg.Db.Driver {
-	case "mysql":
-		if cfg.Db.Mysql.User == "" || cfg.Db.Mysql.Host == "" || cfg.Db.Mysql.Database == "" {
-			return nil, fmt.Errorf("missing connection info")
-		}
-
-		dsn := fmt.Sprintf("%s:%s@tcp(%s)/%s?charset=utf8mb4&parseTime=True&loc=Local",
-			cfg.Db.Mysql.User, cfg.Db.Mysql.Password, cfg.Db.Mysql.Host, cfg.Db.Mysql.Database)
-		db, err = gorm.Open(mysql.Open(dsn), &gorm.Config{})
-		if err != nil {
-			return nil, err
-		}
 
-	default:
-		return nil, fmt.Errorf("unknown db driver %s", cfg.Db.Driver)
-	}
+	mu		sync.Mutex			// guards cfg, agents and killSigs on reload
+	loader		func() (Config, error)		// reads the configuration again on SIGHUP
+	killSigs	map[*PollAgent]chan struct{}	// of running agents
+	nextId		int
 
-	if cfg.Db.Debug {
-		db.Logger = db.Logger.LogMode(logger.Info)
-	}
-
-	return db, err
+	startedAt	time.Time
 }
 
 func New(cfg Config) (*Poller, error) {
@@ -58,11 +36,19 @@ func New(cfg Config) (*Poller, error) {
 	r := &Poller {
 		cfg:	cfg,
 		agents:	make([]*PollAgent, 0),
+		metrics:	newPollMetrics(),
 		wg:	&sync.WaitGroup{},
+		startedAt:	time.Now(),
+	}
+
+	err = validateConfig(cfg)
+	if err != nil {
+		log.Printf("invalid configuration %v", err)
+		return nil, err
 	}
 
 	// DB Conn Initialization
-	r.dbConn, err = getDbConn(cfg)
+	r.dbConn, err = models.OpenDb(cfg.Db)
 	if err != nil {
 		return nil, err
 	}
@@ -85,45 +71,128 @@ func New(cfg Config) (*Poller, error) {
 		return nil, err
 	}
 
+	err = r.dbConn.Debug().AutoMigrate(&models.Site{})
+	if err != nil {
+		log.Printf("failed to automigrate database %v", err)
+		return nil, err
+	}
+
+	err = r.dbConn.Debug().AutoMigrate(&models.Building{})
+	if err != nil {
+		log.Printf("failed to automigrate database %v", err)
+		return nil, err
+	}
+
+	// Building Hierarchy Initialization
+	err = syncBuildings(r.dbConn, cfg)
+	if err != nil {
+		log.Printf("failed to store building configuration %v", err)
+		return nil, err
+	}
+	floors := getFloorAssignments(cfg)
+
 	// Poll Agent Initialization
-	for id, v := range(cfg.Datasource) {
-		agent := &PollAgent {
-			Id:		id,
-			DbConn:		r.dbConn,
-			Endpoint:	cfg.Mist.Endpoint,
-			Apikey:		cfg.Mist.Apikey,
-			Uri:		v.Uri,
-			Layout:		v.Datalayout,
-			Interval:	v.Interval,
-			Debug:		cfg.Mist.Debug,
-		}
-	
-		r.agents = append(r.agents, agent)
-		id++
+	for _, v := range(cfg.Datasource) {
+		r.agents = append(r.agents, r.newAgent(cfg, r.nextId, v.Uri, v.Datalayout, v.Interval, floors))
+		r.nextId++
 	}
 
 	return r, nil 
 }
 
-func (s *Poller) Run() error {
-	var shutdownSigs []chan struct{}
-	// Launch
-	for _, agent := range(s.agents) {
-		agentShutdownSig := make(chan struct{}, 1)
-		shutdownSigs = append(shutdownSigs, agentShutdownSig)
-		go agent.Run(s.wg, agentShutdownSig)
+func (s *Poller) newAgent(cfg Config, id int, uri string, layout string, interval int, floors map[string]FloorAssignment) *PollAgent {
+	return &PollAgent {
+		Id:		id,
+		DbConn:		s.dbConn,
+		Endpoint:	cfg.Mist.Endpoint,
+		Apikey:		cfg.Mist.Apikey,
+		Uri:		uri,
+		Layout:		layout,
+		Interval:	interval,
+		Timeout:	cfg.Mist.Timeout,
+		Debug:		cfg.Mist.Debug,
+		Floors:		floors,
+		Metrics:	s.metrics,
 	}
+}
+
+// startAgent launches agent, s.mu must be held
+func (s *Poller) startAgent(agent *PollAgent) {
+	killSig := make(chan struct{})
+	s.killSigs[agent] = killSig
+	agent.done = make(chan struct{})
+	go agent.Run(s.wg, killSig)
+}
 
-	// Main thread to wait until we get a kill signal or something go wrong
-	killSig := make(chan os.Signal, 1)
-	signal.Notify(killSig, syscall.SIGINT, syscall.SIGQUIT, syscall.SIGTERM)
-	<-killSig
+// stopAgent tells agent to stop and returns the channel closed when its thread has exited,
+// s.mu must be held. Callers wait on it after releasing s.mu so health checks are not blocked.
+func (s *Poller) stopAgent(agent *PollAgent) <-chan struct{} {
+	killSig, ok := s.killSigs[agent]
+	if !ok {
+		return nil
+	}
 
-	log.Printf("Caught kill signal, shutting down")
-	for _, sig := range(shutdownSigs) {
-		close(sig)
+	close(killSig)
+	delete(s.killSigs, agent)
+	return agent.done
+}
+
+// waitAgents waits until the threads of the stopped agents have exited
+func waitAgents(stopped []<-chan struct{}) {
+	for _, done := range(stopped) {
+		if done != nil {
+			<-done
+		}
+	}
+}
+
+// start launches all agents
+func (s *Poller) start() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.killSigs = make(map[*PollAgent]chan struct{})
+	for _, agent := range(s.agents) {
+		s.startAgent(agent)
 	}
+}
+
+// stop stops all agents
+func (s *Poller) stop() {
+	s.mu.Lock()
+	stopped := make([]<-chan struct{}, 0, len(s.agents))
+	for _, agent := range(s.agents) {
+		stopped = append(stopped, s.stopAgent(agent))
+	}
+	s.killSigs = nil
+	s.mu.Unlock()
+
+	waitAgents(stopped)
 	s.wg.Wait()
+}
+
+func (s *Poller) Run() error {
+	// Metrics and Health Listener
+	if s.cfg.Http.Listen != "" {
+		go s.serveHttp(s.cfg.Http.Listen)
+	}
+
+	// Launch
+	s.start()
+
+	// Main thread to wait until we get a kill signal or something go wrong, SIGHUP reloads the configuration
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGINT, syscall.SIGQUIT, syscall.SIGTERM, syscall.SIGHUP)
+	for v := range(sig) {
+		if v != syscall.SIGHUP {
+			break
+		}
+		log.Printf("Caught SIGHUP, reloading configuration")
+		s.ReloadConfig()
+	}
+
+	log.Printf("Caught kill signal, shutting down")
+	s.stop()
 
 	log.Printf("All threads exited")
 
@@ -0,0 +1,310 @@
+package mistpoller
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"mist-location-visualization/internal/mistfake"
+	"mist-location-visualization/internal/models"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+var update = flag.Bool("update", false, "update golden files")
+
+func checkGolden(t *testing.T, name string, v interface{}) {
+	t.Helper()
+
+	got, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		t.Fatal(err)
+	}
+	got = append(got, '\n')
+
+	path := filepath.Join("testdata", name+".golden")
+	if *update {
+		err = os.WriteFile(path, got, 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	want, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("failed to read golden file (run with -update): %v", err)
+	}
+
+	if string(got) != string(want) {
+		t.Errorf("%s mismatch\ngot:\n%s\nwant:\n%s", path, got, want)
+	}
+}
+
+func newTestPoller(t *testing.T, fake *mistfake.Server) *Poller {
+	t.Helper()
+
+	cfg := Config{}
+	cfg.Db.Driver = "sqlite"
+	cfg.Db.Sqlite.Path = filepath.Join(t.TempDir(), "mistpolld.db")
+	cfg.Mist.Endpoint = fake.URL
+	cfg.Mist.Apikey = fake.Apikey
+	cfg.Mist.Timeout = 10
+	cfg.Health.StaleAfter = 900
+	cfg.Datasource = []struct {
+		Uri        string `mapstructure:"uri"`
+		Datalayout string `mapstructure:"data_layout"`
+		Interval   int    `mapstructure:"interval"`
+	}{
+		{Uri: "/api/v1/orgs/" + mistfake.OrgId + "/sites", Datalayout: "sites", Interval: 60},
+		{Uri: "/api/v1/sites/" + mistfake.SiteId + "/maps", Datalayout: "maps", Interval: 60},
+		{Uri: "/api/v1/sites/" + mistfake.SiteId + "/zones", Datalayout: "zones", Interval: 60},
+	}
+
+	err := json.Unmarshal([]byte(`[{"id": "hq", "name": "Headquarters", "floors": [{"level": 11, "name": "11F"}]}]`), &cfg.Buildings)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.Buildings[0].SiteId = mistfake.SiteId
+	cfg.Buildings[0].Floors[0].MapId = mistfake.MapId11F
+
+	p, err := New(cfg)
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+
+	return p
+}
+
+type syncState struct {
+	Sites     []models.Site
+	Buildings []models.Building
+	Maps      []models.Map
+	Zones     []models.Zone
+}
+
+func dumpState(t *testing.T, p *Poller) syncState {
+	t.Helper()
+
+	st := syncState{}
+	for _, q := range []interface{}{&st.Sites, &st.Buildings, &st.Maps, &st.Zones} {
+		r := p.dbConn.Order("id").Find(q)
+		if r.Error != nil {
+			t.Fatal(r.Error)
+		}
+	}
+
+	return st
+}
+
+func TestPollerSync(t *testing.T) {
+	fake, err := mistfake.NewServer("testkey")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fake.Close()
+
+	p := newTestPoller(t, fake)
+	for _, agent := range p.agents {
+		agent.runRequest(context.Background())
+	}
+
+	checkGolden(t, "sync", dumpState(t, p))
+
+	// entries which disappear from Mist are removed
+	fake.SetResponse("/api/v1/sites/"+mistfake.SiteId+"/zones", http.StatusOK, []byte(`[]`))
+	for _, agent := range p.agents {
+		agent.runRequest(context.Background())
+	}
+
+	st := dumpState(t, p)
+	if len(st.Zones) != 0 {
+		t.Errorf("got %d zones after removal; want 0", len(st.Zones))
+	}
+	if len(st.Maps) != 2 {
+		t.Errorf("got %d maps; want 2", len(st.Maps))
+	}
+}
+
+func TestPollerApiFailureKeepsData(t *testing.T) {
+	fake, err := mistfake.NewServer("testkey")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fake.Close()
+
+	p := newTestPoller(t, fake)
+	for _, agent := range p.agents {
+		agent.runRequest(context.Background())
+	}
+
+	fake.SetResponse("/api/v1/sites/"+mistfake.SiteId+"/maps", http.StatusInternalServerError, nil)
+	for _, agent := range p.agents {
+		agent.runRequest(context.Background())
+	}
+
+	st := dumpState(t, p)
+	if len(st.Maps) != 2 {
+		t.Errorf("got %d maps after API failure; want 2", len(st.Maps))
+	}
+
+	// agent#1 polls the maps
+	failures := testutil.ToFloat64(p.metrics.polls.WithLabelValues("1", "maps", "status_error"))
+	if failures != 1 {
+		t.Errorf("got %v failed polls; want 1", failures)
+	}
+	saved := testutil.ToFloat64(p.metrics.rowsChanged.WithLabelValues("1", "maps", rowsSaved))
+	if saved != 2 {
+		t.Errorf("got %v saved rows; want 2", saved)
+	}
+}
+
+func TestPollerHealth(t *testing.T) {
+	fake, err := mistfake.NewServer("testkey")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fake.Close()
+
+	p := newTestPoller(t, fake)
+	for _, agent := range p.agents {
+		agent.runRequest(context.Background())
+	}
+
+	ts := httptest.NewServer(p.handler())
+	defer ts.Close()
+
+	readyz := func() (int, healthReport) {
+		resp, err := http.Get(ts.URL + "/readyz")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+
+		report := healthReport{}
+		err = json.NewDecoder(resp.Body).Decode(&report)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp.StatusCode, report
+	}
+
+	status, report := readyz()
+	if status != http.StatusOK || report.Status != healthOk {
+		t.Errorf("readyz: status %d %s; want %d %s", status, report.Status, http.StatusOK, healthOk)
+	}
+
+	// the maps agent has not succeeded for longer than three intervals
+	p.agents[1].lastSuccess.Store(time.Now().Add(-time.Hour).UnixNano())
+	status, report = readyz()
+	if status != http.StatusOK || report.Status != healthDegraded {
+		t.Errorf("readyz with stale agent: status %d %s; want %d %s", status, report.Status, http.StatusOK, healthDegraded)
+	}
+
+	// none of the agents has succeeded within health.stale_after
+	for _, agent := range p.agents {
+		agent.lastSuccess.Store(time.Now().Add(-time.Hour).UnixNano())
+	}
+	status, report = readyz()
+	if status != http.StatusServiceUnavailable || report.Status != healthDown {
+		t.Errorf("readyz with stale agents: status %d %s; want %d %s", status, report.Status, http.StatusServiceUnavailable, healthDown)
+	}
+}
+
+func TestPollerReload(t *testing.T) {
+	fake, err := mistfake.NewServer("testkey")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fake.Close()
+
+	p := newTestPoller(t, fake)
+	p.start()
+	defer p.stop()
+	sites := p.agents[0]
+
+	// retune the maps agent, drop the zones agent and poll the zones of the 12F map instead
+	cfg := p.cfg
+	cfg.Datasource = append(cfg.Datasource[:0:0], cfg.Datasource[:2]...)
+	cfg.Datasource[1].Interval = 30
+	cfg.Datasource = append(cfg.Datasource, cfg.Datasource[1])
+	cfg.Datasource[2].Uri = "/api/v1/sites/" + mistfake.SiteId + "/zones?map_id=" + mistfake.MapId12F
+	cfg.Datasource[2].Datalayout = "zones"
+
+	err = p.Reload(cfg)
+	if err != nil {
+		t.Fatalf("Reload: %v", err)
+	}
+
+	if len(p.agents) != 3 || p.agents[0] != sites || p.agents[1].Id != 1 || p.agents[1].Interval != 30 || p.agents[2].Id != 3 {
+		t.Errorf("agents after reload: %+v", p.agents)
+	}
+	if len(p.killSigs) != 3 {
+		t.Errorf("got %d running agents; want 3", len(p.killSigs))
+	}
+
+	cfg.Datasource[2].Interval = 0
+	err = p.Reload(cfg)
+	if err == nil || len(p.agents) != 3 || p.agents[2].Interval != 30 {
+		t.Errorf("Reload with invalid interval: %v", err)
+	}
+
+	cfg.Datasource[2].Interval = 30
+	cfg.Datasource = append(cfg.Datasource, cfg.Datasource[1])
+	err = p.Reload(cfg)
+	if err == nil || len(p.agents) != 3 || len(p.killSigs) != 3 {
+		t.Errorf("Reload with duplicate datasource: %v", err)
+	}
+}
+
+func TestPollerReloadHungRequest(t *testing.T) {
+	fake, err := mistfake.NewServer("testkey")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fake.Close()
+
+	// the Mist API accepts the zones request and never answers
+	requested := make(chan struct{}, 1)
+	hung := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requested <- struct{}{}
+		<-r.Context().Done()
+	}))
+	defer hung.Close()
+
+	p := newTestPoller(t, fake)
+	p.agents[2].Endpoint = hung.URL
+	p.start()
+	defer p.stop()
+
+	select {
+	case <-requested:
+	case <-time.After(5 * time.Second):
+		t.Fatal("zones agent did not poll")
+	}
+
+	// dropping the zones agent cancels its request instead of waiting for it
+	cfg := p.cfg
+	cfg.Datasource = append(cfg.Datasource[:0:0], cfg.Datasource[:2]...)
+	reloaded := make(chan error, 1)
+	go func() {
+		reloaded <- p.Reload(cfg)
+	}()
+
+	select {
+	case err = <-reloaded:
+		if err != nil {
+			t.Fatalf("Reload: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Reload blocked on the hung request")
+	}
+	if len(p.agents) != 2 || len(p.killSigs) != 2 {
+		t.Errorf("agents after reload: %+v", p.agents)
+	}
+}
@@ -1,12 +1,14 @@
 package mistpoller
 
 import (
+	"context"
 	"fmt"
 	"io"
 	"log"
 	"net/http"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"gorm.io/gorm"
@@ -28,21 +30,39 @@ type PollAgent struct {
 	Uri		string
 	Layout		string
 	Interval	int
+	Timeout		int
 	Debug		bool
+	Floors		map[string]FloorAssignment
+	Metrics		*pollMetrics
+
+	lastSuccess	atomic.Int64	// unix nanoseconds of the last successful poll
 
 	intvlTicker	*time.Ticker
 	killSig		chan struct{}
 	wg		*sync.WaitGroup
+	done		chan struct{}	// closed when the thread exits
 }
 
 
-func (s *PollAgent) runRequest() {
+func (s *PollAgent) runRequest(ctx context.Context) {
+	started := time.Now()
+	err := s.poll(ctx)
+	if err == nil {
+		s.lastSuccess.Store(time.Now().UnixNano())
+	}
+	s.Metrics.observePoll(s, started, err)
+
+	return
+}
+
+// poll fetches the datasource and stores the result in the database, ctx aborts the request
+func (s *PollAgent) poll(ctx context.Context) error {
 	// build request
 	reqURL := buildURL(s.Endpoint, s.Uri)
-	req, err := http.NewRequest(http.MethodGet, reqURL, nil)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, reqURL, nil)
 	if err != nil {
 		log.Printf("agent#%d: failed to build HTTP request (%v)", s.Id, err)
-		return
+		return err
 	}
 
 	// set authentication header
@@ -53,11 +73,11 @@ func (s *PollAgent) runRequest() {
 	if s.Debug {
 		log.Printf("agent#%d: start HTTP GET request: url %s", s.Id, reqURL)
 	}
-	client := new(http.Client)
+	client := &http.Client{Timeout: time.Duration(s.Timeout) * time.Second}
 	resp, err := client.Do(req)
 	if err != nil {
 		log.Printf("agent#%d: HTTP request failure (%v)", s.Id, err)
-		return
+		return err
 	}
 	defer resp.Body.Close()
 
@@ -68,34 +88,34 @@ func (s *PollAgent) runRequest() {
 
 	if resp.StatusCode != 200 {
 		log.Printf("agent#%d: HTTP request has returned status code %d", s.Id, resp.StatusCode)
-		return
+		return fmt.Errorf("%w %d", errHttpStatus, resp.StatusCode)
 	}
 
 	body, err := io.ReadAll(resp.Body)
 	if err != nil {
 		log.Printf("agent#%d: Failed to read HTTP response body (%v)", s.Id, err)
-		return
+		return err
 	}
 
-	s.processData(string(body))
-	return
+	return s.processData(string(body))
 }
 
 
-func (s *PollAgent) processData(data string) {
+func (s *PollAgent) processData(data string) error {
 	switch(s.Layout) {
 	case "maps":
-		s.processDataMap(data)
+		return s.processDataMap(data)
 
 	case "zones":
-		s.processDataZone(data)
+		return s.processDataZone(data)
+
+	case "sites":
+		return s.processDataSite(data)
 
 	default:
 		log.Printf("agent#%d: unknown data layout %s", s.Id, s.Layout)
-		return
+		return fmt.Errorf("%w: unknown data layout %s", errPollData, s.Layout)
 	}
-
-	return
 }
 
 func (s *PollAgent) finish() {
@@ -109,6 +129,10 @@ func (s *PollAgent) finish() {
 
 	log.Printf("agent#%d: finished process thread", s.Id)
 
+	if s.done != nil {
+		close(s.done)
+	}
+
 	return
 }
 
@@ -120,20 +144,29 @@ func (s *PollAgent) Run(wg *sync.WaitGroup, killSig chan struct{}) error {
 	s.killSig = killSig
 	s.wg = wg
 
+	// requests in flight are cancelled on kill so that stopping never waits for the Mist API
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		select {
+		case <-killSig:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
 	// start
 	wg.Add(1)
 	defer s.finish()
 
-	s.runRequest()
+	s.runRequest(ctx)
 	for {
 		select {
 		case <-killSig:
 			return nil
 		case <-s.intvlTicker.C:
-			s.runRequest()
+			s.runRequest(ctx)
 		}
 	}
-
-	return nil
 }
 
@@ -0,0 +1,183 @@
+package mistpoller
+
+import (
+	"fmt"
+	"log"
+	"reflect"
+
+	"mist-location-visualization/internal/configdiff"
+)
+
+// restartOnly are the configuration sections which are read once at startup
+var restartOnly = []string{"db", "http.listen"}
+
+// validateConfig checks the datasources before agents are created for them.
+// Agents are told apart by uri and data layout, so these pairs must be unique.
+func validateConfig(cfg Config) error {
+	if cfg.Mist.Timeout <= 0 {
+		return fmt.Errorf("mist.timeout must be positive")
+	}
+	if cfg.Health.StaleAfter < 0 {
+		return fmt.Errorf("health.stale_after must not be negative")
+	}
+
+	seen := make(map[string]int)
+	for i, v := range(cfg.Datasource) {
+		switch(v.Datalayout) {
+		case "maps", "zones", "sites":
+		default:
+			return fmt.Errorf("datasource[%d]: unknown data layout %s", i, v.Datalayout)
+		}
+
+		if v.Uri == "" {
+			return fmt.Errorf("datasource[%d]: missing uri", i)
+		}
+		if v.Interval <= 0 {
+			return fmt.Errorf("datasource[%d]: interval must be positive", i)
+		}
+
+		key := agentKey(v.Uri, v.Datalayout)
+		if j, ok := seen[key]; ok {
+			return fmt.Errorf("datasource[%d]: duplicates datasource[%d] (%s %s)", i, j, v.Datalayout, v.Uri)
+		}
+		seen[key] = i
+	}
+
+	return nil
+}
+
+func agentKey(uri string, layout string) string {
+	return uri + "|" + layout
+}
+
+// SetConfigLoader sets the function ReloadConfig uses to read the configuration again
+func (s *Poller) SetConfigLoader(load func() (Config, error)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.loader = load
+}
+
+// ReloadConfig reads the configuration with the loader and applies it
+func (s *Poller) ReloadConfig() error {
+	s.mu.Lock()
+	load := s.loader
+	s.mu.Unlock()
+
+	if load == nil {
+		log.Printf("ReloadConfig: no configuration loader, ignoring reload")
+		return nil
+	}
+
+	cfg, err := load()
+	if err != nil {
+		log.Printf("ReloadConfig: failed to read configuration (%v)", err)
+		return err
+	}
+
+	return s.Reload(cfg)
+}
+
+// Reload validates cfg and applies it. Agents of new datasources are started and those
+// of removed ones stopped. Agents whose settings changed are restarted with the same id,
+// the others keep polling undisturbed. Changes to db and http.listen need a restart.
+func (s *Poller) Reload(cfg Config) error {
+	// deferred after the unlock below, so stopped agents are awaited without holding s.mu
+	stopped := make([]<-chan struct{}, 0)
+	defer func() {
+		waitAgents(stopped)
+	}()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	err := validateConfig(cfg)
+	if err != nil {
+		log.Printf("Reload: invalid configuration (%v)", err)
+		return err
+	}
+
+	changes := configdiff.Diff(s.cfg, cfg)
+	if len(changes) == 0 {
+		log.Printf("Reload: configuration unchanged")
+		return nil
+	}
+	for _, c := range(changes) {
+		restart := false
+		for _, v := range(restartOnly) {
+			restart = restart || c.Under(v)
+		}
+
+		if restart {
+			log.Printf("Reload: %s changed, requires a restart", c.Path)
+		} else {
+			log.Printf("Reload: %s", c)
+		}
+	}
+	cfg.Db = s.cfg.Db
+	cfg.Http = s.cfg.Http
+
+	// Building Hierarchy
+	floors := getFloorAssignments(cfg)
+	if !reflect.DeepEqual(cfg.Buildings, s.cfg.Buildings) {
+		err = syncBuildings(s.dbConn, cfg)
+		if err != nil {
+			log.Printf("Reload: failed to store building configuration (%v)", err)
+			return err
+		}
+	}
+
+	// Poll Agents
+	current := make(map[string]*PollAgent)
+	for _, agent := range(s.agents) {
+		current[agentKey(agent.Uri, agent.Layout)] = agent
+	}
+
+	agents := make([]*PollAgent, 0, len(cfg.Datasource))
+	for _, v := range(cfg.Datasource) {
+		key := agentKey(v.Uri, v.Datalayout)
+		old, ok := current[key]
+		if ok {
+			delete(current, key)
+		}
+
+		id := s.nextId
+		if ok {
+			id = old.Id
+		} else {
+			s.nextId++
+		}
+		agent := s.newAgent(cfg, id, v.Uri, v.Datalayout, v.Interval, floors)
+
+		if ok {
+			if agent.Interval == old.Interval && agent.Endpoint == old.Endpoint && agent.Apikey == old.Apikey &&
+				agent.Timeout == old.Timeout && agent.Debug == old.Debug && (agent.Layout != "maps" || reflect.DeepEqual(agent.Floors, old.Floors)) {
+				agents = append(agents, old)
+				continue
+			}
+
+			log.Printf("Reload: restarting agent#%d (%s)", id, v.Uri)
+			stopped = append(stopped, s.stopAgent(old))
+			agent.lastSuccess.Store(old.lastSuccess.Load())
+		} else {
+			log.Printf("Reload: adding agent#%d (%s)", id, v.Uri)
+		}
+
+		if s.killSigs != nil {
+			s.startAgent(agent)
+		}
+		agents = append(agents, agent)
+	}
+
+	for _, old := range(s.agents) {
+		if _, ok := current[agentKey(old.Uri, old.Layout)]; ok {
+			log.Printf("Reload: removing agent#%d (%s)", old.Id, old.Uri)
+			stopped = append(stopped, s.stopAgent(old))
+		}
+	}
+
+	s.agents = agents
+	s.cfg = cfg
+
+	return nil
+}
@@ -0,0 +1,137 @@
+package mistpoller
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+
+	"gorm.io/gorm"
+
+	"mist-location-visualization/internal/mistdatafmt"
+	"mist-location-visualization/internal/models"
+)
+
+// FloorAssignment places a map on a floor of a locally configured building
+type FloorAssignment struct {
+	BuildingId	string
+	Level		int
+	Name		string
+}
+
+func getFloorAssignments(cfg Config) map[string]FloorAssignment {
+	floors := make(map[string]FloorAssignment)
+	for _, b := range(cfg.Buildings) {
+		for _, f := range(b.Floors) {
+			floors[f.MapId] = FloorAssignment {
+				BuildingId:	b.Id,
+				Level:		f.Level,
+				Name:		f.Name,
+			}
+		}
+	}
+
+	return floors
+}
+
+func syncBuildings(db *gorm.DB, cfg Config) error {
+	keep := make([]string, 0)
+	for _, b := range(cfg.Buildings) {
+		dbEntry := &models.Building {
+			Id:		b.Id,
+			SiteId:		b.SiteId,
+			Name:		b.Name,
+		}
+
+		r := db.Save(dbEntry)
+		if r.Error != nil {
+			return r.Error
+		}
+		keep = append(keep, b.Id)
+	}
+
+	// drop buildings which were removed from the configuration
+	q := db.Session(&gorm.Session{AllowGlobalUpdate: true})
+	if len(keep) > 0 {
+		q = q.Where("id NOT IN ?", keep)
+	}
+	r := q.Delete(&models.Building{})
+	if r.Error != nil {
+		return r.Error
+	}
+
+	return nil
+}
+
+func (s *PollAgent) updateDbEntrySite(siteData *mistdatafmt.ApiDataSiteEntry) {
+	// inject data to db
+	dbEntry := &models.Site {
+			Id:		siteData.Id,
+			Name:		siteData.Name,
+			OrgId:		siteData.OrgId,
+			Timezone:	siteData.Timezone,
+	}
+
+	if s.Debug {
+		s.DbConn.Debug().Save(dbEntry)
+	} else {
+		s.DbConn.Save(dbEntry)
+	}
+
+	return
+}
+
+func (s *PollAgent) processDataSite(data string) error {
+	// Get API response
+	apiEntries := make([]*mistdatafmt.ApiDataSiteEntry, 0)
+	err := json.Unmarshal([]byte(data), &apiEntries)
+	if err != nil {
+		log.Printf("agent#%d: failed to parse JSON (%v)", s.Id, err)
+		return fmt.Errorf("%w: %v", errPollData, err)
+	}
+
+	if s.Debug {
+		log.Printf("agent#%d: got %d entries", s.Id, len(apiEntries))
+	}
+
+	// Get current data from DB
+	delKeys := make(map[string]bool)
+	dbEntries := make([]models.Site, 0)
+	r := s.DbConn.Find(&dbEntries)
+	if r.Error != nil {
+		log.Printf("agent#%d: failed to fetch site data in DB (%v)", s.Id, r.Error)
+		return fmt.Errorf("%w: %v", errPollData, r.Error)
+	}
+
+	for _, dbEntry := range(dbEntries) {
+		delKeys[dbEntry.Id] = true
+	}
+
+	// Check diff and update if necessary
+	for _, apiEntry := range(apiEntries) {
+		s.updateDbEntrySite(apiEntry)
+
+		id, _ := apiEntry.GetJsonKeyValueAsStr("id")
+		log.Printf("agent#%d: site id = %s has been updated", s.Id, id)
+		delKeys[id] = false
+	}
+	s.Metrics.addRows(s, rowsSaved, len(apiEntries))
+
+	// Delete keys if necesary
+	deleted := 0
+	for key, flag := range delKeys {
+		if flag {
+			r := s.DbConn.Delete(&models.Site{}, "id = ?", key)
+			if r.Error != nil {
+				log.Printf("agent#%d: failed to delete key %s (%v)", s.Id, key, r.Error)
+			} else {
+				deleted++
+				if s.Debug {
+					log.Printf("agent#%d: deleted key %s", s.Id, key)
+				}
+			}
+		}
+	}
+	s.Metrics.addRows(s, rowsDeleted, deleted)
+
+	return nil
+}
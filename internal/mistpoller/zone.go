@@ -2,6 +2,7 @@ package mistpoller
 
 import (
 	"encoding/json"
+	"fmt"
 	"log"
 
 	"mist-location-visualization/internal/mistdatafmt"
@@ -15,6 +16,17 @@ func (s *PollAgent) updateDbEntryZone(zoneData *mistdatafmt.ApiDataZoneEntry) er
 			MapId:		zoneData.MapId,
 			SiteId:		zoneData.SiteId,
 			Name:		zoneData.Name,
+			Vertices:	make([]models.Point, 0),
+	}
+
+	for _, v := range(zoneData.VerticesM) {
+		x, errX := v.X.Float64()
+		y, errY := v.Y.Float64()
+		if errX != nil || errY != nil {
+			log.Printf("agent#%d: invalid vertex (%v, %v) in zone %s", s.Id, v.X, v.Y, zoneData.Id)
+			continue
+		}
+		dbEntry.Vertices = append(dbEntry.Vertices, models.Point{X: x, Y: y})
 	}
 
 	if s.Debug {
@@ -25,13 +37,13 @@ func (s *PollAgent) updateDbEntryZone(zoneData *mistdatafmt.ApiDataZoneEntry) er
 
 	return nil
 }
-func (s *PollAgent) processDataZone(data string) {
+func (s *PollAgent) processDataZone(data string) error {
 	// Get API response
 	apiEntries := make([]*mistdatafmt.ApiDataZoneEntry, 0)
 	err := json.Unmarshal([]byte(data), &apiEntries)
 	if err != nil {
 		log.Printf("agent#%d: failed to parse JSON (%v)", s.Id, err)
-		return
+		return fmt.Errorf("%w: %v", errPollData, err)
 	}
 
 	if s.Debug {
@@ -44,7 +56,7 @@ func (s *PollAgent) processDataZone(data string) {
 	r := s.DbConn.Find(&dbEntries)
 	if r.Error != nil {
 		log.Printf("agent#%d: failed to fetch map data in DB (%v)", s.Id, r.Error)
-		return
+		return fmt.Errorf("%w: %v", errPollData, r.Error)
 	}
 
 	for _, dbEntry := range(dbEntries) {
@@ -59,17 +71,25 @@ func (s *PollAgent) processDataZone(data string) {
 		log.Printf("agent#%d: map id = %s has been updated", s.Id, id)
 		delKeys[id] = false
 	}
+	s.Metrics.addRows(s, rowsSaved, len(apiEntries))
 
 	// Delete keys if necesary
+	deleted := 0
 	for key, flag := range delKeys {
 		if flag {
-			err := s.DbConn.Delete(&models.Zone{}, key)
-			if err != nil {
-				log.Printf("agent%d: failed to delete key %s", s.Id, key)
-			} else if s.Debug {
-				log.Printf("agent#%d: deleted key %s", s.Id, key)
+			r := s.DbConn.Delete(&models.Zone{}, "id = ?", key)
+			if r.Error != nil {
+				log.Printf("agent#%d: failed to delete key %s (%v)", s.Id, key, r.Error)
+			} else {
+				deleted++
+				if s.Debug {
+					log.Printf("agent#%d: deleted key %s", s.Id, key)
+				}
 			}
 		}
 	}
+	s.Metrics.addRows(s, rowsDeleted, deleted)
+
+	return nil
 }
 
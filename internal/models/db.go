@@ -0,0 +1,64 @@
+package models
+
+import (
+	"fmt"
+
+	"github.com/glebarez/sqlite"
+	"gorm.io/driver/mysql"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+)
+
+// DbConfig is the database section shared by the daemons and tagsim
+type DbConfig struct {
+	Driver string `mapstructure:"driver"`
+	Debug  bool   `mapstructure:"debug"`
+	Mysql  struct {
+		User     string `mapstructure:"user"`
+		Password string `mapstructure:"password"`
+		Host     string `mapstructure:"host"`
+		Database string `mapstructure:"database"`
+	} `mapstructure:"mysql"`
+	Sqlite struct {
+		Path string `mapstructure:"path"`
+	} `mapstructure:"sqlite"`
+}
+
+// OpenDb connects to the database configured in cfg
+func OpenDb(cfg DbConfig) (*gorm.DB, error) {
+	var db *gorm.DB
+	var err error
+
+	switch cfg.Driver {
+	case "mysql":
+		if cfg.Mysql.User == "" || cfg.Mysql.Host == "" || cfg.Mysql.Database == "" {
+			return nil, fmt.Errorf("missing connection info")
+		}
+
+		dsn := fmt.Sprintf("%s:%s@tcp(%s)/%s?charset=utf8mb4&parseTime=True&loc=Local",
+			cfg.Mysql.User, cfg.Mysql.Password, cfg.Mysql.Host, cfg.Mysql.Database)
+		db, err = gorm.Open(mysql.Open(dsn), &gorm.Config{})
+		if err != nil {
+			return nil, err
+		}
+
+	case "sqlite":
+		if cfg.Sqlite.Path == "" {
+			return nil, fmt.Errorf("missing sqlite path")
+		}
+
+		db, err = gorm.Open(sqlite.Open(cfg.Sqlite.Path), &gorm.Config{})
+		if err != nil {
+			return nil, err
+		}
+
+	default:
+		return nil, fmt.Errorf("unknown db driver %s", cfg.Driver)
+	}
+
+	if cfg.Debug {
+		db.Logger = db.Logger.LogMode(logger.Info)
+	}
+
+	return db, err
+}
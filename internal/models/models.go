@@ -4,36 +4,102 @@ import (
 	"time"
 )
 
-// Map represents a floor map in the system
-type Map struct {
-	Id        string    `gorm:"primaryKey" json:"id"`
+// Site represents a Mist site
+type Site struct {
+	Id        string    `gorm:"primaryKey;not null" json:"id"`
 	Name      string    `json:"name"`
-	Url       string    `json:"-"`
+	OrgId     string    `json:"org_id"`
+	Timezone  string    `json:"timezone"`
+	CreatedAt time.Time `json:"-"`
+	UpdatedAt time.Time `json:"-"`
+}
+
+// Building represents a group of floor maps within a site
+type Building struct {
+	Id        string    `gorm:"primaryKey;not null" json:"id"`
 	SiteId    string    `json:"site_id"`
-	Width     int64     `json:"width"`
-	Height    int64     `json:"height"`
-	Ppm       float64   `json:"ppm"`
+	Name      string    `json:"name"`
 	CreatedAt time.Time `json:"-"`
 	UpdatedAt time.Time `json:"-"`
 }
 
+// Map represents a floor map in the system
+type Map struct {
+	Id         string    `gorm:"primaryKey" json:"id"`
+	Name       string    `json:"name"`
+	Url        string    `json:"-"`
+	SiteId     string    `json:"site_id"`
+	BuildingId string    `json:"building_id"`
+	FloorLevel int       `json:"floor_level"`
+	FloorName  string    `json:"floor_name"`
+	Width      int64     `json:"width"`
+	Height     int64     `json:"height"`
+	Ppm        float64   `json:"ppm"`
+	CreatedAt  time.Time `json:"-"`
+	UpdatedAt  time.Time `json:"-"`
+}
+
+// Point is a position on a map in metres
+type Point struct {
+	X float64 `json:"x"`
+	Y float64 `json:"y"`
+}
+
 // Zone represents a defined area on a map
 type Zone struct {
 	Name      string    `json:"name"`
 	Id        string    `gorm:"primaryKey;not null" json:"id"`
 	MapId     string    `json:"map_id"`
 	SiteId    string    `json:"site_id"`
+	Vertices  []Point   `gorm:"serializer:json" json:"vertices"`
+	CreatedAt time.Time `json:"-"`
+	UpdatedAt time.Time `json:"-"`
+}
+
+// Geofence shapes
+const (
+	GeofenceShapePolygon = "polygon"
+	GeofenceShapeCircle  = "circle"
+)
+
+// Geofence is a locally managed area on a map. Polygons use Vertices and circles
+// use Center and Radius, all in metres.
+type Geofence struct {
+	Id        string    `gorm:"primaryKey;not null" json:"id"`
+	Name      string    `json:"name"`
+	MapId     string    `gorm:"index" json:"map_id"`
+	SiteId    string    `json:"site_id"`
+	Shape     string    `json:"shape"`
+	Vertices  []Point   `gorm:"serializer:json" json:"vertices"`
+	Center    Point     `gorm:"serializer:json" json:"center"`
+	Radius    float64   `json:"radius"`
 	CreatedAt time.Time `json:"-"`
 	UpdatedAt time.Time `json:"-"`
 }
 
-// Entity represents a tracked device or asset in the system
+// Kinds of tracked entities
+const (
+	EntityKindBleAsset    = "ble_asset"
+	EntityKindWifiClient  = "wifi_client"
+	EntityKindUnconnected = "unconnected"
+	EntityKindSdk         = "sdk"
+)
+
+// EntityKinds lists all valid entity kinds
+var EntityKinds = []string{EntityKindBleAsset, EntityKindWifiClient, EntityKindUnconnected, EntityKindSdk}
+
+// Entity represents a tracked device or asset in the system.
+// SDK clients have no MAC address and are keyed by their client id.
 type Entity struct {
 	Mac         string    `gorm:"primaryKey;not null" json:"mac"`
+	Kind        string    `gorm:"index;default:ble_asset" json:"kind"`
 	MapId       string    `json:"map_id"`
+	LastMapId   string    `json:"last_map_id"` // kept when the position times out
 	Name        string    `json:"name"`
 	X           float64   `json:"x"`
 	Y           float64   `json:"y"`
+	RawX        float64   `json:"raw_x"`
+	RawY        float64   `json:"raw_y"`
 	Lastseen    float64   `json:"last_seen"`
 	ZoneId      string    `json:"zone_id"`
 	ZoneName    string    `json:"zone_name"`
@@ -43,3 +109,124 @@ type Entity struct {
 	CreatedAt   time.Time `json:"created_at"`
 	UpdatedAt   time.Time `json:"updated_at"`
 }
+
+// FloorChange records an entity moving from one map to another
+type FloorChange struct {
+	Id         uint      `gorm:"primaryKey;autoIncrement" json:"id"`
+	Mac        string    `gorm:"index" json:"mac"`
+	FromMapId  string    `json:"from_map_id"`
+	ToMapId    string    `json:"to_map_id"`
+	FromLevel  int       `json:"from_level"`
+	ToLevel    int       `json:"to_level"`
+	BuildingId string    `json:"building_id"`
+	ChangedAt  time.Time `gorm:"index" json:"changed_at"`
+}
+
+// ZoneVisit records an entity staying in a zone or geofence. ExitAt is nil while the visit
+// is open and Dwell holds the length of a closed visit in seconds.
+type ZoneVisit struct {
+	Id       uint       `gorm:"primaryKey;autoIncrement" json:"id"`
+	Mac      string     `gorm:"index" json:"mac"`
+	ZoneId   string     `gorm:"index" json:"zone_id"`
+	MapId    string     `json:"map_id"`
+	Geofence bool       `gorm:"default:false" json:"geofence"`
+	EnterAt  time.Time  `gorm:"index" json:"enter_at"`
+	ExitAt   *time.Time `json:"exit_at"`
+	Dwell    float64    `json:"dwell"`
+}
+
+// Occupancy scopes
+const (
+	OccupancyScopeZone = "zone"
+	OccupancyScopeMap  = "map"
+)
+
+// OccupancySample is the number of entities in a zone or on a map at a point in time
+type OccupancySample struct {
+	Id        uint      `gorm:"primaryKey;autoIncrement" json:"id"`
+	Scope     string    `gorm:"index:idx_occupancy_scope" json:"scope"`
+	ScopeId   string    `gorm:"index:idx_occupancy_scope" json:"scope_id"`
+	Count     int64     `json:"count"`
+	SampledAt time.Time `gorm:"index:idx_occupancy_scope" json:"sampled_at"`
+}
+
+// PositionSample is a recorded location of an entity in metres from the map origin.
+// X and Y are smoothed by the position filter, RawX and RawY are as reported by Mist.
+type PositionSample struct {
+	Id     uint      `gorm:"primaryKey;autoIncrement" json:"id"`
+	Mac    string    `gorm:"index" json:"mac"`
+	MapId  string    `gorm:"index:idx_position_map" json:"map_id"`
+	X      float64   `json:"x"`
+	Y      float64   `json:"y"`
+	RawX   float64   `json:"raw_x"`
+	RawY   float64   `json:"raw_y"`
+	SeenAt time.Time `gorm:"index:idx_position_map" json:"seen_at"`
+}
+
+// Alert is created by a rule with an alert action. AckedAt is nil until the alert is acknowledged.
+// AnonMessage is the message rendered with the pseudonym of the entity.
+type Alert struct {
+	Id          uint       `gorm:"primaryKey;autoIncrement" json:"id"`
+	Rule        string     `gorm:"index" json:"rule"`
+	Severity    string     `json:"severity"`
+	Message     string     `json:"message"`
+	AnonMessage string     `json:"anon_message"`
+	Trigger     string     `json:"trigger"`
+	Mac         string     `gorm:"index" json:"mac"`
+	ZoneId      string     `json:"zone_id"`
+	MapId       string     `json:"map_id"`
+	CreatedAt   time.Time  `gorm:"index" json:"created_at"`
+	AckedAt     *time.Time `json:"acked_at"`
+	AckedBy     string     `json:"acked_by"`
+}
+
+// Contact is an episode of two entities staying within the proximity distance of each other
+// on one map. MacA sorts before MacB. LastAt is the last time they were seen close together.
+type Contact struct {
+	Id          uint      `gorm:"primaryKey;autoIncrement" json:"id"`
+	MacA        string    `gorm:"index" json:"mac_a"`
+	MacB        string    `gorm:"index" json:"mac_b"`
+	MapId       string    `json:"map_id"`
+	StartAt     time.Time `gorm:"index" json:"start_at"`
+	LastAt      time.Time `json:"last_at"`
+	MinDistance float64   `json:"min_distance"`
+	Closed      bool      `gorm:"default:false" json:"closed"`
+}
+
+// Entity privacy visibilities
+const (
+	PrivacyVisible   = "visible"
+	PrivacyZoneOnly  = "zone"
+	PrivacyAnonymous = "anonymous"
+	PrivacyHidden    = "hidden"
+)
+
+// EntityPrivacy holds the privacy settings of an entity. Outside the optional schedule
+// (Days, From and To in Timezone) the entity is hidden.
+type EntityPrivacy struct {
+	Mac        string    `gorm:"primaryKey;not null" json:"mac"`
+	Visibility string    `json:"visibility"`
+	Days       []string  `gorm:"serializer:json" json:"days"`
+	From       string    `json:"from"`
+	To         string    `json:"to"`
+	Timezone   string    `json:"timezone"`
+	CreatedAt  time.Time `json:"-"`
+	UpdatedAt  time.Time `json:"-"`
+}
+
+// Audit actions
+const (
+	AuditDeleteEntity = "delete_entity"
+	AuditPurgeEntity  = "purge_entity"
+)
+
+// AuditRecord records an administrative change to stored data, such as the erasure of an entity.
+// Detail holds the rows removed per table.
+type AuditRecord struct {
+	Id        uint      `gorm:"primaryKey;autoIncrement" json:"id"`
+	Action    string    `gorm:"index" json:"action"`
+	Target    string    `gorm:"index" json:"target"`
+	Actor     string    `json:"actor"`
+	Detail    string    `json:"detail"`
+	CreatedAt time.Time `gorm:"index" json:"created_at"`
+}
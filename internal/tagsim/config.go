@@ -0,0 +1,35 @@
+package tagsim
+
+import (
+	"mist-location-visualization/internal/models"
+)
+
+// Config defines the configuration structure for the tag simulator
+type Config struct {
+	Target struct {
+		Url    string `mapstructure:"url"`
+		Secret string `mapstructure:"secret"`
+	} `mapstructure:"target"`
+	Db         models.DbConfig `mapstructure:"db"`
+	LayoutFile string          `mapstructure:"layout_file"`
+	SiteId     string          `mapstructure:"site_id"`
+	Interval   float64         `mapstructure:"interval"`
+	Duration   int             `mapstructure:"duration"`
+	Seed       int64           `mapstructure:"seed"`
+	Tags       struct {
+		Count     int      `mapstructure:"count"`
+		MacPrefix string   `mapstructure:"mac_prefix"`
+		Speed     float64  `mapstructure:"speed"`
+		MapIds    []string `mapstructure:"map_ids"`
+	} `mapstructure:"tags"`
+	Paths []struct {
+		Mac       string  `mapstructure:"mac"`
+		MapId     string  `mapstructure:"map_id"`
+		Loop      bool    `mapstructure:"loop"`
+		Speed     float64 `mapstructure:"speed"`
+		Waypoints []struct {
+			X float64 `mapstructure:"x"`
+			Y float64 `mapstructure:"y"`
+		} `mapstructure:"waypoints"`
+	} `mapstructure:"paths"`
+}
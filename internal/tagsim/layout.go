@@ -0,0 +1,137 @@
+package tagsim
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"mist-location-visualization/internal/mistdatafmt"
+	"mist-location-visualization/internal/models"
+)
+
+// Zone is a polygon on a floor map in metres
+type Zone struct {
+	Id       string
+	Name     string
+	Vertices []models.Point
+}
+
+// FloorMap is a map tags move on, sized in metres
+type FloorMap struct {
+	Id     string
+	SiteId string
+	Width  float64
+	Height float64
+	Zones  []Zone
+}
+
+// Contains reports whether p is inside the zone polygon (ray casting)
+func (z *Zone) Contains(p models.Point) bool {
+	in := false
+	n := len(z.Vertices)
+	for i, j := 0, n-1; i < n; j, i = i, i+1 {
+		a, b := z.Vertices[i], z.Vertices[j]
+		if (a.Y > p.Y) != (b.Y > p.Y) && p.X < (b.X-a.X)*(p.Y-a.Y)/(b.Y-a.Y)+a.X {
+			in = !in
+		}
+	}
+
+	return in
+}
+
+// loadLayoutFromDb reads the maps and zones synchronized by mistpolld
+func loadLayoutFromDb(cfg Config) (map[string]*FloorMap, error) {
+	db, err := models.OpenDb(cfg.Db)
+	if err != nil {
+		return nil, err
+	}
+
+	maps := make([]models.Map, 0)
+	ret := db.Find(&maps)
+	if ret.Error != nil {
+		return nil, ret.Error
+	}
+
+	zones := make([]models.Zone, 0)
+	ret = db.Find(&zones)
+	if ret.Error != nil {
+		return nil, ret.Error
+	}
+
+	layout := make(map[string]*FloorMap)
+	for _, m := range maps {
+		if m.Ppm <= 0 {
+			continue
+		}
+
+		layout[m.Id] = &FloorMap{
+			Id:     m.Id,
+			SiteId: m.SiteId,
+			Width:  float64(m.Width) / m.Ppm,
+			Height: float64(m.Height) / m.Ppm,
+			Zones:  make([]Zone, 0),
+		}
+	}
+
+	for _, z := range zones {
+		if m, ok := layout[z.MapId]; ok && len(z.Vertices) > 2 {
+			m.Zones = append(m.Zones, Zone{Id: z.Id, Name: z.Name, Vertices: z.Vertices})
+		}
+	}
+
+	return layout, nil
+}
+
+// layoutFile is a dump of the Mist maps and zones APIs
+type layoutFile struct {
+	Maps  []mistdatafmt.ApiDataMapEntry  `json:"maps"`
+	Zones []mistdatafmt.ApiDataZoneEntry `json:"zones"`
+}
+
+// loadLayoutFromFile reads maps and zones in the Mist API format
+func loadLayoutFromFile(path string) (map[string]*FloorMap, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	data := layoutFile{}
+	err = json.Unmarshal(b, &data)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse layout file: %w", err)
+	}
+
+	layout := make(map[string]*FloorMap)
+	for _, m := range data.Maps {
+		w, errW := m.WidthM.Float64()
+		h, errH := m.HeightM.Float64()
+		if errW != nil || errH != nil {
+			return nil, fmt.Errorf("map %s has no size in metres", m.Id)
+		}
+
+		layout[m.Id] = &FloorMap{
+			Id:     m.Id,
+			SiteId: m.SiteId,
+			Width:  w,
+			Height: h,
+			Zones:  make([]Zone, 0),
+		}
+	}
+
+	for _, z := range data.Zones {
+		m, ok := layout[z.MapId]
+		if !ok {
+			continue
+		}
+
+		zone := Zone{Id: z.Id, Name: z.Name, Vertices: make([]models.Point, 0)}
+		for _, v := range z.VerticesM {
+			x, _ := v.X.Float64()
+			y, _ := v.Y.Float64()
+			zone.Vertices = append(zone.Vertices, models.Point{X: x, Y: y})
+		}
+		m.Zones = append(m.Zones, zone)
+	}
+
+	return layout, nil
+}
@@ -0,0 +1,267 @@
+package tagsim
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"math/rand"
+	"os"
+	"os/signal"
+	"sort"
+	"syscall"
+	"time"
+
+	"mist-location-visualization/internal/mistfake"
+	"mist-location-visualization/internal/models"
+)
+
+type tag struct {
+	mac       string
+	floor     *FloorMap
+	pos       models.Point
+	speed     float64
+	waypoints []models.Point
+	next      int
+	loop      bool
+	random    bool
+	zones     map[string]bool
+}
+
+// Simulator moves virtual tags and reports them to locapid like Mist does
+type Simulator struct {
+	cfg    Config
+	layout map[string]*FloorMap
+	tags   []*tag
+	rnd    *rand.Rand
+	sender *mistfake.WebhookSender
+	now    func() time.Time
+}
+
+func New(cfg Config) (*Simulator, error) {
+	var err error
+
+	if cfg.Target.Url == "" {
+		return nil, fmt.Errorf("missing target url")
+	} else if cfg.Interval <= 0 {
+		return nil, fmt.Errorf("invalid interval %v", cfg.Interval)
+	} else if len(cfg.Tags.MacPrefix) > 10 {
+		return nil, fmt.Errorf("mac prefix %s is too long", cfg.Tags.MacPrefix)
+	}
+
+	// Base Initialization
+	r := &Simulator{
+		cfg:    cfg,
+		tags:   make([]*tag, 0),
+		rnd:    rand.New(rand.NewSource(cfg.Seed)),
+		sender: mistfake.NewWebhookSender(cfg.Target.Url, cfg.Target.Secret),
+		now:    time.Now,
+	}
+
+	// Layout Initialization
+	if cfg.LayoutFile != "" {
+		r.layout, err = loadLayoutFromFile(cfg.LayoutFile)
+	} else {
+		r.layout, err = loadLayoutFromDb(cfg)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if len(r.layout) == 0 {
+		return nil, fmt.Errorf("no maps available")
+	}
+
+	// Tag Initialization
+	for _, p := range cfg.Paths {
+		floor, ok := r.layout[p.MapId]
+		if !ok {
+			return nil, fmt.Errorf("path for %s refers to unknown map %s", p.Mac, p.MapId)
+		}
+		if len(p.Waypoints) == 0 {
+			return nil, fmt.Errorf("path for %s has no waypoints", p.Mac)
+		}
+
+		t := &tag{
+			mac:       p.Mac,
+			floor:     floor,
+			speed:     p.Speed,
+			waypoints: make([]models.Point, 0),
+			loop:      p.Loop,
+			zones:     make(map[string]bool),
+		}
+		for _, w := range p.Waypoints {
+			t.waypoints = append(t.waypoints, models.Point{X: w.X, Y: w.Y})
+		}
+		if t.speed <= 0 {
+			t.speed = cfg.Tags.Speed
+		}
+		t.pos = t.waypoints[0]
+
+		r.tags = append(r.tags, t)
+	}
+
+	mapIds := cfg.Tags.MapIds
+	if len(mapIds) == 0 {
+		for id := range r.layout {
+			mapIds = append(mapIds, id)
+		}
+		sort.Strings(mapIds)
+	}
+
+	for i := 0; i < cfg.Tags.Count; i++ {
+		floor, ok := r.layout[mapIds[i%len(mapIds)]]
+		if !ok {
+			return nil, fmt.Errorf("unknown map %s", mapIds[i%len(mapIds)])
+		}
+
+		t := &tag{
+			mac:    fmt.Sprintf("%s%0*x", cfg.Tags.MacPrefix, 12-len(cfg.Tags.MacPrefix), i+1),
+			floor:  floor,
+			speed:  cfg.Tags.Speed,
+			random: true,
+			zones:  make(map[string]bool),
+		}
+		t.pos = r.randomPoint(floor)
+
+		r.tags = append(r.tags, t)
+	}
+
+	if len(r.tags) == 0 {
+		return nil, fmt.Errorf("no tags to simulate")
+	}
+
+	return r, nil
+}
+
+func (s *Simulator) randomPoint(floor *FloorMap) models.Point {
+	return models.Point{
+		X: s.rnd.Float64() * floor.Width,
+		Y: s.rnd.Float64() * floor.Height,
+	}
+}
+
+// move advances the tag by dt seconds along its path
+func (s *Simulator) move(t *tag, dt float64) {
+	dist := t.speed * dt
+
+	// bounded so that paths made of identical waypoints cannot spin forever
+	for i := 0; dist > 0 && i < 1000; i++ {
+		if t.next >= len(t.waypoints) {
+			if t.random {
+				t.waypoints = []models.Point{s.randomPoint(t.floor)}
+				t.next = 0
+			} else if t.loop {
+				t.next = 0
+			} else {
+				return
+			}
+		}
+
+		target := t.waypoints[t.next]
+		dx, dy := target.X-t.pos.X, target.Y-t.pos.Y
+		remain := math.Hypot(dx, dy)
+		if remain <= dist {
+			t.pos = target
+			t.next++
+			dist -= remain
+			continue
+		}
+
+		t.pos.X += dx / remain * dist
+		t.pos.Y += dy / remain * dist
+		dist = 0
+	}
+}
+
+// Step moves all tags by dt seconds and posts the resulting webhooks
+func (s *Simulator) Step(dt float64) error {
+	ts := float64(s.now().UnixMilli()) / 1000
+	locations := make([]mistfake.LocationAssetEvent, 0, len(s.tags))
+	zones := make([]mistfake.ZoneEvent, 0)
+
+	for _, t := range s.tags {
+		s.move(t, dt)
+
+		siteId := t.floor.SiteId
+		if siteId == "" {
+			siteId = s.cfg.SiteId
+		}
+
+		locations = append(locations, mistfake.LocationAssetEvent{
+			Mac:       t.mac,
+			SiteId:    siteId,
+			MapId:     t.floor.Id,
+			X:         math.Round(t.pos.X*100) / 100,
+			Y:         math.Round(t.pos.Y*100) / 100,
+			Timestamp: ts,
+		})
+
+		for _, z := range t.floor.Zones {
+			in := z.Contains(t.pos)
+			if in == t.zones[z.Id] {
+				continue
+			}
+
+			trigger := "exit"
+			if in {
+				trigger = "enter"
+			}
+			t.zones[z.Id] = in
+
+			zones = append(zones, mistfake.ZoneEvent{
+				Mac:       t.mac,
+				SiteId:    siteId,
+				MapId:     t.floor.Id,
+				ZoneId:    z.Id,
+				Trigger:   trigger,
+				Timestamp: ts,
+			})
+		}
+	}
+
+	// positions are sent first so that zone events find the entity
+	err := s.sender.PostLocationAsset(locations...)
+	if err != nil {
+		return fmt.Errorf("location-asset webhook failed: %w", err)
+	}
+
+	if len(zones) > 0 {
+		err = s.sender.PostZone(zones...)
+		if err != nil {
+			return fmt.Errorf("zone webhook failed: %w", err)
+		}
+	}
+
+	return nil
+}
+
+func (s *Simulator) Run() error {
+	interval := time.Duration(s.cfg.Interval * float64(time.Second))
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	var deadline <-chan time.Time
+	if s.cfg.Duration > 0 {
+		deadline = time.After(time.Duration(s.cfg.Duration) * time.Second)
+	}
+
+	killSig := make(chan os.Signal, 1)
+	signal.Notify(killSig, syscall.SIGINT, syscall.SIGQUIT, syscall.SIGTERM)
+
+	log.Printf("Simulating %d tags on %d maps every %v", len(s.tags), len(s.layout), interval)
+	for {
+		select {
+		case <-killSig:
+			log.Printf("Caught kill signal, shutting down")
+			return nil
+		case <-deadline:
+			log.Printf("Simulation finished")
+			return nil
+		case <-ticker.C:
+			err := s.Step(s.cfg.Interval)
+			if err != nil {
+				log.Printf("Step failed (%v)", err)
+			}
+		}
+	}
+}
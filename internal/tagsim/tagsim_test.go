@@ -0,0 +1,93 @@
+package tagsim
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"mist-location-visualization/internal/mistfake"
+	"mist-location-visualization/internal/models"
+)
+
+type received struct {
+	Topic  string            `json:"topic"`
+	Events []json.RawMessage `json:"events"`
+}
+
+func TestSimulatorScriptedPath(t *testing.T) {
+	const secret = "testsecret"
+
+	posts := make([]received, 0)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		if r.Header.Get("X-Mist-Signature-v2") != mistfake.Sign(secret, body) {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		v := received{}
+		json.Unmarshal(body, &v)
+		posts = append(posts, v)
+	}))
+	defer ts.Close()
+
+	cfg := Config{}
+	cfg.Target.Url = ts.URL
+	cfg.Target.Secret = secret
+	cfg.LayoutFile = "testdata/layout.json"
+	cfg.Interval = 1
+	err := json.Unmarshal([]byte(`[{"mac": "5b0000000001", "speed": 10, "waypoints": [{"x": 0, "y": 20}, {"x": 40, "y": 20}]}]`), &cfg.Paths)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.Paths[0].MapId = mistfake.MapId11F
+
+	sim, err := New(cfg)
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+
+	// 0 -> 10 -> 20 (enter booth) -> 30 (exit booth) -> 40 -> 40
+	topics := make(map[string]int)
+	for i := 0; i < 5; i++ {
+		err = sim.Step(1)
+		if err != nil {
+			t.Fatalf("Step: %v", err)
+		}
+	}
+
+	for _, p := range posts {
+		topics[p.Topic] += len(p.Events)
+	}
+	if topics["location-asset"] != 5 || topics["zone"] != 2 {
+		t.Errorf("got events %v; want 5 location-asset and 2 zone", topics)
+	}
+
+	if sim.tags[0].pos.X != 40 {
+		t.Errorf("tag stopped at x=%v; want 40", sim.tags[0].pos.X)
+	}
+}
+
+func TestZoneContains(t *testing.T) {
+	layout, err := loadLayoutFromFile("testdata/layout.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	zone := layout[mistfake.MapId11F].Zones[0]
+	for _, tt := range []struct {
+		x, y float64
+		in   bool
+	}{
+		{10, 20, true},
+		{23.9, 31.9, true},
+		{7, 20, false},
+		{10, 33, false},
+	} {
+		if zone.Contains(models.Point{X: tt.x, Y: tt.y}) != tt.in {
+			t.Errorf("Contains(%v, %v) = %v; want %v", tt.x, tt.y, !tt.in, tt.in)
+		}
+	}
+}